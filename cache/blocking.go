@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"sync"
+)
+
+// keyWaiters 记录阻塞等待key写入元素的请求，只有leader上会有等待者，
+// FSM.Apply在每个副本上都会调用notify，没有等待者时是空操作
+type keyWaiters struct {
+	mutex   sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// watch 在keys上注册一个等待者，任意一个key有新元素时ch会收到通知，
+// 使用完后需要调用cancel注销
+func (w *keyWaiters) watch(keys []string) (ch chan struct{}, cancel func()) {
+	ch = make(chan struct{}, 1)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.waiters == nil {
+		w.waiters = make(map[string]map[chan struct{}]struct{})
+	}
+	for _, key := range keys {
+		if w.waiters[key] == nil {
+			w.waiters[key] = make(map[chan struct{}]struct{})
+		}
+		w.waiters[key][ch] = struct{}{}
+	}
+
+	return ch, func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		for _, key := range keys {
+			delete(w.waiters[key], ch)
+			if len(w.waiters[key]) == 0 {
+				delete(w.waiters, key)
+			}
+		}
+	}
+}
+
+// notify 唤醒所有等待key的请求，被唤醒的请求重新通过raft尝试弹出元素，没抢到的继续等待
+func (w *keyWaiters) notify(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for ch := range w.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyAll 唤醒所有等待者，leader退位时调用，让阻塞的请求重试后得到错误而不是一直等待
+func (w *keyWaiters) notifyAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, chs := range w.waiters {
+		for ch := range chs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
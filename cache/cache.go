@@ -1,131 +1,609 @@
 package cache
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/Emiliaab/gedis/datasource/mysql"
 	lru_k "github.com/Emiliaab/gedis/lru-k"
 	"gorm.io/gorm"
 	"io"
+	"log"
+	"math/rand"
 	"sync"
 	"time"
+	"unsafe"
 )
 
 /*
 *
-cache代理，封装lru kv并提供并发控制
+cache代理，封装lru kv并提供并发控制。
+keyspace按hash分成多个segment，每个segment独立加锁，不同segment上的读写互不阻塞
 */
 type Cache struct {
-	mutex     sync.Mutex
-	lru       lru_k.Cache
+	once      sync.Once
+	segments  []*segment
 	dirtyKeys chan string   // 脏key队列
 	ticker    *time.Ticker  // 定时器，定期将缓存中的脏key持久化到磁盘
 	stop      chan struct{} // 停止信号
 	db        *gorm.DB
+	policy    string // 淘汰策略，见lru_k.Policies()
+	nsegments int    // 分段数，0表示使用DefaultSegments
+
+	// maxBytes和maxmemoryPolicy在raft group中通过OperSetMaxMemory统一，见SetMaxMemory
+	memoryMutex     sync.RWMutex
+	maxBytes        int64  // 缓存允许使用的最大字节数，0表示不限制，按分段数平均分给每个分段
+	maxmemoryPolicy string // 达到maxBytes后的处理策略，见lru_k.MaxmemoryPolicies()
+	maxmemorySet    bool   // maxBytes和maxmemoryPolicy已经由raft日志设置，不再是本节点的启动参数
+}
+
+type CacheOption func(*Cache)
+
+// WithPolicy 指定缓存的淘汰策略，为空时使用默认的LRU-K
+func WithPolicy(policy string) CacheOption {
+	return func(c *Cache) {
+		c.policy = policy
+	}
+}
+
+// WithMaxMemory 指定缓存允许使用的最大字节数，0表示不限制
+func WithMaxMemory(maxBytes int64) CacheOption {
+	return func(c *Cache) {
+		c.maxBytes = maxBytes
+	}
+}
+
+// WithMaxmemoryPolicy 指定缓存达到最大字节数后的处理策略，为空时按淘汰策略淘汰
+func WithMaxmemoryPolicy(policy string) CacheOption {
+	return func(c *Cache) {
+		c.maxmemoryPolicy = policy
+	}
+}
+
+// WithSegments 指定缓存的分段数，淘汰策略在每个分段内独立生效
+func WithSegments(n int) CacheOption {
+	return func(c *Cache) {
+		c.nsegments = n
+	}
 }
 
 const (
-	maxitems = 10
 	chansize = 1024
+
+	// entryOverhead 每个key除key和value的内容以外额外计入的字节数，包括lru_k中entry的开销
+	// 以及gvalue结构体和value接口的开销
+	entryOverhead = lru_k.DefaultEntryOverhead + int64(unsafe.Sizeof(gvalue{})+unsafe.Sizeof(any(nil)))
 )
 
-func NewCache() Cache {
-	c := Cache{
+func NewCache(opts ...CacheOption) (*Cache, error) {
+	c := &Cache{
 		dirtyKeys: make(chan string, chansize),
 		ticker:    time.NewTicker(10 * time.Second),
 		stop:      make(chan struct{}),
-		db:        mysql.New(),
 	}
-	return c
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.nsegments < 0 {
+		return nil, fmt.Errorf("invalid segment count %d", c.nsegments)
+	}
+	if c.maxmemoryPolicy != "" {
+		if err := lru_k.ValidateMaxmemoryPolicy(c.maxmemoryPolicy); err != nil {
+			return nil, err
+		}
+	}
+	// 提前校验淘汰策略，lazyInit中就不会出错了
+	if _, err := c.newLRU(0); err != nil {
+		return nil, err
+	}
+
+	c.lazyInit()
+	c.db = mysql.New()
+	return c, nil
+}
+
+// newLRU 创建分段使用的lru_k，写入时lru_k不淘汰也不拒绝：各副本上的访问记录不同，
+// 由各副本自己淘汰会产生分歧，淘汰的key由leader通过Victims选出后写入raft日志
+func (c *Cache) newLRU(maxBytes int64) (lru_k.Cache, error) {
+	return lru_k.New(c.policy, maxBytes, lru_k.WithEntryOverhead(entryOverhead), lru_k.WithExternalEviction())
+}
+
+func (c *Cache) lazyInit() {
+	c.once.Do(func() {
+		n := c.nsegments
+		if n <= 0 {
+			n = DefaultSegments
+		}
+		// 容量平均分给每个分段，除不尽的部分分给前面的分段，保证总和等于maxBytes
+		c.segments = make([]*segment, n)
+		for i := range c.segments {
+			maxBytes := splitMaxBytes(c.maxBytes, i, n)
+			lru, err := c.newLRU(maxBytes)
+			if err != nil {
+				// NewCache中已经校验过淘汰策略，这里不会出错
+				panic(err)
+			}
+			c.segments[i] = newSegment(lru)
+			c.segments[i].maxBytes = maxBytes
+		}
+	})
 }
 
-func (c *Cache) Add(key string, value []byte) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// splitMaxBytes 返回n个分段中第i个分段的容量，容量平均分给每个分段，
+// 除不尽的部分分给前面的分段，保证总和等于maxBytes
+func splitMaxBytes(maxBytes int64, i int, n int) int64 {
+	ret := maxBytes / int64(n)
+	if int64(i) < maxBytes%int64(n) {
+		ret++
+	}
+	return ret
+}
+
+// maxmemory 返回当前的最大字节数和maxmemory策略
+func (c *Cache) maxmemory() (int64, string) {
+	c.memoryMutex.RLock()
+	defer c.memoryMutex.RUnlock()
+	if c.maxmemoryPolicy == "" {
+		return c.maxBytes, lru_k.DefaultMaxmemoryPolicy
+	}
+	return c.maxBytes, c.maxmemoryPolicy
+}
+
+// replicatedMaxMemory 返回raft日志设置的最大字节数和maxmemory策略，还没有设置过时ok为false
+func (c *Cache) replicatedMaxMemory() (maxBytes int64, policy string, ok bool) {
+	c.memoryMutex.RLock()
+	defer c.memoryMutex.RUnlock()
+	return c.maxBytes, c.maxmemoryPolicy, c.maxmemorySet
+}
+
+// SetMaxMemory 修改最大字节数和maxmemory策略，由FSM.Apply调用，raft group中的所有副本使用相同的容量，
+// noeviction拒绝写入和leader选出淘汰的key才会得到相同的结果。各分段的lru_k按新的容量重新划分内部的列表
+func (c *Cache) SetMaxMemory(maxBytes int64, policy string) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("invalid maxmemory %d", maxBytes)
+	}
+	if err := lru_k.ValidateMaxmemoryPolicy(policy); err != nil {
+		return err
+	}
+	c.lazyInit()
+	c.memoryMutex.Lock()
+	c.maxBytes, c.maxmemoryPolicy, c.maxmemorySet = maxBytes, policy, true
+	c.memoryMutex.Unlock()
+	for i, s := range c.segments {
+		s.lock()
+		s.maxBytes = splitMaxBytes(maxBytes, i, len(c.segments))
+		s.lru.SetMaxBytes(s.maxBytes)
+		s.unlock()
+	}
+	return nil
+}
 
-	if c.lru == nil {
-		OnEliminateKeys := make([]string, 0)
-		OnEliminateFun := func(key string, value any) {
-			OnEliminateKeys = append(OnEliminateKeys, key)
+// Victims 按maxmemory策略选出写入之前需要淘汰的key，growth是每个key写入后增加的字节数的估计值。
+// 只由leader调用，选出的key通过OperMDel写入raft日志，所有副本按日志的顺序删除相同的key。
+// noeviction策略不淘汰，由FSM在写入时拒绝；没有足够的key可以淘汰时返回lru_k.ErrOutOfMemory
+func (c *Cache) Victims(growth map[string]int64) ([]string, error) {
+	maxBytes, policy := c.maxmemory()
+	if maxBytes == 0 || policy == lru_k.NoEviction {
+		return nil, nil
+	}
+	c.lazyInit()
+	perSegment := make(map[*segment]int64, len(growth))
+	skip := make(map[*segment][]string, len(growth))
+	for key, n := range growth {
+		s := c.segment(key)
+		perSegment[s] += n
+		skip[s] = append(skip[s], key)
+	}
+	var keys []string
+	for _, s := range c.segments {
+		n, ok := perSegment[s]
+		if !ok {
+			continue
+		}
+		s.mutex.RLock()
+		victims, err := s.lru.Victims(policy, s.maxBytes, n, skip[s])
+		s.mutex.RUnlock()
+		if err != nil {
+			return nil, err
 		}
-		c.lru = lru_k.NewCache(2, int64(maxitems*4), lru_k.WithOnEliminate(OnEliminateFun))
+		keys = append(keys, victims...)
+	}
+	return keys, nil
+}
+
+// Growth 估计写入key后缓存增加的字节数，replace为true表示value整体替换为size字节，
+// 否则表示向已有的复合类型中追加size字节
+func (c *Cache) Growth(key string, size int, replace bool) int64 {
+	s := c.segment(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if _, ok := s.lru.Lookup(key); ok && !replace {
+		return int64(size)
+	}
+	return s.growthLocked(key, size)
+}
+
+// segment 返回key所在的分段
+func (c *Cache) segment(key string) *segment {
+	c.lazyInit()
+	return c.segments[segmentIndex(key, len(c.segments))]
+}
+
+func (c *Cache) Add(key string, value []byte) error {
+	return c.AddWithExpire(key, value, 0, 0)
+}
+
+// AddWithExpire 写入key并设置过期的绝对时间expireAt(unix纳秒)，
+// slide大于0时表示滑动过期，每次Touch都会把过期时间顺延slide。
+// maxmemory策略为noeviction或者没有可淘汰的key时，超出容量的写入返回lru_k.ErrOutOfMemory
+func (c *Cache) AddWithExpire(key string, value []byte, expireAt int64, slide int64) error {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	if err := c.setLocked(s, key, &gvalue{bytes: value}, expireAt, slide); err != nil {
+		return err
 	}
-	c.lru.Set(key, &gvalue{bytes: value})
 
 	// 加入到脏key队列，如果队列满了就丢弃
 	select {
 	case c.dirtyKeys <- key:
 	default:
-		return
 	}
+	return nil
+}
+
+// MSet 依次写入pairs中的key和value，所有key使用相同的过期时间，返回每个key写入的结果
+func (c *Cache) MSet(pairs []string, expireAt int64, slide int64) []error {
+	errs := make([]error, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		errs[i/2] = c.AddWithExpire(pairs[i], []byte(pairs[i+1]), expireAt, slide)
+	}
+	return errs
+}
+
+// MDel 删除keys，返回每个key是否存在
+func (c *Cache) MDel(keys []string) []bool {
+	deleted := make([]bool, len(keys))
+	for i, key := range keys {
+		deleted[i] = c.Remove(key)
+	}
+	return deleted
 }
 
+// Evict 删除leader按maxmemory策略选出的key，和MDel不同的是淘汰策略会记录这次淘汰，
+// 例如ARC和2Q的幽灵列表，leader之后选出的淘汰顺序才和策略本身一致
+func (c *Cache) Evict(keys []string) []bool {
+	evicted := make([]bool, len(keys))
+	for i, key := range keys {
+		s := c.segment(key)
+		s.lock()
+		evicted[i] = s.lru.Evict(key)
+		s.unlock()
+	}
+	return evicted
+}
+
+// MemoryUsage 返回缓存当前使用的字节数和允许的最大字节数
+func (c *Cache) MemoryUsage() (used int64, max int64) {
+	c.lazyInit()
+	for _, s := range c.segments {
+		s.mutex.RLock()
+		used += s.lru.BytesUsed()
+		s.mutex.RUnlock()
+	}
+	max, _ = c.maxmemory()
+	return used, max
+}
+
+// Len 返回缓存中的key数量，包括已过期但还没有被删除的key
+func (c *Cache) Len() (n int) {
+	c.lazyInit()
+	for _, s := range c.segments {
+		s.mutex.RLock()
+		n += s.lru.Len()
+		s.mutex.RUnlock()
+	}
+	return n
+}
+
+// Get 读取字符串类型的value，只拿分段的读锁，访问记录异步补记到lru_k
 func (c *Cache) Get(key string) (value []byte, ok bool) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	s := c.segment(key)
+	s.mutex.RLock()
+	gv, ok := s.lru.Peek(key)
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
 
-	if c.lru == nil {
+	// 复合类型需要用对应的命令读取
+	v, ok := gv.(*gvalue)
+	if !ok {
 		return nil, false
 	}
-	gv, ok := c.lru.Get(key)
-	value = gv.(*gvalue).GetBytes()
-	return
+	s.recordAccess(key)
+	return v.GetBytes(), true
 }
 
-func (c *Cache) GetAll() map[string]string {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+/*
+*
+下面几个过期相关的写操作都由FSM.Apply调用，now取自raft日志中leader写入的时间戳，
+而不是本地时钟，这样每个副本对key是否已过期的判断都是一致的
+*/
 
-	if c.lru == nil {
-		return nil
+// setLocked 写入lru_k，调用方需持有分段的写锁。
+// maxmemory策略为noeviction时拒绝超出分段容量的写入，容量和策略经过raft复制，各副本的判断结果相同；
+// 其他策略下leader在提交写入之前已经淘汰了足够的key，这里不再淘汰
+func (c *Cache) setLocked(s *segment, key string, v cacheValue, expireAt int64, slide int64) error {
+	if _, policy := c.maxmemory(); policy == lru_k.NoEviction && s.maxBytes > 0 {
+		if growth := s.growthLocked(key, v.Len()); growth > 0 && s.lru.BytesUsed()+growth > s.maxBytes {
+			return lru_k.ErrOutOfMemory
+		}
 	}
-	ans := make(map[string]string)
-	for k, v := range c.lru.GetAll() {
-		ans[k] = string(v.(*gvalue).GetBytes())
+	return s.lru.SetWithExpire(key, v, expireAt, slide)
+}
+
+// growthLocked 返回把key的value写为size字节后分段增加的字节数，调用方需持有分段的锁
+func (s *segment) growthLocked(key string, size int) int64 {
+	if old, ok := s.lru.Lookup(key); ok {
+		return int64(size - old.Len())
+	}
+	return int64(len(key)+size) + entryOverhead
+}
+
+// expiredLocked 判断key在now时刻是否已过期，已过期则直接删除，调用方需持有分段的写锁
+func (s *segment) expiredLocked(key string, now int64) bool {
+	expireAt, _, ok := s.lru.GetExpire(key)
+	if !ok {
+		return true
+	}
+	if expireAt != 0 && expireAt <= now {
+		s.lru.Remove(key)
+		return true
+	}
+	return false
+}
+
+// Expire 为未过期的key设置新的过期时间，key不存在时返回false
+func (c *Cache) Expire(key string, expireAt int64, slide int64, now int64) bool {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	if s.expiredLocked(key, now) {
+		return false
+	}
+	return s.lru.Expire(key, expireAt, slide)
+}
+
+// Persist 移除key的过期时间
+func (c *Cache) Persist(key string, now int64) bool {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	if s.expiredLocked(key, now) {
+		return false
+	}
+	return s.lru.Persist(key)
+}
+
+// Touch 对滑动过期的key顺延过期时间到now+slide
+func (c *Cache) Touch(key string, now int64) bool {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	if s.expiredLocked(key, now) {
+		return false
+	}
+	_, slide, _ := s.lru.GetExpire(key)
+	if slide <= 0 {
+		return false
+	}
+	return s.lru.Expire(key, now+slide, slide)
+}
+
+// RemoveExpired 只有key在now时刻确实已经过期才删除，
+// 避免定期清理发起的删除覆盖掉在此期间重新写入的值
+func (c *Cache) RemoveExpired(key string, now int64) bool {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	expireAt, _, ok := s.lru.GetExpire(key)
+	if !ok || expireAt == 0 || expireAt > now {
+		return false
+	}
+	return s.lru.Remove(key)
+}
+
+// TTL 按本地时钟返回key的剩余存活时间，没有过期时间返回-1，key不存在时ok为false
+func (c *Cache) TTL(key string) (ttl time.Duration, slide time.Duration, ok bool) {
+	s := c.segment(key)
+	s.mutex.RLock()
+	expireAt, slideNs, ok := s.lru.GetExpire(key)
+	s.mutex.RUnlock()
+	if !ok {
+		return 0, 0, false
+	}
+	if expireAt == 0 {
+		return -1, 0, true
+	}
+	now := time.Now().UnixNano()
+	if expireAt <= now {
+		return 0, 0, false
+	}
+	return time.Duration(expireAt - now), time.Duration(slideNs), true
+}
+
+// SampleExpired 采样最多n个设置了过期时间的key，返回采样数和其中已过期的key。
+// 从随机的分段开始依次采样，直到采满n个或者所有分段都采过一遍
+func (c *Cache) SampleExpired(now int64, n int) (int, []string) {
+	c.lazyInit()
+	var (
+		sampled int
+		expired []string
+		start   = rand.Intn(len(c.segments))
+	)
+	for i := 0; i < len(c.segments) && sampled < n; i++ {
+		s := c.segments[(start+i)%len(c.segments)]
+		s.lock()
+		cnt, keys := s.lru.SampleExpired(now, n-sampled)
+		s.unlock()
+		sampled += cnt
+		expired = append(expired, keys...)
+	}
+	return sampled, expired
+}
 
+func (c *Cache) GetAll() map[string]string {
+	c.lazyInit()
+	ans := make(map[string]string)
+	for _, s := range c.segments {
+		s.mutex.RLock()
+		for k, v := range s.lru.GetAll() {
+			if v, ok := v.(*gvalue); ok {
+				ans[k] = string(v.GetBytes())
+			}
+		}
+		s.mutex.RUnlock()
 	}
 	return ans
 }
 
 func (c *Cache) Remove(key string) (ok bool) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
 
-	if c.lru == nil {
-		ok = false
-	}
+	return s.lru.Remove(key)
+}
+
+// snapshotVersion 旧的JSON快照格式的版本号，新的快照使用snapshot.go中的二进制格式
+const snapshotVersion = 1
+
+// snapshotData JSON格式快照中保存的完整缓存状态，仅用于恢复旧版本生成的快照
+type snapshotData struct {
+	Version int
+	Entries []snapshotEntry
+}
 
-	return c.Remove(key)
+// snapshotEntry 对应lru_k中的一个entry，包含LRU-K的访问计数、所在列表以及过期信息，
+// Entries按lru_k.Records的顺序保存，恢复时按相同顺序重建即可还原访问顺序
+type snapshotEntry struct {
+	Key      string
+	Value    []byte
+	Count    int
+	Active   bool
+	ExpireAt int64 `json:",omitempty"`
+	Slide    int64 `json:",omitempty"`
 }
 
-func (c *Cache) Marshal() ([]byte, error) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	dataBytes, err := json.Marshal(c.lru.GetData())
-	return dataBytes, err
+// SnapshotRecords 返回当前时刻缓存的只读视图，只在锁内复制entry的索引，不复制value，
+// value写入后不会被原地修改(见gvalue和object)，因此视图可以在锁外慢慢序列化。
+// 各分段依次加锁，先拿齐所有分段的锁再复制，保证视图对应同一时刻
+func (c *Cache) SnapshotRecords() []lru_k.Record {
+	c.lazyInit()
+	for _, s := range c.segments {
+		s.lock()
+		defer s.unlock()
+	}
+
+	var records []lru_k.Record
+	for _, s := range c.segments {
+		records = append(records, s.lru.Records()...)
+	}
+	// 复合类型的value会被原地修改，freeze之后的写操作改为先复制再修改
+	for _, r := range records {
+		if o, ok := r.Value.(*gobject); ok {
+			o.data.freeze()
+		}
+	}
+	return records
 }
 
+// UnMarshal 用快照替换当前缓存的全部数据，兼容旧的JSON格式快照
 func (c *Cache) UnMarshal(serialized io.ReadCloser) error {
-	//var newData map[string]string
-	//var newData map[string]*list.Element
-	//if err := json.NewDecoder(serialized).Decode(&newData); err != nil {
-	//	return err
-	//}
-	//c.mutex.Lock()
-	//defer c.mutex.Unlock()
-	//
-	//c.lru.SetData(newData)
-	return nil
+	_, err := c.load(serialized)
+	return err
 }
 
-func (c *Cache) GetRangeData(start, end int) ([]byte, error) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// load 用快照替换当前缓存的全部数据，返回快照中缓存数据之外的状态机状态
+func (c *Cache) load(serialized io.ReadCloser) (snapshotMeta, error) {
+	defer serialized.Close()
 
-	if c.lru != nil {
-		return c.lru.GetRangeData(start, end)
+	r := bufio.NewReader(serialized)
+	var (
+		records []lru_k.Record
+		meta    snapshotMeta
+	)
+	if magic, err := r.Peek(len(snapshotMagic) + 1); err == nil && string(magic[:len(snapshotMagic)]) == snapshotMagic {
+		version := magic[len(snapshotMagic)]
+		if version < snapshotStringVersion || version > snapshotBinaryVersion {
+			return meta, fmt.Errorf("unsupported snapshot version %d", version)
+		}
+		r.Discard(len(magic))
+		if records, err = readSnapshot(r, version); err != nil {
+			return meta, err
+		}
+		if meta, err = readSnapshotMeta(r, version); err != nil {
+			return meta, fmt.Errorf("%w: %v", errSnapshotCorrupted, err)
+		}
+	} else {
+		var data snapshotData
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			return meta, err
+		}
+		if data.Version != snapshotVersion {
+			return meta, fmt.Errorf("unsupported snapshot version %d", data.Version)
+		}
+		records = make([]lru_k.Record, 0, len(data.Entries))
+		for _, e := range data.Entries {
+			records = append(records, lru_k.Record{
+				Key:      e.Key,
+				Value:    &gvalue{bytes: e.Value},
+				Count:    e.Count,
+				Active:   e.Active,
+				ExpireAt: e.ExpireAt,
+				Slide:    e.Slide,
+			})
+		}
+	}
+
+	c.lazyInit()
+	// 按分段拆分，同一分段内的记录保持快照中的相对顺序
+	parts := make([][]lru_k.Record, len(c.segments))
+	for _, r := range records {
+		i := segmentIndex(r.Key, len(c.segments))
+		parts[i] = append(parts[i], r)
+	}
+	for _, s := range c.segments {
+		s.lock()
+		defer s.unlock()
+	}
+	for i, s := range c.segments {
+		s.lru.Load(parts[i])
+	}
+	return meta, nil
+}
+
+func (c *Cache) GetRangeData(start, end int) ([]byte, error) {
+	c.lazyInit()
+	result := make(map[string]string)
+	for _, s := range c.segments {
+		s.lock()
+		data, err := s.lru.GetRangeData(start, end)
+		s.unlock()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
 	}
-	return nil, fmt.Errorf("LRU cache is not initialized")
+	return json.Marshal(result)
 }
 
 func (c *Cache) FlushDirtyKeys() {
@@ -148,12 +626,12 @@ func (c *Cache) flushOnce() {
 	for {
 		select {
 		case key := <-c.dirtyKeys:
-			value, ok := c.lru.Get(key)
+			value, ok := c.Get(key)
 			if !ok {
 				continue
 			}
 			// key-value持久化到mysql
-			err := c.flushToDataSource(key, string(value.(*gvalue).GetBytes()))
+			err := c.flushToDataSource(key, string(value))
 			if !err {
 				// 刷盘失败, 将 key 重新加入队列
 				//select {
@@ -181,7 +659,7 @@ func (c *Cache) flushToDataSource(key string, value string) bool {
 		data.Value = value
 		result := c.db.Model(&data).Where("gedis_key = ?", key).Update("gedis_value", value)
 		if result.Error != nil {
-			fmt.Errorf("datasource save data error, the reason is %e", result.Error)
+			log.Printf("datasource save data error, the reason is %v", result.Error)
 			return false
 		}
 		return true
@@ -193,7 +671,7 @@ func (c *Cache) flushToDataSource(key string, value string) bool {
 		Value: value,
 	})
 	if result.Error != nil {
-		fmt.Errorf("datasource create data error, the reason is %e", result.Error)
+		log.Printf("datasource create data error, the reason is %v", result.Error)
 		return false
 	}
 
@@ -206,6 +684,8 @@ func (c *Cache) Close() {
 	c.flushOnce()
 }
 
+// gvalue 写入lru_k后bytes不允许被原地修改，更新时总是替换为新的gvalue，
+// 快照依赖这一点在锁外读取value
 type gvalue struct {
 	bytes []byte
 }
@@ -1,16 +1,18 @@
 package cache
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/Emiliaab/gedis/consistenthash"
 	"github.com/Emiliaab/gedis/singleflight"
 	"github.com/hashicorp/raft"
-	"github.com/spaolacci/murmur3"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
@@ -20,20 +22,61 @@ const (
 	ENABLE_WRITE_FALSE = int32(0)
 )
 
+// 节点之间转发请求时携带的请求头
+const (
+	// ForwardedHeader 标记请求是由其他节点转发过来的，值为发送方的http地址
+	ForwardedHeader = "X-Gedis-Forwarded"
+	// EpochHeader 请求中是发送方哈希环的epoch，moved响应中是接收方哈希环的epoch
+	EpochHeader = "X-Gedis-Epoch"
+	// OwnerHeader moved响应中接收方哈希环上负责key的节点
+	OwnerHeader = "X-Gedis-Owner"
+)
+
+var (
+	ErrNotLeader = errors.New("write method not allowed") // 只有raft group的leader可以执行写命令
+	ErrNotFound  = errors.New("key not found")
+)
+
 type Cache_proxy struct {
 	Opts        *Options
 	Log         *log.Logger
-	Cache       Cache
+	Cache       *Cache
 	Raft        *RaftNodeInfo
-	Peers       *consistenthash.Map
+	peers       atomic.Pointer[consistenthash.Map] // 一致性hash环，只整体替换，不原地修改
 	sfGroup     singleflight.Group
 	enableWrite int32
+	waiters     keyWaiters // 阻塞在list上等待元素的请求
+	members     members    // raft group中每个节点的http地址
+	cluster     *Cluster   // 分散stale读请求的副本列表
+	routes      routes     // 转发给其他分片组时优先使用的节点
+	commits     chan *pendingEntry
+	touches     slidingTouches // 读命中的滑动过期key，由touchCycle合并顺延
+	evictions   evictions      // leader选出淘汰的key时还没有应用的写入
+
+	migrationSessions migrationSessions // 本分片作为迁移来源时的迁移会话
+	migrationJobs     migrationJobs     // 本分片作为迁移接收方时的迁移任务
 }
 
-func NewCacheProxy(httpPort int32, raftPort int32, node string, bootstrap bool, joinAddress string) *Cache_proxy {
+func NewCacheProxy(config *Config) *Cache_proxy {
 	proxy := &Cache_proxy{}
-	opts := NewOptions(httpPort, raftPort, node, bootstrap, joinAddress)
+	opts := NewOptions(config.HttpPort, config.RaftPort, config.NodeName, config.Bootstrap, config.JoinAddress)
+	opts.RedirectWrites = config.RedirectWrites
+	opts.Nonvoter = config.Nonvoter
+	opts.Ctrlers = config.Ctrlers
+	opts.GID = config.GID
+	opts.MigrateRate = config.MigrateRate
 	log := log.New(os.Stderr, "Cache_proxy: ", log.Ldate|log.Ltime)
+	// 先创建缓存再创建raft节点，raft启动时可能立即从快照恢复数据
+	cache, err := NewCache(
+		WithPolicy(config.Policy),
+		WithMaxMemory(config.MaxMemory),
+		WithMaxmemoryPolicy(config.MaxmemoryPolicy),
+		WithSegments(config.Segments),
+	)
+	if err != nil {
+		log.Fatalf("cache create error: %v", err)
+	}
+	proxy.Cache = cache
 	raftNode, err := NewRaftNode(opts, proxy)
 	if err != nil {
 		log.Fatal("gedisraft create error!")
@@ -41,50 +84,78 @@ func NewCacheProxy(httpPort int32, raftPort int32, node string, bootstrap bool,
 	proxy.Opts = opts
 	proxy.Log = log
 	proxy.Raft = raftNode
-	proxy.Cache = NewCache()
 	proxy.enableWrite = ENABLE_WRITE_FALSE
-	proxy.Peers = consistenthash.New(3, func(key []byte) uint32 {
-		return uint32(murmur3.Sum64(key))
-	})
-	proxy.Peers.Add(proxy.Opts.HttpAddress)
+	peers := consistenthash.New(3, consistenthash.Murmur3)
+	peers.Add(proxy.Opts.HttpAddress)
+	proxy.SetPeers(peers)
+	proxy.cluster = NewCluster(proxy.Opts.HttpAddress, config.ReadPolicy)
+	proxy.commits = make(chan *pendingEntry, maxGroupCommit)
+	go proxy.groupCommit()
+	go proxy.touchCycle()
 
 	return proxy
 }
 
+// Peers 返回当前的一致性hash环，调用方不能修改返回的哈希环
+func (c *Cache_proxy) Peers() *consistenthash.Map {
+	return c.peers.Load()
+}
+
+// SetPeers 替换一致性hash环，正在处理的请求继续使用旧的哈希环
+func (c *Cache_proxy) SetPeers(peers *consistenthash.Map) {
+	c.peers.Store(peers)
+}
+
+// SetForwarded 给转发给其他节点的请求加上本节点的地址和哈希环的epoch，
+// 接收方的哈希环上key不属于它时返回moved，而不是在错误的分片上执行
+func (c *Cache_proxy) SetForwarded(header http.Header) {
+	header.Set(ForwardedHeader, c.Opts.HttpAddress)
+	header.Set(EpochHeader, strconv.FormatUint(c.Peers().Epoch, 10))
+}
+
 func (c *Cache_proxy) checkWritePermission() bool {
 	return atomic.LoadInt32(&c.enableWrite) == ENABLE_WRITE_TRUE
 }
 
-func (c *Cache_proxy) DoGet(key string, masterAddress string) ([]byte, bool) {
+/*
+*
+DoGet 读取字符串类型的value，本地未命中时从负责的节点读取。query是请求中的consistency、
+max_staleness和min_index参数，key属于其他分片时原样带给负责的分片组，由它按自己的状态机检查，
+不是stale读时交给分片组的leader，也不再读本地缓存中迁移前留下的旧数据。
+masterAddress是本节点所在分片组的leader，只用于读取本分片组的key，其他分片的key发给哈希环上负责的节点
+*/
+func (c *Cache_proxy) DoGet(key string, masterAddress string, query url.Values) ([]byte, bool) {
 	if key == "" {
 		log.Println("doGet() error, get nil key")
 		return nil, false
 	}
 
 	// 尝试从本地缓存获取数据
-	value, ok := c.Cache.Get(key)
-	if ok {
-		return value, true
+	owner := c.Peers().Get(key)
+	if owner == c.Opts.HttpAddress || len(query) == 0 {
+		value, ok := c.DoGetLocal(key)
+		if ok {
+			return value, true
+		}
 	}
 
-	// 使用 singleflight 来保证对于相同的 key 只有一个网络请求被发起
-	result, err := c.sfGroup.Do(key, func() (interface{}, error) {
+	// 使用 singleflight 来保证对于相同的 key 和一致性参数只有一个网络请求被发起
+	result, err := c.sfGroup.Do(key+"?"+query.Encode(), func() (interface{}, error) {
 		// 确定应该从哪个节点获取数据
-		if masterAddress == "" {
-			peerAddress := c.Peers.Get(key)
-			if peerAddress == c.Opts.HttpAddress {
-				// 如果哈希算法确定本地是负责节点，说明前面缓存未命中已是正确结果
-				return nil, fmt.Errorf("data not found locally")
-			}
-			// 从对应的远端节点获取数据
-			return GetFromPeer(peerAddress, key)
+		if !c.inGroup(owner) {
+			// 从负责的分片组中读取数据，本分片组的leader会返回421
+			return c.GetFromPeer(owner, key, query)
 		}
-		// 如果提供了主节点地址，则直接从该地址获取数据
-		return GetFromPeer(masterAddress, key)
+		if masterAddress == "" || masterAddress == c.Opts.HttpAddress {
+			// 如果哈希算法确定本地是负责节点，说明前面缓存未命中已是正确结果
+			return nil, fmt.Errorf("data not found locally")
+		}
+		// 本分片组的key由主节点读取
+		return c.GetFromPeer(masterAddress, key, query)
 	})
 
 	if err != nil {
-		log.Printf("DoGet singleflight failed, err: %v, shared: %t", err)
+		log.Printf("DoGet singleflight failed, err: %v", err)
 		return nil, false
 	}
 
@@ -97,18 +168,50 @@ func (c *Cache_proxy) DoGet(key string, masterAddress string) ([]byte, bool) {
 	return finalValue, true
 }
 
-func GetFromPeer(address string, key string) (res []byte, err error) {
+// DoGetLocal 只从本地缓存读取字符串类型的value，命中滑动过期的key时顺延过期时间
+func (c *Cache_proxy) DoGetLocal(key string) ([]byte, bool) {
+	value, ok := c.Cache.Get(key)
+	if ok {
+		c.touchIfSliding(key)
+	}
+	return value, ok
+}
+
+// GetFromPeer 通过/v1/keys接口从哈希环上的真实节点owner读取value，query中的一致性参数原样带上。
+// owner是分片组时，stale读交给分片组中任意一个可用的节点，其他一致性交给leader，key不存在时返回ErrNotFound
+func (c *Cache_proxy) GetFromPeer(owner string, key string, query url.Values) (res []byte, err error) {
 	// 输出日志，表示一次网络请求
 	log.Printf("发起网络请求:%s\n", key)
-	url := "http://" + address + "/get?key=" + key
-	resp, err := http.Get(url)
+	level, err := ParseConsistency(query.Get("consistency"))
+	if err != nil {
+		return nil, err
+	}
+	path := KeyPath(key)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := c.PeerDo(owner, level == ConsistencyStale, func(address string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+address+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.SetForwarded(req.Header)
+		return http.DefaultClient.Do(req)
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, err
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusMisdirectedRequest:
+		return nil, fmt.Errorf("get %s from %s failed, key moved to %s at ring epoch %s",
+			key, owner, resp.Header.Get(OwnerHeader), resp.Header.Get(EpochHeader))
+	default:
+		return nil, fmt.Errorf("get %s from %s failed, status:%d", key, owner, resp.StatusCode)
 	}
 	res, err = io.ReadAll(resp.Body)
 	if err != nil {
@@ -117,6 +220,11 @@ func GetFromPeer(address string, key string) (res []byte, err error) {
 	return res, nil
 }
 
+// KeyPath 返回key在/v1/keys接口中的路径，key中的特殊字符会被转义
+func KeyPath(key string) string {
+	return "/v1/keys/" + url.PathEscape(key)
+}
+
 func (c *Cache_proxy) GetAll() map[string]string {
 	return c.Cache.GetAll()
 }
@@ -125,41 +233,178 @@ func (c *Cache_proxy) SetWriteFlag(flag bool) {
 		atomic.StoreInt32(&c.enableWrite, ENABLE_WRITE_TRUE)
 	} else {
 		atomic.StoreInt32(&c.enableWrite, ENABLE_WRITE_FALSE)
+		c.waiters.notifyAll()
+		c.migrationSessions.reset()
 	}
 }
 
-func (c *Cache_proxy) DoSet(oper int8, key string, value string) bool {
+func (c *Cache_proxy) DoSet(ctx context.Context, oper int8, key string, value string) error {
+	return c.DoSetEx(ctx, oper, key, value, 0, false)
+}
+
+// DoSetEx 写入key并设置存活时间，ttl为0表示永不过期
+// 缓存已满且maxmemory策略拒绝写入时返回lru_k.ErrOutOfMemory
+func (c *Cache_proxy) DoSetEx(ctx context.Context, oper int8, key string, value string, ttl time.Duration, sliding bool) error {
 	if !c.checkWritePermission() {
-		log.Println("write method not allowed\n")
-		return false
+		return ErrNotLeader
 	}
 
-	if key == "" || value == "" {
-		log.Println("doSet() error, get nil key or nil value")
-		return false
+	if key == "" {
+		return fmt.Errorf("doSet() error, get nil key")
+	}
+	// 并发的写入由groupCommit合并成一条raft日志
+	if _, err := c.commit(ctx, NewLogEntry(oper, key, value, ttl, sliding)); err != nil {
+		c.Log.Printf("gedisraft.Apply failed:%v", err)
+		return err
+	}
+	return nil
+}
+
+// DoDel 删除任意类型的key，key不存在时返回false
+func (c *Cache_proxy) DoDel(ctx context.Context, key string) (bool, error) {
+	if !c.checkWritePermission() {
+		return false, ErrNotLeader
 	}
-	event := LogEntryData{Oper: oper, Key: key, Value: value}
-	eventBytes, err := json.Marshal(event)
+	ret, err := c.apply(ctx, NewLogEntry(OperRemove, key, "", 0, false))
 	if err != nil {
-		c.Log.Printf("json.Marshal failed, err:%v", err)
-		return false
+		return false, err
+	}
+	return ret.(bool), nil
+}
+
+// DoMSet 把pairs中的key和value作为一条raft日志写入，pairs中的key需要属于同一个分片。
+// 返回每个key写入的结果，整条日志提交失败时返回error
+func (c *Cache_proxy) DoMSet(ctx context.Context, pairs []string, ttl time.Duration, sliding bool) ([]error, error) {
+	if !c.checkWritePermission() {
+		return nil, ErrNotLeader
 	}
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("doMSet() error, get %d fields", len(pairs))
+	}
+	e := NewLogEntry(OperMSet, "", "", ttl, sliding)
+	e.Fields = pairs
+	ret, err := c.apply(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return ret.([]error), nil
+}
 
-	applyFuture := c.Raft.Raft.Apply(eventBytes, 5*time.Second)
+// DoMDel 把keys作为一条raft日志删除，返回每个key是否存在
+func (c *Cache_proxy) DoMDel(ctx context.Context, keys []string) ([]bool, error) {
+	if !c.checkWritePermission() {
+		return nil, ErrNotLeader
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("doMDel() error, get nil keys")
+	}
+	e := NewLogEntry(OperMDel, "", "", 0, false)
+	e.Fields = keys
+	ret, err := c.apply(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return ret.([]bool), nil
+}
+
+// DoExpire 为key设置存活时间，key不存在时返回false
+func (c *Cache_proxy) DoExpire(ctx context.Context, key string, ttl time.Duration, sliding bool) (bool, error) {
+	if !c.checkWritePermission() {
+		return false, ErrNotLeader
+	}
+	if ttl <= 0 {
+		return false, fmt.Errorf("invalid ttl %v", ttl)
+	}
+	ret, err := c.apply(ctx, NewLogEntry(OperExpire, key, "", ttl, sliding))
+	if err != nil {
+		return false, err
+	}
+	return ret.(bool), nil
+}
+
+// DoPersist 移除key的存活时间，key不存在或者没有存活时间时返回false
+func (c *Cache_proxy) DoPersist(ctx context.Context, key string) (bool, error) {
+	if !c.checkWritePermission() {
+		return false, ErrNotLeader
+	}
+	ret, err := c.apply(ctx, NewLogEntry(OperPersist, key, "", 0, false))
+	if err != nil {
+		return false, err
+	}
+	return ret.(bool), nil
+}
+
+// apply 将日志提交到raft，返回FSM.Apply的结果，FSM.Apply返回error时作为错误返回，
+// 日志的index记录到ctx的会话中
+func (c *Cache_proxy) apply(ctx context.Context, event LogEntryData) (interface{}, error) {
+	ret, index, err := c.applyData(encodeLogEntry(event, c.logVersion()), []LogEntryData{event})
+	if err != nil {
+		return nil, err
+	}
+	recordIndex(ctx, index)
+	return ret, nil
+}
+
+// applyData 提交编码好的日志，entries是日志中的命令，写入正在切换的区间时返回ErrMigrating。
+// index是这条日志的raft index
+func (c *Cache_proxy) applyData(data []byte, entries []LogEntryData) (ret interface{}, index uint64, err error) {
+	return c.wait(c.submit(data, entries))
+}
+
+// wait 等待submit交给raft的日志应用，返回FSM.Apply的结果和日志的index
+func (c *Cache_proxy) wait(applyFuture raft.ApplyFuture, err error) (ret interface{}, index uint64, _ error) {
+	if err != nil {
+		return nil, 0, err
+	}
 	if err := applyFuture.Error(); err != nil {
-		c.Log.Printf("gedisraft.Apply failed:%v", err)
-		return false
+		return nil, 0, err
+	}
+	if err, ok := applyFuture.Response().(error); ok {
+		return nil, 0, err
+	}
+	return applyFuture.Response(), applyFuture.Index(), nil
+}
+
+const (
+	expireCycleInterval   = 100 * time.Millisecond
+	expireCycleSampleSize = 20
+	expireCycleMaxRounds  = 16
+)
+
+// ExpireCycle 主动过期，只在leader上运行，直到stop被关闭
+// 每个周期采样一批设置了过期时间的key，对已过期的key提交REMOVE_EXPIRED日志，
+// 如果过期比例超过1/4就继续下一轮采样，和redis的activeExpireCycle策略类似
+func (c *Cache_proxy) ExpireCycle(stop <-chan struct{}) {
+	ticker := time.NewTicker(expireCycleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for i := 0; i < expireCycleMaxRounds; i++ {
+				sampled, expired := c.Cache.SampleExpired(time.Now().UnixNano(), expireCycleSampleSize)
+				for _, key := range expired {
+					if _, err := c.apply(context.Background(), NewLogEntry(OperRemoveExpired, key, "", 0, false)); err != nil {
+						c.Log.Printf("remove expired key %s failed:%v", key, err)
+						break
+					}
+				}
+				if sampled == 0 || len(expired)*4 <= sampled {
+					break
+				}
+			}
+		case <-stop:
+			return
+		}
 	}
-	return true
 }
 
+// DoJoin 只把节点加入raft配置，不登记http地址和日志版本，leader写日志时按minLogEntryVersion对待它
 func (c *Cache_proxy) DoJoin(peerAddress string) bool {
 	if peerAddress == "" {
 		c.Log.Println("invalid peerAddress")
 		return false
 	}
-	addPeerFuture := c.Raft.Raft.AddVoter(raft.ServerID(peerAddress), raft.ServerAddress(peerAddress), 0, 0)
-	if err := addPeerFuture.Error(); err != nil {
+	if err := c.DoAddServer(peerAddress, peerAddress, "", 0, true); err != nil {
 		c.Log.Printf("Error joining peer to raft, peeraddress:%s, err:%v", peerAddress, err)
 		return false
 	}
@@ -174,11 +419,36 @@ func (c *Cache_proxy) GetRangeData(start, end int) ([]byte, error) {
 		return nil, err
 	}
 
-	// 将数据序列化为JSON格式以便传输
+	return data, nil
+}
+
+// DoIncrBy 将key的整数值加上incr，返回相加后的值。
+// 加法在每个副本的FSM.Apply中执行，并发的自增不会互相覆盖
+func (c *Cache_proxy) DoIncrBy(ctx context.Context, key string, incr int64) (int64, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" {
+		return 0, fmt.Errorf("doIncrBy() error, get nil key")
+	}
+	ret, err := c.apply(ctx, NewLogEntry(OperIncrBy, key, strconv.FormatInt(incr, 10), 0, false))
 	if err != nil {
-		c.Log.Printf("Error marshaling data: %v", err)
-		return nil, err
+		return 0, err
 	}
+	return ret.(int64), nil
+}
 
-	return data, nil
+// DoIncrByFloat 将key的浮点数值加上incr，返回相加后的值
+func (c *Cache_proxy) DoIncrByFloat(ctx context.Context, key string, incr float64) (float64, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" {
+		return 0, fmt.Errorf("doIncrByFloat() error, get nil key")
+	}
+	ret, err := c.apply(ctx, NewLogEntry(OperIncrByFloat, key, strconv.FormatFloat(incr, 'g', -1, 64), 0, false))
+	if err != nil {
+		return 0, err
+	}
+	return ret.(float64), nil
 }
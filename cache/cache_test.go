@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestCache 构造不连接数据库的Cache
+func newTestCache() *Cache {
+	return &Cache{dirtyKeys: make(chan string, chansize)}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := newTestCache()
+	c.Add("k1", []byte("v1"))
+	c.AddWithExpire("k2", []byte("v2"), 1<<62, 0)
+	c.Get("k1")
+	c.Get("k1")
+
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, c.SnapshotRecords(), snapshotMeta{}); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+
+	restored := newTestCache()
+	restored.Add("stale", []byte("x"))
+	if err := restored.UnMarshal(io.NopCloser(&buf)); err != nil {
+		t.Fatalf("UnMarshal failed: %v", err)
+	}
+
+	if _, ok := restored.Get("stale"); ok {
+		t.Fatal("expected restore to drop existing data")
+	}
+	if v, ok := restored.Get("k1"); !ok || string(v) != "v1" {
+		t.Fatalf("got k1=%s; want v1", v)
+	}
+	if ttl, _, ok := restored.TTL("k2"); !ok || ttl <= 0 {
+		t.Fatalf("got k2 ttl %v; want positive", ttl)
+	}
+	want, _ := c.MemoryUsage()
+	if got, _ := restored.MemoryUsage(); got != want {
+		t.Fatalf("got %d bytes used; want %d", got, want)
+	}
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	c := newTestCache()
+	for i := 0; i < snapshotChunkEntries*2+1; i++ {
+		c.Add(strconv.Itoa(i), []byte{byte(i)})
+	}
+
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, c.SnapshotRecords(), snapshotMeta{}); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	restored := newTestCache()
+	if err := restored.UnMarshal(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("UnMarshal failed: %v", err)
+	}
+	if restored.Len() != snapshotChunkEntries*2+1 {
+		t.Fatalf("got %d entries; want %d", restored.Len(), snapshotChunkEntries*2+1)
+	}
+
+	// 篡改payload后crc校验失败
+	data[len(snapshotMagic)+10] ^= 0xff
+	if err := newTestCache().UnMarshal(io.NopCloser(bytes.NewReader(data))); err == nil {
+		t.Fatal("expected corrupted snapshot to fail")
+	}
+}
+
+func TestSnapshotMeta(t *testing.T) {
+	c := newTestCache()
+	c.Add("k1", []byte("v1"))
+	meta := snapshotMeta{
+		members:    map[string]string{"127.0.0.1:9000": "127.0.0.1:8000", "127.0.0.1:9001": "127.0.0.1:8001"},
+		applied:    42,
+		migrations: map[string]string{"job1": `{"phase":"copy"}`},
+		versions:   map[string]string{"127.0.0.1:9000": "1"},
+		config:     map[string]string{configMaxMemory: "1024", configMaxmemoryPolicy: lru_k.NoEviction},
+	}
+
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, c.SnapshotRecords(), meta); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	got, err := newTestCache().load(io.NopCloser(&buf))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if got.applied != meta.applied || len(got.members) != len(meta.members) {
+		t.Fatalf("got meta %+v; want %+v", got, meta)
+	}
+	for id, addr := range meta.members {
+		if got.members[id] != addr {
+			t.Fatalf("got meta %+v; want %+v", got, meta)
+		}
+	}
+	if got.migrations["job1"] != meta.migrations["job1"] {
+		t.Fatalf("got migrations %v; want %v", got.migrations, meta.migrations)
+	}
+	if got.versions["127.0.0.1:9000"] != "1" {
+		t.Fatalf("got versions %v; want %v", got.versions, meta.versions)
+	}
+	if got.config[configMaxmemoryPolicy] != lru_k.NoEviction {
+		t.Fatalf("got config %v; want %v", got.config, meta.config)
+	}
+}
+
+func TestSnapshotCorruptedLength(t *testing.T) {
+	header := snapshotMagic + string([]byte{snapshotBinaryVersion})
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	cases := map[string][]byte{
+		// 第一个chunk的payload长度过大
+		"payload": append([]byte(header+"\x01"), huge...),
+		// 成员表的条目数过大
+		"members": append([]byte(header+"\x00"), huge...),
+		// 成员表中的字符串过长
+		"string": append([]byte(header+"\x00\x01"), huge...),
+	}
+	for name, data := range cases {
+		_, err := newTestCache().load(io.NopCloser(bytes.NewReader(data)))
+		if !errors.Is(err, errSnapshotCorrupted) {
+			t.Errorf("%s: got %v; want %v", name, err, errSnapshotCorrupted)
+		}
+	}
+}
+
+func TestSnapshotCorruptedRecordSize(t *testing.T) {
+	uvarint := func(v uint64) []byte {
+		return binary.AppendUvarint(nil, v)
+	}
+	record := func(typ byte, data []byte) []byte {
+		b := append(uvarint(1), 'k', typ)
+		b = append(b, uvarint(uint64(len(data)))...)
+		b = append(b, data...)
+		// count、flags、expireAt、slide
+		return append(b, 1, 0, 0, 0)
+	}
+	// 长度在uint64加上元素的其他部分后溢出
+	overflow := uint64(math.MaxUint64 - 7)
+	cases := map[string][]byte{
+		"key":  uvarint(overflow),
+		"list": record(TypeList, append(uvarint(1), uvarint(overflow)...)),
+		"set":  record(TypeSet, append(uvarint(1), uvarint(overflow)...)),
+		"hash": record(TypeHash, append(uvarint(1), uvarint(overflow)...)),
+		"zset": record(TypeZSet, append(uvarint(1), uvarint(overflow)...)),
+	}
+	for name, payload := range cases {
+		// chunk的校验和正确，损坏的是chunk内部记录的长度
+		data := []byte(snapshotMagic + string([]byte{snapshotBinaryVersion}))
+		data = append(data, uvarint(1)...)
+		data = append(data, uvarint(uint64(len(payload)))...)
+		data = append(data, payload...)
+		data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+		_, err := newTestCache().load(io.NopCloser(bytes.NewReader(data)))
+		if !errors.Is(err, errSnapshotCorrupted) {
+			t.Errorf("%s: got %v; want %v", name, err, errSnapshotCorrupted)
+		}
+	}
+}
+
+func TestRestoreJSONSnapshot(t *testing.T) {
+	legacy := `{"Version":1,"Entries":[{"Key":"k1","Value":"djE=","Count":2,"Active":true}]}`
+	c := newTestCache()
+	if err := c.UnMarshal(io.NopCloser(strings.NewReader(legacy))); err != nil {
+		t.Fatalf("UnMarshal failed: %v", err)
+	}
+	if v, ok := c.Get("k1"); !ok || string(v) != "v1" {
+		t.Fatalf("got k1=%s; want v1", v)
+	}
+}
+
+func TestMaxMemoryNoEviction(t *testing.T) {
+	c := newTestCache()
+	c.maxBytes = 2 * (entryOverhead + int64(len("k1v1")))
+	c.maxmemoryPolicy = lru_k.NoEviction
+	c.nsegments = 1
+
+	if err := c.Add("k1", []byte("v1")); err != nil {
+		t.Fatalf("Add k1 failed: %v", err)
+	}
+	if err := c.Add("k2", []byte("v2")); err != nil {
+		t.Fatalf("Add k2 failed: %v", err)
+	}
+	if err := c.Add("k3", []byte("v3")); err != lru_k.ErrOutOfMemory {
+		t.Fatalf("got err %v; want ErrOutOfMemory", err)
+	}
+	if used, max := c.MemoryUsage(); used != max {
+		t.Fatalf("got used %d; want %d", used, max)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	c := newTestCache()
+	c.nsegments = 4
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	for i, s := range c.segments {
+		if s.lru.Len() == 0 {
+			t.Fatalf("segment %d is empty", i)
+		}
+	}
+	if c.Len() != 1000 {
+		t.Fatalf("got %d entries; want 1000", c.Len())
+	}
+	if v, ok := c.Get("42"); !ok || string(v) != "42" {
+		t.Fatalf("got 42=%s; want 42", v)
+	}
+	if !c.Remove("42") || c.Len() != 999 {
+		t.Fatal("expected 42 to be removed")
+	}
+}
+
+func TestBufferedAccess(t *testing.T) {
+	c := newTestCache()
+	c.nsegments = 1
+	c.Add("k1", []byte("v1"))
+	s := c.segments[0]
+
+	// 读请求只记录访问，不改变lru_k的状态
+	c.Get("k1")
+	if records := s.lru.Records(); records[0].Active {
+		t.Fatal("expected Get not to promote k1 before the batch is drained")
+	}
+
+	// 积压的访问批次在下一次拿写锁时补记，LRU-K下访问两次的key进入active列表
+	s.batches <- []string{"k1", "k1"}
+	s.lock()
+	records := s.lru.Records()
+	s.unlock()
+	if len(records) != 1 || !records[0].Active {
+		t.Fatalf("got records %+v; want k1 active", records)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	c := newTestCache()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(i % 100)
+				if i%10 == g {
+					c.Add(key, []byte(key))
+				} else {
+					c.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestMSetMDel(t *testing.T) {
+	c := newTestCache()
+	if errs := c.MSet([]string{"k1", "v1", "k2", "v2"}, 1<<62, 0); len(errs) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Fatalf("got MSet errors %v; want 2 nils", errs)
+	}
+	if v, ok := c.Get("k2"); !ok || string(v) != "v2" {
+		t.Fatalf("got k2=%s; want v2", v)
+	}
+	if ttl, _, ok := c.TTL("k1"); !ok || ttl <= 0 {
+		t.Fatalf("got k1 ttl %v; want positive", ttl)
+	}
+
+	deleted := c.MDel([]string{"k1", "missing", "k2"})
+	if len(deleted) != 3 || !deleted[0] || deleted[1] || !deleted[2] {
+		t.Fatalf("got MDel %v; want [true false true]", deleted)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("got %d keys; want 0", c.Len())
+	}
+}
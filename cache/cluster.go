@@ -1,41 +1,220 @@
 package cache
 
 import (
-	"math/rand"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ReadPolicy 是raft group内分散stale读请求的策略
+type ReadPolicy int
+
+const (
+	// ReadLocal 优先在收到请求的节点上读，本地排队的读请求明显多于其他副本时才交给最空闲的副本
+	ReadLocal ReadPolicy = iota
+	// ReadRoundRobin 依次把读请求交给每个副本
+	ReadRoundRobin
+	// ReadLeastOutstanding 交给正在处理的读请求最少的副本
+	ReadLeastOutstanding
+)
+
+const (
+	// replicaRefreshInterval 副本列表从raft配置和成员表刷新的间隔
+	replicaRefreshInterval = time.Second
+	// replicaDownTime 转发失败的副本在这段时间内不再接收读请求
+	replicaDownTime = 3 * time.Second
+	// localReadSlack ReadLocal策略下本地比最空闲的副本多出这么多读请求时才交给其他副本
+	localReadSlack = 8
+)
+
+func ParseReadPolicy(s string) (ReadPolicy, error) {
+	switch s {
+	case "", "local":
+		return ReadLocal, nil
+	case "roundrobin":
+		return ReadRoundRobin, nil
+	case "leastoutstanding":
+		return ReadLeastOutstanding, nil
+	}
+	return 0, fmt.Errorf("invalid read policy %q, must be one of local, roundrobin, leastoutstanding", s)
+}
+
+func (p ReadPolicy) String() string {
+	switch p {
+	case ReadRoundRobin:
+		return "roundrobin"
+	case ReadLeastOutstanding:
+		return "leastoutstanding"
+	}
+	return "local"
+}
+
+// replica 是raft group中可以处理读请求的一个节点，voter和learner都可以
+type replica struct {
+	address     string // http地址
+	outstanding int64  // 经过本节点路由、还没有返回的读请求数
+	downUntil   time.Time
+}
+
+// Cluster 记录本节点所在raft group的副本，按ReadPolicy为stale读请求选择副本，
+// 热点分片可以通过加入learner扩展读能力，而不增加参与投票的节点数
 type Cluster struct {
-	master *Cache_proxy
-	nodes  []*Cache_proxy
-	mutex  sync.Mutex
+	mutex    sync.Mutex
+	self     string
+	policy   ReadPolicy
+	nodes    []*replica
+	next     uint64
+	loadedAt time.Time
 }
 
-func createClsuter() *Cluster {
-	cl := &Cluster{}
-	cl.nodes = make([]*Cache_proxy, 0)
+func NewCluster(self string, policy ReadPolicy) *Cluster {
+	return &Cluster{self: self, policy: policy}
+}
 
-	return cl
+// Update 用raft配置替换副本列表，已有副本的计数和下线时间保留，
+// 还没有登记http地址的节点不参与读
+func (cl *Cluster) Update(servers []Server) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	old := make(map[string]*replica, len(cl.nodes))
+	for _, n := range cl.nodes {
+		old[n.address] = n
+	}
+	nodes := make([]*replica, 0, len(servers))
+	for _, s := range servers {
+		if s.HttpAddress == "" {
+			continue
+		}
+		if n, ok := old[s.HttpAddress]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &replica{address: s.HttpAddress})
+		}
+	}
+	cl.nodes = nodes
+	cl.loadedAt = time.Now()
+}
 
+// stale 判断副本列表是否需要刷新
+func (cl *Cluster) stale() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return time.Since(cl.loadedAt) > replicaRefreshInterval
 }
 
-func (cl *Cluster) RegisterCluster(proxy *Cache_proxy) {
+// Replicas 返回可以接收读请求的副本的http地址
+func (cl *Cluster) Replicas() []string {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
-	cl.nodes = append(cl.nodes, proxy)
+	var ret []string
+	now := time.Now()
+	for _, n := range cl.healthy(now) {
+		ret = append(ret, n.address)
+	}
+	return ret
 }
 
-func (cl *Cluster) SetMaster(proxy *Cache_proxy) {
+// Pick 按策略选择处理读请求的副本，请求结束后必须调用done。
+// 没有可用的副本时返回本节点
+func (cl *Cluster) Pick() (address string, done func()) {
+	cl.mutex.Lock()
+	var n *replica
+	switch cl.policy {
+	case ReadRoundRobin:
+		n = cl.robin()
+	case ReadLeastOutstanding:
+		n = cl.leastOutstanding()
+	default:
+		n = cl.local()
+	}
+	cl.mutex.Unlock()
+
+	if n == nil {
+		return cl.self, func() {}
+	}
+	atomic.AddInt64(&n.outstanding, 1)
+	return n.address, func() { atomic.AddInt64(&n.outstanding, -1) }
+}
+
+// Robin 依次返回每个可用的副本，没有可用的副本时返回本节点
+func (cl *Cluster) Robin() string {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if n := cl.robin(); n != nil {
+		return n.address
+	}
+	return cl.self
+}
+
+// MarkDown 转发读请求失败后调用，副本在replicaDownTime内不再被选中
+func (cl *Cluster) MarkDown(address string) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
-	cl.master = proxy
+	for _, n := range cl.nodes {
+		if n.address == address && address != cl.self {
+			n.downUntil = time.Now().Add(replicaDownTime)
+		}
+	}
+}
+
+func (cl *Cluster) healthy(now time.Time) []*replica {
+	nodes := make([]*replica, 0, len(cl.nodes))
+	for _, n := range cl.nodes {
+		if n.address == cl.self || now.After(n.downUntil) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (cl *Cluster) robin() *replica {
+	nodes := cl.healthy(time.Now())
+	if len(nodes) == 0 {
+		return nil
+	}
+	n := nodes[cl.next%uint64(len(nodes))]
+	cl.next++
+	return n
+}
+
+func (cl *Cluster) leastOutstanding() *replica {
+	var least *replica
+	for _, n := range cl.healthy(time.Now()) {
+		if least == nil || atomic.LoadInt64(&n.outstanding) < atomic.LoadInt64(&least.outstanding) {
+			least = n
+		}
+	}
+	return least
+}
+
+func (cl *Cluster) local() *replica {
+	least := cl.leastOutstanding()
+	for _, n := range cl.nodes {
+		if n.address == cl.self {
+			if least == nil || atomic.LoadInt64(&n.outstanding) <= atomic.LoadInt64(&least.outstanding)+localReadSlack {
+				return n
+			}
+			return least
+		}
+	}
+	return least
 }
 
-func (cl *Cluster) Robin() *Cache_proxy {
-	r := rand.Int() % (len(cl.nodes) - 1)
-	return cl.nodes[r]
+// PickReplica 为本分片的stale读请求选择副本，副本列表每隔replicaRefreshInterval
+// 从raft配置刷新一次，请求结束后必须调用done
+func (c *Cache_proxy) PickReplica() (address string, done func()) {
+	if c.cluster.stale() {
+		if servers, err := c.Configuration(); err == nil {
+			c.cluster.Update(servers)
+		} else {
+			c.Log.Printf("refresh replicas failed:%v", err)
+		}
+	}
+	return c.cluster.Pick()
 }
 
-func (cl *Cluster) GetMaster() *Cache_proxy {
-	return cl.master
+// MarkReplicaDown 转发读请求给副本失败后调用
+func (c *Cache_proxy) MarkReplicaDown(address string) {
+	c.cluster.MarkDown(address)
 }
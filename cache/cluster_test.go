@@ -0,0 +1,92 @@
+package cache
+
+import "testing"
+
+func newTestCluster(policy ReadPolicy, addrs ...string) *Cluster {
+	cl := NewCluster(addrs[0], policy)
+	var servers []Server
+	for _, addr := range addrs {
+		servers = append(servers, Server{ID: addr, HttpAddress: addr})
+	}
+	cl.Update(servers)
+	return cl
+}
+
+func TestParseReadPolicy(t *testing.T) {
+	for _, p := range []ReadPolicy{ReadLocal, ReadRoundRobin, ReadLeastOutstanding} {
+		if got, err := ParseReadPolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseReadPolicy(%q) = %v, %v; want %v", p, got, err, p)
+		}
+	}
+	if _, err := ParseReadPolicy("random"); err == nil {
+		t.Error("ParseReadPolicy(\"random\") should fail")
+	}
+}
+
+func TestRobin(t *testing.T) {
+	// 只有一个节点时不能panic
+	if got := newTestCluster(ReadRoundRobin, "a").Robin(); got != "a" {
+		t.Fatalf("got %s; want a", got)
+	}
+	if got := NewCluster("a", ReadRoundRobin).Robin(); got != "a" {
+		t.Fatalf("got %s; want a", got)
+	}
+
+	cl := newTestCluster(ReadRoundRobin, "a", "b", "c")
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[cl.Robin()]++
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if seen[addr] != 2 {
+			t.Fatalf("got %v; want every replica picked twice", seen)
+		}
+	}
+
+	cl.MarkDown("b")
+	for i := 0; i < 4; i++ {
+		if got := cl.Robin(); got == "b" {
+			t.Fatal("expected replica b to be skipped after MarkDown")
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	cl := newTestCluster(ReadLeastOutstanding, "a", "b", "c")
+	a, doneA := cl.Pick()
+	b, doneB := cl.Pick()
+	c, _ := cl.Pick()
+	if a == b || b == c || a == c {
+		t.Fatalf("got %s %s %s; want 3 different replicas", a, b, c)
+	}
+	doneB()
+	if got, _ := cl.Pick(); got != b {
+		t.Fatalf("got %s; want %s", got, b)
+	}
+	doneA()
+	if got, _ := cl.Pick(); got != a {
+		t.Fatalf("got %s; want %s", got, a)
+	}
+}
+
+func TestPreferLocal(t *testing.T) {
+	cl := newTestCluster(ReadLocal, "a", "b")
+	var dones []func()
+	for i := 0; i <= localReadSlack; i++ {
+		addr, done := cl.Pick()
+		if addr != "a" {
+			t.Fatalf("pick %d got %s; want a", i, addr)
+		}
+		dones = append(dones, done)
+	}
+	// 本地排队的读请求超过localReadSlack后交给其他副本
+	if got, _ := cl.Pick(); got != "b" {
+		t.Fatalf("got %s; want b", got)
+	}
+	for _, done := range dones {
+		done()
+	}
+	if got, _ := cl.Pick(); got != "a" {
+		t.Fatalf("got %s; want a", got)
+	}
+}
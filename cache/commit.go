@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// maxGroupCommit 一条合并日志最多包含的命令数
+	maxGroupCommit = 256
+	// maxInflightCommits 同时等待raft提交的合并日志数，前面的日志在等待复制和落盘时，
+	// 新到的命令在队列中积累，下一条日志一次提交
+	maxInflightCommits = 4
+	applyTimeout       = 5 * time.Second
+)
+
+// pendingEntry 是等待groupCommit合并提交的一条命令
+type pendingEntry struct {
+	entry LogEntryData
+	done  chan commitResult
+}
+
+type commitResult struct {
+	ret   interface{}
+	index uint64 // 命令所在的raft日志的index
+	err   error
+}
+
+// commit 把命令交给groupCommit，和其他并发的写命令合并成一条raft日志提交，
+// 返回这条命令在FSM中的执行结果，日志的index记录到ctx的会话中
+func (c *Cache_proxy) commit(ctx context.Context, e LogEntryData) (interface{}, error) {
+	p := &pendingEntry{entry: e, done: make(chan commitResult, 1)}
+	c.commits <- p
+	r := <-p.done
+	if r.err == nil {
+		recordIndex(ctx, r.index)
+	}
+	return r.ret, r.err
+}
+
+// groupCommit 在后台把排队的写命令合并成一条raft日志，每条日志只需要一次复制和落盘，
+// 并发写入时大幅减少raft日志的条数
+func (c *Cache_proxy) groupCommit() {
+	inflight := make(chan struct{}, maxInflightCommits)
+	for p := range c.commits {
+		batch := []*pendingEntry{p}
+	drain:
+		for len(batch) < maxGroupCommit {
+			select {
+			case p := <-c.commits:
+				batch = append(batch, p)
+			default:
+				break drain
+			}
+		}
+
+		inflight <- struct{}{}
+		go func(batch []*pendingEntry) {
+			defer func() { <-inflight }()
+			c.commitBatch(batch)
+		}(batch)
+	}
+}
+
+// commitBatch 提交一条合并日志并把每条命令的结果交给等待的调用方
+func (c *Cache_proxy) commitBatch(batch []*pendingEntry) {
+	// 检查冻结的区间和交给raft在同一个gate读锁内完成，期间不会有新的区间被冻结，
+	// 写入正在切换的区间的命令直接返回，不影响合并在一起的其他命令
+	s := &c.migrationSessions
+	s.gate.RLock()
+	pending := batch[:0]
+	for _, p := range batch {
+		if s.frozen(p.entry) {
+			p.done <- commitResult{nil, 0, ErrMigrating}
+			continue
+		}
+		pending = append(pending, p)
+	}
+	batch = pending
+	if len(batch) == 0 {
+		s.gate.RUnlock()
+		return
+	}
+	entries := make([]LogEntryData, len(batch))
+	for i, p := range batch {
+		entries[i] = p.entry
+	}
+	var data []byte
+	if len(batch) == 1 {
+		data = encodeLogEntry(entries[0], c.logVersion())
+	} else {
+		data = encodeLogBatch(entries, c.logVersion())
+	}
+	future, err := c.submitLocked(data, entries)
+	s.gate.RUnlock()
+
+	ret, index, err := c.wait(future, err)
+	if len(batch) == 1 {
+		batch[0].done <- commitResult{ret, index, err}
+		return
+	}
+	rets, ok := ret.([]interface{})
+	if err == nil && (!ok || len(rets) != len(batch)) {
+		err = fmt.Errorf("invalid batch response %T", ret)
+	}
+	for i, p := range batch {
+		if err != nil {
+			p.done <- commitResult{nil, 0, err}
+			continue
+		}
+		if e, ok := rets[i].(error); ok {
+			p.done <- commitResult{nil, 0, e}
+			continue
+		}
+		p.done <- commitResult{rets[i], index, nil}
+	}
+}
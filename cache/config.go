@@ -2,26 +2,59 @@ package cache
 
 import (
 	"flag"
+	"fmt"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"log"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
 	//raftNodes int32
-	HttpPort    int32
-	RaftPort    int32
-	NodeName    string
-	Bootstrap   bool
-	JoinAddress string
+	HttpPort        int32
+	RespPort        int32 // 为0时不开启redis协议端口
+	RaftPort        int32
+	NodeName        string
+	Bootstrap       bool
+	JoinAddress     string
+	RedirectWrites  bool // follower收到写请求时返回307重定向到leader，否则转发给leader
+	Nonvoter        bool // 作为只复制日志、不参与投票的learner加入raft group
+	ReadPolicy      ReadPolicy
+	Ctrlers         []string // 分片控制器的http地址，为空时哈希环通过/sharepeers等接口维护
+	GID             string   // 本节点所在分片组(raft group)的ID
+	MigrateRate     int      // 迁移数据时每秒最多拷贝的key数量，0表示不限制
+	Policy          string
+	MaxMemory       int64
+	MaxmemoryPolicy string
+	Segments        int
 }
 
+// autoMemoryPercent -maxmemory=auto时，缓存占Go运行时内存上限(GOMEMLIMIT)的比例，
+// 剩下的留给raft日志、网络缓冲区等
+const autoMemoryPercent = 75
+
 func NewConfig() *Config {
 	config := &Config{}
 
 	//var raftNodes = flag.String("nodes", "3", "count of gedisraft nodes")
 	var httpPort = flag.Int("httpport", 8000, "http tcp address port")
+	var respPort = flag.Int("respport", 0, "redis protocol (RESP) tcp address port, 0 means disabled")
 	var raftPort = flag.Int("raftport", 9000, "gedisraft tcp address port")
 	var nodeName = flag.String("node", "default", "node name")
 	var bootstrap = flag.Bool("bootstrap", false, "boostrap")
 	var joinAddress = flag.String("joinaddr", "", "join addr")
+	var redirectWrites = flag.Bool("redirectwrites", false, "redirect writes on followers to the leader with 307 instead of forwarding them")
+	var nonvoter = flag.Bool("nonvoter", false, "join the raft group as a read-only non-voting learner")
+	var readPolicy = flag.String("readpolicy", ReadLocal.String(), "how stale reads are spread over the replicas of a raft group, one of local, roundrobin, leastoutstanding")
+	var ctrlers = flag.String("ctrler", "", "comma separated http addresses of the shard controllers, the ring is then managed by the controller")
+	var gid = flag.String("gid", "", "id of the shard group (raft group) this node belongs to, required with -ctrler")
+	var migrateRate = flag.Int("migraterate", 0, "max keys copied per second when migrating data to this node, 0 means no limit")
+	var policy = flag.String("policy", lru_k.DefaultPolicy, fmt.Sprintf("cache eviction policy, one of %v", lru_k.Policies()))
+	var maxMemory = flag.String("maxmemory", "auto", "max bytes used by cache, e.g. 512mb, 0 means no limit, auto means 75% of GOMEMLIMIT")
+	var segments = flag.Int("segments", DefaultSegments, "number of independently locked cache segments")
+	var maxmemoryPolicy = flag.String("maxmemory-policy", lru_k.DefaultMaxmemoryPolicy, fmt.Sprintf("how to handle writes when maxmemory is reached, one of %v", lru_k.MaxmemoryPolicies()))
 
 	flag.Parse()
 	//nodes, err := strconv.Atoi(*raftNodes)
@@ -30,9 +63,76 @@ func NewConfig() *Config {
 	//}
 	//config.raftNodes = int32(nodes)
 	config.HttpPort = int32(*httpPort)
+	config.RespPort = int32(*respPort)
 	config.RaftPort = int32(*raftPort)
 	config.Bootstrap = *bootstrap
 	config.NodeName = *nodeName
 	config.JoinAddress = *joinAddress
+	config.RedirectWrites = *redirectWrites
+	config.Nonvoter = *nonvoter
+	config.Policy = *policy
+	config.MaxmemoryPolicy = *maxmemoryPolicy
+	config.Segments = *segments
+
+	memory, err := ParseMemory(*maxMemory)
+	if err != nil {
+		log.Fatalf("invalid maxmemory: %v", err)
+	}
+	config.MaxMemory = memory
+
+	config.ReadPolicy, err = ParseReadPolicy(*readPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *ctrlers != "" {
+		config.Ctrlers = strings.Split(*ctrlers, ",")
+		if *gid == "" {
+			log.Fatal("-gid is required with -ctrler")
+		}
+	}
+	config.GID = *gid
+	config.MigrateRate = *migrateRate
+	if config.Nonvoter && config.Bootstrap {
+		log.Fatal("a nonvoter can not bootstrap a raft group")
+	}
 	return config
 }
+
+// ParseMemory 解析redis风格的内存大小，例如100、64kb、512mb、1gb，
+// auto表示按Go运行时的内存上限自动计算，没有设置GOMEMLIMIT时不限制
+func ParseMemory(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "auto" {
+		limit := debug.SetMemoryLimit(-1)
+		if limit == math.MaxInt64 {
+			return 0, nil
+		}
+		return limit / 100 * autoMemoryPercent, nil
+	}
+
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"gb", 1 << 30},
+		{"mb", 1 << 20},
+		{"kb", 1 << 10},
+		{"b", 1},
+	}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			scale = u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	if n > math.MaxInt64/scale {
+		return 0, fmt.Errorf("memory size %q overflows", s)
+	}
+	return n * scale, nil
+}
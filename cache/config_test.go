@@ -0,0 +1,40 @@
+package cache
+
+import "testing"
+
+func TestParseMemory(t *testing.T) {
+	testCases := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"64kb":  64 << 10,
+		"512MB": 512 << 20,
+		"2gb":   2 << 30,
+	}
+	for s, want := range testCases {
+		if got, err := ParseMemory(s); err != nil || got != want {
+			t.Errorf("ParseMemory(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "1tb", "abc"} {
+		if _, err := ParseMemory(s); err == nil {
+			t.Errorf("ParseMemory(%q) should fail", s)
+		}
+	}
+}
+
+func TestParseConsistency(t *testing.T) {
+	testCases := map[string]Consistency{
+		"":             ConsistencyStale,
+		"stale":        ConsistencyStale,
+		"leader":       ConsistencyLeader,
+		"linearizable": ConsistencyLinearizable,
+	}
+	for s, want := range testCases {
+		if got, err := ParseConsistency(s); err != nil || got != want {
+			t.Errorf("ParseConsistency(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseConsistency("strong"); err == nil {
+		t.Error("ParseConsistency(\"strong\") should fail")
+	}
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Consistency 是读请求的一致性级别
+type Consistency int
+
+const (
+	// ConsistencyStale 直接读本地缓存，follower可能读到任意旧的数据
+	ConsistencyStale Consistency = iota
+	// ConsistencyLeader 只在leader上读，依赖leader租约：leader在LeaderLeaseTimeout内
+	// 联系不上多数节点会自动下台，时钟漂移很大时被罢免的leader可能短暂地读到旧数据
+	ConsistencyLeader
+	// ConsistencyLinearizable 按ReadIndex读：记下commit index，通过VerifyLeader确认
+	// 自己仍是leader，等状态机应用到该index后再读，不依赖时钟
+	ConsistencyLinearizable
+)
+
+var ErrStaleRead = errors.New("replica too stale") // follower落后leader的时间超过max_staleness
+
+// readBarrierTimeout 等待状态机追上commit index的最长时间，和raft.Apply的超时时间一致
+const readBarrierTimeout = 5 * time.Second
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch s {
+	case "", "stale":
+		return ConsistencyStale, nil
+	case "leader":
+		return ConsistencyLeader, nil
+	case "linearizable":
+		return ConsistencyLinearizable, nil
+	}
+	return 0, fmt.Errorf("invalid consistency %q, must be one of stale, leader, linearizable", s)
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyLeader:
+		return "leader"
+	case ConsistencyLinearizable:
+		return "linearizable"
+	}
+	return "stale"
+}
+
+// ReadBarrier 在读本地缓存之前调用，返回nil之后本地缓存满足level要求的一致性。
+// 不是leader时返回ErrNotLeader；stale级别的maxStaleness大于0时，follower距离上次收到
+// leader消息的时间超过maxStaleness，或者没能在maxStaleness内应用完已知的日志，返回ErrStaleRead
+func (c *Cache_proxy) ReadBarrier(level Consistency, maxStaleness time.Duration) error {
+	r := c.Raft.Raft
+	switch level {
+	case ConsistencyLeader:
+		if !c.IsLeader() {
+			return ErrNotLeader
+		}
+		// 刚当选的leader可能还没有应用完上一个任期提交的日志
+		return c.waitApplied(r.CommitIndex(), readBarrierTimeout)
+	case ConsistencyLinearizable:
+		if !c.IsLeader() {
+			return ErrNotLeader
+		}
+		readIndex := r.CommitIndex()
+		if err := r.VerifyLeader().Error(); err != nil {
+			return fmt.Errorf("%w: %v", ErrNotLeader, err)
+		}
+		return c.waitApplied(readIndex, readBarrierTimeout)
+	}
+
+	if maxStaleness <= 0 || c.IsLeader() {
+		return nil
+	}
+	if last := r.LastContact(); last.IsZero() || time.Since(last) > maxStaleness {
+		return ErrStaleRead
+	}
+	if err := c.waitApplied(r.CommitIndex(), maxStaleness); err != nil {
+		return ErrStaleRead
+	}
+	return nil
+}
+
+// Session 记录一个请求提交的写日志的index，作为读己之写的会话token。
+// 请求提交了多条日志时记录最大的index，index只在提交日志的raft group内有意义
+type Session struct {
+	index uint64
+}
+
+type sessionKey struct{}
+
+// WithSession 返回带有会话的ctx，通过ctx提交的写命令把日志的index记录到s中
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// Index 返回会话中写日志的最大index，没有提交过写日志时返回0
+func (s *Session) Index() uint64 {
+	return atomic.LoadUint64(&s.index)
+}
+
+// recordIndex 把写日志的index记录到ctx的会话中，ctx没有会话时忽略
+func recordIndex(ctx context.Context, index uint64) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	if !ok {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&s.index)
+		if index <= old || atomic.CompareAndSwapUint64(&s.index, old, index) {
+			return
+		}
+	}
+}
+
+// WaitIndex 等待状态机应用到会话token中的index，超时返回ErrStaleRead。
+// token都是经过FSM.Apply的写日志，快照中也保存了applied，只需要等FSM.Apply记录的index
+func (c *Cache_proxy) WaitIndex(index uint64, timeout time.Duration) error {
+	if c.Raft.fsm.appliedIndex() >= index {
+		return nil
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for c.Raft.fsm.appliedIndex() < index {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return fmt.Errorf("%w: wait for index %d timeout, applied %d", ErrStaleRead, index, c.Raft.fsm.appliedIndex())
+		}
+	}
+	return nil
+}
+
+// waitApplied 等待状态机应用到index。以FSM.Apply中记录的index为准，
+// commit index可能是不经过FSM.Apply的noop和成员变更日志，raft已经把index之前的日志
+// 都交给FSM之后，leader通过Barrier等待它们应用完，follower不能提交Barrier，直接认为已经应用，
+// 只用于允许读到旧数据的max_staleness
+func (c *Cache_proxy) waitApplied(index uint64, timeout time.Duration) error {
+	r := c.Raft.Raft
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for c.Raft.fsm.appliedIndex() < index {
+		if r.AppliedIndex() >= index {
+			if !c.IsLeader() {
+				return nil
+			}
+			return r.Barrier(timeout).Error()
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return fmt.Errorf("wait for applied index %d timeout, applied %d", index, c.Raft.fsm.appliedIndex())
+		}
+	}
+	return nil
+}
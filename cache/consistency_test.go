@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSessionIndex(t *testing.T) {
+	leader := waitLeader(t, newTestRaftGroup(t, 1))
+	leader.commits = make(chan *pendingEntry, maxGroupCommit)
+	go leader.groupCommit()
+
+	first := &Session{}
+	if err := leader.DoSet(WithSession(context.Background(), first), OperSet, "a", "1"); err != nil {
+		t.Fatalf("set a: %v", err)
+	}
+	// token是这条写命令自己所在的日志，而不是之后状态机应用到的位置
+	if index := leader.Raft.Raft.LastIndex(); first.Index() != index {
+		t.Fatalf("got token %d; want index %d of the write", first.Index(), index)
+	}
+	if err := leader.DoSet(context.Background(), OperSet, "b", "1"); err != nil {
+		t.Fatalf("set b: %v", err)
+	}
+	second := &Session{}
+	if _, err := leader.DoMSet(WithSession(context.Background(), second), []string{"c", "1", "d", "1"}, 0, false); err != nil {
+		t.Fatalf("mset: %v", err)
+	}
+	if index := leader.Raft.Raft.LastIndex(); second.Index() != index || first.Index() >= index-1 {
+		t.Fatalf("got tokens %d and %d; want %d and less than %d", first.Index(), second.Index(), index, index-1)
+	}
+	if err := leader.WaitIndex(second.Index(), 0); err != nil {
+		t.Fatalf("wait for own token: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotFloat = errors.New("value is not a valid float")
+	ErrNaN      = errors.New("increment would produce NaN or Infinity")
+)
+
+// updateString 在key所在分段的写锁内读出字符串value，用fn算出新的value后写回，保留原有的过期时间。
+// 由FSM.Apply调用，now取自raft日志，在每个副本上得到相同的结果
+func (c *Cache) updateString(key string, now int64, fn func(old []byte, exists bool) ([]byte, error)) error {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	var (
+		old      []byte
+		exists   bool
+		expireAt int64
+		slide    int64
+	)
+	if !s.expiredLocked(key, now) {
+		v, _ := s.lru.Lookup(key)
+		gv, ok := v.(*gvalue)
+		if !ok {
+			return ErrWrongType
+		}
+		old, exists = gv.GetBytes(), true
+		expireAt, slide, _ = s.lru.GetExpire(key)
+	}
+
+	value, err := fn(old, exists)
+	if err != nil {
+		return err
+	}
+	// gvalue不允许原地修改，总是写入新的gvalue
+	if err := c.setLocked(s, key, &gvalue{bytes: value}, expireAt, slide); err != nil {
+		return err
+	}
+
+	select {
+	case c.dirtyKeys <- key:
+	default:
+	}
+	return nil
+}
+
+// IncrBy 将key的整数值加上incr，key不存在时视为0，返回相加后的值
+func (c *Cache) IncrBy(key string, incr int64, now int64) (int64, error) {
+	var result int64
+	err := c.updateString(key, now, func(old []byte, exists bool) ([]byte, error) {
+		var cur int64
+		if exists {
+			n, err := strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			cur = n
+		}
+		if (incr > 0 && cur > math.MaxInt64-incr) || (incr < 0 && cur < math.MinInt64-incr) {
+			return nil, ErrNotInteger
+		}
+		result = cur + incr
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	return result, err
+}
+
+// IncrByFloat 将key的浮点数值加上incr，key不存在时视为0，返回相加后的值
+func (c *Cache) IncrByFloat(key string, incr float64, now int64) (float64, error) {
+	var result float64
+	err := c.updateString(key, now, func(old []byte, exists bool) ([]byte, error) {
+		var cur float64
+		if exists {
+			f, err := strconv.ParseFloat(string(old), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, ErrNotFloat
+			}
+			cur = f
+		}
+		result = cur + incr
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, ErrNaN
+		}
+		return FormatFloat(result), nil
+	})
+	return result, err
+}
+
+// FormatFloat 按redis的INCRBYFLOAT的格式输出浮点数，不使用科学计数法
+func FormatFloat(f float64) []byte {
+	return strconv.AppendFloat(nil, f, 'f', -1, 64)
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"math"
+	"testing"
+)
+
+func TestIncrBy(t *testing.T) {
+	c := newTestCache()
+	if v, err := c.IncrBy("n", 5, 0); err != nil || v != 5 {
+		t.Fatalf("got %d, %v; want 5", v, err)
+	}
+	if v, _ := c.IncrBy("n", -7, 0); v != -2 {
+		t.Fatalf("got %d; want -2", v)
+	}
+	if v, ok := c.Get("n"); !ok || string(v) != "-2" {
+		t.Fatalf("got n=%s; want -2", v)
+	}
+
+	c.Add("max", []byte("9223372036854775807"))
+	if _, err := c.IncrBy("max", 1, 0); err != ErrNotInteger {
+		t.Fatalf("got err %v; want ErrNotInteger", err)
+	}
+	c.Add("s", []byte("abc"))
+	if _, err := c.IncrBy("s", 1, 0); err != ErrNotInteger {
+		t.Fatalf("got err %v; want ErrNotInteger", err)
+	}
+	c.HSet("h", []string{"f", "1"}, 0)
+	if _, err := c.IncrBy("h", 1, 0); err != ErrWrongType {
+		t.Fatalf("got err %v; want ErrWrongType", err)
+	}
+}
+
+func TestIncrByKeepsExpire(t *testing.T) {
+	c := newTestCache()
+	c.AddWithExpire("n", []byte("1"), 1<<62, 0)
+	c.IncrBy("n", 1, 0)
+	if ttl, _, ok := c.TTL("n"); !ok || ttl <= 0 {
+		t.Fatalf("got ttl %v; want positive", ttl)
+	}
+
+	// 已过期的key按不存在处理
+	c.AddWithExpire("old", []byte("10"), 1, 0)
+	if v, _ := c.IncrBy("old", 1, 2); v != 1 {
+		t.Fatalf("got %d; want 1", v)
+	}
+}
+
+func TestIncrByFloat(t *testing.T) {
+	c := newTestCache()
+	c.Add("f", []byte("10.5"))
+	if v, err := c.IncrByFloat("f", 0.1, 0); err != nil || v != 10.6 {
+		t.Fatalf("got %v, %v; want 10.6", v, err)
+	}
+	if v, _ := c.Get("f"); string(v) != "10.6" {
+		t.Fatalf("got f=%s; want 10.6", v)
+	}
+	if _, err := c.IncrByFloat("f", math.Inf(1), 0); err != ErrNaN {
+		t.Fatalf("got err %v; want ErrNaN", err)
+	}
+	if string(FormatFloat(1e21)) != "1000000000000000000000" {
+		t.Fatalf("got %s", FormatFloat(1e21))
+	}
+}
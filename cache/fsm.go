@@ -1,52 +1,375 @@
 package cache
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/hashicorp/raft"
 	"io"
 	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type FSM struct {
-	proxy *Cache_proxy
-	log   *log.Logger
+	proxy   *Cache_proxy
+	log     *log.Logger
+	applied uint64 // 最后一条经过Apply的日志的index
 }
 
 func (f *FSM) Apply(logEntry *raft.Log) interface{} {
-	e := LogEntryData{}
-	if err := json.Unmarshal(logEntry.Data, &e); err != nil {
-		panic("Failed unmarshaling Raft log entry. This is a bug.")
+	ret := f.applyLog(logEntry)
+	atomic.StoreUint64(&f.applied, logEntry.Index)
+	return ret
+}
+
+// ApplyBatch 实现raft.BatchingFSM，一次应用raft提交的多条日志，
+// 配置变更等不是命令的日志也会传进来，返回nil
+func (f *FSM) ApplyBatch(logs []*raft.Log) []interface{} {
+	rets := make([]interface{}, len(logs))
+	for i, l := range logs {
+		if l.Type == raft.LogCommand {
+			rets[i] = f.applyLog(l)
+		}
 	}
+	if len(logs) > 0 {
+		atomic.StoreUint64(&f.applied, logs[len(logs)-1].Index)
+	}
+	return rets
+}
+
+// applyLog 解码并应用一条命令日志。groupCommit合并的日志返回每条命令的结果组成的[]interface{}。
+// 无法解码的日志记录错误后作为结果返回，不让整个节点崩溃；leader按所有节点都支持的版本写日志，
+// 正常情况下不会出现，出现时说明本节点需要升级
+func (f *FSM) applyLog(logEntry *raft.Log) interface{} {
+	entries, batch, err := decodeLogEntry(logEntry.Data)
+	if err != nil {
+		err = fmt.Errorf("cannot decode log entry %d, upgrade this node: %w", logEntry.Index, err)
+		f.log.Printf("fsm.Apply() %v", err)
+		return err
+	}
+	if !batch {
+		return f.applyEntry(entries[0])
+	}
+	rets := make([]interface{}, len(entries))
+	for i, e := range entries {
+		rets[i] = f.applyEntry(e)
+	}
+	return rets
+}
+
+func (f *FSM) applyEntry(e LogEntryData) interface{} {
+	var ret interface{}
 	switch e.Oper {
-	case 0:
+	case OperAdd:
+		{
+			if err := f.proxy.Cache.AddWithExpire(e.Key, []byte(e.Value), e.ExpireAt, e.Slide); err != nil {
+				ret = err
+			}
+		}
+	case OperSet:
+		{
+			if err := f.proxy.Cache.AddWithExpire(e.Key, []byte(e.Value), e.ExpireAt, e.Slide); err != nil {
+				ret = err
+			}
+		}
+	case OperRemove:
+		{
+			ret = f.proxy.Cache.Remove(e.Key)
+		}
+	case OperExpire:
+		{
+			ret = f.proxy.Cache.Expire(e.Key, e.ExpireAt, e.Slide, e.Time)
+		}
+	case OperPersist:
+		{
+			ret = f.proxy.Cache.Persist(e.Key, e.Time)
+		}
+	case OperTouch:
+		{
+			ret = f.proxy.Cache.Touch(e.Key, e.Time)
+		}
+	case OperRemoveExpired:
+		{
+			ret = f.proxy.Cache.RemoveExpired(e.Key, e.Time)
+		}
+	case OperHSet:
+		{
+			ret = result(f.proxy.Cache.HSet(e.Key, e.Fields, e.Time))
+		}
+	case OperHDel:
+		{
+			ret = result(f.proxy.Cache.HDel(e.Key, e.Fields, e.Time))
+		}
+	case OperHIncrBy:
+		{
+			if len(e.Fields) != 1 {
+				ret = fmt.Errorf("invalid hincrby entry, fields:%v", e.Fields)
+				break
+			}
+			incr, err := strconv.ParseInt(e.Value, 10, 64)
+			if err != nil {
+				ret = ErrNotInteger
+				break
+			}
+			ret = result(f.proxy.Cache.HIncrBy(e.Key, e.Fields[0], incr, e.Time))
+		}
+	case OperLPush:
+		{
+			ret = result(f.proxy.Cache.LPush(e.Key, e.Fields, e.Time))
+			f.proxy.waiters.notify(e.Key)
+		}
+	case OperRPush:
+		{
+			ret = result(f.proxy.Cache.RPush(e.Key, e.Fields, e.Time))
+			f.proxy.waiters.notify(e.Key)
+		}
+	case OperLPop:
+		{
+			ret = result(f.proxy.Cache.LPop(e.Fields, e.Time))
+		}
+	case OperRPop:
+		{
+			ret = result(f.proxy.Cache.RPop(e.Fields, e.Time))
+		}
+	case OperLTrim:
+		{
+			start, stop, err := parseRange(e.Fields)
+			if err != nil {
+				ret = err
+				break
+			}
+			if err := f.proxy.Cache.LTrim(e.Key, start, stop, e.Time); err != nil {
+				ret = err
+			}
+		}
+	case OperSAdd:
+		{
+			ret = result(f.proxy.Cache.SAdd(e.Key, e.Fields, e.Time))
+		}
+	case OperSRem:
+		{
+			ret = result(f.proxy.Cache.SRem(e.Key, e.Fields, e.Time))
+		}
+	case OperZAdd:
+		{
+			members, err := parseZMembers(e.Fields)
+			if err != nil {
+				ret = err
+				break
+			}
+			ret = result(f.proxy.Cache.ZAdd(e.Key, members, e.Time))
+		}
+	case OperZRem:
+		{
+			ret = result(f.proxy.Cache.ZRem(e.Key, e.Fields, e.Time))
+		}
+	case OperIncrBy:
+		{
+			incr, err := strconv.ParseInt(e.Value, 10, 64)
+			if err != nil {
+				ret = ErrNotInteger
+				break
+			}
+			ret = result(f.proxy.Cache.IncrBy(e.Key, incr, e.Time))
+		}
+	case OperIncrByFloat:
+		{
+			incr, err := ParseScore(e.Value)
+			if err != nil {
+				ret = ErrNotFloat
+				break
+			}
+			ret = result(f.proxy.Cache.IncrByFloat(e.Key, incr, e.Time))
+		}
+	case OperMSet:
+		{
+			if len(e.Fields)%2 != 0 {
+				ret = fmt.Errorf("invalid mset entry, fields:%d", len(e.Fields))
+				break
+			}
+			ret = f.proxy.Cache.MSet(e.Fields, e.ExpireAt, e.Slide)
+		}
+	case OperMDel:
 		{
-			f.proxy.Cache.Add(e.Key, []byte(e.Value))
+			if e.Value == evictValue {
+				ret = f.proxy.Cache.Evict(e.Fields)
+				break
+			}
+			ret = f.proxy.Cache.MDel(e.Fields)
 		}
-	case 1:
+	case OperSetMember:
 		{
-			f.proxy.Cache.Add(e.Key, []byte(e.Value))
+			var version string
+			if len(e.Fields) > 0 {
+				version = e.Fields[0]
+			}
+			f.proxy.members.set(e.Key, e.Value, version)
 		}
-	case 2:
+	case OperRemoveMember:
 		{
-			f.proxy.Cache.Remove(e.Key)
+			f.proxy.members.remove(e.Key)
+		}
+	case OperSetMigration:
+		{
+			f.proxy.migrationJobs.set(e.Key, e.Value)
+		}
+	case OperRemoveMigration:
+		{
+			ret = f.proxy.migrationJobs.remove(e.Key)
+		}
+	case OperSetMaxMemory:
+		{
+			maxBytes, err := strconv.ParseInt(e.Value, 10, 64)
+			if err != nil || len(e.Fields) != 1 {
+				ret = fmt.Errorf("invalid maxmemory entry, value:%s fields:%v", e.Value, e.Fields)
+				break
+			}
+			if err := f.proxy.Cache.SetMaxMemory(maxBytes, e.Fields[0]); err != nil {
+				ret = err
+			}
+		}
+	case OperRestore:
+		{
+			entries, err := decodeRestore(e.Fields)
+			if err != nil {
+				ret = err
+				break
+			}
+			ret = f.proxy.Cache.Restore(entries, e.Time)
 		}
 	default:
-		panic("oper val error!")
+		err := fmt.Errorf("%w: oper %d, upgrade this node", ErrUnsupportedLogEntry, e.Oper)
+		f.log.Printf("fsm.Apply() %v", err)
+		return err
 	}
-	f.log.Printf("fms.Apply(), logEntry:%s\n", logEntry.Data)
-	return nil
+	f.proxy.migrationSessions.touch(e)
+	return ret
+}
+
+// appliedIndex 返回状态机已经应用的最后一条日志的index。
+// raft.AppliedIndex()在日志交给FSM时就会更新，比状态机实际应用的进度超前
+func (f *FSM) appliedIndex() uint64 {
+	return atomic.LoadUint64(&f.applied)
+}
+
+// parseRange 解析日志中[start, stop]形式的下标区间
+func parseRange(fields []string) (start, stop int64, err error) {
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %v", fields)
+	}
+	if start, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	stop, err = strconv.ParseInt(fields[1], 10, 64)
+	return start, stop, err
+}
+
+// parseZMembers 解析日志中依次为score和member的参数
+func parseZMembers(fields []string) ([]ZMember, error) {
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid zadd fields %v", fields)
+	}
+	members := make([]ZMember, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		score, err := ParseScore(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ZMember{Member: fields[i+1], Score: score})
+	}
+	return members, nil
+}
+
+// result 把命令的返回值转换为FSM.Apply的返回值，出错时返回error
+func result[T any](v T, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return v
 }
 
 func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
-	return &snapshot{proxy: f.proxy}, nil
+	// FSM.Snapshot和Apply不会并发执行，这里只截取视图，序列化在Persist中完成
+	return &snapshot{
+		records: f.proxy.Cache.SnapshotRecords(),
+		meta: snapshotMeta{
+			members:    f.proxy.members.copy(),
+			versions:   f.proxy.members.copyVersions(),
+			applied:    f.appliedIndex(),
+			migrations: f.proxy.migrationJobs.copy(),
+			config:     f.proxy.Cache.snapshotConfig(),
+		},
+	}, nil
 }
 
 func (f *FSM) Restore(snapshot io.ReadCloser) error {
-	return f.proxy.Cache.UnMarshal(snapshot)
+	meta, err := f.proxy.Cache.load(snapshot)
+	if err != nil {
+		return err
+	}
+	f.proxy.members.load(meta.members, meta.versions)
+	f.proxy.migrationJobs.load(meta.migrations)
+	if err := f.proxy.Cache.loadConfig(meta.config); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&f.applied, meta.applied)
+	return nil
 }
 
+const (
+	OperAdd             int8 = iota // 0
+	OperSet                         // 1
+	OperRemove                      // 2
+	OperExpire                      // 3 设置过期时间
+	OperPersist                     // 4 移除过期时间
+	OperTouch                       // 5 顺延滑动过期的key
+	OperRemoveExpired               // 6 定期清理，只删除在Time时刻已过期的key
+	OperHSet                        // 7 Fields依次为field和value
+	OperHDel                        // 8 Fields为要删除的field
+	OperHIncrBy                     // 9 Fields[0]为field，Value为增量
+	OperLPush                       // 10 Fields为要插入的元素
+	OperRPush                       // 11
+	OperLPop                        // 12 Fields为依次尝试的key，从第一个非空的list中弹出
+	OperRPop                        // 13
+	OperLTrim                       // 14 Fields为[start, stop]
+	OperSAdd                        // 15 Fields为成员
+	OperSRem                        // 16
+	OperZAdd                        // 17 Fields依次为score和member
+	OperZRem                        // 18 Fields为成员
+	OperIncrBy                      // 19 Value为整数增量
+	OperIncrByFloat                 // 20 Value为浮点数增量
+	OperMSet                        // 21 Fields依次为key和value，一条日志写入同一分片的多个key
+	OperMDel                        // 22 Fields为要删除的key，Value为evictValue时表示maxmemory淘汰
+	OperSetMember                   // 23 Key为节点的raft地址，Value为http地址，Fields[0]为节点支持的日志版本(可选)
+	OperRemoveMember                // 24 Key为被移出raft group的节点的raft地址
+	OperSetMigration                // 25 Key为迁移任务ID，Value为任务状态
+	OperRemoveMigration             // 26 Key为迁移任务ID
+	OperSetMaxMemory                // 27 Value为raft group的最大字节数，Fields[0]为maxmemory策略
+	OperRestore                     // 28 Fields每5个一组，按原样写入迁移的key，见restore.go
+)
+
 type LogEntryData struct {
-	Oper  int8 // 0->ADD   1->SET   2->REMOVE
-	Key   string
-	Value string
+	Oper   int8 // 0->ADD   1->SET   2->REMOVE   3->EXPIRE   4->PERSIST   5->TOUCH   6->REMOVE_EXPIRED   7->HSET   8->HDEL   9->HINCRBY   10~14->LPUSH/RPUSH/LPOP/RPOP/LTRIM   15~18->SADD/SREM/ZADD/ZREM   19->INCRBY   20->INCRBYFLOAT   21->MSET   22->MDEL   23->SET_MEMBER   24->REMOVE_MEMBER   25->SET_MIGRATION   26->REMOVE_MIGRATION   27->SET_MAXMEMORY   28->RESTORE
+	Key    string
+	Value  string
+	Fields []string `json:",omitempty"` // 复合类型命令的参数
+
+	// Time是leader提交日志时的unix纳秒时间戳，FSM中所有和过期相关的判断都以它为当前时间，
+	// 而不是各副本的本地时钟，保证follower回放日志得到和leader完全相同的状态
+	Time     int64 `json:",omitempty"`
+	ExpireAt int64 `json:",omitempty"` // 过期的绝对时间(unix纳秒)，由leader根据Time+ttl算出
+	Slide    int64 `json:",omitempty"` // 滑动过期时长(纳秒)
+}
+
+// NewLogEntry 由leader构造一条日志，ttl大于0时根据当前时间算出过期的绝对时间，
+// sliding为true表示滑动过期，每次读命中都会把过期时间顺延ttl
+func NewLogEntry(oper int8, key string, value string, ttl time.Duration, sliding bool) LogEntryData {
+	e := LogEntryData{Oper: oper, Key: key, Value: value, Time: time.Now().UnixNano()}
+	if ttl > 0 {
+		e.ExpireAt = e.Time + int64(ttl)
+		if sliding {
+			e.Slide = int64(ttl)
+		}
+	}
+	return e
 }
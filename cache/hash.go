@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"unsafe"
+)
+
+// hashFieldOverhead 每个field除内容以外计入的字节数：field和value两个字符串头，以及map中分摊的开销(估算)
+const hashFieldOverhead = int(2*unsafe.Sizeof("")) + 16
+
+// hash 字段到值的映射，对应redis的hash类型
+type hash struct {
+	cow
+	fields map[string]string
+}
+
+func newHash() *hash {
+	return &hash{fields: make(map[string]string)}
+}
+
+func (h *hash) Type() byte {
+	return TypeHash
+}
+
+func (h *hash) Len() int {
+	return len(h.fields)
+}
+
+func (h *hash) clone() object {
+	n := &hash{fields: make(map[string]string, len(h.fields))}
+	for f, v := range h.fields {
+		n.fields[f] = v
+	}
+	return n
+}
+
+// encode 编码格式: field数量(uvarint) | 每个field: field长度(uvarint) | field | value长度(uvarint) | value
+func (h *hash) encode() []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putString := func(s string) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s)))])
+		buf.WriteString(s)
+	}
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(h.fields)))])
+	for f, v := range h.fields {
+		putString(f)
+		putString(v)
+	}
+	return buf.Bytes()
+}
+
+func decodeHash(data []byte) (object, error) {
+	r := bytes.NewReader(data)
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if l > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	h := newHash()
+	for i := uint64(0); i < n; i++ {
+		f, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		v, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		h.fields[f] = v
+	}
+	return h, nil
+}
+
+func (h *hash) memSize() int {
+	size := 0
+	for f, v := range h.fields {
+		size += len(f) + len(v) + hashFieldOverhead
+	}
+	return size
+}
+
+// setDelta 返回把field设置为value后大小的变化量
+func (h *hash) setDelta(field, value string) int {
+	if old, ok := h.fields[field]; ok {
+		return len(value) - len(old)
+	}
+	return len(field) + len(value) + hashFieldOverhead
+}
+
+/*
+*
+下面几个写操作由FSM.Apply调用，now取自raft日志中的时间戳
+*/
+
+// HSet 设置hash中的若干个field，pairs依次为field和value，返回新增的field数量
+func (c *Cache) HSet(key string, pairs []string, now int64) (int, error) {
+	// 同一条命令中重复的field以最后一次为准
+	values := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	added := 0
+	err := c.update(key, TypeHash, now, true, func(o object) (int, func(), error) {
+		h := o.(*hash)
+		delta := 0
+		for f, v := range values {
+			delta += h.setDelta(f, v)
+		}
+		return delta, func() {
+			for f, v := range values {
+				if _, ok := h.fields[f]; !ok {
+					added++
+				}
+				h.fields[f] = v
+			}
+		}, nil
+	})
+	return added, err
+}
+
+// HDel 删除hash中的若干个field，返回实际删除的数量
+func (c *Cache) HDel(key string, fields []string, now int64) (int, error) {
+	removed := 0
+	err := c.update(key, TypeHash, now, false, func(o object) (int, func(), error) {
+		h := o.(*hash)
+		delta := 0
+		for _, f := range fields {
+			if v, ok := h.fields[f]; ok {
+				delta -= len(f) + len(v) + hashFieldOverhead
+			}
+		}
+		if delta == 0 {
+			return 0, nil, nil
+		}
+		return delta, func() {
+			for _, f := range fields {
+				if _, ok := h.fields[f]; ok {
+					delete(h.fields, f)
+					removed++
+				}
+			}
+		}, nil
+	})
+	return removed, err
+}
+
+// HIncrBy 将hash中field的值加上incr，field不存在时视为0，返回相加后的值
+func (c *Cache) HIncrBy(key string, field string, incr int64, now int64) (int64, error) {
+	var result int64
+	err := c.update(key, TypeHash, now, true, func(o object) (int, func(), error) {
+		h := o.(*hash)
+		var cur int64
+		if v, ok := h.fields[field]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, nil, ErrNotInteger
+			}
+			cur = n
+		}
+		if (incr > 0 && cur > math.MaxInt64-incr) || (incr < 0 && cur < math.MinInt64-incr) {
+			return 0, nil, ErrNotInteger
+		}
+		result = cur + incr
+		value := strconv.FormatInt(result, 10)
+		return h.setDelta(field, value), func() {
+			h.fields[field] = value
+		}, nil
+	})
+	return result, err
+}
+
+// HGet 读取hash中field的值
+func (c *Cache) HGet(key string, field string) (value []byte, ok bool, err error) {
+	err = c.view(key, TypeHash, func(o object) {
+		var v string
+		if v, ok = o.(*hash).fields[field]; ok {
+			value = []byte(v)
+		}
+	})
+	return
+}
+
+// HGetAll 读取hash中所有的field，key不存在时返回空map
+func (c *Cache) HGetAll(key string) (map[string]string, error) {
+	result := make(map[string]string)
+	err := c.view(key, TypeHash, func(o object) {
+		for f, v := range o.(*hash).fields {
+			result[f] = v
+		}
+	})
+	return result, err
+}
+
+// HLen 返回hash中field的数量
+func (c *Cache) HLen(key string) (n int, err error) {
+	err = c.view(key, TypeHash, func(o object) {
+		n = o.Len()
+	})
+	return
+}
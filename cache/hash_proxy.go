@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// DoHSet 设置hash中的若干个field，pairs依次为field和value，返回新增的field数量
+func (c *Cache_proxy) DoHSet(ctx context.Context, key string, pairs []string) (int, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" || len(pairs) == 0 || len(pairs)%2 != 0 {
+		return 0, fmt.Errorf("doHSet() error, get nil key or wrong number of fields")
+	}
+	event := NewLogEntry(OperHSet, key, "", 0, false)
+	event.Fields = pairs
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	return ret.(int), nil
+}
+
+// DoHDel 删除hash中的若干个field，返回实际删除的数量
+func (c *Cache_proxy) DoHDel(ctx context.Context, key string, fields []string) (int, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" || len(fields) == 0 {
+		return 0, fmt.Errorf("doHDel() error, get nil key or nil field")
+	}
+	event := NewLogEntry(OperHDel, key, "", 0, false)
+	event.Fields = fields
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	return ret.(int), nil
+}
+
+// DoHIncrBy 将hash中field的值加上incr，返回相加后的值，加法在每个副本的FSM.Apply中执行
+func (c *Cache_proxy) DoHIncrBy(ctx context.Context, key string, field string, incr int64) (int64, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" || field == "" {
+		return 0, fmt.Errorf("doHIncrBy() error, get nil key or nil field")
+	}
+	event := NewLogEntry(OperHIncrBy, key, strconv.FormatInt(incr, 10), 0, false)
+	event.Fields = []string{field}
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	return ret.(int64), nil
+}
+
+// DoHGet 读取本地hash中field的值
+func (c *Cache_proxy) DoHGet(key string, field string) ([]byte, bool, error) {
+	value, ok, err := c.Cache.HGet(key, field)
+	if ok {
+		c.touchIfSliding(key)
+	}
+	return value, ok, err
+}
+
+// DoHGetAll 读取本地hash中所有的field
+func (c *Cache_proxy) DoHGetAll(key string) (map[string]string, error) {
+	fields, err := c.Cache.HGetAll(key)
+	if len(fields) > 0 {
+		c.touchIfSliding(key)
+	}
+	return fields, err
+}
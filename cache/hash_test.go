@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"bytes"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"io"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	c := newTestCache()
+	if n, err := c.HSet("user", []string{"name", "tom", "age", "18", "name", "jerry"}, 0); err != nil || n != 2 {
+		t.Fatalf("got HSet %d, %v; want 2", n, err)
+	}
+	if v, ok, _ := c.HGet("user", "name"); !ok || string(v) != "jerry" {
+		t.Fatalf("got name=%s; want jerry", v)
+	}
+	if v, err := c.HIncrBy("user", "age", 2, 0); err != nil || v != 20 {
+		t.Fatalf("got age %d, %v; want 20", v, err)
+	}
+	if _, err := c.HIncrBy("user", "name", 1, 0); err != ErrNotInteger {
+		t.Fatalf("got err %v; want ErrNotInteger", err)
+	}
+	if n, _ := c.HDel("user", []string{"name", "missing"}, 0); n != 1 {
+		t.Fatalf("got HDel %d; want 1", n)
+	}
+	if fields, _ := c.HGetAll("user"); len(fields) != 1 || fields["age"] != "20" {
+		t.Fatalf("got fields %v; want age=20", fields)
+	}
+
+	// 删光所有field后key也被删除
+	c.HDel("user", []string{"age"}, 0)
+	if c.Len() != 0 {
+		t.Fatalf("got %d keys; want 0", c.Len())
+	}
+	if used, _ := c.MemoryUsage(); used != 0 {
+		t.Fatalf("got %d bytes used; want 0", used)
+	}
+}
+
+func TestHashWrongType(t *testing.T) {
+	c := newTestCache()
+	c.Add("str", []byte("v"))
+	if _, err := c.HSet("str", []string{"f", "v"}, 0); err != ErrWrongType {
+		t.Fatalf("got err %v; want ErrWrongType", err)
+	}
+	c.HSet("h", []string{"f", "v"}, 0)
+	if _, ok := c.Get("h"); ok {
+		t.Fatal("expected Get on a hash to miss")
+	}
+	if _, _, err := c.HGet("h", "f"); err != nil {
+		t.Fatalf("HGet failed: %v", err)
+	}
+}
+
+func TestHashMaxMemory(t *testing.T) {
+	c := newTestCache()
+	c.nsegments = 1
+	c.maxBytes = entryOverhead + int64(len("h")) + 2*int64(len("fv")+hashFieldOverhead)
+	c.maxmemoryPolicy = lru_k.NoEviction
+
+	c.HSet("h", []string{"f", "v"}, 0)
+	c.HSet("h", []string{"g", "v"}, 0)
+	if used, max := c.MemoryUsage(); used != max {
+		t.Fatalf("got used %d; want %d", used, max)
+	}
+	if _, err := c.HSet("h", []string{"x", "v"}, 0); err != lru_k.ErrOutOfMemory {
+		t.Fatalf("got err %v; want ErrOutOfMemory", err)
+	}
+	// 被拒绝的写入不修改hash
+	if n, _ := c.HLen("h"); n != 2 {
+		t.Fatalf("got %d fields; want 2", n)
+	}
+}
+
+func TestHashSnapshot(t *testing.T) {
+	c := newTestCache()
+	c.HSet("h", []string{"f", "v1"}, 0)
+	records := c.SnapshotRecords()
+
+	// 截取视图后的修改不影响视图
+	c.HSet("h", []string{"f", "v2", "g", "v"}, 0)
+
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, records, snapshotMeta{}); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	restored := newTestCache()
+	if err := restored.UnMarshal(io.NopCloser(&buf)); err != nil {
+		t.Fatalf("UnMarshal failed: %v", err)
+	}
+	if fields, _ := restored.HGetAll("h"); len(fields) != 1 || fields["f"] != "v1" {
+		t.Fatalf("got fields %v; want f=v1", fields)
+	}
+	if v, _, _ := c.HGet("h", "f"); string(v) != "v2" {
+		t.Fatalf("got f=%s; want v2", v)
+	}
+}
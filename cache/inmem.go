@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"errors"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"github.com/hashicorp/raft"
+	"io"
+	"log"
+	"time"
+)
+
+/*
+*
+NewInmemCacheProxy 创建单节点raft group中的Cache_proxy，返回时本节点已经是leader，可以写入：
+
+  - raft的日志、快照和transport都在内存中，缓存不连接数据源，进程退出后数据丢失
+  - 哈希环上只有httpAddress，心跳和选举的超时都很短
+
+供其他包的测试使用，不需要启动mysql和监听raft端口。使用完之后调用Raft.Raft.Shutdown()
+*/
+func NewInmemCacheProxy(httpAddress string) (*Cache_proxy, error) {
+	addr, transport := raft.NewInmemTransport("")
+	c := &Cache_proxy{
+		Opts:  &Options{HttpAddress: httpAddress, raftTCPAddress: string(addr)},
+		Log:   log.New(io.Discard, "", 0),
+		Cache: &Cache{dirtyKeys: make(chan string, chansize)},
+	}
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(addr)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+	fsm := &FSM{proxy: c, log: c.Log}
+	store := raft.NewInmemStore()
+	r, err := raft.NewRaft(config, fsm, store, store, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		return nil, err
+	}
+	c.Raft = &RaftNodeInfo{Raft: r, fsm: fsm}
+	if err := r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: addr}}}).Error(); err != nil {
+		r.Shutdown()
+		return nil, err
+	}
+
+	peers := consistenthash.New(3, consistenthash.Murmur3)
+	peers.Add(httpAddress)
+	c.SetPeers(peers)
+	c.cluster = NewCluster(httpAddress, ReadLocal)
+	c.commits = make(chan *pendingEntry, maxGroupCommit)
+	go c.groupCommit()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			r.Shutdown()
+			return nil, errors.New("no leader elected in the in-memory raft group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.SetWriteFlag(true)
+	return c, nil
+}
@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unsafe"
+)
+
+// listElemOverhead 每个元素除内容以外计入的字节数：slice中的字符串头
+const listElemOverhead = int(unsafe.Sizeof(""))
+
+// list 双端队列，对应redis的list类型，元素保存在buf[head:tail]中，两端都预留空间，
+// 两端的push和pop都是均摊O(1)，按下标访问是O(1)
+type list struct {
+	cow
+	buf  []string
+	head int
+	tail int
+}
+
+func newList() *list {
+	return &list{}
+}
+
+func (l *list) Type() byte {
+	return TypeList
+}
+
+func (l *list) Len() int {
+	return l.tail - l.head
+}
+
+func (l *list) memSize() int {
+	size := 0
+	for _, v := range l.buf[l.head:l.tail] {
+		size += len(v) + listElemOverhead
+	}
+	return size
+}
+
+func (l *list) clone() object {
+	n := &list{}
+	n.grow(l.Len(), 0)
+	for _, v := range l.buf[l.head:l.tail] {
+		n.pushBack(v)
+	}
+	return n
+}
+
+// encode 编码格式: 元素数量(uvarint) | 每个元素: 长度(uvarint) | 内容
+func (l *list) encode() []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(l.Len()))])
+	for _, v := range l.buf[l.head:l.tail] {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(v)))])
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+func decodeList(data []byte) (object, error) {
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	l := newList()
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		l.pushBack(string(b))
+	}
+	return l, nil
+}
+
+// grow 重新分配buf，保证头部至少有front个、尾部至少有back个空位
+func (l *list) grow(front, back int) {
+	n := l.Len()
+	// 空位按当前长度成倍预留，保证push是均摊O(1)的
+	if front < n/2+4 {
+		front = n/2 + 4
+	}
+	if back < n/2+4 {
+		back = n/2 + 4
+	}
+	buf := make([]string, front+n+back)
+	copy(buf[front:], l.buf[l.head:l.tail])
+	l.buf, l.head, l.tail = buf, front, front+n
+}
+
+func (l *list) pushFront(v string) {
+	if l.head == 0 {
+		l.grow(1, 0)
+	}
+	l.head--
+	l.buf[l.head] = v
+}
+
+func (l *list) pushBack(v string) {
+	if l.tail == len(l.buf) {
+		l.grow(0, 1)
+	}
+	l.buf[l.tail] = v
+	l.tail++
+}
+
+func (l *list) front() string {
+	return l.buf[l.head]
+}
+
+func (l *list) back() string {
+	return l.buf[l.tail-1]
+}
+
+func (l *list) popFront() string {
+	v := l.buf[l.head]
+	l.buf[l.head] = "" // 释放引用
+	l.head++
+	return v
+}
+
+func (l *list) popBack() string {
+	l.tail--
+	v := l.buf[l.tail]
+	l.buf[l.tail] = ""
+	return v
+}
+
+// slice 返回[from, to)之间的元素，和list共享底层数组，调用方不能修改
+func (l *list) slice(from, to int) []string {
+	return l.buf[l.head+from : l.head+to]
+}
+
+// rangeIndex 把redis风格的闭区间[start, stop]转换为[from, to)，负数下标表示从末尾倒数，
+// 超出范围的部分被截掉，区间为空时from等于to
+func rangeIndex(start, stop int64, n int) (from, to int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(n) {
+		stop = int64(n) - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+// PopResult 是pop命令的结果，Key是弹出元素所在的key
+type PopResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+/*
+*
+下面几个写操作由FSM.Apply调用，now取自raft日志中的时间戳
+*/
+
+// LPush 依次把values插入list头部，返回插入后list的长度
+func (c *Cache) LPush(key string, values []string, now int64) (int, error) {
+	return c.push(key, values, true, now)
+}
+
+// RPush 依次把values追加到list尾部，返回追加后list的长度
+func (c *Cache) RPush(key string, values []string, now int64) (int, error) {
+	return c.push(key, values, false, now)
+}
+
+func (c *Cache) push(key string, values []string, left bool, now int64) (int, error) {
+	n := 0
+	err := c.update(key, TypeList, now, true, func(o object) (int, func(), error) {
+		l := o.(*list)
+		delta := 0
+		for _, v := range values {
+			delta += len(v) + listElemOverhead
+		}
+		return delta, func() {
+			for _, v := range values {
+				if left {
+					l.pushFront(v)
+				} else {
+					l.pushBack(v)
+				}
+			}
+			n = l.Len()
+		}, nil
+	})
+	return n, err
+}
+
+// LPop 从第一个非空的list头部弹出一个元素，所有list都为空时返回nil
+func (c *Cache) LPop(keys []string, now int64) (*PopResult, error) {
+	return c.pop(keys, true, now)
+}
+
+// RPop 从第一个非空的list尾部弹出一个元素，所有list都为空时返回nil
+func (c *Cache) RPop(keys []string, now int64) (*PopResult, error) {
+	return c.pop(keys, false, now)
+}
+
+func (c *Cache) pop(keys []string, left bool, now int64) (*PopResult, error) {
+	for _, key := range keys {
+		var ret *PopResult
+		err := c.update(key, TypeList, now, false, func(o object) (int, func(), error) {
+			l := o.(*list)
+			if l.Len() == 0 {
+				return 0, nil, nil
+			}
+			v := l.back()
+			if left {
+				v = l.front()
+			}
+			return -(len(v) + listElemOverhead), func() {
+				if left {
+					l.popFront()
+				} else {
+					l.popBack()
+				}
+				ret = &PopResult{Key: key, Value: v}
+			}, nil
+		})
+		if err != nil || ret != nil {
+			return ret, err
+		}
+	}
+	return nil, nil
+}
+
+// LTrim 只保留list中[start, stop]之间的元素，下标规则和LRange一致
+func (c *Cache) LTrim(key string, start, stop int64, now int64) error {
+	return c.update(key, TypeList, now, false, func(o object) (int, func(), error) {
+		l := o.(*list)
+		from, to := rangeIndex(start, stop, l.Len())
+		if from == 0 && to == l.Len() {
+			return 0, nil, nil
+		}
+		delta := 0
+		for i, v := range l.slice(0, l.Len()) {
+			if i < from || i >= to {
+				delta -= len(v) + listElemOverhead
+			}
+		}
+		return delta, func() {
+			for l.Len() > to {
+				l.popBack()
+			}
+			for i := 0; i < from; i++ {
+				l.popFront()
+			}
+		}, nil
+	})
+}
+
+// LRange 返回list中[start, stop]之间的元素，负数下标表示从末尾倒数
+func (c *Cache) LRange(key string, start, stop int64) ([]string, error) {
+	var values []string
+	err := c.view(key, TypeList, func(o object) {
+		l := o.(*list)
+		from, to := rangeIndex(start, stop, l.Len())
+		values = append(values, l.slice(from, to)...)
+	})
+	return values, err
+}
+
+// LLen 返回list的长度，key不存在时返回0
+func (c *Cache) LLen(key string) (n int, err error) {
+	err = c.view(key, TypeList, func(o object) {
+		n = o.Len()
+	})
+	return
+}
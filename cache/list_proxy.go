@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DoPush 把values插入list的头部(left为true)或尾部，返回插入后list的长度
+func (c *Cache_proxy) DoPush(ctx context.Context, key string, values []string, left bool) (int, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" || len(values) == 0 {
+		return 0, fmt.Errorf("doPush() error, get nil key or nil value")
+	}
+	oper := OperRPush
+	if left {
+		oper = OperLPush
+	}
+	event := NewLogEntry(oper, key, "", 0, false)
+	event.Fields = values
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	return ret.(int), nil
+}
+
+// DoPop 从keys中第一个非空的list的头部(left为true)或尾部弹出一个元素，都为空时返回nil
+func (c *Cache_proxy) DoPop(ctx context.Context, keys []string, left bool) (*PopResult, error) {
+	if !c.checkWritePermission() {
+		return nil, ErrNotLeader
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("doPop() error, get nil key")
+	}
+	oper := OperRPop
+	if left {
+		oper = OperLPop
+	}
+	event := NewLogEntry(oper, keys[0], "", 0, false)
+	event.Fields = keys
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return ret.(*PopResult), nil
+}
+
+// DoBlockingPop 和DoPop一样弹出元素，所有list都为空时阻塞等待，直到有元素写入、
+// 超时(timeout为0表示一直等待)或者ctx被取消，超时返回nil
+func (c *Cache_proxy) DoBlockingPop(ctx context.Context, keys []string, left bool, timeout time.Duration) (*PopResult, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		// 先注册再尝试弹出，避免错过两者之间写入的元素
+		ch, cancel := c.waiters.watch(keys)
+		ret, err := c.DoPop(ctx, keys, left)
+		if err != nil || ret != nil {
+			cancel()
+			return ret, err
+		}
+
+		select {
+		case <-ch:
+			cancel()
+		case <-deadline:
+			cancel()
+			return nil, nil
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// DoLTrim 只保留list中[start, stop]之间的元素
+func (c *Cache_proxy) DoLTrim(ctx context.Context, key string, start, stop int64) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	if key == "" {
+		return fmt.Errorf("doLTrim() error, get nil key")
+	}
+	event := NewLogEntry(OperLTrim, key, "", 0, false)
+	event.Fields = []string{strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10)}
+	_, err := c.apply(ctx, event)
+	return err
+}
+
+// DoLRange 读取本地list中[start, stop]之间的元素
+func (c *Cache_proxy) DoLRange(key string, start, stop int64) ([]string, error) {
+	values, err := c.Cache.LRange(key, start, stop)
+	if len(values) > 0 {
+		c.touchIfSliding(key)
+	}
+	return values, err
+}
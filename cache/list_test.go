@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	c := newTestCache()
+	if n, _ := c.RPush("l", []string{"b", "c"}, 0); n != 2 {
+		t.Fatalf("got RPush %d; want 2", n)
+	}
+	if n, _ := c.LPush("l", []string{"a", "z"}, 0); n != 4 {
+		t.Fatalf("got LPush %d; want 4", n)
+	}
+	if values, _ := c.LRange("l", 0, -1); !reflect.DeepEqual(values, []string{"z", "a", "b", "c"}) {
+		t.Fatalf("got %v; want [z a b c]", values)
+	}
+	if values, _ := c.LRange("l", -2, 100); !reflect.DeepEqual(values, []string{"b", "c"}) {
+		t.Fatalf("got %v; want [b c]", values)
+	}
+
+	if ret, _ := c.LPop([]string{"missing", "l"}, 0); ret == nil || ret.Key != "l" || ret.Value != "z" {
+		t.Fatalf("got %+v; want l z", ret)
+	}
+	if ret, _ := c.RPop([]string{"l"}, 0); ret == nil || ret.Value != "c" {
+		t.Fatalf("got %+v; want c", ret)
+	}
+	c.LTrim("l", 1, 1, 0)
+	if values, _ := c.LRange("l", 0, -1); !reflect.DeepEqual(values, []string{"b"}) {
+		t.Fatalf("got %v; want [b]", values)
+	}
+
+	// 弹出最后一个元素后key被删除
+	c.LPop([]string{"l"}, 0)
+	if ret, _ := c.LPop([]string{"l"}, 0); ret != nil {
+		t.Fatalf("got %+v; want nil", ret)
+	}
+	if used, _ := c.MemoryUsage(); used != 0 {
+		t.Fatalf("got %d bytes used; want 0", used)
+	}
+}
+
+func TestListGrow(t *testing.T) {
+	l := newList()
+	for i := 0; i < 100; i++ {
+		l.pushFront("f")
+		l.pushBack("b")
+	}
+	if l.Len() != 200 || l.front() != "f" || l.back() != "b" {
+		t.Fatalf("got len %d", l.Len())
+	}
+	decoded, err := decodeList(l.encode())
+	if err != nil || decoded.Len() != 200 || decoded.memSize() != l.memSize() {
+		t.Fatalf("decode failed: %v", err)
+	}
+}
+
+func TestKeyWaiters(t *testing.T) {
+	var w keyWaiters
+	ch, cancel := w.watch([]string{"a", "b"})
+	w.notify("c")
+	select {
+	case <-ch:
+		t.Fatal("unexpected notify")
+	default:
+	}
+
+	w.notify("b")
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("expected notify")
+	}
+	cancel()
+	if len(w.waiters) != 0 {
+		t.Fatalf("got %d watched keys after cancel; want 0", len(w.waiters))
+	}
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+*
+raft日志采用带版本号的二进制格式：
+
+	header: magic(1 byte, 0xd7) | version(1 byte) | kind(1 byte)
+	single: entry
+	batch:  entry数量(uvarint) | entry...
+
+每个entry: oper(1 byte) | key长度(uvarint) | key | value长度(uvarint) | value |
+fields数量(uvarint) | (field长度(uvarint) | field)... | time(varint) | expireAt(varint) | slide(varint)
+
+key、value和field都按原始字节保存，不像json那样把非UTF-8的字节替换掉。
+第一个字节是'{'的日志是升级之前写入的json格式，仍然可以回放。
+
+每个节点通过成员表登记自己支持的版本(见members.go)，leader按所有节点都支持的最高版本写入日志，
+新的命令只在整个raft group都升级之后才会出现在日志中。节点仍然收到无法解码的日志时FSM停止运行，
+而不是跳过这条日志和其他副本产生分歧，升级之后重新回放
+*/
+
+const (
+	logEntryMagic      = 0xd7
+	logEntryVersion    = 3 // 本节点支持的最高版本
+	minLogEntryVersion = 1 // 没有登记版本的节点按这个版本处理
+
+	logEntrySingle = 0 // 一条命令
+	logEntryBatch  = 1 // leader把并发的多条命令合并成的一条日志，见groupCommit
+
+	logEntryHeaderSize = 3
+)
+
+// operVersions 记录在版本1之后新增的命令，leader只在整个raft group都支持时提交这些命令
+var operVersions = map[int8]byte{
+	OperSetMaxMemory: 2,
+	OperRestore:      3,
+}
+
+// operVersion 返回支持oper的最低日志版本
+func operVersion(oper int8) byte {
+	if v, ok := operVersions[oper]; ok {
+		return v
+	}
+	return minLogEntryVersion
+}
+
+var (
+	ErrUnsupportedLogEntry = errors.New("unsupported log entry") // 日志的版本或者命令不被本节点支持
+	errLogEntryCorrupted   = errors.New("log entry corrupted")
+)
+
+// encodeLogEntry 按version把一条命令编码为raft日志
+func encodeLogEntry(e LogEntryData, version byte) []byte {
+	buf := make([]byte, logEntryHeaderSize, logEntryHeaderSize+entrySize(e))
+	buf[0], buf[1], buf[2] = logEntryMagic, version, logEntrySingle
+	return appendEntry(buf, e)
+}
+
+// encodeLogBatch 按version把多条命令编码为一条raft日志，FSM按顺序应用并分别返回结果
+func encodeLogBatch(entries []LogEntryData, version byte) []byte {
+	size := logEntryHeaderSize + binary.MaxVarintLen64
+	for _, e := range entries {
+		size += entrySize(e)
+	}
+	buf := make([]byte, logEntryHeaderSize, size)
+	buf[0], buf[1], buf[2] = logEntryMagic, version, logEntryBatch
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = appendEntry(buf, e)
+	}
+	return buf
+}
+
+// decodeLogEntry 解码raft日志，batch为false时entries只有一条
+func decodeLogEntry(data []byte) (entries []LogEntryData, batch bool, err error) {
+	if len(data) > 0 && data[0] == '{' {
+		var e LogEntryData
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, false, err
+		}
+		return []LogEntryData{e}, false, nil
+	}
+	if len(data) < logEntryHeaderSize || data[0] != logEntryMagic {
+		return nil, false, fmt.Errorf("%w: bad magic", ErrUnsupportedLogEntry)
+	}
+	if data[1] > logEntryVersion {
+		return nil, false, fmt.Errorf("%w: version %d, this node supports up to %d", ErrUnsupportedLogEntry, data[1], logEntryVersion)
+	}
+	d := entryDecoder{data: data[logEntryHeaderSize:]}
+	switch data[2] {
+	case logEntrySingle:
+		entries = []LogEntryData{d.entry()}
+	case logEntryBatch:
+		n := d.uvarint()
+		if n > uint64(len(d.data)) {
+			return nil, false, errLogEntryCorrupted
+		}
+		entries = make([]LogEntryData, 0, n)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			entries = append(entries, d.entry())
+		}
+		batch = true
+	default:
+		return nil, false, fmt.Errorf("%w: kind %d", ErrUnsupportedLogEntry, data[2])
+	}
+	if d.err != nil {
+		return nil, false, d.err
+	}
+	return entries, batch, nil
+}
+
+func entrySize(e LogEntryData) int {
+	size := 1 + len(e.Key) + len(e.Value) + 6*binary.MaxVarintLen64
+	for _, f := range e.Fields {
+		size += binary.MaxVarintLen64 + len(f)
+	}
+	return size
+}
+
+func appendEntry(buf []byte, e LogEntryData) []byte {
+	buf = append(buf, byte(e.Oper))
+	buf = appendString(buf, e.Key)
+	buf = appendString(buf, e.Value)
+	buf = binary.AppendUvarint(buf, uint64(len(e.Fields)))
+	for _, f := range e.Fields {
+		buf = appendString(buf, f)
+	}
+	buf = binary.AppendVarint(buf, e.Time)
+	buf = binary.AppendVarint(buf, e.ExpireAt)
+	return binary.AppendVarint(buf, e.Slide)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// entryDecoder 依次读取entry的各个字段，第一次出错后后续的读取都返回零值
+type entryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *entryDecoder) entry() LogEntryData {
+	var e LogEntryData
+	e.Oper = int8(d.byte())
+	e.Key = d.string()
+	e.Value = d.string()
+	if n := d.uvarint(); n > 0 {
+		if n > uint64(len(d.data)) {
+			d.err = errLogEntryCorrupted
+			return e
+		}
+		e.Fields = make([]string, n)
+		for i := range e.Fields {
+			e.Fields[i] = d.string()
+		}
+	}
+	e.Time = d.varint()
+	e.ExpireAt = d.varint()
+	e.Slide = d.varint()
+	return e
+}
+
+func (d *entryDecoder) byte() byte {
+	if d.err != nil || len(d.data) == 0 {
+		d.err = errLogEntryCorrupted
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *entryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errLogEntryCorrupted
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *entryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errLogEntryCorrupted
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *entryDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.err = errLogEntryCorrupted
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"errors"
+	"github.com/hashicorp/raft"
+	"io"
+	"log"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestLogEntryRoundTrip(t *testing.T) {
+	e := NewLogEntry(OperSet, "k1", "\xff\xfe\x00v", 0, false)
+	e.Fields = []string{"a", "", "\x80"}
+	e.ExpireAt, e.Slide = -1, 42
+
+	entries, batch, err := decodeLogEntry(encodeLogEntry(e, logEntryVersion))
+	if err != nil || batch || len(entries) != 1 {
+		t.Fatalf("got %v, %v, %v; want one entry", entries, batch, err)
+	}
+	if !reflect.DeepEqual(entries[0], e) {
+		t.Fatalf("got %+v; want %+v", entries[0], e)
+	}
+
+	batchEntries := []LogEntryData{e, NewLogEntry(OperRemove, "k2", "", 0, false)}
+	entries, batch, err = decodeLogEntry(encodeLogBatch(batchEntries, logEntryVersion))
+	if err != nil || !batch || !reflect.DeepEqual(entries, batchEntries) {
+		t.Fatalf("got %+v, %v, %v; want %+v", entries, batch, err, batchEntries)
+	}
+}
+
+func TestDecodeLogEntry(t *testing.T) {
+	// 升级之前写入的json日志仍然可以回放
+	entries, _, err := decodeLogEntry([]byte(`{"Oper":1,"Key":"k1","Value":"v1"}`))
+	if err != nil || entries[0].Key != "k1" || entries[0].Value != "v1" {
+		t.Fatalf("got %+v, %v; want k1=v1", entries, err)
+	}
+
+	data := encodeLogEntry(NewLogEntry(OperSet, "k1", "v1", 0, false), logEntryVersion)
+	future := append([]byte(nil), data...)
+	future[1] = logEntryVersion + 1
+	if _, _, err := decodeLogEntry(future); !errors.Is(err, ErrUnsupportedLogEntry) {
+		t.Fatalf("got err %v; want ErrUnsupportedLogEntry", err)
+	}
+	for i := logEntryHeaderSize; i < len(data); i++ {
+		if _, _, err := decodeLogEntry(data[:i]); err == nil {
+			t.Fatalf("expected truncated entry of %d bytes to fail", i)
+		}
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	f := &FSM{proxy: &Cache_proxy{Cache: newTestCache()}, log: log.New(io.Discard, "", 0)}
+	logs := []*raft.Log{
+		{Index: 1, Type: raft.LogConfiguration},
+		{Index: 2, Type: raft.LogCommand, Data: encodeLogEntry(NewLogEntry(OperSet, "k0", "v0", 0, false), logEntryVersion)},
+		{Index: 3, Type: raft.LogCommand, Data: encodeLogBatch([]LogEntryData{
+			NewLogEntry(OperSet, "k1", "v1", 0, false),
+			NewLogEntry(OperRemove, "k2", "", 0, false),
+		}, logEntryVersion)},
+	}
+
+	rets := f.ApplyBatch(logs)
+	if len(rets) != 3 || rets[0] != nil || rets[1] != nil {
+		t.Fatalf("got %v; want 3 results", rets)
+	}
+	if batch, ok := rets[2].([]interface{}); !ok || len(batch) != 2 || batch[0] != nil || batch[1] != false {
+		t.Fatalf("got %v; want [nil false]", rets[2])
+	}
+	if v, ok := f.proxy.Cache.Get("k1"); !ok || string(v) != "v1" {
+		t.Fatalf("got k1=%s; want v1", v)
+	}
+	if f.appliedIndex() != 3 {
+		t.Fatalf("got applied %d; want 3", f.appliedIndex())
+	}
+}
+
+func TestApplyUnsupported(t *testing.T) {
+	future := encodeLogEntry(NewLogEntry(OperSet, "k1", "v1", 0, false), logEntryVersion+1)
+	cases := map[string][]byte{
+		"oper":    encodeLogEntry(NewLogEntry(127, "k1", "", 0, false), logEntryVersion),
+		"version": future,
+	}
+	for name, data := range cases {
+		f := &FSM{proxy: &Cache_proxy{Cache: newTestCache()}, log: log.New(io.Discard, "", 0)}
+		// 无法应用的日志返回错误，节点不会崩溃
+		ret := f.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: data})
+		if err, ok := ret.(error); !ok || !errors.Is(err, ErrUnsupportedLogEntry) {
+			t.Errorf("%s: got %v; want %v", name, ret, ErrUnsupportedLogEntry)
+		}
+		if _, ok := f.proxy.Cache.Get("k1"); ok {
+			t.Errorf("%s: expected the entry not to be applied", name)
+		}
+	}
+}
+
+func TestLogVersion(t *testing.T) {
+	var m members
+	if v := m.minVersion(nil); v != logEntryVersion {
+		t.Fatalf("got version %d for empty members; want %d", v, logEntryVersion)
+	}
+	m.set("n1", "127.0.0.1:8001", strconv.Itoa(logEntryVersion))
+	m.set("n2", "127.0.0.1:8002", strconv.Itoa(logEntryVersion+1))
+	if v := m.minVersion([]string{"n1", "n2"}); v != logEntryVersion {
+		t.Fatalf("got version %d; want %d", v, logEntryVersion)
+	}
+	// 没有登记版本的节点按最低版本处理
+	m.set("n3", "127.0.0.1:8003", "")
+	if v := m.minVersion([]string{"n1", "n2", "n3"}); v != minLogEntryVersion {
+		t.Fatalf("got version %d; want %d", v, minLogEntryVersion)
+	}
+	m.remove("n3")
+	if v, ok := m.version("n2"); !ok || v != logEntryVersion+1 {
+		t.Fatalf("got n2 version %d, %v; want %d", v, ok, logEntryVersion+1)
+	}
+	// raft配置中有但是成员表中没有的节点同样按最低版本处理
+	if v := m.minVersion([]string{"n1", "n4"}); v != minLogEntryVersion {
+		t.Fatalf("got version %d with an unregistered server; want %d", v, minLogEntryVersion)
+	}
+}
+
+func TestLogVersionRaftConfiguration(t *testing.T) {
+	nodes := newTestRaftGroup(t, 2)
+	leader := waitLeader(t, nodes)
+	if v := leader.logVersion(); v != logEntryVersion {
+		t.Fatalf("got version %d for a single node group; want %d", v, logEntryVersion)
+	}
+	// 只加入raft配置、没有登记http地址和版本的节点也限制日志版本
+	id := nodes[1].Opts.raftTCPAddress
+	if err := leader.Raft.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(id), 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if v := leader.logVersion(); v != minLogEntryVersion {
+		t.Fatalf("got version %d with an unregistered voter; want %d", v, minLogEntryVersion)
+	}
+	if err := leader.DoSetMember(id, nodes[1].Opts.HttpAddress, logEntryVersion); err != nil {
+		t.Fatal(err)
+	}
+	if v := leader.logVersion(); v != logEntryVersion {
+		t.Fatalf("got version %d after the voter registered; want %d", v, logEntryVersion)
+	}
+}
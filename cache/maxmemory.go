@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"github.com/hashicorp/raft"
+	"strconv"
+	"sync"
+)
+
+/*
+*
+raft group中的maxmemory：
+各副本上读请求记录的访问顺序不同，部分maxmemory策略还是随机采样，如果每个副本在FSM中各自淘汰，
+同一条日志在不同副本上会删除不同的key。因此FSM写入时从不淘汰，由leader在提交写命令之前
+通过Cache.Victims选出需要淘汰的key，作为一条OperMDel日志排在写命令前面，所有副本按日志的顺序删除相同的key。
+
+noeviction拒绝写入只取决于已使用的字节数，仍然在FSM中判断，前提是所有副本的容量和策略相同。
+容量和策略通过OperSetMaxMemory写入raft日志，第一个leader按自己的启动参数写入，
+之后加入的节点和新的leader都沿用日志中的设置，-maxmemory auto也只在第一个leader上计算一次
+*/
+
+// 快照中保存maxmemory设置的配置名
+const (
+	configMaxMemory       = "maxmemory"
+	configMaxmemoryPolicy = "maxmemory-policy"
+)
+
+// evictValue 标记leader淘汰key的OperMDel，各副本通过Cache.Evict删除，淘汰策略同时记录幽灵列表等淘汰历史。
+// 不认识这个标记的旧版本节点按普通的MDel删除相同的key，数据仍然一致
+const evictValue = "evict"
+
+// evictions 串行化leader上淘汰key的选择。groupCommit同时有多批日志在等待提交，
+// 选出淘汰的key时要算上已经交给raft、还没有应用的写命令，否则并发的几批会按同一个状态重复淘汰、超出maxmemory
+type evictions struct {
+	mutex        sync.Mutex // 串行选出淘汰的key和提交
+	pendingMutex sync.Mutex
+	pending      map[string]int64 // 已经交给raft、还没有应用的写命令对每个key增加的字节数
+}
+
+// add 把交给raft的写命令增加的字节数计入pending，日志应用之后移除，这时增加的字节数已经计入缓存
+func (ev *evictions) add(growth map[string]int64, future raft.ApplyFuture) {
+	ev.pendingMutex.Lock()
+	if ev.pending == nil {
+		ev.pending = make(map[string]int64)
+	}
+	for key, n := range growth {
+		ev.pending[key] += n
+	}
+	ev.pendingMutex.Unlock()
+	go func() {
+		future.Error()
+		ev.pendingMutex.Lock()
+		defer ev.pendingMutex.Unlock()
+		for key, n := range growth {
+			if ev.pending[key] -= n; ev.pending[key] == 0 {
+				delete(ev.pending, key)
+			}
+		}
+	}()
+}
+
+// expected 返回growth加上还没有应用的写命令增加的字节数
+func (ev *evictions) expected(growth map[string]int64) map[string]int64 {
+	ev.pendingMutex.Lock()
+	defer ev.pendingMutex.Unlock()
+	expected := make(map[string]int64, len(growth)+len(ev.pending))
+	for key, n := range ev.pending {
+		expected[key] += n
+	}
+	for key, n := range growth {
+		expected[key] += n
+	}
+	return expected
+}
+
+// submitWithEviction 按maxmemory策略淘汰足够的key之后把data交给raft，调用方需要持有migrationSessions.gate的读锁
+func (c *Cache_proxy) submitWithEviction(data []byte, entries []LogEntryData) (raft.ApplyFuture, error) {
+	ev := &c.evictions
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+	growth, err := c.evict(entries)
+	if err != nil {
+		return nil, err
+	}
+	future := c.Raft.Raft.Apply(data, applyTimeout)
+	if len(growth) > 0 {
+		ev.add(growth, future)
+	}
+	return future, nil
+}
+
+// evict 在提交entries之前按maxmemory策略淘汰key，返回entries对每个key增加的字节数。
+// 淘汰的key作为一条OperMDel日志提交，应用之后才返回，调用方需要持有evictions.mutex
+func (c *Cache_proxy) evict(entries []LogEntryData) (map[string]int64, error) {
+	if maxBytes, policy := c.Cache.maxmemory(); maxBytes == 0 || policy == lru_k.NoEviction {
+		return nil, nil
+	}
+	growth := make(map[string]int64)
+	for _, e := range entries {
+		e.growth(c.Cache, growth)
+	}
+	if len(growth) == 0 {
+		return nil, nil
+	}
+	keys, err := c.Cache.Victims(c.evictions.expected(growth))
+	if err != nil || len(keys) == 0 {
+		return growth, err
+	}
+	e := NewLogEntry(OperMDel, "", evictValue, 0, false)
+	e.Fields = keys
+	future := c.Raft.Raft.Apply(encodeLogEntry(e, c.logVersion()), applyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("evict %d keys: %w", len(keys), err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, fmt.Errorf("evict %d keys: %w", len(keys), err)
+	}
+	return growth, nil
+}
+
+// growth 估计命令执行后每个key增加的字节数并累加到growth中，只删除或者修改过期时间的命令不处理
+func (e LogEntryData) growth(cache *Cache, growth map[string]int64) {
+	switch e.Oper {
+	case OperAdd, OperSet, OperIncrBy, OperIncrByFloat:
+		// 自增命令的结果和增量的长度相近
+		growth[e.Key] += cache.Growth(e.Key, len(e.Value), true)
+	case OperMSet:
+		for i := 0; i+1 < len(e.Fields); i += 2 {
+			growth[e.Fields[i]] += cache.Growth(e.Fields[i], len(e.Fields[i+1]), true)
+		}
+	case OperRestore:
+		for i := 0; i+2 < len(e.Fields); i += restoreFields {
+			growth[e.Fields[i]] += cache.Growth(e.Fields[i], len(e.Fields[i+2]), true)
+		}
+	case OperHSet, OperHIncrBy, OperLPush, OperRPush, OperSAdd, OperZAdd:
+		// 不区分新增和覆盖的元素，按全部新增估计
+		size := len(e.Value)
+		for _, f := range e.Fields {
+			size += len(f)
+		}
+		growth[e.Key] += cache.Growth(e.Key, size, false)
+	}
+}
+
+// PublishMaxMemory 成为leader后，raft group还没有统一的maxmemory设置时，把本节点的启动参数写入raft日志
+func (c *Cache_proxy) PublishMaxMemory() {
+	// 先应用完之前的日志，才能知道是否已经有其他leader写入过
+	if err := c.Raft.Raft.Barrier(applyTimeout).Error(); err != nil {
+		c.Log.Printf("publish maxmemory failed:%v", err)
+		return
+	}
+	maxBytes, policy, ok := c.Cache.replicatedMaxMemory()
+	if ok {
+		return
+	}
+	if policy == "" {
+		policy = lru_k.DefaultMaxmemoryPolicy
+	}
+	e := NewLogEntry(OperSetMaxMemory, "", strconv.FormatInt(maxBytes, 10), 0, false)
+	e.Fields = []string{policy}
+	if _, err := c.apply(context.Background(), e); err != nil {
+		c.Log.Printf("publish maxmemory failed:%v", err)
+	}
+}
+
+// snapshotConfig 返回写入快照的maxmemory设置，还没有通过raft日志设置过时返回nil
+func (c *Cache) snapshotConfig() map[string]string {
+	maxBytes, policy, ok := c.replicatedMaxMemory()
+	if !ok {
+		return nil
+	}
+	return map[string]string{configMaxMemory: strconv.FormatInt(maxBytes, 10), configMaxmemoryPolicy: policy}
+}
+
+// loadConfig 恢复快照中的maxmemory设置，旧版本的快照中没有时保留当前的设置
+func (c *Cache) loadConfig(config map[string]string) error {
+	v, ok := config[configMaxMemory]
+	if !ok {
+		return nil
+	}
+	maxBytes, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: maxmemory %q", errSnapshotCorrupted, v)
+	}
+	if err := c.SetMaxMemory(maxBytes, config[configMaxmemoryPolicy]); err != nil {
+		return fmt.Errorf("%w: %v", errSnapshotCorrupted, err)
+	}
+	return nil
+}
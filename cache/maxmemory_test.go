@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderEviction(t *testing.T) {
+	nodes := newTestRaftGroup(t, 2)
+	leader := waitLeader(t, nodes)
+	follower := nodes[1]
+	id := follower.Opts.raftTCPAddress
+	if err := leader.DoAddServer(id, id, follower.Opts.HttpAddress, logEntryVersion, true); err != nil {
+		t.Fatalf("add voter: %v", err)
+	}
+
+	// 两个副本的启动参数不同，以raft日志中的设置为准
+	follower.Cache.SetMaxMemory(1<<30, lru_k.NoEviction)
+	const maxBytes = 4096
+	e := NewLogEntry(OperSetMaxMemory, "", strconv.Itoa(maxBytes), 0, false)
+	e.Fields = []string{lru_k.AllKeysPolicy}
+	if _, err := leader.apply(context.Background(), e); err != nil {
+		t.Fatalf("set maxmemory: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if _, err := leader.apply(context.Background(), NewLogEntry(OperSet, key, "value", 0, false)); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+		// follower上的读请求改变本地的访问顺序，不影响淘汰的结果
+		follower.Cache.Get(fmt.Sprintf("k%03d", i/2))
+	}
+	if used, max := leader.Cache.MemoryUsage(); max != maxBytes || used > maxBytes {
+		t.Fatalf("got used %d max %d; want at most %d", used, max, maxBytes)
+	}
+
+	want := leader.Cache.GetAll()
+	if len(want) == 200 {
+		t.Fatal("expected the leader to evict keys")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := follower.Cache.GetAll()
+		if fmt.Sprint(got) == fmt.Sprint(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got follower keys %d; want the same %d keys as the leader", len(got), len(want))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, max := follower.Cache.MemoryUsage(); max != maxBytes {
+		t.Fatalf("got follower max %d; want %d", max, maxBytes)
+	}
+}
+
+func TestConcurrentEviction(t *testing.T) {
+	nodes := newTestRaftGroup(t, 1)
+	// 只有一个分段，容量不再按分段划分
+	nodes[0].Cache = &Cache{dirtyKeys: make(chan string, chansize), nsegments: 1}
+	leader := waitLeader(t, nodes)
+	leader.commits = make(chan *pendingEntry, maxGroupCommit)
+	go leader.groupCommit()
+	const maxBytes = 64 << 10
+	e := NewLogEntry(OperSetMaxMemory, "", strconv.Itoa(maxBytes), 0, false)
+	e.Fields = []string{lru_k.AllKeysPolicy}
+	if _, err := leader.apply(context.Background(), e); err != nil {
+		t.Fatalf("set maxmemory: %v", err)
+	}
+
+	// 同时有多批日志在等待提交，每批都要算上其他批还没有应用的写入，任何时候都不超过maxmemory
+	var peak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if used, _ := leader.Cache.MemoryUsage(); used > peak {
+				peak = used
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 40; i++ {
+				if err := leader.DoSet(context.Background(), OperSet, fmt.Sprintf("k%02d-%02d", g, i), "value"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	<-sampled
+	close(errs)
+	for err := range errs {
+		t.Fatalf("set: %v", err)
+	}
+	if leader.Cache.Len() == 32*40 {
+		t.Fatal("expected the leader to evict keys")
+	}
+	if peak > maxBytes {
+		t.Fatalf("got peak used %d; want at most %d", peak, maxBytes)
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"github.com/hashicorp/raft"
+	"strconv"
+	"sync"
+)
+
+// members 记录raft group中每个节点的http地址和支持的日志版本，键是raft的ServerID(即raft地址)。
+// 成员表通过SET_MEMBER日志同步到每个副本并保存在快照中，
+// 任何节点都能根据raft.LeaderWithID()找到leader的http地址
+type members struct {
+	mutex    sync.RWMutex
+	addrs    map[string]string
+	versions map[string]string // 节点支持的日志版本，没有登记的节点按minLogEntryVersion处理
+}
+
+func (m *members) set(id string, httpAddress string, version string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.addrs == nil {
+		m.addrs = make(map[string]string)
+	}
+	m.addrs[id] = httpAddress
+	if version != "" {
+		if m.versions == nil {
+			m.versions = make(map[string]string)
+		}
+		m.versions[id] = version
+	}
+}
+
+func (m *members) remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.addrs, id)
+	delete(m.versions, id)
+}
+
+// version 返回节点登记的日志版本
+func (m *members) version(id string) (byte, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	v, err := strconv.Atoi(m.versions[id])
+	if err != nil || v < minLogEntryVersion || v > 255 {
+		return 0, false
+	}
+	return byte(v), true
+}
+
+// minVersion 返回ids中所有节点都支持的最高日志版本，不超过本节点支持的版本。
+// ids取自raft配置，没有登记过版本的节点(包括不在成员表中的节点)按minLogEntryVersion处理
+func (m *members) minVersion(ids []string) byte {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	min := byte(logEntryVersion)
+	for _, id := range ids {
+		v, err := strconv.Atoi(m.versions[id])
+		if err != nil || v < minLogEntryVersion {
+			v = minLogEntryVersion
+		}
+		if v < int(min) {
+			min = byte(v)
+		}
+	}
+	return min
+}
+
+func (m *members) get(id string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	addr, ok := m.addrs[id]
+	return addr, ok
+}
+
+// copy 返回成员表的副本
+func (m *members) copy() map[string]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ret := make(map[string]string, len(m.addrs))
+	for id, addr := range m.addrs {
+		ret[id] = addr
+	}
+	return ret
+}
+
+// copyVersions 返回日志版本表的副本
+func (m *members) copyVersions() map[string]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ret := make(map[string]string, len(m.versions))
+	for id, v := range m.versions {
+		ret[id] = v
+	}
+	return ret
+}
+
+// load 用快照中的成员表和日志版本表替换当前的成员表
+func (m *members) load(addrs map[string]string, versions map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.addrs = addrs
+	m.versions = versions
+}
+
+// IsLeader 判断本节点是否是raft group的leader
+func (c *Cache_proxy) IsLeader() bool {
+	return c.Raft.Raft.State() == raft.Leader
+}
+
+// Leader 返回当前leader的http地址，还没有选出leader或者leader的地址还没有同步过来时ok为false
+func (c *Cache_proxy) Leader() (string, bool) {
+	_, id := c.Raft.Raft.LeaderWithID()
+	if id == "" {
+		return "", false
+	}
+	if id == raft.ServerID(c.Opts.raftTCPAddress) {
+		return c.Opts.HttpAddress, true
+	}
+	return c.members.get(string(id))
+}
+
+// Members 返回raft group中每个节点的raft地址和http地址
+func (c *Cache_proxy) Members() map[string]string {
+	return c.members.copy()
+}
+
+// DoSetMember 由leader提交一条日志，记录raft地址为id的节点的http地址和支持的日志版本，
+// version为0表示节点没有报告版本
+func (c *Cache_proxy) DoSetMember(id string, httpAddress string, version int) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	e := NewLogEntry(OperSetMember, id, httpAddress, 0, false)
+	if version > 0 {
+		e.Fields = []string{strconv.Itoa(version)}
+	}
+	_, err := c.apply(context.Background(), e)
+	return err
+}
+
+// RegisterSelf 成为leader后把自己的http地址和日志版本写入成员表，
+// bootstrap的节点没有经过/join，只能由自己登记；升级后的leader也在这里更新自己的版本
+func (c *Cache_proxy) RegisterSelf() {
+	addr, ok := c.members.get(c.Opts.raftTCPAddress)
+	if version, _ := c.members.version(c.Opts.raftTCPAddress); ok && addr == c.Opts.HttpAddress && version == logEntryVersion {
+		return
+	}
+	if err := c.DoSetMember(c.Opts.raftTCPAddress, c.Opts.HttpAddress, logEntryVersion); err != nil {
+		c.Log.Printf("register self to members failed:%v", err)
+	}
+}
+
+// logVersion 返回leader写入日志使用的版本：raft配置中所有节点都支持的最高版本。
+// 滚动升级期间还有旧节点时继续使用旧版本，旧节点不会收到无法解码的日志；
+// 加入raft group但还没有登记http地址和版本的节点同样按最低版本处理
+func (c *Cache_proxy) logVersion() byte {
+	future := c.Raft.Raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return minLogEntryVersion
+	}
+	ids := make([]string, 0, len(future.Configuration().Servers))
+	for _, server := range future.Configuration().Servers {
+		// 本节点一定支持logEntryVersion，不需要等自己登记
+		if string(server.ID) != c.Opts.raftTCPAddress {
+			ids = append(ids, string(server.ID))
+		}
+	}
+	return c.members.minVersion(ids)
+}
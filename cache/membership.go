@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"strings"
+	"time"
+)
+
+var ErrServerNotFound = errors.New("server not found") // raft配置中没有这个节点
+
+// membershipTimeout 成员变更等待提交的最长时间
+const membershipTimeout = 10 * time.Second
+
+// Server 是raft配置中的一个节点
+type Server struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`                // raft地址
+	HttpAddress string `json:"http_address,omitempty"` // 成员表中的http地址
+	Suffrage    string `json:"suffrage"`               // voter、nonvoter或者staging
+	Leader      bool   `json:"leader"`
+}
+
+// Configuration 返回raft group当前的配置，任何节点都可以调用
+func (c *Cache_proxy) Configuration() ([]Server, error) {
+	future := c.Raft.Raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leader := c.Raft.Raft.LeaderWithID()
+	var servers []Server
+	for _, s := range future.Configuration().Servers {
+		httpAddress, _ := c.members.get(string(s.ID))
+		servers = append(servers, Server{
+			ID:          string(s.ID),
+			Address:     string(s.Address),
+			HttpAddress: httpAddress,
+			Suffrage:    strings.ToLower(s.Suffrage.String()),
+			Leader:      s.ID == leader,
+		})
+	}
+	return servers, nil
+}
+
+// Stats 返回raft的运行状态，例如state、term、commit_index和last_contact
+func (c *Cache_proxy) Stats() map[string]string {
+	return c.Raft.Raft.Stats()
+}
+
+// DoAddServer 把节点加入raft group，voter为false时作为不参与投票的learner加入，
+// httpAddress不为空时同时把http地址和节点支持的日志版本version写入成员表。节点已经在配置中时只更新它的角色和地址
+func (c *Cache_proxy) DoAddServer(id string, address string, httpAddress string, version int, voter bool) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	var future raft.IndexFuture
+	if voter {
+		future = c.Raft.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, membershipTimeout)
+	} else {
+		future = c.Raft.Raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(address), 0, membershipTimeout)
+	}
+	if err := future.Error(); err != nil {
+		return membershipError(err)
+	}
+	if httpAddress != "" {
+		return c.DoSetMember(id, httpAddress, version)
+	}
+	return nil
+}
+
+// DoRemoveServer 把节点移出raft group并删除它在成员表中的http地址，
+// 用于替换故障的机器，移除leader自己时leader会在提交后下台
+func (c *Cache_proxy) DoRemoveServer(id string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	if _, err := c.server(id); err != nil {
+		return err
+	}
+	if err := c.Raft.Raft.RemoveServer(raft.ServerID(id), 0, membershipTimeout).Error(); err != nil {
+		return membershipError(err)
+	}
+	if id == c.Opts.raftTCPAddress {
+		// 已经不是leader，不能再提交日志，成员表中残留的地址不在raft配置中，不会再被使用
+		return nil
+	}
+	_, err := c.apply(context.Background(), NewLogEntry(OperRemoveMember, id, "", 0, false))
+	return err
+}
+
+// DoDemoteVoter 把voter降级为不参与投票的learner，learner继续复制日志
+func (c *Cache_proxy) DoDemoteVoter(id string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	if _, err := c.server(id); err != nil {
+		return err
+	}
+	if err := c.Raft.Raft.DemoteVoter(raft.ServerID(id), 0, membershipTimeout).Error(); err != nil {
+		return membershipError(err)
+	}
+	return nil
+}
+
+// DoTransferLeadership 把leader转移给id对应的voter，id为空时由raft选择日志最新的voter
+func (c *Cache_proxy) DoTransferLeadership(id string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	var future raft.Future
+	if id == "" {
+		future = c.Raft.Raft.LeadershipTransfer()
+	} else {
+		s, err := c.server(id)
+		if err != nil {
+			return err
+		}
+		future = c.Raft.Raft.LeadershipTransferToServer(s.ID, s.Address)
+	}
+	if err := future.Error(); err != nil {
+		return membershipError(err)
+	}
+	return nil
+}
+
+// server 在raft配置中查找id对应的节点
+func (c *Cache_proxy) server(id string) (raft.Server, error) {
+	future := c.Raft.Raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return raft.Server{}, err
+	}
+	for _, s := range future.Configuration().Servers {
+		if string(s.ID) == id {
+			return s, nil
+		}
+	}
+	return raft.Server{}, fmt.Errorf("%w: %s", ErrServerNotFound, id)
+}
+
+// membershipError 把raft返回的不是leader的错误转换为ErrNotLeader
+func membershipError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return fmt.Errorf("%w: %v", ErrNotLeader, err)
+	}
+	return err
+}
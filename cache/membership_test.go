@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// newTestRaftGroup 用内存中的transport和存储启动n个节点，第一个节点bootstrap，
+// 其余节点还没有加入raft group
+func newTestRaftGroup(t *testing.T, n int) []*Cache_proxy {
+	var (
+		nodes      []*Cache_proxy
+		transports []*raft.InmemTransport
+	)
+	for i := 0; i < n; i++ {
+		addr, transport := raft.NewInmemTransport("")
+		for _, other := range transports {
+			other.Connect(addr, transport)
+			transport.Connect(other.LocalAddr(), other)
+		}
+		transports = append(transports, transport)
+
+		c := &Cache_proxy{
+			Opts:  &Options{raftTCPAddress: string(addr), HttpAddress: fmt.Sprintf("127.0.0.1:%d", 8000+i)},
+			Log:   log.New(io.Discard, "", 0),
+			Cache: newTestCache(),
+		}
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID(addr)
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.Logger = nil
+		config.LogOutput = io.Discard
+		fsm := &FSM{proxy: c, log: c.Log}
+		store := raft.NewInmemStore()
+		r, err := raft.NewRaft(config, fsm, store, store, raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Raft = &RaftNodeInfo{Raft: r, fsm: fsm}
+		if i == 0 {
+			r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: addr}}})
+		}
+		nodes = append(nodes, c)
+	}
+	t.Cleanup(func() {
+		for _, c := range nodes {
+			c.Raft.Raft.Shutdown().Error()
+		}
+	})
+	return nodes
+}
+
+// waitLeader 等待选出leader，只有leader可以写入，和main中处理LeaderNotifyCh一致
+func waitLeader(t *testing.T, nodes []*Cache_proxy) *Cache_proxy {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, c := range nodes {
+			if c.Raft.Raft.State() == raft.Leader {
+				for _, other := range nodes {
+					other.SetWriteFlag(other == c)
+				}
+				return c
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func suffrage(t *testing.T, c *Cache_proxy, id string) string {
+	servers, err := c.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.ID == id {
+			return s.Suffrage
+		}
+	}
+	return ""
+}
+
+func TestMembership(t *testing.T) {
+	nodes := newTestRaftGroup(t, 3)
+	leader := waitLeader(t, nodes)
+	n1, n2 := nodes[1].Opts.raftTCPAddress, nodes[2].Opts.raftTCPAddress
+
+	if err := leader.DoAddServer(n1, n1, nodes[1].Opts.HttpAddress, logEntryVersion, true); err != nil {
+		t.Fatalf("add voter: %v", err)
+	}
+	if err := leader.DoAddServer(n2, n2, nodes[2].Opts.HttpAddress, 0, false); err != nil {
+		t.Fatalf("add nonvoter: %v", err)
+	}
+	if got := suffrage(t, leader, n1); got != "voter" {
+		t.Fatalf("got %s suffrage %q; want voter", n1, got)
+	}
+	if got := suffrage(t, leader, n2); got != "nonvoter" {
+		t.Fatalf("got %s suffrage %q; want nonvoter", n2, got)
+	}
+	if addr, ok := leader.members.get(n1); !ok || addr != nodes[1].Opts.HttpAddress {
+		t.Fatalf("got %s http address %q; want %q", n1, addr, nodes[1].Opts.HttpAddress)
+	}
+
+	// 只有leader可以修改成员
+	if err := nodes[1].DoDemoteVoter(n1); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("demote on follower: got %v; want ErrNotLeader", err)
+	}
+	if err := leader.DoDemoteVoter(n1); err != nil {
+		t.Fatalf("demote: %v", err)
+	}
+	if got := suffrage(t, leader, n1); got != "nonvoter" {
+		t.Fatalf("got %s suffrage %q after demote; want nonvoter", n1, got)
+	}
+
+	for _, change := range []func(string) error{leader.DoRemoveServer, leader.DoDemoteVoter, leader.DoTransferLeadership} {
+		if err := change("unknown"); !errors.Is(err, ErrServerNotFound) {
+			t.Fatalf("got %v; want ErrServerNotFound", err)
+		}
+	}
+
+	if err := leader.DoRemoveServer(n2); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if got := suffrage(t, leader, n2); got != "" {
+		t.Fatalf("got %s suffrage %q after remove; want removed", n2, got)
+	}
+	if _, ok := leader.members.get(n2); ok {
+		t.Fatalf("expected %s to be removed from members", n2)
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	nodes := newTestRaftGroup(t, 2)
+	leader := waitLeader(t, nodes)
+	other := nodes[1].Opts.raftTCPAddress
+	if err := leader.DoAddServer(other, other, nodes[1].Opts.HttpAddress, logEntryVersion, true); err != nil {
+		t.Fatalf("add voter: %v", err)
+	}
+	if err := leader.DoTransferLeadership(other); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if got := waitLeader(t, nodes); got != nodes[1] {
+		t.Fatalf("got leader %s; want %s", got.Opts.raftTCPAddress, other)
+	}
+}
@@ -0,0 +1,390 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"github.com/hashicorp/raft"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// migrationSessionTTL 没有冻结的迁移会话超过这个时间没有被接收方访问时丢弃，避免接收方放弃迁移后一直记录写入的key
+const migrationSessionTTL = 10 * time.Minute
+
+var (
+	ErrMigrating         = errors.New("key is being migrated, retry later") // key所在的区间正在切换到新的分片
+	ErrMigrationNotFound = errors.New("migration session not found")        // 来源分片重启或者切换了leader，会话已经丢失
+)
+
+/*
+*
+migrationSessions 是迁出数据的分片(来源分片)的leader上的迁移会话。接收方开始拷贝之前先建立会话：
+
+ 1. 会话建立之后FSM应用的日志中，key落在会话区间内的都记录为脏key，接收方拷贝完成后取走脏key重新拷贝，
+    拷贝期间来源分片照常处理写请求，写入不会丢失
+ 2. 切换之前接收方冻结会话，冻结期间区间内的key的写命令返回ErrMigrating，冻结之前已经交给raft的日志
+    在Barrier之后都已经应用，最后一次取走的脏key包含了全部写入
+ 3. 冻结一直持续到结束会话：接收方切换、来源分片的哈希环不再负责这些区间之后，来源分片先删除区间中的key，
+    再结束会话。冻结期间区间内的写入都没有执行，删除时不会丢失接收方没有拷贝的写入
+
+会话只保存在leader的内存中，leader切换或者重启后接收方收到ErrMigrationNotFound，需要重新拷贝。
+冻结的会话不会过期，接收方放弃迁移时，转移来源分片的leader即可丢弃会话、恢复写入
+*/
+type migrationSessions struct {
+	// gate 冻结区间和提交日志互斥：提交日志时持有读锁检查冻结的区间并交给raft，冻结时持有写锁
+	gate     sync.RWMutex
+	mutex    sync.Mutex
+	count    int32 // 会话数量，没有会话时FSM不需要计算key的hash
+	sessions map[string]*migrationSession
+}
+
+type migrationSession struct {
+	ranges   []consistenthash.RangeNode
+	dirty    map[string]struct{}
+	frozen   bool
+	accessed time.Time
+	// index 是第一次读取区间时会话区间中的key，按hash值排序，之后的分页读取都在上面二分查找。
+	// 之后新写入的key都记录在脏key中
+	index []hashedKey
+}
+
+func (s *migrationSession) contains(key string) bool {
+	return inRanges(int(consistenthash.Murmur3([]byte(key))), s.ranges)
+}
+
+// BeginMigration 由来源分片的leader为迁出ranges建立会话，返回会话ID
+func (c *Cache_proxy) BeginMigration(ranges []consistenthash.RangeNode) (string, error) {
+	if !c.checkWritePermission() {
+		return "", ErrNotLeader
+	}
+	s := &c.migrationSessions
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*migrationSession)
+	}
+	for id, session := range s.sessions {
+		if !session.frozen && now.Sub(session.accessed) > migrationSessionTTL {
+			c.Log.Printf("migration session %s expired", id)
+			delete(s.sessions, id)
+		}
+	}
+	id := strconv.FormatInt(now.UnixNano(), 36)
+	s.sessions[id] = &migrationSession{ranges: ranges, dirty: make(map[string]struct{}), accessed: now}
+	atomic.StoreInt32(&s.count, int32(len(s.sessions)))
+	return id, nil
+}
+
+// session 返回会话并更新访问时间，调用方需要持有mutex
+func (s *migrationSessions) session(id string) (*migrationSession, error) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrMigrationNotFound
+	}
+	session.accessed = time.Now()
+	return session, nil
+}
+
+// CheckMigration 确认会话仍然存在，会话丢失后会话建立以来的写入无从得知，接收方需要重新拷贝
+func (c *Cache_proxy) CheckMigration(id string) error {
+	s := &c.migrationSessions
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.session(id)
+	return err
+}
+
+// DrainMigration 取走会话记录的脏key，最多max个
+func (c *Cache_proxy) DrainMigration(id string, max int) ([]string, error) {
+	s := &c.migrationSessions
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, err := s.session(id)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(session.dirty))
+	for key := range session.dirty {
+		if len(keys) == max {
+			break
+		}
+		keys = append(keys, key)
+		delete(session.dirty, key)
+	}
+	return keys, nil
+}
+
+/*
+*
+MigrationPage 返回会话区间中hash值在[start, end]内最小的最多limit个key，按原样编码，hash值相同的key在同一页中返回。
+下一页从next开始，next大于end表示已经读完。
+会话第一次读取时建立区间中全部key的有序索引，之后每一页只需要二分查找，不会每页都遍历整个缓存
+*/
+func (c *Cache_proxy) MigrationPage(id string, start, end, limit int) ([]MigrationEntry, int, error) {
+	s := &c.migrationSessions
+	s.mutex.Lock()
+	session, err := s.session(id)
+	var index []hashedKey
+	if err == nil {
+		index = session.index
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	if index == nil {
+		// 遍历缓存时不持有mutex，避免阻塞FSM记录脏key
+		index = c.Cache.hashedKeys(session.ranges)
+		s.mutex.Lock()
+		if session.index == nil {
+			session.index = index
+		}
+		index = session.index
+		s.mutex.Unlock()
+	}
+
+	now := time.Now().UnixNano()
+	next := end + 1
+	entries := make([]MigrationEntry, 0)
+	count := 0
+	for i := sort.Search(len(index), func(i int) bool { return index[i].hash >= start }); i < len(index); i++ {
+		k := index[i]
+		if k.hash > end {
+			break
+		}
+		if count >= limit && k.hash != index[i-1].hash {
+			next = k.hash
+			break
+		}
+		count++
+		// 建立索引之后删除的key已经记录在脏key中
+		if e, ok := c.Cache.Entry(k.key, now); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, next, nil
+}
+
+// FreezeMigration 冻结会话的区间直到会话结束，返回时冻结之前提交的日志都已经应用，记录在脏key中。
+// 重复冻结没有影响
+func (c *Cache_proxy) FreezeMigration(id string) error {
+	s := &c.migrationSessions
+	s.gate.Lock()
+	s.mutex.Lock()
+	session, err := s.session(id)
+	if err == nil {
+		session.frozen = true
+	}
+	s.mutex.Unlock()
+	s.gate.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Raft.Raft.Barrier(applyTimeout).Error()
+}
+
+// EndMigration 结束会话，冻结的区间恢复写入
+func (c *Cache_proxy) EndMigration(id string) {
+	s := &c.migrationSessions
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+	atomic.StoreInt32(&s.count, int32(len(s.sessions)))
+}
+
+// PurgeMigration 由来源分片的leader通过raft日志删除迁出的keys，冻结的区间中的key也可以删除，
+// 其他写入仍然返回ErrMigrating，删除完成之后再结束会话
+func (c *Cache_proxy) PurgeMigration(ctx context.Context, keys []string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	e := NewLogEntry(OperMDel, "", "", 0, false)
+	e.Fields = keys
+	s := &c.migrationSessions
+	s.gate.RLock()
+	future, err := c.submitWithEviction(encodeLogEntry(e, c.logVersion()), []LogEntryData{e})
+	s.gate.RUnlock()
+	_, index, err := c.wait(future, err)
+	if err != nil {
+		return err
+	}
+	recordIndex(ctx, index)
+	return nil
+}
+
+// reset 失去leader身份时丢弃全部会话，新的leader上没有这些会话，接收方会重新拷贝
+func (s *migrationSessions) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions = nil
+	atomic.StoreInt32(&s.count, 0)
+}
+
+// touch 由FSM在应用日志之后调用，把落在会话区间内的key记录为脏key
+func (s *migrationSessions) touch(e LogEntryData) {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return
+	}
+	keys := e.keys()
+	if len(keys) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, session := range s.sessions {
+		for _, key := range keys {
+			if session.contains(key) {
+				session.dirty[key] = struct{}{}
+			}
+		}
+	}
+}
+
+// frozen 判断命令是否写入了冻结的区间
+func (s *migrationSessions) frozen(e LogEntryData) bool {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return false
+	}
+	keys := e.keys()
+	if len(keys) == 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, session := range s.sessions {
+		if !session.frozen {
+			continue
+		}
+		for _, key := range keys {
+			if session.contains(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// submit 把日志交给raft，entries中有写入冻结区间的命令时返回ErrMigrating，
+// 有raft group中还有节点不支持的命令时返回ErrUnsupportedLogEntry。
+// 写入之前按maxmemory策略淘汰足够的key，见evict
+func (c *Cache_proxy) submit(data []byte, entries []LogEntryData) (raft.ApplyFuture, error) {
+	s := &c.migrationSessions
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	return c.submitLocked(data, entries)
+}
+
+// submitLocked 和submit相同，调用方需要持有migrationSessions.gate的读锁
+func (c *Cache_proxy) submitLocked(data []byte, entries []LogEntryData) (raft.ApplyFuture, error) {
+	s := &c.migrationSessions
+	version := c.logVersion()
+	for _, e := range entries {
+		if s.frozen(e) {
+			return nil, ErrMigrating
+		}
+		if v := operVersion(e.Oper); v > version {
+			return nil, fmt.Errorf("%w: oper %d needs version %d, raft group supports up to %d", ErrUnsupportedLogEntry, e.Oper, v, version)
+		}
+	}
+	return c.submitWithEviction(data, entries)
+}
+
+// keys 返回命令写入的key，不写入key的命令返回nil
+func (e LogEntryData) keys() []string {
+	switch e.Oper {
+	case OperMSet:
+		keys := make([]string, 0, len(e.Fields)/2)
+		for i := 0; i < len(e.Fields); i += 2 {
+			keys = append(keys, e.Fields[i])
+		}
+		return keys
+	case OperMDel, OperLPop, OperRPop:
+		return e.Fields
+	case OperRestore:
+		keys := make([]string, 0, len(e.Fields)/restoreFields)
+		for i := 0; i < len(e.Fields); i += restoreFields {
+			keys = append(keys, e.Fields[i])
+		}
+		return keys
+	case OperSetMember, OperRemoveMember, OperSetMigration, OperRemoveMigration, OperSetMaxMemory:
+		return nil
+	default:
+		return []string{e.Key}
+	}
+}
+
+// migrationJobs 记录接收方分片的迁移任务，键是任务ID，值是任务状态的json。
+// 任务状态通过SET_MIGRATION日志同步到每个副本并保存在快照中，leader切换或者重启后由新的leader继续执行
+type migrationJobs struct {
+	mutex sync.RWMutex
+	jobs  map[string]string
+}
+
+func (m *migrationJobs) set(id string, state string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.jobs == nil {
+		m.jobs = make(map[string]string)
+	}
+	m.jobs[id] = state
+}
+
+func (m *migrationJobs) remove(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.jobs[id]
+	delete(m.jobs, id)
+	return ok
+}
+
+// copy 返回任务表的副本
+func (m *migrationJobs) copy() map[string]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ret := make(map[string]string, len(m.jobs))
+	for id, state := range m.jobs {
+		ret[id] = state
+	}
+	return ret
+}
+
+// load 用快照中的任务表替换当前的任务表
+func (m *migrationJobs) load(jobs map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jobs = jobs
+}
+
+// MigrationJobs 返回每个迁移任务的状态
+func (c *Cache_proxy) MigrationJobs() map[string]string {
+	return c.migrationJobs.copy()
+}
+
+// DoSetMigration 由leader提交一条日志，保存迁移任务的状态
+func (c *Cache_proxy) DoSetMigration(id string, state string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	_, err := c.apply(context.Background(), NewLogEntry(OperSetMigration, id, state, 0, false))
+	return err
+}
+
+// DoRemoveMigration 由leader提交一条日志，删除迁移任务
+func (c *Cache_proxy) DoRemoveMigration(id string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	_, err := c.apply(context.Background(), NewLogEntry(OperRemoveMigration, id, "", 0, false))
+	return err
+}
+
+// Barrier 等待之前提交的日志都已经应用，新的leader读取迁移任务之前调用
+func (c *Cache_proxy) Barrier() error {
+	return c.Raft.Raft.Barrier(applyTimeout).Error()
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMigrationSession(t *testing.T) {
+	c := &Cache_proxy{Opts: &Options{}, Log: log.New(io.Discard, "", 0), enableWrite: ENABLE_WRITE_TRUE}
+	hash := int(consistenthash.Murmur3([]byte("moving")))
+	id, err := c.BeginMigration([]consistenthash.RangeNode{{Start: hash, End: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只记录会话区间内的key
+	s := &c.migrationSessions
+	s.touch(NewLogEntry(OperSet, "moving", "v", 0, false))
+	s.touch(NewLogEntry(OperSet, "staying", "v", 0, false))
+	keys, err := c.DrainMigration(id, 10)
+	if err != nil || len(keys) != 1 || keys[0] != "moving" {
+		t.Fatalf("got %v %v; want [moving]", keys, err)
+	}
+	if keys, _ := c.DrainMigration(id, 10); len(keys) != 0 {
+		t.Fatalf("got %v after drain; want none", keys)
+	}
+
+	// 冻结期间拒绝写入区间内的key，包括mset中的key
+	mset := NewLogEntry(OperMSet, "", "", 0, false)
+	mset.Fields = []string{"staying", "v", "moving", "v"}
+	if s.frozen(mset) {
+		t.Fatal("frozen before freeze")
+	}
+	s.sessions[id].frozen = true
+	if !s.frozen(mset) || s.frozen(NewLogEntry(OperSet, "staying", "v", 0, false)) {
+		t.Fatal("only keys in the frozen ranges should be rejected")
+	}
+
+	// 冻结的会话不会因为没有访问而过期
+	s.sessions[id].accessed = time.Now().Add(-2 * migrationSessionTTL)
+	if _, err := c.BeginMigration(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckMigration(id); err != nil {
+		t.Fatalf("got %v for an idle frozen session; want it kept", err)
+	}
+
+	c.EndMigration(id)
+	if s.frozen(mset) {
+		t.Fatal("frozen after the session ended")
+	}
+	if _, err := c.DrainMigration(id, 10); !errors.Is(err, ErrMigrationNotFound) {
+		t.Fatalf("got %v; want ErrMigrationNotFound", err)
+	}
+}
+
+func TestMigrationRestore(t *testing.T) {
+	src := newTestCache()
+	expireAt := time.Now().Add(time.Hour).UnixNano()
+	src.AddWithExpire("bin", []byte{0xff, 0x00, 0xfe}, expireAt, 0)
+	src.HSet("hash", []string{"f", "v"}, 0)
+	src.RPush("list", []string{"a", "b"}, 0)
+	src.AddWithExpire("expired", []byte("v"), 1, 0)
+
+	// 经过json和OperRestore的编码后按原样写入，类型、非utf-8的value和过期时间都保留
+	var entries []MigrationEntry
+	now := time.Now().UnixNano()
+	for _, key := range []string{"bin", "hash", "list", "expired"} {
+		if e, ok := src.Entry(key, now); ok {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries; want 3 without the expired key", len(entries))
+	}
+	data, _ := json.Marshal(entries)
+	entries = nil
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRestore(encodeRestore(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestCache()
+	for _, err := range dst.Restore(decoded, now) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ok := dst.Get("bin"); !ok || !bytes.Equal(v, []byte{0xff, 0x00, 0xfe}) {
+		t.Fatalf("got bin=%v; want ff00fe", v)
+	}
+	if ttl, _, ok := dst.TTL("bin"); !ok || ttl <= 0 {
+		t.Fatalf("got ttl %v; want the ttl kept", ttl)
+	}
+	if v, ok, _ := dst.HGet("hash", "f"); !ok || string(v) != "v" {
+		t.Fatalf("got hash f=%s; want v", v)
+	}
+	if values, _ := dst.LRange("list", 0, -1); len(values) != 2 || values[1] != "b" {
+		t.Fatalf("got list %v; want [a b]", values)
+	}
+
+	// 写入时已经过期的key被删除
+	dst.Restore([]MigrationEntry{{Key: []byte("bin"), Type: TypeString, Data: []byte("v"), ExpireAt: 1}}, now)
+	if _, ok := dst.Get("bin"); ok {
+		t.Fatal("got bin after restoring an expired entry")
+	}
+}
+
+func TestMigrationPage(t *testing.T) {
+	c := &Cache_proxy{Opts: &Options{}, Log: log.New(io.Discard, "", 0), enableWrite: ENABLE_WRITE_TRUE, Cache: newTestCache()}
+	for i := 0; i < 10; i++ {
+		c.Cache.Add(strconv.Itoa(i), []byte("v"))
+	}
+	c.Cache.HSet("hash", []string{"f", "v"}, 0)
+	full := []consistenthash.RangeNode{{Start: 0, End: math.MaxUint32}}
+	id, err := c.BeginMigration(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 按页读完整个区间，每个key只返回一次，包括hash
+	seen := make(map[string]byte)
+	for next := 0; next <= math.MaxUint32; {
+		entries, n, err := c.MigrationPage(id, next, math.MaxUint32, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n <= next {
+			t.Fatalf("got next %d after %d; want it to advance", n, next)
+		}
+		for _, e := range entries {
+			if _, ok := seen[string(e.Key)]; ok {
+				t.Fatalf("got %s twice", e.Key)
+			}
+			seen[string(e.Key)] = e.Type
+		}
+		next = n
+	}
+	if len(seen) != 11 || seen["hash"] != TypeHash {
+		t.Fatalf("got %d keys %v; want 11 with the hash", len(seen), seen)
+	}
+	if keys := c.Cache.KeysInRanges(full); len(keys) != 11 {
+		t.Fatalf("got %d keys in ranges; want 11", len(keys))
+	}
+}
+
+func TestCommitBatchFrozen(t *testing.T) {
+	leader := waitLeader(t, newTestRaftGroup(t, 1))
+	hash := int(consistenthash.Murmur3([]byte("moving")))
+	id, err := leader.BeginMigration([]consistenthash.RangeNode{{Start: hash, End: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.migrationSessions.sessions[id].frozen = true
+
+	// 只有写入冻结区间的命令失败，合并在同一批中的其他命令照常提交
+	moving := &pendingEntry{entry: NewLogEntry(OperSet, "moving", "v", 0, false), done: make(chan commitResult, 1)}
+	staying := &pendingEntry{entry: NewLogEntry(OperSet, "staying", "v", 0, false), done: make(chan commitResult, 1)}
+	leader.commitBatch([]*pendingEntry{moving, staying})
+	if r := <-moving.done; !errors.Is(r.err, ErrMigrating) {
+		t.Fatalf("got %v for the frozen key; want ErrMigrating", r.err)
+	}
+	if r := <-staying.done; r.err != nil {
+		t.Fatalf("got %v for the key outside the frozen ranges", r.err)
+	}
+	if _, ok := leader.Cache.Get("staying"); !ok {
+		t.Fatal("staying was not written")
+	}
+}
+
+// 冻结的区间中的key由PurgeMigration删除，其他写入仍然被拒绝
+func TestPurgeMigrationFrozen(t *testing.T) {
+	leader := waitLeader(t, newTestRaftGroup(t, 1))
+	leader.commits = make(chan *pendingEntry, maxGroupCommit)
+	go leader.groupCommit()
+	if err := leader.DoSet(context.Background(), OperSet, "moving", "v"); err != nil {
+		t.Fatal(err)
+	}
+	hash := int(consistenthash.Murmur3([]byte("moving")))
+	id, err := leader.BeginMigration([]consistenthash.RangeNode{{Start: hash, End: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.FreezeMigration(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.DoMDel(context.Background(), []string{"moving"}); !errors.Is(err, ErrMigrating) {
+		t.Fatalf("got %v for a delete in the frozen range; want ErrMigrating", err)
+	}
+	if err := leader.PurgeMigration(context.Background(), []string{"moving"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := leader.Cache.Get("moving"); ok {
+		t.Fatal("moving was not purged")
+	}
+	if err := leader.DoSet(context.Background(), OperSet, "moving", "v2"); !errors.Is(err, ErrMigrating) {
+		t.Fatalf("got %v for a write after the purge; want ErrMigrating until the session ends", err)
+	}
+}
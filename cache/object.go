@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// value的类型，快照中按类型保存value的编码
+const (
+	TypeString byte = iota
+	TypeHash
+	TypeList
+	TypeSet
+	TypeZSet
+)
+
+var (
+	ErrWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+)
+
+/*
+*
+object 是字符串以外的复合类型(hash、list、set、zset)，支持按元素原地修改。
+快照截取视图时会freeze所有object，freeze之后object不再被原地修改，
+后续的写操作先clone一份再修改，快照可以在锁外安全地读取被freeze的object
+*/
+type object interface {
+	Type() byte
+	Len() int     // 元素个数，为0时key会被删除
+	memSize() int // 计入内存的字节数，只在从快照恢复时计算一次，之后由各个写操作增量维护
+	encode() []byte
+	clone() object
+	frozen() bool
+	freeze()
+}
+
+// cow 嵌入到object中实现freeze，只在分段的锁内读写
+type cow struct {
+	isFrozen bool
+}
+
+func (c *cow) frozen() bool {
+	return c.isFrozen
+}
+
+func (c *cow) freeze() {
+	c.isFrozen = true
+}
+
+func newObject(typ byte) object {
+	switch typ {
+	case TypeHash:
+		return newHash()
+	case TypeList:
+		return newList()
+	case TypeSet:
+		return newSet()
+	case TypeZSet:
+		return newZSet()
+	}
+	panic(fmt.Sprintf("unknown value type %d", typ))
+}
+
+// cacheValue 是写入lru_k的value，和lru_k中的gValue方法一致
+type cacheValue interface {
+	Len() int
+	GetBytes() []byte
+}
+
+// decodeValue 按类型解码快照中的value
+func decodeValue(typ byte, data []byte) (cacheValue, error) {
+	var (
+		o   object
+		err error
+	)
+	switch typ {
+	case TypeString:
+		return &gvalue{bytes: data}, nil
+	case TypeHash:
+		o, err = decodeHash(data)
+	case TypeList:
+		o, err = decodeList(data)
+	case TypeSet:
+		o, err = decodeSet(data)
+	case TypeZSet:
+		o, err = decodeZSet(data)
+	default:
+		return nil, fmt.Errorf("unknown value type %d", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gobject{data: o, size: o.memSize()}, nil
+}
+
+// gobject 是object在lru_k中的value，每次修改都会换成新的gobject，
+// 这样lru_k能根据新旧gobject的Len算出大小的变化
+type gobject struct {
+	data object
+	size int // object计入内存的字节数
+}
+
+func (g *gobject) Len() int {
+	return g.size
+}
+
+func (g *gobject) GetBytes() []byte {
+	return g.data.encode()
+}
+
+// valueType 返回lru_k中value的类型
+func valueType(v interface{}) byte {
+	if o, ok := v.(*gobject); ok {
+		return o.data.Type()
+	}
+	return TypeString
+}
+
+// TypeName 返回类型在redis TYPE命令中的名字
+func TypeName(typ byte) string {
+	switch typ {
+	case TypeString:
+		return "string"
+	case TypeHash:
+		return "hash"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	}
+	return "none"
+}
+
+// Type 返回key的类型，key不存在时ok为false
+func (c *Cache) Type(key string) (typ byte, ok bool) {
+	s := c.segment(key)
+	s.mutex.RLock()
+	v, ok := s.lru.Peek(key)
+	s.mutex.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return valueType(v), true
+}
+
+// update 在key所在分段的写锁内修改类型为typ的value，由FSM.Apply调用，now取自raft日志。
+// key不存在时，create为true则新建一个空的value，否则直接返回。
+// fn检查命令能否执行，返回value大小的变化量以及真正执行修改的apply，apply为nil表示不需要修改。
+// 先按修改后的大小写回lru_k，maxmemory拒绝写入时value保持不变
+func (c *Cache) update(key string, typ byte, now int64, create bool, fn func(o object) (delta int, apply func(), err error)) error {
+	s := c.segment(key)
+	s.lock()
+	defer s.unlock()
+
+	var (
+		old      *gobject
+		expireAt int64
+		slide    int64
+	)
+	if !s.expiredLocked(key, now) {
+		v, _ := s.lru.Lookup(key)
+		o, ok := v.(*gobject)
+		if !ok || o.data.Type() != typ {
+			return ErrWrongType
+		}
+		old = o
+		expireAt, slide, _ = s.lru.GetExpire(key)
+	} else if !create {
+		return nil
+	}
+
+	var data object
+	size := 0
+	switch {
+	case old == nil:
+		data = newObject(typ)
+	case old.data.frozen():
+		data, size = old.data.clone(), old.size
+	default:
+		data, size = old.data, old.size
+	}
+	delta, apply, err := fn(data)
+	if err != nil || apply == nil {
+		return err
+	}
+	if err := c.setLocked(s, key, &gobject{data: data, size: size + delta}, expireAt, slide); err != nil {
+		return err
+	}
+	apply()
+	// 和redis一致，复合类型的元素被删光后key也一并删除
+	if data.Len() == 0 {
+		s.lru.Remove(key)
+	}
+	return nil
+}
+
+// view 在读锁内读取类型为typ的value，key不存在时不调用fn
+func (c *Cache) view(key string, typ byte, fn func(o object)) error {
+	s := c.segment(key)
+	s.mutex.RLock()
+	v, ok := s.lru.Peek(key)
+	if !ok {
+		s.mutex.RUnlock()
+		return nil
+	}
+	o, ok := v.(*gobject)
+	if !ok || o.data.Type() != typ {
+		s.mutex.RUnlock()
+		return ErrWrongType
+	}
+	fn(o.data)
+	s.mutex.RUnlock()
+
+	s.recordAccess(key)
+	return nil
+}
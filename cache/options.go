@@ -10,6 +10,11 @@ type Options struct {
 	raftTCPAddress string
 	bootstrap      bool
 	JoinAddress    string
+	RedirectWrites bool
+	Nonvoter       bool
+	Ctrlers        []string
+	GID            string
+	MigrateRate    int
 }
 
 func NewOptions(httpPort int32, raftPort int32, node string, bootstrap bool, joinAddress string) *Options {
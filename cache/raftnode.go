@@ -92,7 +92,10 @@ func NewRaftNode(opts *Options, proxy *Cache_proxy) (*RaftNodeInfo, error) {
 
 // joinRaftCluster joins a node to gedisraft cluster
 func JoinRaftCluster(opts *Options) error {
-	url := fmt.Sprintf("http://%s/join?peerAddress=%s", opts.JoinAddress, opts.raftTCPAddress)
+	url := fmt.Sprintf("http://%s/join?peerAddress=%s&httpAddress=%s&logVersion=%d", opts.JoinAddress, opts.raftTCPAddress, opts.HttpAddress, logEntryVersion)
+	if opts.Nonvoter {
+		url += "&nonvoter=true"
+	}
 
 	resp, err := http.Get(url)
 	if err != nil {
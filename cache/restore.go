@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"sort"
+	"strconv"
+)
+
+/*
+*
+分片之间迁移key时按原样拷贝：来源分片用Entry读出key的类型、按类型编码的value(和快照中的编码相同)
+以及过期的绝对时间，接收方通过OperRestore日志写入，hash、list、set、zset和存活时间都不会丢失。
+OperRestore的Fields每restoreFields个一组，依次为key、类型(1字节)、value的编码、expireAt和slide(十进制)
+*/
+
+const restoreFields = 5
+
+// MigrationEntry 是迁移的一个key，Data是按Type编码的value，ExpireAt是过期的绝对时间(unix纳秒)，
+// Slide是滑动过期时长。Key和Data在json中按base64编码，可以是任意字节。Deleted表示key在来源分片上已经被删除
+type MigrationEntry struct {
+	Key      []byte `json:"key"`
+	Type     byte   `json:"type"`
+	Data     []byte `json:"data,omitempty"`
+	ExpireAt int64  `json:"expire_at,omitempty"`
+	Slide    int64  `json:"slide,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// Entry 返回key的类型、编码后的value和过期时间，key不存在或者已经过期时ok为false
+func (c *Cache) Entry(key string, now int64) (e MigrationEntry, ok bool) {
+	s := c.segment(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	v, ok := s.lru.Lookup(key)
+	if !ok {
+		return e, false
+	}
+	expireAt, slide, _ := s.lru.GetExpire(key)
+	if expireAt > 0 && expireAt <= now {
+		return e, false
+	}
+	// 写复合类型需要分段的写锁，这里持有读锁，编码时object不会被修改
+	return MigrationEntry{Key: []byte(key), Type: valueType(v), Data: v.GetBytes(), ExpireAt: expireAt, Slide: slide}, true
+}
+
+// Restore 按原样写入迁移的key，在now时刻已经过期的key直接删除，返回每个key写入的结果
+func (c *Cache) Restore(entries []MigrationEntry, now int64) []error {
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		key := string(e.Key)
+		if e.ExpireAt > 0 && e.ExpireAt <= now {
+			c.Remove(key)
+			continue
+		}
+		v, err := decodeValue(e.Type, e.Data)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		s := c.segment(key)
+		s.lock()
+		errs[i] = c.setLocked(s, key, v, e.ExpireAt, e.Slide)
+		s.unlock()
+		// 和其他字符串写入一样加入脏key队列
+		if errs[i] == nil && e.Type == TypeString {
+			select {
+			case c.dirtyKeys <- key:
+			default:
+			}
+		}
+	}
+	return errs
+}
+
+// hashedKey 是带有一致性hash环上位置的key
+type hashedKey struct {
+	hash int
+	key  string
+}
+
+// hashedKeys 返回hash值落在ranges中的全部key，按hash值和key排序
+func (c *Cache) hashedKeys(ranges []consistenthash.RangeNode) []hashedKey {
+	c.lazyInit()
+	keys := make([]hashedKey, 0)
+	for _, s := range c.segments {
+		s.mutex.RLock()
+		for key := range s.lru.GetAll() {
+			if hash := int(consistenthash.Murmur3([]byte(key))); inRanges(hash, ranges) {
+				keys = append(keys, hashedKey{hash, key})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].key < keys[j].key
+	})
+	return keys
+}
+
+// KeysInRanges 返回hash值落在ranges中的全部key，包括所有类型
+func (c *Cache) KeysInRanges(ranges []consistenthash.RangeNode) []string {
+	hashed := c.hashedKeys(ranges)
+	keys := make([]string, len(hashed))
+	for i, k := range hashed {
+		keys[i] = k.key
+	}
+	return keys
+}
+
+func inRanges(hash int, ranges []consistenthash.RangeNode) bool {
+	for _, r := range ranges {
+		if hash >= r.Start && hash <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// DoRestore 把迁移的key作为一条OperRestore日志写入，返回每个key写入的结果，整条日志提交失败时返回error。
+// raft group中还有节点不支持OperRestore时返回ErrUnsupportedLogEntry
+func (c *Cache_proxy) DoRestore(ctx context.Context, entries []MigrationEntry) ([]error, error) {
+	if !c.checkWritePermission() {
+		return nil, ErrNotLeader
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("doRestore() error, get nil entries")
+	}
+	e := NewLogEntry(OperRestore, "", "", 0, false)
+	e.Fields = encodeRestore(entries)
+	ret, err := c.apply(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return ret.([]error), nil
+}
+
+func encodeRestore(entries []MigrationEntry) []string {
+	fields := make([]string, 0, len(entries)*restoreFields)
+	for _, e := range entries {
+		fields = append(fields, string(e.Key), string([]byte{e.Type}), string(e.Data),
+			strconv.FormatInt(e.ExpireAt, 10), strconv.FormatInt(e.Slide, 10))
+	}
+	return fields
+}
+
+func decodeRestore(fields []string) ([]MigrationEntry, error) {
+	if len(fields)%restoreFields != 0 {
+		return nil, fmt.Errorf("invalid restore entry, fields:%d", len(fields))
+	}
+	entries := make([]MigrationEntry, 0, len(fields)/restoreFields)
+	for i := 0; i < len(fields); i += restoreFields {
+		expireAt, err1 := strconv.ParseInt(fields[i+3], 10, 64)
+		slide, err2 := strconv.ParseInt(fields[i+4], 10, 64)
+		if len(fields[i+1]) != 1 || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid restore entry for key %q", fields[i])
+		}
+		entries = append(entries, MigrationEntry{
+			Key:      []byte(fields[i]),
+			Type:     fields[i+1][0],
+			Data:     []byte(fields[i+2]),
+			ExpireAt: expireAt,
+			Slide:    slide,
+		})
+	}
+	return entries, nil
+}
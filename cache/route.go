@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// LeaderHeader 是follower返回的leader提示，值为leader的http地址
+const LeaderHeader = "X-Gedis-Leader"
+
+/*
+*
+routes 记录转发给其他分片组时每个分片组优先使用的节点。哈希环上的真实节点是分片组ID时，
+一个分片组有多个节点，转发写请求和需要leader的读请求时优先发给最近一次成功处理请求的节点，
+响应中带有leader提示时改为leader，它通常就是分片组的leader；stale读在分片组的节点之间轮询。
+*/
+type routes struct {
+	mutex     sync.Mutex
+	preferred map[string]string // 哈希环上的真实节点 -> 优先使用的http地址
+	next      map[string]int    // stale读轮询的位置
+}
+
+// candidates 返回转发给哈希环上的真实节点owner时依次尝试的http地址
+func (c *Cache_proxy) candidates(owner string, stale bool) []string {
+	members := c.Peers().Members(owner)
+	if len(members) <= 1 {
+		return members
+	}
+	c.routes.mutex.Lock()
+	defer c.routes.mutex.Unlock()
+	start := 0
+	if stale {
+		if c.routes.next == nil {
+			c.routes.next = make(map[string]int)
+		}
+		start = c.routes.next[owner] % len(members)
+		c.routes.next[owner] = start + 1
+	} else if preferred, ok := c.routes.preferred[owner]; ok {
+		for i, address := range members {
+			if address == preferred {
+				start = i
+				break
+			}
+		}
+	}
+	return append(append([]string(nil), members[start:]...), members[:start]...)
+}
+
+// inGroup 判断哈希环上的真实节点owner是否是本节点或者本节点所在的分片组
+func (c *Cache_proxy) inGroup(owner string) bool {
+	return owner == c.Opts.HttpAddress || contains(c.Peers().Members(owner), c.Opts.HttpAddress)
+}
+
+// prefer 记录分片组owner优先使用的节点，address不在分片组中时忽略
+func (c *Cache_proxy) prefer(owner string, address string) {
+	members := c.Peers().Members(owner)
+	if len(members) <= 1 || !contains(members, address) {
+		return
+	}
+	c.routes.mutex.Lock()
+	defer c.routes.mutex.Unlock()
+	if c.routes.preferred == nil {
+		c.routes.preferred = make(map[string]string)
+	}
+	c.routes.preferred[owner] = address
+}
+
+// Address 返回转发给哈希环上的真实节点owner时优先使用的http地址
+func (c *Cache_proxy) Address(owner string) string {
+	if candidates := c.candidates(owner, false); len(candidates) > 0 {
+		return candidates[0]
+	}
+	return owner
+}
+
+/*
+*
+PeerDo 把请求发送给哈希环上的真实节点owner，send按http地址发送一次请求。owner是分片组时：
+
+ 1. 连接失败或者节点返回503(分片组还没有选出leader)时依次尝试分片组的其他节点，这两种情况下
+    请求没有被执行，重试是安全的；503响应中带有leader提示时下一个尝试leader
+ 2. 其他错误直接返回，避免非幂等的写请求被执行两次
+ 3. 不是stale读时，记录成功处理请求的节点或者响应中的leader，之后的请求优先发给它
+
+最后一个节点返回的503响应原样返回给调用方
+*/
+func (c *Cache_proxy) PeerDo(owner string, stale bool, send func(address string) (*http.Response, error)) (*http.Response, error) {
+	candidates := c.candidates(owner, stale)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no servers for %s", owner)
+	}
+	tried := make(map[string]bool, len(candidates))
+	var lastErr error
+	for len(candidates) > 0 {
+		address := candidates[0]
+		candidates = candidates[1:]
+		if tried[address] {
+			continue
+		}
+		tried[address] = true
+
+		resp, err := send(address)
+		if err != nil {
+			if !isDialError(err) {
+				return nil, err
+			}
+			c.Log.Printf("%s of %s unavailable:%v", address, owner, err)
+			lastErr = err
+			continue
+		}
+		leader := resp.Header.Get(LeaderHeader)
+		if resp.StatusCode == http.StatusServiceUnavailable && len(candidates) > 0 {
+			resp.Body.Close()
+			if leader != "" && !tried[leader] && contains(candidates, leader) {
+				candidates = append([]string{leader}, candidates...)
+			}
+			lastErr = fmt.Errorf("%s of %s is not available for writes", address, owner)
+			continue
+		}
+		if !stale && resp.StatusCode != http.StatusServiceUnavailable {
+			if leader != "" {
+				address = leader
+			}
+			c.prefer(owner, address)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// isDialError 连接没有建立起来，请求一定没有被执行
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func contains(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
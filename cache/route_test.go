@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestRouter 返回哈希环上只有分片组g1的Cache_proxy
+func newTestRouter(members ...string) *Cache_proxy {
+	c := &Cache_proxy{Opts: &Options{HttpAddress: "self"}, Log: log.New(io.Discard, "", 0)}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add("g1")
+	ring.Groups = map[string][]string{"g1": members}
+	c.SetPeers(ring)
+	return c
+}
+
+func peerGet(c *Cache_proxy, stale bool) (string, int, error) {
+	var served string
+	resp, err := c.PeerDo("g1", stale, func(address string) (*http.Response, error) {
+		served = address
+		return http.Get("http://" + address + "/")
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	return served, resp.StatusCode, nil
+}
+
+func TestPeerDoFailover(t *testing.T) {
+	// 关闭监听得到一个连接会被拒绝的地址，模拟宕机的leader
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	var leader string
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(LeaderHeader, leader)
+		http.Error(w, "leader unknown", http.StatusServiceUnavailable)
+	}))
+	defer follower.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	leader = strings.TrimPrefix(ok.URL, "http://")
+	followerAddr := strings.TrimPrefix(follower.URL, "http://")
+
+	c := newTestRouter(dead, followerAddr, leader)
+	served, status, err := peerGet(c, false)
+	if err != nil || status != http.StatusOK || served != leader {
+		t.Fatalf("got %s %d %v; want %s 200", served, status, err, leader)
+	}
+	// 之后的请求直接发给leader
+	if got := c.candidates("g1", false)[0]; got != leader {
+		t.Fatalf("got preferred %s; want %s", got, leader)
+	}
+
+	// 没有可用的节点时返回最后一个节点的503
+	c = newTestRouter(dead, followerAddr)
+	leader = ""
+	if _, status, err := peerGet(c, false); err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d %v; want 503", status, err)
+	}
+	c = newTestRouter(dead)
+	if _, _, err := peerGet(c, false); err == nil {
+		t.Fatal("expected error when every member is down")
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	c := newTestRouter("a", "b", "c")
+	// stale读在分片组的节点之间轮询
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[c.candidates("g1", true)[0]] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("stale reads went to %v; want all members", seen)
+	}
+	// 不在分片组中的地址不会成为优先节点
+	c.prefer("g1", "x")
+	if got := c.Address("g1"); got != "a" {
+		t.Fatalf("got %s; want a", got)
+	}
+	c.prefer("g1", "b")
+	if got := c.candidates("g1", false); strings.Join(got, ",") != "b,c,a" {
+		t.Fatalf("got %v; want b,c,a", got)
+	}
+	// 哈希环上没有分组信息的真实节点本身就是地址
+	if got := c.Address("127.0.0.1:8001"); got != "127.0.0.1:8001" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+// follower上其他分片的key未命中时发给哈希环上负责的分片组，而不是本分片组的leader
+func TestDoGetForeignKey(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v1"))
+	}))
+	defer owner.Close()
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "moved", http.StatusMisdirectedRequest)
+	}))
+	defer leader.Close()
+
+	c := newTestRouter(strings.TrimPrefix(owner.URL, "http://"))
+	c.Cache = newTestCache()
+	if v, ok := c.DoGet("k1", strings.TrimPrefix(leader.URL, "http://"), nil); !ok || string(v) != "v1" {
+		t.Fatalf("got %q, %v; want v1 from the owning shard", v, ok)
+	}
+}
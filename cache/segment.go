@@ -0,0 +1,105 @@
+package cache
+
+import (
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"sync"
+)
+
+const (
+	// DefaultSegments 默认的分段数
+	DefaultSegments = 16
+
+	// 选择分段使用FNV-1a，和一致性hash环使用的murmur3错开，
+	// 否则同一个节点负责的key会集中落在少数几个分段上
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+
+	readBatchSize  = 64 // 每攒够这么多次访问提交一批
+	readBatchQueue = 16 // 每个分段最多积压的批次数，积压满了新的批次直接丢弃
+)
+
+/*
+*
+segment 是Cache的一个分段，每个分段持有keyspace中的一部分key和独立的lru_k实例。
+读请求只拿读锁，通过Peek读取value，访问记录先攒在缓冲区里，攒够一批后在拿到写锁时
+统一通过Touch补记，这样读路径不会因为调整链表顺序而互相阻塞。
+缓冲区满了就丢弃访问记录，少量访问记录的丢失只会让淘汰稍微不那么精确，不影响正确性
+*/
+type segment struct {
+	mutex    sync.RWMutex
+	lru      lru_k.Cache
+	maxBytes int64 // 分段的容量，0表示不限制，见Cache.SetMaxMemory
+
+	reads   sync.Pool     // *[]string，sync.Pool按P缓存对象，各个核的读请求写入不同的缓冲区
+	batches chan []string // 待补记的访问批次
+}
+
+func newSegment(lru lru_k.Cache) *segment {
+	s := &segment{
+		lru:     lru,
+		batches: make(chan []string, readBatchQueue),
+	}
+	s.reads.New = func() any {
+		buf := make([]string, 0, readBatchSize)
+		return &buf
+	}
+	return s
+}
+
+// recordAccess 记录一次对key的访问，调用方不能持有锁
+func (s *segment) recordAccess(key string) {
+	bp := s.reads.Get().(*[]string)
+	*bp = append(*bp, key)
+	if len(*bp) < readBatchSize {
+		s.reads.Put(bp)
+		return
+	}
+
+	batch := *bp
+	*bp = make([]string, 0, readBatchSize)
+	s.reads.Put(bp)
+	select {
+	case s.batches <- batch:
+	default:
+	}
+
+	// 拿不到锁说明有写请求正在进行，它会顺带处理积压的批次
+	if s.mutex.TryLock() {
+		s.drainLocked()
+		s.mutex.Unlock()
+	}
+}
+
+// drainLocked 把积压的访问批次补记到lru_k，调用方需持有写锁
+func (s *segment) drainLocked() {
+	for {
+		select {
+		case batch := <-s.batches:
+			for _, key := range batch {
+				s.lru.Touch(key)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// lock 拿写锁，并先补记积压的访问，让写操作看到尽量新的访问顺序
+func (s *segment) lock() {
+	s.mutex.Lock()
+	s.drainLocked()
+}
+
+func (s *segment) unlock() {
+	s.mutex.Unlock()
+}
+
+// segmentIndex 计算key所在的分段
+func segmentIndex(key string, n int) int {
+	h := uint32(fnvOffset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= fnvPrime32
+	}
+	return int(h % uint32(n))
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// setMemberOverhead 每个成员除内容以外计入的字节数：字符串头以及map中分摊的开销(估算)
+const setMemberOverhead = int(unsafe.Sizeof("")) + 16
+
+// set 无序不重复的字符串集合，对应redis的set类型
+type set struct {
+	cow
+	members map[string]struct{}
+}
+
+func newSet() *set {
+	return &set{members: make(map[string]struct{})}
+}
+
+func (s *set) Type() byte {
+	return TypeSet
+}
+
+func (s *set) Len() int {
+	return len(s.members)
+}
+
+func (s *set) memSize() int {
+	size := 0
+	for m := range s.members {
+		size += len(m) + setMemberOverhead
+	}
+	return size
+}
+
+func (s *set) clone() object {
+	n := &set{members: make(map[string]struct{}, len(s.members))}
+	for m := range s.members {
+		n.members[m] = struct{}{}
+	}
+	return n
+}
+
+// encode 编码格式: 成员数量(uvarint) | 每个成员: 长度(uvarint) | 内容
+func (s *set) encode() []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s.members)))])
+	for m := range s.members {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(m)))])
+		buf.WriteString(m)
+	}
+	return buf.Bytes()
+}
+
+func decodeSet(data []byte) (object, error) {
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	s := newSet()
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		s.members[string(b)] = struct{}{}
+	}
+	return s, nil
+}
+
+// SAdd 向set中加入若干个成员，返回新加入的数量
+func (c *Cache) SAdd(key string, members []string, now int64) (int, error) {
+	added := 0
+	err := c.update(key, TypeSet, now, true, func(o object) (int, func(), error) {
+		s := o.(*set)
+		fresh := make(map[string]struct{})
+		delta := 0
+		for _, m := range members {
+			if _, ok := s.members[m]; ok {
+				continue
+			}
+			if _, ok := fresh[m]; ok {
+				continue
+			}
+			fresh[m] = struct{}{}
+			delta += len(m) + setMemberOverhead
+		}
+		if len(fresh) == 0 {
+			return 0, nil, nil
+		}
+		return delta, func() {
+			for m := range fresh {
+				s.members[m] = struct{}{}
+			}
+			added = len(fresh)
+		}, nil
+	})
+	return added, err
+}
+
+// SRem 从set中删除若干个成员，返回实际删除的数量
+func (c *Cache) SRem(key string, members []string, now int64) (int, error) {
+	removed := 0
+	err := c.update(key, TypeSet, now, false, func(o object) (int, func(), error) {
+		s := o.(*set)
+		gone := make(map[string]struct{})
+		delta := 0
+		for _, m := range members {
+			if _, ok := s.members[m]; !ok {
+				continue
+			}
+			if _, ok := gone[m]; ok {
+				continue
+			}
+			gone[m] = struct{}{}
+			delta -= len(m) + setMemberOverhead
+		}
+		if len(gone) == 0 {
+			return 0, nil, nil
+		}
+		return delta, func() {
+			for m := range gone {
+				delete(s.members, m)
+			}
+			removed = len(gone)
+		}, nil
+	})
+	return removed, err
+}
+
+// SMembers 返回set的所有成员，按字典序排列
+func (c *Cache) SMembers(key string) ([]string, error) {
+	members := []string{}
+	err := c.view(key, TypeSet, func(o object) {
+		for m := range o.(*set).members {
+			members = append(members, m)
+		}
+	})
+	sort.Strings(members)
+	return members, err
+}
+
+// SIsMember 判断member是否在set中
+func (c *Cache) SIsMember(key string, member string) (ok bool, err error) {
+	err = c.view(key, TypeSet, func(o object) {
+		_, ok = o.(*set).members[member]
+	})
+	return
+}
+
+// SInter 返回多个set的交集，按字典序排列，不存在的key视为空集
+func (c *Cache) SInter(keys []string) ([]string, error) {
+	var result map[string]struct{}
+	for _, key := range keys {
+		next := make(map[string]struct{})
+		err := c.view(key, TypeSet, func(o object) {
+			for m := range o.(*set).members {
+				if _, ok := result[m]; ok || result == nil {
+					next[m] = struct{}{}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = next
+		if len(result) == 0 {
+			break
+		}
+	}
+	return sortedMembers(result), nil
+}
+
+// SUnion 返回多个set的并集，按字典序排列
+func (c *Cache) SUnion(keys []string) ([]string, error) {
+	result := make(map[string]struct{})
+	for _, key := range keys {
+		err := c.view(key, TypeSet, func(o object) {
+			for m := range o.(*set).members {
+				result[m] = struct{}{}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sortedMembers(result), nil
+}
+
+func sortedMembers(members map[string]struct{}) []string {
+	ret := make([]string, 0, len(members))
+	for m := range members {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// DoSAdd 向set中加入若干个成员，返回新加入的数量
+func (c *Cache_proxy) DoSAdd(ctx context.Context, key string, members []string) (int, error) {
+	return c.applyMembers(ctx, OperSAdd, key, members)
+}
+
+// DoSRem 从set中删除若干个成员，返回实际删除的数量
+func (c *Cache_proxy) DoSRem(ctx context.Context, key string, members []string) (int, error) {
+	return c.applyMembers(ctx, OperSRem, key, members)
+}
+
+// DoZAdd 向有序集合中加入成员或者更新已有成员的score，返回新加入的数量
+func (c *Cache_proxy) DoZAdd(ctx context.Context, key string, members []ZMember) (int, error) {
+	fields := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		fields = append(fields, strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member)
+	}
+	return c.applyMembers(ctx, OperZAdd, key, fields)
+}
+
+// DoZRem 从有序集合中删除若干个成员，返回实际删除的数量
+func (c *Cache_proxy) DoZRem(ctx context.Context, key string, members []string) (int, error) {
+	return c.applyMembers(ctx, OperZRem, key, members)
+}
+
+// applyMembers 提交以成员列表为参数、返回修改数量的命令
+func (c *Cache_proxy) applyMembers(ctx context.Context, oper int8, key string, fields []string) (int, error) {
+	if !c.checkWritePermission() {
+		return 0, ErrNotLeader
+	}
+	if key == "" || len(fields) == 0 {
+		return 0, fmt.Errorf("oper %d error, get nil key or nil member", oper)
+	}
+	event := NewLogEntry(oper, key, "", 0, false)
+	event.Fields = fields
+	ret, err := c.apply(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	return ret.(int), nil
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// touchCycleInterval 合并提交滑动过期顺延的间隔，滑动过期时长应当远大于这个间隔
+	touchCycleInterval = 100 * time.Millisecond
+	// TouchPath 是leader接收follower读命中的滑动过期key的接口
+	TouchPath = "/v1/cluster/touch"
+)
+
+/*
+*
+滑动过期的顺延：读命中滑动过期的key时只在本地记录，读请求不会提交raft日志。
+每个节点(包括follower)上的touchCycle定期取走记录的key：leader把它们合并成一条日志，每个key一条OperTouch；
+follower把key发送给leader，由leader合并提交。顺延仍然经过raft，各副本的过期时间保持一致
+*/
+type slidingTouches struct {
+	mutex sync.Mutex
+	keys  map[string]struct{}
+}
+
+func (s *slidingTouches) record(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]struct{})
+	}
+	s.keys[key] = struct{}{}
+}
+
+// drain 取走记录的全部key
+func (s *slidingTouches) drain() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	s.keys = nil
+	return keys
+}
+
+// touchIfSliding 读命中滑动过期的key时记录下来，由touchCycle合并顺延
+func (c *Cache_proxy) touchIfSliding(key string) {
+	if _, slide, ok := c.Cache.TTL(key); !ok || slide <= 0 {
+		return
+	}
+	c.touches.record(key)
+}
+
+// touchCycle 在后台定期顺延记录的key，每个节点都运行
+func (c *Cache_proxy) touchCycle() {
+	ticker := time.NewTicker(touchCycleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		keys := c.touches.drain()
+		if len(keys) == 0 {
+			continue
+		}
+		if err := c.flushTouches(keys); err != nil {
+			c.Log.Printf("touch %d sliding keys failed:%v", len(keys), err)
+		}
+	}
+}
+
+// flushTouches leader直接提交顺延，follower把key发送给leader
+func (c *Cache_proxy) flushTouches(keys []string) error {
+	if c.checkWritePermission() {
+		return c.DoTouch(context.Background(), keys)
+	}
+	leader, ok := c.Leader()
+	if !ok {
+		return ErrNotLeader
+	}
+	body, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post("http://"+leader+TouchPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("leader %s status %d", leader, resp.StatusCode)
+	}
+	return nil
+}
+
+// DoTouch 由leader顺延keys的过期时间，每个key一条OperTouch，通过groupCommit合并成尽量少的日志。
+// 正在切换的区间中的key跳过，迁移时按原样拷贝过期时间
+func (c *Cache_proxy) DoTouch(ctx context.Context, keys []string) error {
+	if !c.checkWritePermission() {
+		return ErrNotLeader
+	}
+	pending := make([]*pendingEntry, len(keys))
+	for i, key := range keys {
+		pending[i] = &pendingEntry{entry: NewLogEntry(OperTouch, key, "", 0, false), done: make(chan commitResult, 1)}
+		c.commits <- pending[i]
+	}
+	var err error
+	for _, p := range pending {
+		if r := <-p.done; r.err != nil && !errors.Is(r.err, ErrMigrating) {
+			err = r.err
+		} else if r.err == nil {
+			recordIndex(ctx, r.index)
+		}
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlidingTouch(t *testing.T) {
+	nodes := newTestRaftGroup(t, 2)
+	leader := waitLeader(t, nodes)
+	leader.commits = make(chan *pendingEntry, maxGroupCommit)
+	go leader.groupCommit()
+	follower := nodes[1]
+	id := follower.Opts.raftTCPAddress
+	if err := leader.DoAddServer(id, id, follower.Opts.HttpAddress, logEntryVersion, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// follower通过成员表找到leader的http地址，把读命中的key发给它
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		if err := leader.DoTouch(r.Context(), keys); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	leader.Opts.HttpAddress = strings.TrimPrefix(srv.URL, "http://")
+	if err := leader.DoSetMember(leader.Opts.raftTCPAddress, leader.Opts.HttpAddress, logEntryVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.DoSetEx(context.Background(), OperSet, "k", "v", time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+	expireAt := func(c *Cache_proxy) int64 {
+		s := c.Cache.segment("k")
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		at, _, _ := s.lru.GetExpire("k")
+		return at
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for expireAt(follower) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := expireAt(follower)
+
+	// 读请求不提交raft日志，只在本地记录
+	index := leader.Raft.Raft.LastIndex()
+	if _, ok := leader.DoGetLocal("k"); !ok {
+		t.Fatal("leader miss")
+	}
+	if _, ok := follower.DoGetLocal("k"); !ok {
+		t.Fatal("follower miss")
+	}
+	if got := leader.Raft.Raft.LastIndex(); got != index {
+		t.Fatalf("got last index %d after reads; want %d", got, index)
+	}
+
+	// follower上的读同样顺延，顺延通过raft同步到每个副本
+	time.Sleep(10 * time.Millisecond)
+	if err := follower.flushTouches(follower.touches.drain()); err != nil {
+		t.Fatal(err)
+	}
+	for expireAt(follower) <= before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := expireAt(follower); after <= before || after != expireAt(leader) {
+		t.Fatalf("got expireAt %d on the follower and %d on the leader; want both extended past %d", after, expireAt(leader), before)
+	}
+}
@@ -1,30 +1,337 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	lru_k "github.com/Emiliaab/gedis/lru-k"
 	"github.com/hashicorp/raft"
 )
 
+/*
+*
+快照采用分块的二进制格式流式写入raft.SnapshotSink：
+
+	header: magic "GDSS" | version(1 byte)
+	chunk:  entry数量(uvarint) | payload长度(uvarint) | payload | crc32(payload, 4 bytes)
+	...
+	end:    entry数量为0的chunk
+	members: 成员数量(uvarint) | (raft地址长度(uvarint) | raft地址 | http地址长度(uvarint) | http地址)...
+	applied: 生成快照时状态机已经应用的日志index(uvarint)
+	migrations: 迁移任务数量(uvarint) | (任务ID长度(uvarint) | 任务ID | 状态长度(uvarint) | 状态)...
+	versions: 成员数量(uvarint) | (raft地址长度(uvarint) | raft地址 | 日志版本长度(uvarint) | 日志版本)...
+	config: 配置项数量(uvarint) | (配置名长度(uvarint) | 配置名 | 值长度(uvarint) | 值)...
+
+每个entry: key长度(uvarint) | key | type(1 byte) | value长度(uvarint) | value | count(uvarint) | flags(1 byte) | expireAt(varint) | slide(varint)
+
+type是value的类型(见object.go)，value是该类型的编码。版本2的快照没有type，value都是字符串，
+版本4之前的快照没有members，版本5之前的快照没有applied，版本6之前的快照没有migrations，
+版本7之前的快照没有versions，版本8之前的快照没有config
+*/
+
+const (
+	snapshotMagic             = "GDSS"
+	snapshotBinaryVersion     = 8
+	snapshotMembersVersion    = 4 // 从这个版本开始快照中保存成员表
+	snapshotAppliedVersion    = 5 // 从这个版本开始快照中保存applied
+	snapshotMigrationsVersion = 6 // 从这个版本开始快照中保存迁移任务
+	snapshotVersionsVersion   = 7 // 从这个版本开始快照中保存成员的日志版本
+	snapshotConfigVersion     = 8 // 从这个版本开始快照中保存raft group统一的配置
+	snapshotStringVersion     = 2 // 只支持字符串类型的旧版本
+	snapshotChunkEntries      = 1024
+	snapshotMaxString         = 1 << 20 // 成员表和迁移任务中字符串的最大长度
+	snapshotMaxMapEntries     = 1 << 16 // 成员表和迁移任务的最大条目数
+
+	snapshotFlagActive = 1 << 0
+)
+
+var errSnapshotCorrupted = errors.New("snapshot corrupted")
+
 type snapshot struct {
-	proxy *Cache_proxy
+	records []lru_k.Record // 生成快照时刻的缓存视图
+	meta    snapshotMeta
 }
 
+// snapshotMeta 是快照中缓存数据之外的状态机状态
+type snapshotMeta struct {
+	members    map[string]string // 成员表
+	applied    uint64            // 状态机已经应用的最后一条日志的index，用于会话token
+	migrations map[string]string // 迁移任务
+	versions   map[string]string // 成员支持的日志版本
+	config     map[string]string // raft group统一的配置，见Cache.snapshotConfig
+}
+
+// Persist 在raft的后台goroutine中执行，不持有Cache的锁，读写请求不会被阻塞
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	snapshotBytes, err := s.proxy.Cache.Marshal()
-	if err != nil {
+	if err := writeSnapshot(sink, s.records, s.meta); err != nil {
 		sink.Cancel()
 		return err
 	}
 
-	if _, err := sink.Write(snapshotBytes); err != nil {
+	if err := sink.Close(); err != nil {
 		sink.Cancel()
 		return err
 	}
+	return nil
+}
 
-	if err := sink.Close(); err != nil {
-		sink.Cancel()
+func (s *snapshot) Release() {
+	s.records = nil
+	s.meta = snapshotMeta{}
+}
+
+// writeSnapshot 将records和meta按分块二进制格式写入w
+func writeSnapshot(w io.Writer, records []lru_k.Record, meta snapshotMeta) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotBinaryVersion)
+
+	var payload bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		payload.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+	}
+	putVarint := func(v int64) {
+		payload.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	flush := func(n int) error {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], uint64(n))])
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], uint64(payload.Len()))])
+		bw.Write(payload.Bytes())
+		binary.BigEndian.PutUint32(scratch[:4], crc32.ChecksumIEEE(payload.Bytes()))
+		_, err := bw.Write(scratch[:4])
+		payload.Reset()
 		return err
 	}
-	return nil
+
+	n := 0
+	for _, r := range records {
+		value := r.Value.GetBytes()
+		putUvarint(uint64(len(r.Key)))
+		payload.WriteString(r.Key)
+		payload.WriteByte(valueType(r.Value))
+		putUvarint(uint64(len(value)))
+		payload.Write(value)
+		putUvarint(uint64(r.Count))
+		var flags byte
+		if r.Active {
+			flags |= snapshotFlagActive
+		}
+		payload.WriteByte(flags)
+		putVarint(r.ExpireAt)
+		putVarint(r.Slide)
+
+		n++
+		if n == snapshotChunkEntries {
+			if err := flush(n); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+	if n > 0 {
+		if err := flush(n); err != nil {
+			return err
+		}
+	}
+	// entry数量为0的chunk表示结束
+	bw.WriteByte(0)
+
+	putString := func(v string) {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(v)))])
+		bw.WriteString(v)
+	}
+	putMap := func(m map[string]string) {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(m)))])
+		for k, v := range m {
+			putString(k)
+			putString(v)
+		}
+	}
+	putMap(meta.members)
+	bw.Write(scratch[:binary.PutUvarint(scratch[:], meta.applied)])
+	putMap(meta.migrations)
+	putMap(meta.versions)
+	putMap(meta.config)
+	return bw.Flush()
+}
+
+// readSnapshotMeta 读取records之后的状态机状态，旧版本的快照中没有的部分为零值
+func readSnapshotMeta(r *bufio.Reader, version byte) (snapshotMeta, error) {
+	var (
+		meta snapshotMeta
+		err  error
+	)
+	if version >= snapshotMembersVersion {
+		if meta.members, err = readSnapshotMap(r); err != nil {
+			return meta, err
+		}
+	}
+	if version >= snapshotAppliedVersion {
+		if meta.applied, err = binary.ReadUvarint(r); err != nil {
+			return meta, err
+		}
+	}
+	if version >= snapshotMigrationsVersion {
+		if meta.migrations, err = readSnapshotMap(r); err != nil {
+			return meta, err
+		}
+	}
+	if version >= snapshotVersionsVersion {
+		if meta.versions, err = readSnapshotMap(r); err != nil {
+			return meta, err
+		}
+	}
+	if version >= snapshotConfigVersion {
+		if meta.config, err = readSnapshotMap(r); err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
 }
 
-func (f *snapshot) Release() {}
+// readSnapshotMap 读取records之后的成员表、迁移任务、日志版本表或者配置
+func readSnapshotMap(r *bufio.Reader) (map[string]string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// n来自快照，先检查再分配，损坏的快照不能导致panic
+	if n > snapshotMaxMapEntries {
+		return nil, errSnapshotCorrupted
+	}
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if l > snapshotMaxString {
+			return "", errSnapshotCorrupted
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	m := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		v, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// readSnapshot 读取writeSnapshot写入的快照，r需要已经跳过header，version为header中的版本号
+func readSnapshot(r *bufio.Reader, version byte) ([]lru_k.Record, error) {
+	var records []lru_k.Record
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return records, nil
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > math.MaxInt64 {
+			return nil, errSnapshotCorrupted
+		}
+		// 按实际读到的数据增长，损坏的size不会一次分配过大的内存
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+			return nil, fmt.Errorf("%w: %v", errSnapshotCorrupted, err)
+		}
+		payload := buf.Bytes()
+		var sum [4]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(payload) {
+			return nil, errSnapshotCorrupted
+		}
+
+		chunk := bytes.NewReader(payload)
+		for i := uint64(0); i < n; i++ {
+			record, err := readSnapshotEntry(chunk, version)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errSnapshotCorrupted, err)
+			}
+			records = append(records, record)
+		}
+	}
+}
+
+func readSnapshotEntry(r *bytes.Reader, version byte) (lru_k.Record, error) {
+	var record lru_k.Record
+	readBytes := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+
+	key, err := readBytes()
+	if err != nil {
+		return record, err
+	}
+	typ := TypeString
+	if version > snapshotStringVersion {
+		if typ, err = r.ReadByte(); err != nil {
+			return record, err
+		}
+	}
+	data, err := readBytes()
+	if err != nil {
+		return record, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return record, err
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return record, err
+	}
+	expireAt, err := binary.ReadVarint(r)
+	if err != nil {
+		return record, err
+	}
+	slide, err := binary.ReadVarint(r)
+	if err != nil {
+		return record, err
+	}
+
+	value, err := decodeValue(typ, data)
+	if err != nil {
+		return record, err
+	}
+
+	record.Key = string(key)
+	record.Value = value
+	record.Count = int(count)
+	record.Active = flags&snapshotFlagActive != 0
+	record.ExpireAt = expireAt
+	record.Slide = slide
+	return record, nil
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// zsetMemberOverhead 每个成员除内容以外计入的字节数：dict中的字符串头和score，
+// 以及跳表节点的开销(平均层数按4/3估算)
+const zsetMemberOverhead = int(unsafe.Sizeof("")+unsafe.Sizeof(float64(0))) + int(unsafe.Sizeof(skiplistNode{})) + 2*int(unsafe.Sizeof(skiplistLevel{}))
+
+// zset 有序集合，dict记录成员的score，跳表按score排序，对应redis的sorted set类型
+type zset struct {
+	cow
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+// ZMember 有序集合中的一个成员
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func newZSet() *zset {
+	return &zset{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+func (z *zset) Type() byte {
+	return TypeZSet
+}
+
+func (z *zset) Len() int {
+	return len(z.dict)
+}
+
+func (z *zset) memSize() int {
+	size := 0
+	for m := range z.dict {
+		size += len(m) + zsetMemberOverhead
+	}
+	return size
+}
+
+func (z *zset) clone() object {
+	n := newZSet()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		n.add(x.member, x.score)
+	}
+	return n
+}
+
+// encode 编码格式: 成员数量(uvarint) | 每个成员: 长度(uvarint) | 内容 | score(float64, 8 bytes)，按排序顺序
+func (z *zset) encode() []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(z.dict)))])
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(x.member)))])
+		buf.WriteString(x.member)
+		binary.BigEndian.PutUint64(scratch[:8], math.Float64bits(x.score))
+		buf.Write(scratch[:8])
+	}
+	return buf.Bytes()
+}
+
+func decodeZSet(data []byte) (object, error) {
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	z := newZSet()
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		// 先比较size本身，size+8在size接近uint64上限时会溢出
+		if size > uint64(r.Len()) || size+8 > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, size+8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		z.add(string(b[:size]), math.Float64frombits(binary.BigEndian.Uint64(b[size:])))
+	}
+	return z, nil
+}
+
+// add 加入或更新成员，返回是否是新成员
+func (z *zset) add(member string, score float64) bool {
+	old, ok := z.dict[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+	return !ok
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+// ScoreRange score的区间，MinEx/MaxEx为true表示不包含端点
+type ScoreRange struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	if r.MinEx {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	if r.MaxEx {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// ParseScoreRange 解析redis风格的score区间，支持-inf、+inf以及用"("前缀表示的开区间
+func ParseScoreRange(min, max string) (ScoreRange, error) {
+	var r ScoreRange
+	var err error
+	if r.Min, r.MinEx, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.Max, r.MaxEx, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	score, err := ParseScore(s)
+	return score, exclusive, err
+}
+
+// ParseScore 解析score，支持inf，不允许NaN
+func ParseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("value is not a valid float: %q", s)
+	}
+	return score, nil
+}
+
+/*
+*
+下面几个写操作由FSM.Apply调用，now取自raft日志中的时间戳
+*/
+
+// ZAdd 向有序集合中加入成员或者更新已有成员的score，返回新加入的数量
+func (c *Cache) ZAdd(key string, members []ZMember, now int64) (int, error) {
+	added := 0
+	err := c.update(key, TypeZSet, now, true, func(o object) (int, func(), error) {
+		z := o.(*zset)
+		fresh := make(map[string]struct{})
+		delta := 0
+		for _, m := range members {
+			if _, ok := z.dict[m.Member]; ok {
+				continue
+			}
+			if _, ok := fresh[m.Member]; ok {
+				continue
+			}
+			fresh[m.Member] = struct{}{}
+			delta += len(m.Member) + zsetMemberOverhead
+		}
+		return delta, func() {
+			for _, m := range members {
+				z.add(m.Member, m.Score)
+			}
+			added = len(fresh)
+		}, nil
+	})
+	return added, err
+}
+
+// ZRem 从有序集合中删除若干个成员，返回实际删除的数量
+func (c *Cache) ZRem(key string, members []string, now int64) (int, error) {
+	removed := 0
+	err := c.update(key, TypeZSet, now, false, func(o object) (int, func(), error) {
+		z := o.(*zset)
+		gone := make(map[string]struct{})
+		delta := 0
+		for _, m := range members {
+			if _, ok := z.dict[m]; !ok {
+				continue
+			}
+			if _, ok := gone[m]; ok {
+				continue
+			}
+			gone[m] = struct{}{}
+			delta -= len(m) + zsetMemberOverhead
+		}
+		if len(gone) == 0 {
+			return 0, nil, nil
+		}
+		return delta, func() {
+			for m := range gone {
+				z.remove(m)
+			}
+			removed = len(gone)
+		}, nil
+	})
+	return removed, err
+}
+
+// ZScore 返回成员的score
+func (c *Cache) ZScore(key string, member string) (score float64, ok bool, err error) {
+	err = c.view(key, TypeZSet, func(o object) {
+		score, ok = o.(*zset).dict[member]
+	})
+	return
+}
+
+// ZRank 返回成员按score升序从0开始的排名
+func (c *Cache) ZRank(key string, member string) (rank int, ok bool, err error) {
+	err = c.view(key, TypeZSet, func(o object) {
+		z := o.(*zset)
+		var score float64
+		if score, ok = z.dict[member]; ok {
+			rank = z.zsl.rank(score, member) - 1
+		}
+	})
+	return
+}
+
+// ZRange 返回按score升序排名在[start, stop]之间的成员，下标规则和LRange一致
+func (c *Cache) ZRange(key string, start, stop int64) ([]ZMember, error) {
+	members := []ZMember{}
+	err := c.view(key, TypeZSet, func(o object) {
+		z := o.(*zset)
+		from, to := rangeIndex(start, stop, z.Len())
+		if from == to {
+			return
+		}
+		for x := z.zsl.byRank(from + 1); x != nil && len(members) < to-from; x = x.level[0].forward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	})
+	return members, err
+}
+
+// ZRangeByScore 返回score在区间r内的成员，按score升序排列
+func (c *Cache) ZRangeByScore(key string, r ScoreRange) ([]ZMember, error) {
+	members := []ZMember{}
+	err := c.view(key, TypeZSet, func(o object) {
+		for x := o.(*zset).zsl.firstInRange(r); x != nil && r.belowMax(x.score); x = x.level[0].forward {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+		}
+	})
+	return members, err
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	zsl := newSkiplist()
+	var members []ZMember
+	for i := 0; i < 1000; i++ {
+		m := ZMember{Member: strconv.Itoa(i), Score: float64(rand.Intn(100))}
+		members = append(members, m)
+		zsl.insert(m.Score, m.Member)
+	}
+	for i := 0; i < 500; i++ {
+		if !zsl.delete(members[i].Score, members[i].Member) {
+			t.Fatalf("delete %v failed", members[i])
+		}
+	}
+	members = members[500:]
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Score < members[j].Score ||
+			(members[i].Score == members[j].Score && members[i].Member < members[j].Member)
+	})
+
+	if zsl.length != len(members) {
+		t.Fatalf("got length %d; want %d", zsl.length, len(members))
+	}
+	for i, m := range members {
+		if rank := zsl.rank(m.Score, m.Member); rank != i+1 {
+			t.Fatalf("got rank %d for %v; want %d", rank, m, i+1)
+		}
+		if x := zsl.byRank(i + 1); x.member != m.Member {
+			t.Fatalf("got %s at rank %d; want %s", x.member, i+1, m.Member)
+		}
+	}
+	if zsl.delete(-1, "missing") {
+		t.Fatal("expected delete of missing member to fail")
+	}
+}
+
+func TestZSet(t *testing.T) {
+	c := newTestCache()
+	members := []ZMember{{"a", 3}, {"b", 1}, {"c", 2}, {"d", 2}}
+	if n, _ := c.ZAdd("z", members, 0); n != 4 {
+		t.Fatalf("got ZAdd %d; want 4", n)
+	}
+	// 更新已有成员的score不计入新增数量
+	if n, _ := c.ZAdd("z", []ZMember{{"a", 0}}, 0); n != 0 {
+		t.Fatalf("got ZAdd %d; want 0", n)
+	}
+	if got, _ := c.ZRange("z", 0, -1); !reflect.DeepEqual(got, []ZMember{{"a", 0}, {"b", 1}, {"c", 2}, {"d", 2}}) {
+		t.Fatalf("got %v", got)
+	}
+	if rank, ok, _ := c.ZRank("z", "c"); !ok || rank != 2 {
+		t.Fatalf("got rank %d; want 2", rank)
+	}
+	r, _ := ParseScoreRange("(1", "+inf")
+	if got, _ := c.ZRangeByScore("z", r); !reflect.DeepEqual(got, []ZMember{{"c", 2}, {"d", 2}}) {
+		t.Fatalf("got %v", got)
+	}
+	if n, _ := c.ZRem("z", []string{"a", "a", "x"}, 0); n != 1 {
+		t.Fatalf("got ZRem %d; want 1", n)
+	}
+	if score, ok, _ := c.ZScore("z", "d"); !ok || score != 2 {
+		t.Fatalf("got score %v; want 2", score)
+	}
+
+	decoded, err := decodeZSet(c.segment("z").lru.Records()[0].Value.GetBytes())
+	if err != nil || decoded.Len() != 3 {
+		t.Fatalf("decode failed: %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := newTestCache()
+	c.SAdd("s1", []string{"a", "b", "c"}, 0)
+	if n, _ := c.SAdd("s2", []string{"b", "c", "d", "d"}, 0); n != 3 {
+		t.Fatalf("got SAdd %d; want 3", n)
+	}
+	if got, _ := c.SInter([]string{"s1", "s2"}); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("got SInter %v", got)
+	}
+	if got, _ := c.SInter([]string{"s1", "missing"}); len(got) != 0 {
+		t.Fatalf("got SInter %v; want empty", got)
+	}
+	if got, _ := c.SUnion([]string{"s1", "s2"}); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("got SUnion %v", got)
+	}
+	if n, _ := c.SRem("s1", []string{"a", "x"}, 0); n != 1 {
+		t.Fatalf("got SRem %d; want 1", n)
+	}
+	if ok, _ := c.SIsMember("s1", "a"); ok {
+		t.Fatal("expected a to be removed")
+	}
+	if got, _ := c.SMembers("s1"); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("got SMembers %v", got)
+	}
+}
@@ -0,0 +1,345 @@
+// Package client 是gedis的Go客户端。
+//
+// 客户端从任意一个节点获取集群的一致性hash环，把每个key直接发送给负责它的分片，
+// 节点返回key不属于它(421)或者不是leader(503)时重新获取hash环并重试
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultRetries      = 3
+	DefaultRetryBackoff = 50 * time.Millisecond
+	DefaultMaxIdleConns = 64
+
+	// forwardedHeader 告诉节点不要再转发请求，key不属于它时直接返回421，客户端据此刷新hash环
+	forwardedHeader = "X-Gedis-Forwarded"
+	// epochHeader 请求中是客户端hash环的epoch，421响应中是节点hash环的epoch
+	epochHeader = "X-Gedis-Epoch"
+	// ownerHeader 421响应中节点认为负责key的节点，客户端优先从它获取hash环
+	ownerHeader = "X-Gedis-Owner"
+)
+
+// ErrNotFound key、field或者成员不存在，BLPop超时也返回ErrNotFound
+var ErrNotFound = errors.New("gedis: not found")
+
+// ErrNoKeys 多个key的命令没有传入key
+var ErrNoKeys = errors.New("gedis: no keys")
+
+// Error 是节点返回的错误，Code是/v1接口中的错误码，旧接口的错误没有Code
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("gedis: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("gedis: %s (%d)", e.Message, e.StatusCode)
+}
+
+type Client struct {
+	seeds   []string
+	http    *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	mutex sync.RWMutex
+	ring  *consistenthash.Map
+}
+
+type Option func(*Client)
+
+// WithTimeout 设置每次请求的超时时间，阻塞命令会在此基础上加上阻塞的时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries 设置请求因为路由错误或者网络错误失败后最多重试的次数
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// WithRetryBackoff 设置第一次重试前等待的时间，之后每次翻倍
+func WithRetryBackoff(backoff time.Duration) Option {
+	return func(c *Client) {
+		c.backoff = backoff
+	}
+}
+
+// WithMaxIdleConns 设置连接池中每个节点保持的空闲连接数
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) {
+		c.http.Transport.(*http.Transport).MaxIdleConnsPerHost = n
+	}
+}
+
+// WithHTTPClient 使用自定义的http.Client，会覆盖WithMaxIdleConns
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// New 创建客户端，seeds是任意几个节点的http地址，例如127.0.0.1:8000，
+// 创建时从seeds获取一次hash环，都不可用时返回错误
+func New(seeds []string, opts ...Option) (*Client, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("gedis: no seed address")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConns
+	c := &Client{
+		seeds:   seeds,
+		http:    &http.Client{Transport: transport},
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+		backoff: DefaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close 关闭连接池中的空闲连接
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// Refresh 依次向已知的节点和seeds获取hash环，成功一个即返回
+func (c *Client) Refresh(ctx context.Context) error {
+	return c.refresh(ctx, "")
+}
+
+// refresh 先向hint获取hash环，hint是421响应中负责key的节点，它的hash环通常比较新
+func (c *Client) refresh(ctx context.Context, hint string) error {
+	addrs := c.candidates()
+	if hint != "" {
+		addrs = append([]string{hint}, addrs...)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		ring, err := c.fetchRing(ctx, addr)
+		if err == nil {
+			c.mutex.Lock()
+			c.ring = ring
+			c.mutex.Unlock()
+			return nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("gedis: refresh ring failed: %w", lastErr)
+}
+
+// candidates 返回获取hash环时尝试的节点，先是当前hash环中的节点，再是seeds
+func (c *Client) candidates() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	c.mutex.RLock()
+	if c.ring != nil {
+		for _, peer := range c.ring.GetPeers() {
+			for _, addr := range c.ring.Members(peer) {
+				if !seen[addr] {
+					seen[addr] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	c.mutex.RUnlock()
+	for _, addr := range c.seeds {
+		if !seen[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (c *Client) fetchRing(ctx context.Context, addr string) (*consistenthash.Map, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/v1/cluster/ring", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get ring from %s: status %d", addr, resp.StatusCode)
+	}
+	var ring consistenthash.Map
+	if err := json.NewDecoder(resp.Body).Decode(&ring); err != nil {
+		return nil, err
+	}
+	if len(ring.Keys) == 0 {
+		return nil, fmt.Errorf("get ring from %s: empty ring", addr)
+	}
+	ring.Hash = consistenthash.Murmur3
+	return &ring, nil
+}
+
+// owner 返回第attempt次尝试时把key发送给哪个节点。hash环上的节点是分片组时，
+// 每次重试换分片组中的下一个节点，分片组的节点把写请求交给leader
+func (c *Client) owner(key string, attempt int) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	members := c.ring.Members(c.ring.Get(key))
+	return members[attempt%len(members)]
+}
+
+// epoch 返回当前hash环的epoch
+func (c *Client) epoch() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.ring.Epoch
+}
+
+// response 是读完响应体之后的结果
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// request 描述一次发送给节点的请求，target根据节点地址构造请求
+type request struct {
+	key        string
+	idempotent bool          // 幂等的请求在网络错误后也可以重试
+	extra      time.Duration // 阻塞命令额外等待的时间
+	target     func(ctx context.Context, addr string) (*http.Request, error)
+}
+
+// do 把请求发送给负责key的节点，路由错误时刷新hash环后重试，幂等的请求在网络错误后也会重试
+func (c *Client) do(ctx context.Context, r request) (*response, error) {
+	var (
+		lastErr error
+		hint    string
+	)
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+			if err := c.refresh(ctx, hint); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		resp, err := c.send(ctx, c.owner(r.key, attempt), r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !r.idempotent && !isDialError(err) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if shouldRefresh(resp.status) {
+			lastErr = parseError(resp)
+			hint = resp.header.Get(ownerHeader)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func (c *Client) send(ctx context.Context, addr string, r request) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout+r.extra)
+	defer cancel()
+	req, err := r.target(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(forwardedHeader, "client")
+	req.Header.Set(epochHeader, strconv.FormatUint(c.epoch(), 10))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &response{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// sleep 第attempt次重试前等待，等待时间按指数增长
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(c.backoff << (attempt - 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shouldRefresh 判断是否是路由错误：key不属于这个节点或者这个节点不是leader，请求没有被执行
+func shouldRefresh(status int) bool {
+	return status == http.StatusMisdirectedRequest || status == http.StatusServiceUnavailable
+}
+
+// isDialError 连接没有建立起来，请求一定没有被执行，非幂等的请求也可以重试
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseError 把非2xx的响应转换为错误，/v1接口返回json格式的错误，旧接口返回文本
+func parseError(resp *response) error {
+	var v1 struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(resp.body, &v1) == nil && v1.Error.Code != "" {
+		if v1.Error.Code == "not_found" {
+			return ErrNotFound
+		}
+		return &Error{StatusCode: resp.status, Code: v1.Error.Code, Message: v1.Error.Message}
+	}
+	if resp.status == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+}
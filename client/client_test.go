@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCluster 模拟若干个节点，节点按当前的hash环判断key是否属于自己
+type fakeCluster struct {
+	mutex sync.Mutex
+	ring  *consistenthash.Map
+	nodes map[string]*fakeNode
+}
+
+type fakeNode struct {
+	addr  string
+	data  map[string]string
+	hits  int
+	epoch string // 最近一次请求中客户端hash环的epoch
+}
+
+func newFakeCluster(t *testing.T, n int) (*fakeCluster, []string) {
+	c := &fakeCluster{nodes: make(map[string]*fakeNode)}
+	var addrs []string
+	for i := 0; i < n; i++ {
+		node := &fakeNode{data: make(map[string]string)}
+		server := httptest.NewServer(c.handler(node))
+		t.Cleanup(server.Close)
+		node.addr = strings.TrimPrefix(server.URL, "http://")
+		c.nodes[node.addr] = node
+		addrs = append(addrs, node.addr)
+	}
+	c.setRing(addrs...)
+	return c, addrs
+}
+
+func (c *fakeCluster) setRing(addrs ...string) {
+	ring := consistenthash.New(50, consistenthash.Murmur3)
+	ring.Add(addrs...)
+	c.mutex.Lock()
+	if c.ring != nil {
+		ring.Epoch = c.ring.Epoch + 1
+	}
+	c.ring = ring
+	c.mutex.Unlock()
+}
+
+func (c *fakeCluster) handler(node *fakeNode) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/cluster/ring", func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		json.NewEncoder(w).Encode(c.ring)
+	})
+	mux.HandleFunc("/v1/keys/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		node.hits++
+		node.epoch = r.Header.Get(epochHeader)
+		if owner := c.ring.Get(key); owner != node.addr {
+			w.Header().Set(epochHeader, strconv.FormatUint(c.ring.Epoch, 10))
+			w.Header().Set(ownerHeader, owner)
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			w.Write([]byte(`{"error":{"code":"wrong_node","message":"wrong node"}}`))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := node.data[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"code":"not_found","message":"key not found"}}`))
+				return
+			}
+			w.Write([]byte(value))
+		case http.MethodPut:
+			value, _ := io.ReadAll(r.Body)
+			node.data[key] = string(value)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/v1/mget", func(w http.ResponseWriter, r *http.Request) {
+		var req batchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		results := make([]map[string]interface{}, len(req.Keys))
+		for i, key := range req.Keys {
+			value, ok := node.data[key]
+			results[i] = map[string]interface{}{"key": key, "value": []byte(value), "found": ok}
+			if c.ring.Get(key) != node.addr {
+				results[i] = map[string]interface{}{"key": key, "error": map[string]string{"code": "wrong_node", "message": "wrong node"}}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	mux.HandleFunc("/incr", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1\n"))
+	})
+	mux.HandleFunc("/hset", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("param error\n"))
+	})
+	return mux
+}
+
+func TestRouting(t *testing.T) {
+	cluster, addrs := newFakeCluster(t, 3)
+	c, err := New(addrs[:1], WithRetryBackoff(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "中文", "a/b c"} {
+		if err := c.Set(ctx, key, []byte("v-"+key), 0); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+		value, err := c.Get(ctx, key)
+		if err != nil || string(value) != "v-"+key {
+			t.Fatalf("get %s: %q %v", key, value, err)
+		}
+	}
+	// 每个请求都直接发给了负责的节点
+	for addr, node := range cluster.nodes {
+		if node.hits != 2*len(node.data) {
+			t.Errorf("node %s: %d hits for %d keys", addr, node.hits, len(node.data))
+		}
+	}
+
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get missing: %v", err)
+	}
+	if n, err := c.Incr(ctx, "counter"); n != 1 || err != nil {
+		t.Errorf("incr: %d %v", n, err)
+	}
+	var e *Error
+	if _, err := c.HSet(ctx, "hash", map[string]string{"f": "v"}); !errors.As(err, &e) || e.Message != "param error" {
+		t.Errorf("hset: %v", err)
+	}
+}
+
+func TestRefreshOnWrongNode(t *testing.T) {
+	cluster, addrs := newFakeCluster(t, 2)
+	cluster.setRing(addrs[0])
+	c, err := New(addrs[:1], WithRetryBackoff(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 扩容后客户端的hash环过期，节点返回421后客户端刷新hash环并重试
+	cluster.setRing(addrs...)
+	ctx := context.Background()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if err := c.Set(ctx, key, []byte(key), 0); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	if len(cluster.nodes[addrs[1]].data) == 0 {
+		t.Fatal("no key routed to the new node")
+	}
+	// 刷新后的请求带着新hash环的epoch
+	if got, want := cluster.nodes[addrs[1]].epoch, strconv.FormatUint(cluster.ring.Epoch, 10); got != want {
+		t.Errorf("got epoch %q; want %s", got, want)
+	}
+
+	cluster.setRing(addrs[1])
+	results, err := c.MGet(ctx, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Key != keys[i] || r.Err != nil {
+			t.Errorf("mget %s: %+v", keys[i], r)
+		}
+		_, ok := cluster.nodes[addrs[1]].data[r.Key]
+		if r.Found != ok || (ok && string(r.Value) != r.Key) {
+			t.Errorf("mget %s: %+v", keys[i], r)
+		}
+	}
+}
+
+func TestNewWithoutSeeds(t *testing.T) {
+	if _, err := New(nil); err == nil {
+		t.Error("expected error without seeds")
+	}
+	if _, err := New([]string{"127.0.0.1:1"}, WithRetries(0), WithTimeout(100*time.Millisecond)); err == nil {
+		t.Error("expected error with unreachable seed")
+	}
+}
+
+func TestMultiKeyCommandsWithoutKeys(t *testing.T) {
+	_, addrs := newFakeCluster(t, 1)
+	c, err := New(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := c.BLPop(ctx, time.Second); err != ErrNoKeys {
+		t.Errorf("blpop: %v", err)
+	}
+	if _, err := c.BRPop(ctx, time.Second); err != ErrNoKeys {
+		t.Errorf("brpop: %v", err)
+	}
+	if _, err := c.SInter(ctx); err != ErrNoKeys {
+		t.Errorf("sinter: %v", err)
+	}
+	if _, err := c.SUnion(ctx); err != ErrNoKeys {
+		t.Errorf("sunion: %v", err)
+	}
+}
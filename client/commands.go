@@ -0,0 +1,416 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command 把命令发送给负责key的节点，参数放在query中，返回200的响应
+func (c *Client) command(ctx context.Context, path string, key string, query url.Values, idempotent bool, extra time.Duration) (*response, error) {
+	resp, err := c.do(ctx, request{
+		key:        key,
+		idempotent: idempotent,
+		extra:      extra,
+		target: func(ctx context.Context, addr string) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path+"?"+query.Encode(), nil)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, parseError(resp)
+	}
+	return resp, nil
+}
+
+// keyQuery 返回只有key参数的query
+func keyQuery(key string) url.Values {
+	return url.Values{"key": {key}}
+}
+
+// intReply 解析整数的响应，参数错误等情况下节点返回200和错误信息
+func intReply(resp *response) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(string(resp.body)), 10, 64)
+	if err != nil {
+		return 0, &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+	}
+	return n, nil
+}
+
+func jsonReply(resp *response, v interface{}) error {
+	if err := json.Unmarshal(resp.body, v); err != nil {
+		return &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+	}
+	return nil
+}
+
+func (c *Client) intCommand(ctx context.Context, path string, key string, query url.Values, idempotent bool) (int64, error) {
+	resp, err := c.command(ctx, path, key, query, idempotent, 0)
+	if err != nil {
+		return 0, err
+	}
+	return intReply(resp)
+}
+
+func (c *Client) jsonCommand(ctx context.Context, path string, key string, query url.Values, v interface{}) error {
+	resp, err := c.command(ctx, path, key, query, true, 0)
+	if err != nil {
+		return err
+	}
+	return jsonReply(resp, v)
+}
+
+/*
+*
+过期时间
+*/
+
+// Expire 为key设置存活时间，key不存在时返回false
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	query := keyQuery(key)
+	query.Set("px", strconv.FormatInt(ttl.Milliseconds(), 10))
+	n, err := c.intCommand(ctx, "/expire", key, query, true)
+	return n == 1, err
+}
+
+// Persist 移除key的存活时间，key不存在或者没有存活时间时返回false
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	n, err := c.intCommand(ctx, "/persist", key, keyQuery(key), true)
+	return n == 1, err
+}
+
+// TTL 返回key剩余的存活时间(精确到秒)，没有存活时间时返回-1，key不存在时返回ErrNotFound
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	n, err := c.intCommand(ctx, "/ttl", key, keyQuery(key), true)
+	switch {
+	case err != nil:
+		return 0, err
+	case n == -2:
+		return 0, ErrNotFound
+	case n == -1:
+		return -1, nil
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+/*
+*
+计数器
+*/
+
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.intCommand(ctx, "/incr", key, keyQuery(key), false)
+}
+
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.intCommand(ctx, "/decr", key, keyQuery(key), false)
+}
+
+func (c *Client) IncrBy(ctx context.Context, key string, incr int64) (int64, error) {
+	query := keyQuery(key)
+	query.Set("incr", strconv.FormatInt(incr, 10))
+	return c.intCommand(ctx, "/incrby", key, query, false)
+}
+
+func (c *Client) DecrBy(ctx context.Context, key string, decr int64) (int64, error) {
+	query := keyQuery(key)
+	query.Set("decr", strconv.FormatInt(decr, 10))
+	return c.intCommand(ctx, "/decrby", key, query, false)
+}
+
+func (c *Client) IncrByFloat(ctx context.Context, key string, incr float64) (float64, error) {
+	query := keyQuery(key)
+	query.Set("incr", strconv.FormatFloat(incr, 'g', -1, 64))
+	resp, err := c.command(ctx, "/incrbyfloat", key, query, false, 0)
+	if err != nil {
+		return 0, err
+	}
+	return floatReply(resp)
+}
+
+func floatReply(resp *response) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(resp.body)), 64)
+	if err != nil {
+		return 0, &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+	}
+	return f, nil
+}
+
+/*
+*
+hash
+*/
+
+// HSet 设置hash的field，返回新增的field数量
+func (c *Client) HSet(ctx context.Context, key string, fields map[string]string) (int64, error) {
+	query := keyQuery(key)
+	for field, value := range fields {
+		query.Add("field", field)
+		query.Add("value", value)
+	}
+	return c.intCommand(ctx, "/hset", key, query, true)
+}
+
+// HGet 返回field的值，field不存在时返回ErrNotFound
+func (c *Client) HGet(ctx context.Context, key string, field string) (string, error) {
+	query := keyQuery(key)
+	query.Set("field", field)
+	resp, err := c.command(ctx, "/hget", key, query, true, 0)
+	if err != nil {
+		return "", err
+	}
+	return string(resp.body), nil
+}
+
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	fields := map[string]string{}
+	err := c.jsonCommand(ctx, "/hgetall", key, keyQuery(key), &fields)
+	return fields, err
+}
+
+// HDel 删除field，返回删除的数量
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	query := keyQuery(key)
+	query["field"] = fields
+	return c.intCommand(ctx, "/hdel", key, query, true)
+}
+
+func (c *Client) HIncrBy(ctx context.Context, key string, field string, incr int64) (int64, error) {
+	query := keyQuery(key)
+	query.Set("field", field)
+	query.Set("incr", strconv.FormatInt(incr, 10))
+	return c.intCommand(ctx, "/hincrby", key, query, false)
+}
+
+func (c *Client) HLen(ctx context.Context, key string) (int64, error) {
+	return c.intCommand(ctx, "/hlen", key, keyQuery(key), true)
+}
+
+/*
+*
+list
+*/
+
+// LPush 依次把values插入list头部，返回插入后list的长度
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.push(ctx, "/lpush", key, values)
+}
+
+// RPush 依次把values追加到list尾部，返回追加后list的长度
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.push(ctx, "/rpush", key, values)
+}
+
+func (c *Client) push(ctx context.Context, path string, key string, values []string) (int64, error) {
+	query := keyQuery(key)
+	query["value"] = values
+	return c.intCommand(ctx, path, key, query, false)
+}
+
+// LPop 弹出list头部的元素，list为空时返回ErrNotFound
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "/lpop", key)
+}
+
+// RPop 弹出list尾部的元素，list为空时返回ErrNotFound
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "/rpop", key)
+}
+
+func (c *Client) pop(ctx context.Context, path string, key string) (string, error) {
+	resp, err := c.command(ctx, path, key, keyQuery(key), false, 0)
+	if err != nil {
+		return "", err
+	}
+	return string(resp.body), nil
+}
+
+// PopResult 是阻塞弹出的结果，Key是弹出元素所在的key
+type PopResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// BLPop 从第一个非空的list头部弹出元素，都为空时阻塞等待，timeout为0表示一直等待，
+// 超时返回ErrNotFound。所有key必须属于同一个分片
+func (c *Client) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (*PopResult, error) {
+	return c.blockingPop(ctx, "/blpop", timeout, keys)
+}
+
+// BRPop 和BLPop一样，从list尾部弹出
+func (c *Client) BRPop(ctx context.Context, timeout time.Duration, keys ...string) (*PopResult, error) {
+	return c.blockingPop(ctx, "/brpop", timeout, keys)
+}
+
+func (c *Client) blockingPop(ctx context.Context, path string, timeout time.Duration, keys []string) (*PopResult, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	query := url.Values{"key": keys}
+	query.Set("timeout", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	extra := timeout
+	if timeout == 0 {
+		// 一直等待，只受ctx控制
+		extra = 1<<63 - 1 - c.timeout
+	}
+	resp, err := c.command(ctx, path, keys[0], query, false, extra)
+	if err != nil {
+		return nil, err
+	}
+	ret := &PopResult{}
+	return ret, jsonReply(resp, ret)
+}
+
+// LRange 返回list中[start, stop]之间的元素，负数下标表示从末尾倒数
+func (c *Client) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	query := keyQuery(key)
+	query.Set("start", strconv.FormatInt(start, 10))
+	query.Set("stop", strconv.FormatInt(stop, 10))
+	var values []string
+	err := c.jsonCommand(ctx, "/lrange", key, query, &values)
+	return values, err
+}
+
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return c.intCommand(ctx, "/llen", key, keyQuery(key), true)
+}
+
+// LTrim 只保留list中[start, stop]之间的元素
+func (c *Client) LTrim(ctx context.Context, key string, start, stop int64) error {
+	query := keyQuery(key)
+	query.Set("start", strconv.FormatInt(start, 10))
+	query.Set("stop", strconv.FormatInt(stop, 10))
+	resp, err := c.command(ctx, "/ltrim", key, query, true, 0)
+	if err != nil {
+		return err
+	}
+	if body := strings.TrimSpace(string(resp.body)); body != "ok" {
+		return &Error{StatusCode: resp.status, Message: body}
+	}
+	return nil
+}
+
+/*
+*
+set
+*/
+
+// SAdd 添加成员，返回新增的成员数量
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.members(ctx, "/sadd", key, members)
+}
+
+// SRem 删除成员，返回删除的成员数量
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.members(ctx, "/srem", key, members)
+}
+
+func (c *Client) members(ctx context.Context, path string, key string, members []string) (int64, error) {
+	query := keyQuery(key)
+	query["member"] = members
+	return c.intCommand(ctx, path, key, query, true)
+}
+
+// SMembers 返回set的所有成员，按字典序排列
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := c.jsonCommand(ctx, "/smembers", key, keyQuery(key), &members)
+	return members, err
+}
+
+func (c *Client) SIsMember(ctx context.Context, key string, member string) (bool, error) {
+	query := keyQuery(key)
+	query.Set("member", member)
+	n, err := c.intCommand(ctx, "/sismember", key, query, true)
+	return n == 1, err
+}
+
+// SInter 返回多个set的交集，所有key必须属于同一个分片
+func (c *Client) SInter(ctx context.Context, keys ...string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	var members []string
+	err := c.jsonCommand(ctx, "/sinter", keys[0], url.Values{"key": keys}, &members)
+	return members, err
+}
+
+// SUnion 返回多个set的并集，所有key必须属于同一个分片
+func (c *Client) SUnion(ctx context.Context, keys ...string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	var members []string
+	err := c.jsonCommand(ctx, "/sunion", keys[0], url.Values{"key": keys}, &members)
+	return members, err
+}
+
+/*
+*
+sorted set
+*/
+
+// Z 是sorted set的成员
+type Z struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ZAdd 添加成员或者更新成员的score，返回新增的成员数量
+func (c *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	query := keyQuery(key)
+	for _, m := range members {
+		query.Add("score", strconv.FormatFloat(m.Score, 'g', -1, 64))
+		query.Add("member", m.Member)
+	}
+	return c.intCommand(ctx, "/zadd", key, query, true)
+}
+
+// ZRem 删除成员，返回删除的成员数量
+func (c *Client) ZRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.members(ctx, "/zrem", key, members)
+}
+
+// ZScore 返回成员的score，成员不存在时返回ErrNotFound
+func (c *Client) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	query := keyQuery(key)
+	query.Set("member", member)
+	resp, err := c.command(ctx, "/zscore", key, query, true, 0)
+	if err != nil {
+		return 0, err
+	}
+	return floatReply(resp)
+}
+
+// ZRank 返回成员按score升序从0开始的排名，成员不存在时返回ErrNotFound
+func (c *Client) ZRank(ctx context.Context, key string, member string) (int64, error) {
+	query := keyQuery(key)
+	query.Set("member", member)
+	return c.intCommand(ctx, "/zrank", key, query, true)
+}
+
+// ZRange 返回按score升序排名在[start, stop]之间的成员
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	query := keyQuery(key)
+	query.Set("start", strconv.FormatInt(start, 10))
+	query.Set("stop", strconv.FormatInt(stop, 10))
+	var members []Z
+	err := c.jsonCommand(ctx, "/zrange", key, query, &members)
+	return members, err
+}
+
+// ZRangeByScore 返回score在[min, max]之间的成员，和redis一样用(表示开区间，-inf和+inf表示无穷
+func (c *Client) ZRangeByScore(ctx context.Context, key string, min, max string) ([]Z, error) {
+	query := keyQuery(key)
+	query.Set("min", min)
+	query.Set("max", max)
+	var members []Z
+	err := c.jsonCommand(ctx, "/zrangebyscore", key, query, &members)
+	return members, err
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keyPath 返回key在/v1/keys接口中的路径
+func keyPath(key string) string {
+	return "/v1/keys/" + url.PathEscape(key)
+}
+
+// keyRequest 构造/v1/keys/{key}的请求
+func keyRequest(method string, key string, query url.Values, body []byte) func(ctx context.Context, addr string) (*http.Request, error) {
+	return func(ctx context.Context, addr string) (*http.Request, error) {
+		u := "http://" + addr + keyPath(key)
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		return http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	}
+}
+
+// Get 读取字符串类型的key，key不存在时返回ErrNotFound
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, request{key: key, idempotent: true, target: keyRequest(http.MethodGet, key, nil, nil)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, parseError(resp)
+	}
+	return resp.body, nil
+}
+
+// Exists 判断key是否存在，key可以是任意类型
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := c.do(ctx, request{key: key, idempotent: true, target: keyRequest(http.MethodHead, key, nil, nil)})
+	if err != nil {
+		return false, err
+	}
+	switch resp.status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusBadRequest:
+		// HEAD没有响应体，400只可能是key的类型不是字符串
+		return true, nil
+	}
+	return false, parseError(resp)
+}
+
+// Set 写入key，ttl为0表示永不过期
+func (c *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.set(ctx, key, value, ttl, false)
+}
+
+// SetSliding 写入滑动过期的key，每次读命中都会把过期时间顺延ttl
+func (c *Client) SetSliding(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.set(ctx, key, value, ttl, true)
+}
+
+func (c *Client) set(ctx context.Context, key string, value []byte, ttl time.Duration, sliding bool) error {
+	query := url.Values{}
+	if ttl > 0 {
+		query.Set("px", strconv.FormatInt(ttl.Milliseconds(), 10))
+		query.Set("sliding", strconv.FormatBool(sliding))
+	}
+	resp, err := c.do(ctx, request{key: key, idempotent: true, target: keyRequest(http.MethodPut, key, query, value)})
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusNoContent && resp.status != http.StatusOK {
+		return parseError(resp)
+	}
+	return nil
+}
+
+// Del 删除任意类型的key，返回key是否存在
+func (c *Client) Del(ctx context.Context, key string) (bool, error) {
+	resp, err := c.do(ctx, request{key: key, idempotent: true, target: keyRequest(http.MethodDelete, key, nil, nil)})
+	if err != nil {
+		return false, err
+	}
+	switch resp.status {
+	case http.StatusNoContent, http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, parseError(resp)
+}
+
+// Entry 是MSet写入的一个key
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Result 是批量命令中一个key的结果，Err不为nil表示这个key执行失败，
+// 批量命令中单个key的Error没有StatusCode
+type Result struct {
+	Key     string
+	Value   []byte
+	Found   bool // MGet
+	Deleted bool // MDel
+	Err     error
+}
+
+type batchRequest struct {
+	Keys    []string `json:"keys,omitempty"`
+	Entries []Entry  `json:"entries,omitempty"`
+	PX      int64    `json:"px,omitempty"`
+	Sliding bool     `json:"sliding,omitempty"`
+}
+
+type batchResult struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Found   bool   `json:"found"`
+	Deleted bool   `json:"deleted"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// MGet 读取多个key，结果和keys一一对应，key不存在时Found为false
+func (c *Client) MGet(ctx context.Context, keys ...string) ([]Result, error) {
+	return c.batch(ctx, "/v1/mget", keys, func(idx []int) batchRequest {
+		req := batchRequest{}
+		for _, i := range idx {
+			req.Keys = append(req.Keys, keys[i])
+		}
+		return req
+	})
+}
+
+// MSet 写入多个key，ttl对所有key生效，为0表示永不过期，同一个分片的key在一条raft日志中写入
+func (c *Client) MSet(ctx context.Context, entries []Entry, ttl time.Duration) ([]Result, error) {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return c.batch(ctx, "/v1/mset", keys, func(idx []int) batchRequest {
+		req := batchRequest{PX: ttl.Milliseconds()}
+		for _, i := range idx {
+			req.Entries = append(req.Entries, entries[i])
+		}
+		return req
+	})
+}
+
+// MDel 删除多个key，key存在时Deleted为true
+func (c *Client) MDel(ctx context.Context, keys ...string) ([]Result, error) {
+	return c.batch(ctx, "/v1/mdel", keys, func(idx []int) batchRequest {
+		req := batchRequest{}
+		for _, i := range idx {
+			req.Keys = append(req.Keys, keys[i])
+		}
+		return req
+	})
+}
+
+// batch 按负责的节点对keys分组，并发地把每组key发送给对应的节点。
+// 因为路由错误或者节点不可用而失败的key在刷新hash环后重新分组重试，
+// 重试次数用完后这些key的Err为最后一次的错误
+func (c *Client) batch(ctx context.Context, path string, keys []string, build func(idx []int) batchRequest) ([]Result, error) {
+	results := make([]Result, len(keys))
+	errs := make([]error, len(keys))
+	pending := make([]int, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0 && attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+			c.Refresh(ctx)
+		}
+
+		groups := make(map[string][]int)
+		for _, i := range pending {
+			owner := c.owner(keys[i], attempt)
+			groups[owner] = append(groups[owner], i)
+		}
+
+		var (
+			wg    sync.WaitGroup
+			mutex sync.Mutex
+			retry []int
+		)
+		for owner, idx := range groups {
+			wg.Add(1)
+			go func(owner string, idx []int) {
+				defer wg.Done()
+				failed := c.sendBatch(ctx, owner, path, idx, build(idx), results, errs)
+				mutex.Lock()
+				retry = append(retry, failed...)
+				mutex.Unlock()
+			}(owner, idx)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		pending = retry
+	}
+	for _, i := range pending {
+		results[i].Err = errs[i]
+	}
+	return results, nil
+}
+
+// sendBatch 把一组key发送给owner并填写结果，返回需要重试的key的下标
+func (c *Client) sendBatch(ctx context.Context, owner string, path string, idx []int, req batchRequest, results []Result, errs []error) []int {
+	fail := func(err error) []int {
+		for _, i := range idx {
+			errs[i] = err
+		}
+		return idx
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := c.send(ctx, owner, request{target: func(ctx context.Context, addr string) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, bytes.NewReader(body))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+		return httpReq, err
+	}})
+	if err != nil {
+		return fail(err)
+	}
+	if resp.status != http.StatusOK {
+		err := parseError(resp)
+		if shouldRefresh(resp.status) {
+			return fail(err)
+		}
+		for _, i := range idx {
+			results[i].Err = err
+		}
+		return nil
+	}
+
+	var ret struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(resp.body, &ret); err != nil {
+		return fail(err)
+	}
+	if len(ret.Results) != len(idx) {
+		return fail(&Error{StatusCode: resp.status, Message: "mismatched batch results"})
+	}
+
+	var retry []int
+	for j, i := range idx {
+		r := ret.Results[j]
+		results[i].Value, results[i].Found, results[i].Deleted = r.Value, r.Found, r.Deleted
+		if r.Error == nil {
+			continue
+		}
+		err := &Error{Code: r.Error.Code, Message: r.Error.Message}
+		switch r.Error.Code {
+		case "wrong_node", "not_leader", "peer_unavailable":
+			errs[i] = err
+			retry = append(retry, i)
+		default:
+			results[i].Err = err
+		}
+	}
+	return retry
+}
@@ -0,0 +1,53 @@
+// shardctrler 启动分片控制器的一个副本，三个副本组成控制器的raft group：
+//
+//	shardctrler -httpport 7001 -raftport 7101 -node ctrl1 -bootstrap
+//	shardctrler -httpport 7002 -raftport 7102 -node ctrl2 -joinaddr 127.0.0.1:7001
+//	shardctrler -httpport 7003 -raftport 7103 -node ctrl3 -joinaddr 127.0.0.1:7001
+package main
+
+import (
+	"flag"
+	"github.com/Emiliaab/gedis/shardctrler"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+func main() {
+	httpPort := flag.Int("httpport", 7001, "http tcp address port")
+	raftPort := flag.Int("raftport", 7101, "shard controller raft tcp address port")
+	nodeName := flag.String("node", "ctrl", "node name, raft data is stored in ./{node}")
+	bootstrap := flag.Bool("bootstrap", false, "bootstrap the shard controller raft group")
+	joinAddress := flag.String("joinaddr", "", "http address of any shard controller to join")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "shardctrler: ", log.Ldate|log.Ltime)
+	opts := shardctrler.Options{
+		HttpAddress: "127.0.0.1:" + strconv.Itoa(*httpPort),
+		RaftAddress: "127.0.0.1:" + strconv.Itoa(*raftPort),
+		DataDir:     "./" + *nodeName,
+		Bootstrap:   *bootstrap,
+		JoinAddress: *joinAddress,
+	}
+	server, err := shardctrler.NewServer(opts)
+	if err != nil {
+		logger.Fatalf("create shard controller failed: %v", err)
+	}
+
+	l, err := net.Listen("tcp", opts.HttpAddress)
+	if err != nil {
+		logger.Fatalf("listen %s failed: %v", opts.HttpAddress, err)
+	}
+	logger.Printf("http server listen:%s", l.Addr())
+
+	if opts.JoinAddress != "" {
+		go func() {
+			if err := server.JoinRaft(); err != nil {
+				logger.Fatalf("join shard controller failed: %v", err)
+			}
+		}()
+	}
+	logger.Fatal(http.Serve(l, server.Handler()))
+}
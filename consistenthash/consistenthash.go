@@ -1,18 +1,28 @@
 package consistenthash
 
 import (
+	"github.com/spaolacci/murmur3"
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 )
 
 type Hash func(data []byte) uint32
 
+// Murmur3 是集群的一致性hash环使用的hash函数，服务端和客户端必须一致
+func Murmur3(data []byte) uint32 {
+	return uint32(murmur3.Sum64(data))
+}
+
 type Map struct {
 	Hash     Hash           `json:"-"`        // hash函数
 	Replicas int            `json:"replicas"` // 虚拟节点倍数
 	Keys     []int          `json:"keys"`     // 哈希环
 	HashMap  map[int]string `json:"hashMap"`  // 虚拟节点和真实节点的映射表，键是虚拟节点的哈希值，值是真实节点的名称
+	Epoch    uint64         `json:"epoch"`    // 哈希环的版本号，每次增删节点后由发布哈希环的一方递增
+	// Groups 真实节点是分片组ID时每个分片组中节点的http地址，没有记录的真实节点本身就是http地址
+	Groups map[string][]string `json:"groups,omitempty"`
 }
 
 // 用于数据迁移，对应一个hash区间和该区间的数据来源节点名称
@@ -34,6 +44,27 @@ func New(replicas int, fn Hash) *Map {
 	return m
 }
 
+// Clone 返回哈希环的副本，发布出去的哈希环不再修改，增删节点时先复制再替换
+func (m *Map) Clone() *Map {
+	c := &Map{
+		Hash:     m.Hash,
+		Replicas: m.Replicas,
+		Keys:     append([]int(nil), m.Keys...),
+		HashMap:  make(map[int]string, len(m.HashMap)),
+		Epoch:    m.Epoch,
+	}
+	for k, v := range m.HashMap {
+		c.HashMap[k] = v
+	}
+	if m.Groups != nil {
+		c.Groups = make(map[string][]string, len(m.Groups))
+		for k, v := range m.Groups {
+			c.Groups[k] = v
+		}
+	}
+	return c
+}
+
 func (m *Map) Add(keys ...string) {
 	for _, key := range keys {
 		for i := 0; i < m.Replicas; i++ {
@@ -45,6 +76,24 @@ func (m *Map) Add(keys ...string) {
 	sort.Ints(m.Keys)
 }
 
+// Remove 从哈希环中删除真实节点及其所有虚拟节点
+func (m *Map) Remove(keys ...string) {
+	for _, key := range keys {
+		for i := 0; i < m.Replicas; i++ {
+			hash := int(m.Hash([]byte(strconv.Itoa(i) + key)))
+			if m.HashMap[hash] == key {
+				delete(m.HashMap, hash)
+			}
+		}
+		delete(m.Groups, key)
+	}
+	m.Keys = m.Keys[:0]
+	for hash := range m.HashMap {
+		m.Keys = append(m.Keys, hash)
+	}
+	sort.Ints(m.Keys)
+}
+
 func (m *Map) Get(key string) string {
 	if len(m.Keys) == 0 {
 		return ""
@@ -59,6 +108,33 @@ func (m *Map) Get(key string) string {
 	return m.HashMap[m.Keys[idx%len(m.Keys)]]
 }
 
+// Owns 判断hash区间[start, end]中是否有hash值映射到真实节点key，区间中没有数据时同样按哈希环判断
+func (m *Map) Owns(key string, start, end int) bool {
+	if len(m.Keys) == 0 || start > end {
+		return false
+	}
+	// 区间依次落在第一个不小于start的虚拟节点，到第一个不小于end的虚拟节点上，超出最后一个虚拟节点时回到第一个
+	for i := sort.SearchInts(m.Keys, start); ; i++ {
+		if i == len(m.Keys) {
+			return m.HashMap[m.Keys[0]] == key
+		}
+		if m.HashMap[m.Keys[i]] == key {
+			return true
+		}
+		if m.Keys[i] >= end {
+			return false
+		}
+	}
+}
+
+// Members 返回真实节点对应的http地址：真实节点是分片组时返回分片组的节点列表，否则返回它自己
+func (m *Map) Members(node string) []string {
+	if members, ok := m.Groups[node]; ok {
+		return members
+	}
+	return []string{node}
+}
+
 func (m *Map) GetPeers() []string {
 	uniqueValues := make(map[string]bool)
 	result := make([]string, 0)
@@ -74,6 +150,41 @@ func (m *Map) GetPeers() []string {
 	return result
 }
 
+/*
+*
+GetRemoveRange 返回删除真实节点key之后需要迁出的区间，RealNode是删除后接管这个区间的真实节点。
+key的每个虚拟节点负责(前一个虚拟节点, 虚拟节点]，删除后由顺时针方向下一个不属于key的虚拟节点接管，
+跨过0的区间拆成两段。哈希环上只有key时返回nil
+*/
+func (m *Map) GetRemoveRange(key string) []RangeNode {
+	after := m.Clone()
+	after.Remove(key)
+	if len(after.Keys) == 0 {
+		return nil
+	}
+
+	var ranges []RangeNode
+	for i, hash := range m.Keys {
+		if m.HashMap[hash] != key {
+			continue
+		}
+		prev := m.Keys[(i-1+len(m.Keys))%len(m.Keys)]
+		nextIdx := sort.SearchInts(after.Keys, hash)
+		if nextIdx == len(after.Keys) {
+			nextIdx = 0
+		}
+		owner := after.HashMap[after.Keys[nextIdx]]
+		if prev < hash {
+			ranges = append(ranges, RangeNode{Start: prev + 1, End: hash, RealNode: owner})
+		} else {
+			ranges = append(ranges,
+				RangeNode{Start: prev + 1, End: math.MaxUint32, RealNode: owner},
+				RangeNode{Start: 0, End: hash, RealNode: owner})
+		}
+	}
+	return ranges
+}
+
 // 根据新加的节点的名称，获取新加的节点所有虚拟节点hash值和哈希环里前一个节点hash值的范围区间合并后的集合
 func (m *Map) GetRange(key string, oldKeys []int) []RangeNode {
 	var ranges []RangeNode
@@ -100,8 +211,15 @@ func (m *Map) GetRange(key string, oldKeys []int) []RangeNode {
 		start := m.Keys[prevIdx] + 1
 		end := hash // 包括当前节点
 
-		// 添加到结果中
-		ranges = append(ranges, RangeNode{Start: start, End: end})
+		// 添加到结果中，跨过0的区间拆成两段，否则start大于end，区间内查不到任何数据
+		if start <= end {
+			ranges = append(ranges, RangeNode{Start: start, End: end})
+			continue
+		}
+		if start <= math.MaxUint32 {
+			ranges = append(ranges, RangeNode{Start: start, End: math.MaxUint32})
+		}
+		ranges = append(ranges, RangeNode{Start: 0, End: end})
 	}
 	t1 := mergeRanges(ranges)
 
@@ -38,3 +38,132 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+	hash.Epoch = 7
+	clone := hash.Clone()
+	hash.Remove("4")
+
+	testCases := map[string]string{
+		"2":  "2",
+		"11": "2",
+		"23": "6",
+		"27": "2",
+	}
+	for k, v := range testCases {
+		if hash.Get(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s", k, v)
+		}
+	}
+	if len(hash.Keys) != 6 || len(hash.GetPeers()) != 2 {
+		t.Errorf("got keys %v; want 6 virtual nodes of 2 peers", hash.Keys)
+	}
+	// 副本不受影响
+	if clone.Get("23") != "4" || clone.Epoch != 7 {
+		t.Errorf("clone changed after Remove, got %s at epoch %d", clone.Get("23"), clone.Epoch)
+	}
+}
+
+func TestGetRemoveRange(t *testing.T) {
+	hash := New(3, Murmur3)
+	hash.Add("a", "b", "c")
+	ranges := hash.GetRemoveRange("b")
+	after := hash.Clone()
+	after.Remove("b")
+
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		h := int(hash.Hash([]byte(key)))
+		var in []RangeNode
+		for _, r := range ranges {
+			if h >= r.Start && h <= r.End {
+				in = append(in, r)
+			}
+		}
+		if hash.Get(key) != "b" {
+			if len(in) != 0 {
+				t.Fatalf("key %s of %s in removed ranges %v", key, hash.Get(key), in)
+			}
+			continue
+		}
+		if len(in) != 1 || in[0].RealNode != after.Get(key) {
+			t.Fatalf("key %s in ranges %v; want one range taken over by %s", key, in, after.Get(key))
+		}
+	}
+
+	single := New(3, Murmur3)
+	single.Add("a")
+	if ranges := single.GetRemoveRange("a"); ranges != nil {
+		t.Fatalf("got %v; want nil for the last node", ranges)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	for n := 0; n < 10; n++ {
+		before := New(3, Murmur3)
+		before.Add("a", "b")
+		after := before.Clone()
+		node := "n" + strconv.Itoa(n)
+		after.Add(node)
+		ranges := after.GetRange(node, before.Keys)
+
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			h := int(after.Hash([]byte(key)))
+			var in []RangeNode
+			for _, r := range ranges {
+				if r.Start > r.End {
+					t.Fatalf("got range %v with start after end", r)
+				}
+				if h >= r.Start && h <= r.End {
+					in = append(in, r)
+				}
+			}
+			if after.Get(key) != node {
+				if len(in) != 0 {
+					t.Fatalf("key %s of %s in ranges %v of %s", key, after.Get(key), in, node)
+				}
+				continue
+			}
+			if len(in) != 1 || in[0].RealNode != before.Get(key) {
+				t.Fatalf("key %s in ranges %v; want one range from %s", key, in, before.Get(key))
+			}
+		}
+	}
+}
+
+func TestOwns(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// 虚拟节点02/12/22、04/14/24、06/16/26
+	hash.Add("6", "4", "2")
+
+	testCases := []struct {
+		key        string
+		start, end int
+		want       bool
+	}{
+		{"4", 3, 4, true},
+		{"4", 5, 12, false},
+		{"2", 5, 12, true},
+		{"6", 5, 12, true},
+		{"6", 7, 12, false},
+		{"4", 13, 13, true},
+		// 超过最后一个虚拟节点的区间属于第一个虚拟节点
+		{"2", 27, 100, true},
+		{"6", 27, 100, false},
+		{"4", 0, 2, false},
+	}
+	for _, c := range testCases {
+		if got := hash.Owns(c.key, c.start, c.end); got != c.want {
+			t.Errorf("Owns(%s, %d, %d) = %v; want %v", c.key, c.start, c.end, got, c.want)
+		}
+	}
+}
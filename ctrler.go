@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/shardctrler"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ctrlerRetryInterval    = time.Second      // 访问分片控制器失败后重试的间隔，也是等待迁移任务切换的初始间隔
+	ctrlerMaxRetryInterval = 30 * time.Second // 等待迁移任务切换时每次加倍的间隔的上限
+	// configMigrationTimeout 等待一份配置的迁移任务记录切换的最长时间，超时后报告失败，
+	// 本节点继续使用旧的哈希环，之后重新应用这份配置
+	configMigrationTimeout = 10 * time.Minute
+)
+
+/*
+*
+watchConfig 订阅分片控制器发布的配置。节点启动后先拿到最新的配置，之后通过长轮询等待编号更大的配置，
+每份新配置按编号逐份应用，中间的配置不会跳过，每份配置的迁移任务ID都由它的编号决定：
+
+ 1. 新加入哈希环的分片组由它的leader执行迁移任务，从之前负责这些区间的分片组拉取数据；
+    移出哈希环的分片组在/removenode中把数据推送给接管的分片组，再通过raft日志记录推送完成。
+    记录之前，所有分片组的所有节点都继续使用旧的哈希环
+ 2. 把以gid为节点的哈希环转换为以http地址为节点的哈希环，整体替换本节点的哈希环
+
+分片组内的每个节点都订阅配置，本分片组的key都映射到自己，读请求在本地处理，写请求交给leader。
+节点重启时最新配置的迁移任务可能还没有切换，和上一份配置比较，同样等待切换。
+等待超时时记录错误并保持旧的哈希环，稍后重新应用同一份配置
+*/
+func (h *httpServer) watchConfig(ck *shardctrler.Clerk) {
+	var current *shardctrler.Config
+	for {
+		after := 0
+		if current != nil {
+			after = current.Num
+		}
+		cfg, err := ck.Watch(context.Background(), after)
+		if err == nil && cfg != nil && current == nil && cfg.Num > 1 {
+			current, err = ck.Query(context.Background(), cfg.Num-1)
+		} else if err == nil && cfg != nil && current != nil && cfg.Num > after+1 {
+			cfg, err = ck.Query(context.Background(), after+1)
+		}
+		if err != nil {
+			h.log.Printf("watch shard controller failed:%v", err)
+			time.Sleep(ctrlerRetryInterval)
+			continue
+		}
+		if cfg == nil || cfg.Num <= after {
+			continue
+		}
+		if err := h.applyConfig(current, cfg); err != nil {
+			h.log.Printf("apply shard config %d failed, keep the ring of config %d:%v", cfg.Num, after, err)
+			continue
+		}
+		current = cfg
+	}
+}
+
+// applyConfig 从配置old切换到cfg，old为nil表示cfg是第一份配置。
+// 先等待cfg中每个新加入和移出的分片组记录切换，再切换本节点的哈希环，超时返回错误，哈希环不变
+func (h *httpServer) applyConfig(old *shardctrler.Config, cfg *shardctrler.Config) error {
+	if old != nil && len(old.Ring.Keys) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), configMigrationTimeout)
+		defer cancel()
+		for _, groups := range []map[string][]string{cfg.Groups, old.Groups} {
+			for g := range groups {
+				_, inOld := old.Groups[g]
+				_, inNew := cfg.Groups[g]
+				if inOld == inNew {
+					continue
+				}
+				if err := h.awaitConfigMigration(ctx, old, cfg, g); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	h.setRing(cfg.Peers(h.cache.Opts.GID, h.cache.Opts.HttpAddress))
+	h.log.Printf("apply shard config %d, groups:%v", cfg.Num, cfg.Groups)
+	return nil
+}
+
+// configJobID 返回配置num的迁移任务的ID：新加入的分片组为它执行的迁移任务，或者移出的分片组推送数据的记录，
+// 每个节点都可以据此找到任务
+func configJobID(num int) string {
+	return "config-" + strconv.Itoa(num)
+}
+
+/*
+*
+awaitConfigMigration 等待cfg中新加入或者移出的分片组g通过raft日志记录切换，间隔从ctrlerRetryInterval开始加倍，
+ctx结束时返回错误：
+
+  - g新加入时等待它为cfg执行的迁移任务。g是本分片组时读本节点的任务状态，本节点是leader并且还没有任务时
+    创建任务并执行，leader切换后由新的leader从检查点继续执行
+  - g移出时等待它的leader在/removenode中记录推送完成，直接调用/ctrler/leave移出的分片组没有这条记录，一直等待
+  - g是其他分片组时向g的节点查询任务状态
+*/
+func (h *httpServer) awaitConfigMigration(ctx context.Context, old *shardctrler.Config, cfg *shardctrler.Config, g string) error {
+	gid, self := h.cache.Opts.GID, h.cache.Opts.HttpAddress
+	id := configJobID(cfg.Num)
+	servers, join := cfg.Groups[g]
+	if !join {
+		servers = old.Groups[g]
+	}
+	for wait := ctrlerRetryInterval; ; wait *= 2 {
+		if g == gid {
+			state, ok := h.cache.MigrationJobs()[id]
+			if !ok && join && h.cache.IsLeader() {
+				ranges := cfg.Ring.GetRange(gid, old.Ring.Keys)
+				if _, err := h.migrate(id, ranges, old.Peers(gid, self), cfg.Peers(gid, self), false); err != nil {
+					h.log.Printf("migrate shard config %d failed:%v", cfg.Num, err)
+				}
+			} else if job, err := decodeJob(state); ok && err == nil && job.cutover() {
+				return nil
+			}
+		} else if h.remoteCutover(servers, id) {
+			return nil
+		}
+
+		if wait > ctrlerMaxRetryInterval {
+			wait = ctrlerMaxRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("group %s has not recorded cutover of %s: %w", g, id, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// remoteCutover 向分片组的节点servers查询迁移任务id是否已经记录切换。
+// 落后的follower可能还没有应用这条记录，依次查询每个节点，任何一个节点看到切换即可
+func (h *httpServer) remoteCutover(servers []string, id string) bool {
+	for _, server := range servers {
+		resp, err := peerClient.Get("http://" + server + "/v1/cluster/migrations")
+		if err != nil {
+			continue
+		}
+		var ret struct {
+			Migrations []*migrationJob `json:"migrations"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&ret)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		for _, job := range ret.Migrations {
+			if job.ID == id && job.cutover() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ringManaged 哈希环由分片控制器维护时拒绝/sharepeers、/sendpeers和/addpeer，
+// 避免手工修改的哈希环和控制器发布的配置不一致
+func (h *httpServer) ringManaged(w http.ResponseWriter) bool {
+	if len(h.cache.Opts.Ctrlers) == 0 {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("ring is managed by shard controllers %v", h.cache.Opts.Ctrlers), http.StatusConflict)
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"github.com/Emiliaab/gedis/shardctrler"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteCutover(t *testing.T) {
+	phase := phaseCutover
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]*migrationJob{"migrations": {{ID: configJobID(3), Phase: phase}}})
+	}))
+	defer srv.Close()
+	// 还没有应用任务记录的follower
+	lagging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]*migrationJob{"migrations": {}})
+	}))
+	defer lagging.Close()
+	h := &httpServer{log: log.New(io.Discard, "", 0)}
+	// 第一个节点不可用、第二个节点落后时查询分片组的下一个节点
+	servers := []string{"127.0.0.1:1", strings.TrimPrefix(lagging.URL, "http://"), strings.TrimPrefix(srv.URL, "http://")}
+
+	// 冻结之后、记录切换之前其他分片组仍然使用旧的哈希环
+	if h.remoteCutover(servers, configJobID(3)) {
+		t.Fatalf("got cutover at phase %s; want false", phase)
+	}
+	phase = phasePurge
+	if !h.remoteCutover(servers, configJobID(3)) {
+		t.Fatalf("got no cutover at phase %s; want true", phase)
+	}
+	if h.remoteCutover(servers, configJobID(4)) {
+		t.Fatal("got cutover for a job that doesn't exist; want false")
+	}
+}
+
+// 移出哈希环的分片组记录推送完成之前，其他分片组的节点继续使用旧的哈希环
+func TestApplyConfigLeave(t *testing.T) {
+	var recorded atomic.Bool
+	leaving := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobs := []*migrationJob{}
+		if recorded.Load() {
+			jobs = append(jobs, &migrationJob{ID: configJobID(3), Phase: phaseDone})
+		}
+		json.NewEncoder(w).Encode(map[string][]*migrationJob{"migrations": jobs})
+	}))
+	defer leaving.Close()
+
+	self := "127.0.0.1:8000"
+	proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: self, GID: "g1"}, Log: log.New(io.Discard, "", 0)}
+	h := &httpServer{cache: proxy, log: log.New(io.Discard, "", 0)}
+	old := &shardctrler.Config{Num: 2, Ring: consistenthash.New(3, consistenthash.Murmur3), Groups: map[string][]string{
+		"g1": {self},
+		"g2": {strings.TrimPrefix(leaving.URL, "http://")},
+	}}
+	old.Ring.Add("g1", "g2")
+	cfg := &shardctrler.Config{Num: 3, Ring: consistenthash.New(3, consistenthash.Murmur3), Groups: map[string][]string{"g1": {self}}}
+	cfg.Ring.Add("g1")
+	h.setRing(old.Peers("g1", self))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.awaitConfigMigration(ctx, old, cfg, "g2"); err == nil {
+		t.Fatal("expected the wait to time out before g2 records its push")
+	}
+	if peers := proxy.Peers().GetPeers(); !contains(peers, "g2") {
+		t.Fatalf("got ring %v before g2 records its push; want g2 still in it", peers)
+	}
+
+	recorded.Store(true)
+	if err := h.applyConfig(old, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if peers := proxy.Peers().GetPeers(); contains(peers, "g2") {
+		t.Fatalf("got ring %v after g2 records its push; want g2 removed", peers)
+	}
+}
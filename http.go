@@ -2,24 +2,31 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Emiliaab/gedis/cache"
 	"github.com/Emiliaab/gedis/consistenthash"
-	"github.com/hashicorp/raft"
-	"github.com/spaolacci/murmur3"
+	"github.com/Emiliaab/gedis/shardctrler"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type httpServer struct {
-	cache *cache.Cache_proxy
-	log   *log.Logger
-	mutex *http.ServeMux
+	cache  *cache.Cache_proxy
+	log    *log.Logger
+	mutex  *http.ServeMux
+	ctrler *shardctrler.Clerk // 哈希环由分片控制器维护时的控制器客户端，否则为nil
+
+	migrations migrations  // 本节点作为接收方正在执行的迁移任务
+	resp       *respServer // 执行其他节点的RESP服务转发来的命令
 }
 
 type Stu struct {
@@ -34,19 +41,88 @@ func NewHttpServer(cache *cache.Cache_proxy) *httpServer {
 		log:   log.New(os.Stderr, "http_server: ", log.Ldate|log.Ltime),
 		mutex: mutex,
 	}
+	s.resp = NewRespServer(cache)
+	s.resp.forwarded = true
+	if len(cache.Opts.Ctrlers) > 0 {
+		s.ctrler = shardctrler.NewClerk(cache.Opts.Ctrlers)
+	}
 
-	mutex.HandleFunc("/get", s.doGet)
-	mutex.HandleFunc("/set", s.doSet)
-	mutex.HandleFunc("/join", s.doJoin)
+	mutex.HandleFunc("/v1/cluster/ring", s.doRing)
+	mutex.HandleFunc("/v1/cluster/members", s.writesOnly(s.doClusterMembers))
+	mutex.HandleFunc("/v1/cluster/demote", s.leaderOnly(s.doDemote))
+	mutex.HandleFunc("/v1/cluster/transfer-leader", s.leaderOnly(s.doTransferLeader))
+	mutex.HandleFunc("/v1/cluster/stats", s.doClusterStats)
+	mutex.HandleFunc(touchPath, s.leaderOnly(s.doTouch))
+	mutex.HandleFunc("/v1/mget", s.consistentRead(s.doBatch(false, s.mgetLocal)))
+	mutex.HandleFunc("/v1/mset", s.leaderOnly(s.doBatch(true, s.msetLocal)))
+	mutex.HandleFunc("/v1/mdel", s.leaderOnly(s.doBatch(false, s.mdelLocal)))
+	mutex.HandleFunc("/get", s.consistentRead(s.doGet))
+	mutex.HandleFunc("/set", s.leaderOnly(s.doSet))
+	mutex.HandleFunc("/expire", s.leaderOnly(s.doExpire))
+	mutex.HandleFunc("/persist", s.leaderOnly(s.doPersist))
+	mutex.HandleFunc("/ttl", s.consistentRead(s.doTTL))
+	mutex.HandleFunc("/incr", s.leaderOnly(s.doIncr(1, 1, "")))
+	mutex.HandleFunc("/decr", s.leaderOnly(s.doIncr(-1, 1, "")))
+	mutex.HandleFunc("/incrby", s.leaderOnly(s.doIncr(1, 0, "incr")))
+	mutex.HandleFunc("/decrby", s.leaderOnly(s.doIncr(-1, 0, "decr")))
+	mutex.HandleFunc("/incrbyfloat", s.leaderOnly(s.doIncrByFloat))
+	mutex.HandleFunc("/hset", s.leaderOnly(s.doHSet))
+	mutex.HandleFunc("/hget", s.consistentRead(s.doHGet))
+	mutex.HandleFunc("/hgetall", s.consistentRead(s.doHGetAll))
+	mutex.HandleFunc("/hdel", s.leaderOnly(s.doHDel))
+	mutex.HandleFunc("/hincrby", s.leaderOnly(s.doHIncrBy))
+	mutex.HandleFunc("/hlen", s.consistentRead(s.doHLen))
+	mutex.HandleFunc("/lpush", s.leaderOnly(s.doPush(true)))
+	mutex.HandleFunc("/rpush", s.leaderOnly(s.doPush(false)))
+	mutex.HandleFunc("/lpop", s.leaderOnly(s.doPop(true)))
+	mutex.HandleFunc("/rpop", s.leaderOnly(s.doPop(false)))
+	mutex.HandleFunc("/blpop", s.leaderOnly(s.doBlockingPop(true)))
+	mutex.HandleFunc("/brpop", s.leaderOnly(s.doBlockingPop(false)))
+	mutex.HandleFunc("/lrange", s.consistentRead(s.doLRange))
+	mutex.HandleFunc("/llen", s.consistentRead(s.doLLen))
+	mutex.HandleFunc("/ltrim", s.leaderOnly(s.doLTrim))
+	mutex.HandleFunc("/sadd", s.leaderOnly(s.doMembers(s.cache.DoSAdd)))
+	mutex.HandleFunc("/srem", s.leaderOnly(s.doMembers(s.cache.DoSRem)))
+	mutex.HandleFunc("/smembers", s.consistentRead(s.doSMembers))
+	mutex.HandleFunc("/sismember", s.consistentRead(s.doSIsMember))
+	mutex.HandleFunc("/sinter", s.consistentRead(s.doSetAlgebra(s.cache.Cache.SInter)))
+	mutex.HandleFunc("/sunion", s.consistentRead(s.doSetAlgebra(s.cache.Cache.SUnion)))
+	mutex.HandleFunc("/zadd", s.leaderOnly(s.doZAdd))
+	mutex.HandleFunc("/zrem", s.leaderOnly(s.doMembers(s.cache.DoZRem)))
+	mutex.HandleFunc("/zscore", s.consistentRead(s.doZScore))
+	mutex.HandleFunc("/zrank", s.consistentRead(s.doZRank))
+	mutex.HandleFunc("/zrange", s.consistentRead(s.doZRange))
+	mutex.HandleFunc("/zrangebyscore", s.consistentRead(s.doZRangeByScore))
+	mutex.HandleFunc("/join", s.leaderOnly(s.doJoin))
 	mutex.HandleFunc("/sharepeers", s.sharePeers)
 	mutex.HandleFunc("/sendpeers", s.sendPeers)
 	mutex.HandleFunc("/addpeer", s.addPeer)
+	mutex.HandleFunc("/removepeer", s.removePeer)
+	mutex.HandleFunc("/removenode", s.leaderOnly(s.removeNode))
+	mutex.HandleFunc("/v1/cluster/import", s.leaderOnly(s.doImport))
+	mutex.HandleFunc("/v1/cluster/migrations", s.doMigrations)
+	mutex.HandleFunc("/v1/cluster/migrate/begin", s.leaderOnly(s.doMigrateBegin))
+	mutex.HandleFunc("/v1/cluster/migrate/range", s.leaderOnly(s.doMigrateRange))
+	mutex.HandleFunc("/v1/cluster/migrate/dirty", s.leaderOnly(s.doMigrateDirty))
+	mutex.HandleFunc("/v1/cluster/migrate/freeze", s.leaderOnly(s.doMigrateFreeze))
+	mutex.HandleFunc("/v1/cluster/migrate/finish", s.leaderOnly(s.doMigrateFinish))
+	mutex.HandleFunc(respPath, s.leaderOnly(s.doResp))
 	mutex.HandleFunc("/getrange", s.doGetRange)
 	mutex.HandleFunc("/getall", s.getAll)
 
 	return s
 }
 
+// ServeHTTP 直接处理/v1/keys/{key}，其他请求交给ServeMux。ServeMux会把含有//、/./和..的路径
+// 301重定向到清理后的路径，而这些字符在key中都是合法的
+func (h *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.EscapedPath(), keysPrefix) {
+		h.writesOnly(h.consistentRead(h.doKey))(w, r)
+		return
+	}
+	h.mutex.ServeHTTP(w, r)
+}
+
 func (h *httpServer) doGet(w http.ResponseWriter, r *http.Request) {
 	vars := r.URL.Query()
 
@@ -56,13 +132,21 @@ func (h *httpServer) doGet(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "")
 		return
 	}
-	// 判断是否是主节点，不是的话获取主节点的地址
-	masterAddress := h.cache.Opts.JoinAddress
+	if owner := h.cache.Peers().Get(key); owner != h.cache.Opts.HttpAddress && h.misrouted(w, r, owner) {
+		return
+	}
+	// 判断是否是主节点，不是的话从成员表中获取主节点的地址，本分片组的key本地未命中时从主节点读取，
+	// 其他分片的key由DoGet发给哈希环上负责的节点
+	masterAddress := ""
+	if !h.cache.IsLeader() {
+		masterAddress, _ = h.cache.Leader()
+	}
 
-	ret, ok := h.cache.DoGet(key, masterAddress)
+	ret, ok := h.cache.DoGet(key, masterAddress, consistencyParams(vars))
 	if !ok {
 		h.log.Println("doGet() error, get false ok")
-		fmt.Fprint(w, "")
+		http.NotFound(w, r)
+		return
 	}
 	fmt.Fprintf(w, "%s\n", ret)
 }
@@ -75,8 +159,8 @@ func (h *httpServer) getAll(w http.ResponseWriter, r *http.Request) {
 func (h *httpServer) doSet(w http.ResponseWriter, r *http.Request) {
 	vars := r.URL.Query()
 
-	operInt, error := strconv.Atoi(vars.Get("oper"))
-	if error != nil {
+	operInt, err := strconv.Atoi(vars.Get("oper"))
+	if err != nil {
 		h.log.Println("doSet() error, get error oper")
 	}
 	key := vars.Get("key")
@@ -87,49 +171,218 @@ func (h *httpServer) doSet(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "param error\n")
 		return
 	}
-
-	event := cache.LogEntryData{Oper: oper, Key: key, Value: value}
-	eventBytes, err := json.Marshal(event)
+	// ex/px指定存活时间(秒/毫秒)，sliding=true表示滑动过期
+	ttl, err := parseTTL(vars)
 	if err != nil {
-		h.log.Printf("json.Marshal failed, err:%v", err)
-		fmt.Fprint(w, "internal error\n")
+		h.log.Printf("doSet() error, %v", err)
+		fmt.Fprint(w, "param error\n")
 		return
 	}
+	sliding := vars.Get("sliding") == "true"
+
 	// 通过一致性hash找到应该写入的节点
 	// 如果是本机，则利用raft协议直接写入, 如果不是本机，则通过http协议写入
-	peerAddress := h.cache.Peers.Get(key)
+	peerAddress := h.cache.Peers().Get(key)
 	if peerAddress == h.cache.Opts.HttpAddress {
-		applyFuture := h.cache.Raft.Raft.Apply(eventBytes, 5)
-		if err := applyFuture.Error(); err != nil {
-			h.log.Printf("raft.Apply failed:%v", err)
-			fmt.Fprint(w, "internal error\n")
+		if err := h.cache.DoSetEx(r.Context(), oper, key, value, ttl, sliding); err != nil {
+			h.log.Printf("doSet() failed, key:%s, err:%v", key, err)
+			h.writeCommandError(w, err)
 			return
 		}
 	} else {
-		if !doSetFromPeer(peerAddress, key, value, oper) {
-			h.log.Println("doSetFromPeer failed")
+		if h.misrouted(w, r, peerAddress) {
+			return
+		}
+		skipSessionToken(w)
+		status, body, err := h.doSetFromPeer(peerAddress, key, value, oper, ttl, sliding)
+		if err != nil {
+			h.log.Printf("doSetFromPeer failed:%v", err)
 			fmt.Fprint(w, "internal error\n")
 			return
 		}
+		if status != http.StatusOK {
+			h.log.Printf("doSetFromPeer rejected, status:%d, body:%s", status, body)
+			http.Error(w, body, status)
+			return
+		}
 	}
 
 	fmt.Fprintf(w, "ok\n")
 }
 
-// 非本机节点，通过http协议写入
-func doSetFromPeer(peerAddress string, key string, value string, oper int8) bool {
-	url := "http://" + peerAddress + "/set?oper=" + strconv.Itoa(int(oper)) + "&key=" + key + "&value=" + value
-	resp, err := http.Post(url, "application/json", nil)
+// 非本机节点，通过/v1/keys接口写入，返回对端的状态码和响应内容。
+// 对端返回2xx或者删除的key不存在时状态码视为200
+func (h *httpServer) doSetFromPeer(peerAddress string, key string, value string, oper int8, ttl time.Duration, sliding bool) (int, string, error) {
+	query := url.Values{}
+	if ttl > 0 {
+		query.Set("px", strconv.FormatInt(ttl.Milliseconds(), 10))
+		query.Set("sliding", strconv.FormatBool(sliding))
+	}
+
+	var (
+		status int
+		body   string
+		err    error
+	)
+	switch oper {
+	case cache.OperAdd, cache.OperSet:
+		status, body, err = h.putKeyToPeer(peerAddress, http.MethodPut, key, []byte(value), query.Encode())
+	case cache.OperRemove:
+		status, body, err = h.putKeyToPeer(peerAddress, http.MethodDelete, key, nil, "")
+		if status == http.StatusNotFound {
+			status = http.StatusOK
+		}
+	default:
+		// 其他操作没有对应的v1接口，仍然转发到对端的/set
+		query.Set("oper", strconv.Itoa(int(oper)))
+		query.Set("key", key)
+		query.Set("value", value)
+		var resp *http.Response
+		resp, err = h.peerDo(context.Background(), peerClient, peerAddress, false, http.MethodPost, "/set?"+query.Encode(), nil, "application/json")
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		status, body = resp.StatusCode, strings.TrimSpace(string(b))
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if status >= 200 && status < 300 {
+		status = http.StatusOK
+	}
+	return status, body, nil
+}
+
+// parseTTL 解析ex(秒)或px(毫秒)参数，都没有时返回0表示永不过期
+func parseTTL(vars url.Values) (time.Duration, error) {
+	if ex := vars.Get("ex"); ex != "" {
+		seconds, err := strconv.ParseInt(ex, 10, 64)
+		if err != nil || seconds <= 0 {
+			return 0, fmt.Errorf("invalid ex %q", ex)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if px := vars.Get("px"); px != "" {
+		millis, err := strconv.ParseInt(px, 10, 64)
+		if err != nil || millis <= 0 {
+			return 0, fmt.Errorf("invalid px %q", px)
+		}
+		return time.Duration(millis) * time.Millisecond, nil
+	}
+	return 0, nil
+}
+
+// forwardToPeer 把请求原样转发给负责该key的节点，并把响应写回
+// 转发过来的请求在本节点的哈希环上也不属于本节点时返回moved。旧接口的读写都使用GET，
+// 无法区分读请求，都优先发给分片组的leader
+func (h *httpServer) forwardToPeer(w http.ResponseWriter, r *http.Request, peerAddress string) {
+	if h.misrouted(w, r, peerAddress) {
+		return
+	}
+	skipSessionToken(w)
+	// 阻塞命令可能超过peerClient的超时时间，这里只受原请求的context控制
+	resp, err := h.peerDo(r.Context(), http.DefaultClient, peerAddress, false, http.MethodGet, r.URL.RequestURI(), nil, "")
 	if err != nil {
-		return false
+		h.log.Printf("forward %s to %s failed:%v", r.URL.Path, peerAddress, err)
+		fmt.Fprint(w, "internal error\n")
+		return
 	}
 	defer resp.Body.Close()
+	if index := resp.Header.Get(indexHeader); index != "" {
+		w.Header().Set(indexHeader, index)
+	}
+	copyMoved(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// ownerOf 返回负责keys的节点，多个key必须属于同一个节点，否则ok为false
+func (h *httpServer) ownerOf(keys []string) (peerAddress string, ok bool) {
+	peerAddress = h.cache.Peers().Get(keys[0])
+	for _, key := range keys[1:] {
+		if h.cache.Peers().Get(key) != peerAddress {
+			return "", false
+		}
+	}
+	return peerAddress, true
+}
+
+// doExpire 为key设置存活时间，返回1表示设置成功，0表示key不存在
+func (h *httpServer) doExpire(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	ttl, err := parseTTL(vars)
+	if key == "" || err != nil || ttl == 0 {
+		h.log.Println("doExpire() error, get nil key or invalid ttl")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	ok, err := h.cache.DoExpire(r.Context(), key, ttl, vars.Get("sliding") == "true")
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", boolToInt(ok))
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return false
+// doPersist 移除key的存活时间，返回1表示移除成功，0表示key不存在或没有存活时间
+func (h *httpServer) doPersist(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doPersist() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	ok, err := h.cache.DoPersist(r.Context(), key)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", boolToInt(ok))
+}
+
+// doTTL 返回key剩余的存活秒数，和redis一致：-1表示没有存活时间，-2表示key不存在
+func (h *httpServer) doTTL(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doTTL() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
 	}
+	ttl, _, ok := h.cache.Cache.TTL(key)
+	switch {
+	case !ok:
+		fmt.Fprint(w, "-2\n")
+	case ttl < 0:
+		fmt.Fprint(w, "-1\n")
+	default:
+		fmt.Fprintf(w, "%d\n", int64((ttl+time.Second-1)/time.Second))
+	}
+}
 
-	return true
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func (h *httpServer) doJoin(w http.ResponseWriter, r *http.Request) {
@@ -142,8 +395,12 @@ func (h *httpServer) doJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addPeerFuture := h.cache.Raft.Raft.AddVoter(raft.ServerID(peerAddress), raft.ServerAddress(peerAddress), 0, 0)
-	if err := addPeerFuture.Error(); err != nil {
+	// 新节点的http地址同时写入成员表，新节点成为follower后可以把写请求转发给leader，
+	// nonvoter=true的节点作为只读的learner加入
+	// logVersion是新节点支持的日志版本，leader只写入所有节点都支持的版本
+	voter := vars.Get("nonvoter") != "true"
+	version, _ := strconv.Atoi(vars.Get("logVersion"))
+	if err := h.cache.DoAddServer(peerAddress, peerAddress, vars.Get("httpAddress"), version, voter); err != nil {
 		h.log.Printf("Error joining peer to raft, peeraddress:%s, err:%v, code:%d", peerAddress, err, http.StatusInternalServerError)
 		fmt.Fprint(w, "internal error\n")
 		return
@@ -152,6 +409,9 @@ func (h *httpServer) doJoin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *httpServer) sharePeers(w http.ResponseWriter, r *http.Request) {
+	if h.ringManaged(w) {
+		return
+	}
 	vars := r.URL.Query()
 
 	dest := vars.Get("dest")
@@ -162,7 +422,7 @@ func (h *httpServer) sharePeers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	url := fmt.Sprintf("http://%s/sendpeers", dest)
-	data, err := json.Marshal(*(h.cache.Peers))
+	data, err := json.Marshal(h.cache.Peers())
 	if err != nil {
 		h.log.Println("peers json error!")
 		fmt.Fprint(w, "peers json error!\n")
@@ -188,6 +448,9 @@ func (h *httpServer) sharePeers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *httpServer) sendPeers(w http.ResponseWriter, r *http.Request) {
+	if h.ringManaged(w) {
+		return
+	}
 	var data consistenthash.Map
 
 	// 从请求体中读取数据
@@ -209,58 +472,38 @@ func (h *httpServer) sendPeers(w http.ResponseWriter, r *http.Request) {
 	//h.pool.mu.Lock()
 	//defer h.pool.mu.Unlock()
 	// 更新 peers 变量
-	data.Hash = func(key []byte) uint32 {
-		return uint32(murmur3.Sum64(key))
-	}
-
-	h.cache.Peers = &data
-	// 获取 h.cache.Peers.Keys 的副本
-	keys := make([]int, len(h.cache.Peers.Keys))
-	copy(keys, h.cache.Peers.Keys)
-
-	// peers中加入自己，并向peers中其他节点都通知加入自己
-	h.cache.Peers.Add(h.cache.Opts.HttpAddress)
+	data.Hash = consistenthash.Murmur3
+
+	// 获取 data.Keys 的副本
+	keys := make([]int, len(data.Keys))
+	copy(keys, data.Keys)
+
+	// 迁移本节点负责的区间，数据拷贝完成后才在哈希环中加入自己，并向peers中其他节点都通知加入自己。
+	// 新的epoch只在这里递增一次，通知其他节点时带上它，其他节点采用同一个epoch
+	before := data.Clone()
+	after := data.Clone()
+	after.Add(h.cache.Opts.HttpAddress)
+	after.Epoch++
 	// 得到数据迁移的区间以及数据来源节点名称
-	getRange := h.cache.Peers.GetRange(h.cache.Opts.HttpAddress, keys)
-	// 数据迁移
-	h.dataMigration(getRange)
-	peerset := h.cache.Peers.GetPeers()
-	for _, peer := range peerset {
-		if peer == h.cache.Opts.HttpAddress {
-			continue
-		}
-		url := fmt.Sprintf("http://%s/addpeer?peerAddress=%s", peer, h.cache.Opts.HttpAddress)
-
-		resp, err := http.Get(url)
-		h.log.Printf("send to peer %s peerAddress %s\n", peer, h.cache.Opts.HttpAddress)
-		fmt.Fprintf(w, "send to peer %s peerAddress %s\n", peer, h.cache.Opts.HttpAddress)
-		if err != nil {
-			h.log.Println("send peers get resp error!")
-			fmt.Fprint(w, "send peers get resp error!\n")
-			return
-		}
-
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		//if err != nil {
-		//	h.log.Println("send peers get resp error!")
-		//	fmt.Fprint(w, "send peers get resp error!\n")
-		//	return
-		//}
-		fmt.Println(body)
-		//if string(body) != "ok" {
-		//	http.Error(w, err.Error(), http.StatusBadRequest)
-		//	return
-		//}
+	getRange := after.GetRange(h.cache.Opts.HttpAddress, keys)
+	job, err := h.migrate(strconv.FormatInt(time.Now().UnixNano(), 36), getRange, before, after, true)
+	if err != nil {
+		h.log.Printf("migrate to %s failed:%v", h.cache.Opts.HttpAddress, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	// 返回响应
 	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "migration %s done, copied %d keys\n", job.ID, job.Copied)
 	fmt.Fprint(w, "Peers updated successfully")
-	log.Printf("当前node: %s 的一致性hash map所包含的peers有: %s", h.cache.Opts.HttpAddress, h.cache.Peers.GetPeers())
+	log.Printf("当前node: %s 的一致性hash map所包含的peers有: %s", h.cache.Opts.HttpAddress, h.cache.Peers().GetPeers())
 }
 
 func (h *httpServer) addPeer(w http.ResponseWriter, r *http.Request) {
+	if h.ringManaged(w) {
+		return
+	}
 	vars := r.URL.Query()
 
 	peerAddress := vars.Get("peerAddress")
@@ -270,10 +513,27 @@ func (h *httpServer) addPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.cache.Peers.Add(peerAddress)
+	epoch, err := publishedEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 迁移任务切换失败后会重新通知，已经采用过这个epoch的节点不再重复加入
+	ring := h.cache.Peers()
+	if ring.Epoch >= epoch {
+		fmt.Fprintf(w, "%s addPeer %s success!", h.cache.Opts.HttpAddress, peerAddress)
+		return
+	}
+	peers := ring.Clone()
+	if !contains(peers.GetPeers(), peerAddress) {
+		peers.Add(peerAddress)
+	}
+	peers.Epoch = epoch
+	h.cache.SetPeers(peers)
 	log.Printf("%s addPeer %s success!", h.cache.Opts.HttpAddress, peerAddress)
 	fmt.Fprintf(w, "%s addPeer %s success!", h.cache.Opts.HttpAddress, peerAddress)
-	log.Printf("当前node: %s 的一致性hash map所包含的peers有: %s", h.cache.Opts.HttpAddress, h.cache.Peers.GetPeers())
+	log.Printf("当前node: %s 的一致性hash map所包含的peers有: %s", h.cache.Opts.HttpAddress, h.cache.Peers().GetPeers())
 }
 
 // doGetRange 处理范围请求，返回start和end之间的数据
@@ -313,57 +573,3 @@ func (h *httpServer) doGetRange(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonData)
 }
-
-// 根据数据迁移的区间以及数据来源节点名称进行数据迁移
-func (h *httpServer) dataMigration(getRange []consistenthash.RangeNode) {
-	for _, rangeNode := range getRange {
-		// 从数据来源节点获取数据
-		jsonData, err := getDataFromPeer(rangeNode.Start, rangeNode.End, rangeNode.RealNode)
-		if err != nil {
-			h.log.Printf("getDataFromPeer failed, err: %v", err)
-			continue
-		}
-		log.Printf("Raw data received: %s", jsonData)
-		// 反序列化数据
-		var dataMap map[string]string
-		err = json.Unmarshal([]byte(jsonData), &dataMap)
-		if err != nil {
-			h.log.Printf("Error unmarshaling data from peer: %v", err)
-			continue
-		}
-
-		// 逐项应用数据
-		for key, value := range dataMap {
-			event := cache.LogEntryData{Oper: 1, Key: key, Value: value} // 假设 Oper: 1 表示设置操作
-			eventBytes, err := json.Marshal(event)
-			if err != nil {
-				h.log.Printf("json.Marshal failed, err:%v", err)
-				continue
-			}
-
-			applyFuture := h.cache.Raft.Raft.Apply(eventBytes, 5*time.Second)
-			if err := applyFuture.Error(); err != nil {
-				h.log.Printf("raft.Apply failed:%v", err)
-				continue
-			}
-		}
-	}
-}
-
-// 调用readnode的doGetRange请求获得数据
-func getDataFromPeer(start, end int, peerAddress string) ([]byte, error) {
-	url := fmt.Sprintf("http://%s/getrange?start=%d&end=%d", peerAddress, start, end)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	//fmt.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!", data)
-	// 序列化data
-	return data, nil
-}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxBatchKeys 一次批量请求最多包含的key数量
+const maxBatchKeys = 10000
+
+// batchEntry 是mset中的一个key，value在json中按base64编码，可以是任意字节
+type batchEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// batchRequest 是/v1/mget、/v1/mset和/v1/mdel的请求体，mget和mdel使用Keys，mset使用Entries
+type batchRequest struct {
+	Keys    []string     `json:"keys,omitempty"`
+	Entries []batchEntry `json:"entries,omitempty"`
+	PX      int64        `json:"px,omitempty"`      // mset的存活时间(毫秒)，对所有key生效
+	Sliding bool         `json:"sliding,omitempty"` // mset是否滑动过期
+}
+
+// batchResult 是一个key的结果，部分分片失败时对应的key带有Error，其他key的结果不受影响
+type batchResult struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value,omitempty"`
+	Found   bool      `json:"found,omitempty"`   // mget
+	Deleted bool      `json:"deleted,omitempty"` // mdel
+	Error   *apiError `json:"error,omitempty"`
+}
+
+// batchResponse 中的Results和请求中的key一一对应，顺序一致
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// doBatch 处理批量请求：把key按所属的分片分组，本节点负责的key在本地执行，
+// 其他分片的key并发转发给对应的节点，最后按请求中的顺序合并结果。
+// 每个分片只需要一次网络往返，写操作在每个分片上只提交一条raft日志。
+// entries为true表示请求使用Entries(mset)，否则使用Keys
+func (h *httpServer) doBatch(entries bool, local func(ctx context.Context, req batchRequest) []batchResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+			return
+		}
+		var req batchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			return
+		}
+		keys := req.Keys
+		if entries {
+			keys = make([]string, len(req.Entries))
+			for i, e := range req.Entries {
+				keys[i] = e.Key
+			}
+		}
+		if len(keys) == 0 || len(keys) > maxBatchKeys || req.PX < 0 {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("batch must contain 1 to %d keys", maxBatchKeys))
+			return
+		}
+		for _, key := range keys {
+			if key == "" {
+				writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "empty key")
+				return
+			}
+		}
+
+		for _, key := range keys {
+			if h.cache.Peers().Get(key) != h.cache.Opts.HttpAddress {
+				// 涉及多个分片的批量写不返回会话token
+				skipSessionToken(w)
+				break
+			}
+		}
+		read := r.URL.Path == "/v1/mget"
+		forwarded := r.Header.Get(forwardedHeader) != ""
+		results := h.scatter(r.Context(), keys, req, entries, r.URL.RequestURI(), isStaleRead(r), forwarded, func(sub batchRequest) ([]batchResult, *apiError) {
+			// 读请求的一致性只在本节点负责的key上检查，其他分片的key由负责的分片组检查
+			if read {
+				if err := h.readBarrier(r); err != nil {
+					return h.batchToLeader(r, sub, err)
+				}
+			}
+			return local(r.Context(), sub), nil
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batchResponse{Results: results})
+	}
+}
+
+/*
+*
+scatter 把keys按负责的节点分组并发执行，按keys的顺序返回结果：本节点负责的key交给local，
+其他分片的key作为一个批量请求发送到负责节点的uri(/v1/mget、/v1/mset或者/v1/mdel)，每个分片只需要一次网络往返。
+forwarded为true表示请求是其他节点转发来的，两个节点的一致性hash环不一致，不属于本节点的key返回moved错误，不再继续转发。
+http的批量接口和RESP的多key命令都通过它跨分片执行
+*/
+func (h *httpServer) scatter(ctx context.Context, keys []string, req batchRequest, entries bool, uri string, stale bool, forwarded bool, local func(sub batchRequest) ([]batchResult, *apiError)) []batchResult {
+	results := make([]batchResult, len(keys))
+	var wg sync.WaitGroup
+	for owner, idx := range h.groupByOwner(keys) {
+		if owner != h.cache.Opts.HttpAddress && forwarded {
+			fillResults(results, keys, idx, nil, h.movedError(owner, h.cache.Peers().Epoch))
+			continue
+		}
+		wg.Add(1)
+		go func(owner string, idx []int) {
+			defer wg.Done()
+			sub := req.subset(idx, entries)
+			if owner == h.cache.Opts.HttpAddress {
+				rs, err := local(sub)
+				fillResults(results, keys, idx, rs, err)
+				return
+			}
+			rs, err := h.batchToPeer(ctx, owner, stale, uri, sub)
+			if err != nil {
+				h.log.Printf("batch %s to %s failed:%v", uri, owner, err)
+				fillResults(results, keys, idx, nil, &apiError{Code: codePeerUnavailable, Message: err.Error()})
+				return
+			}
+			fillResults(results, keys, idx, rs, nil)
+		}(owner, idx)
+	}
+	wg.Wait()
+	return results
+}
+
+// groupByOwner 按负责的节点对keys分组，返回每个节点负责的key在keys中的下标
+func (h *httpServer) groupByOwner(keys []string) map[string][]int {
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		owner := h.cache.Peers().Get(key)
+		groups[owner] = append(groups[owner], i)
+	}
+	return groups
+}
+
+// subset 返回只包含下标为idx的key的请求
+func (req batchRequest) subset(idx []int, entries bool) batchRequest {
+	sub := batchRequest{PX: req.PX, Sliding: req.Sliding}
+	for _, i := range idx {
+		if entries {
+			sub.Entries = append(sub.Entries, req.Entries[i])
+		} else {
+			sub.Keys = append(sub.Keys, req.Keys[i])
+		}
+	}
+	return sub
+}
+
+// fillResults 把一个分片的结果写回results中对应的位置，err不为nil时这个分片的key都返回err
+func fillResults(results []batchResult, keys []string, idx []int, rs []batchResult, err *apiError) {
+	if err == nil && len(rs) != len(idx) {
+		err = &apiError{Code: codeInternal, Message: fmt.Sprintf("got %d results for %d keys", len(rs), len(idx))}
+	}
+	for j, i := range idx {
+		if err != nil {
+			results[i] = batchResult{Key: keys[i], Error: err}
+		} else {
+			results[i] = rs[j]
+		}
+	}
+}
+
+// batchToPeer 把同一个分片的key作为一个批量请求发送给负责的分片组，uri中的consistency等参数原样保留
+func (h *httpServer) batchToPeer(ctx context.Context, peerAddress string, stale bool, uri string, req batchRequest) ([]batchResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.peerDo(ctx, peerClient, peerAddress, stale, http.MethodPost, uri, body, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	return decodeBatch(resp)
+}
+
+// batchToLeader 本节点负责的key不满足读的一致性时，把这部分key交给本分片组的leader读取，
+// leader也不能处理时这部分key返回not_leader错误，不在节点之间来回转发
+func (h *httpServer) batchToLeader(r *http.Request, req batchRequest, barrierErr error) ([]batchResult, *apiError) {
+	leader, ok := h.cache.Leader()
+	if !h.leaderReads(barrierErr) || !ok || leader == h.cache.Opts.HttpAddress || r.Header.Get(leaderForwardedHeader) != "" {
+		h.log.Printf("%s %s read barrier failed:%v", r.Method, r.URL.Path, barrierErr)
+		return nil, &apiError{Code: codeNotLeader, Message: barrierErr.Error()}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, &apiError{Code: codeInternal, Message: err.Error()}
+	}
+	leaderReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "http://"+leader+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, &apiError{Code: codeInternal, Message: err.Error()}
+	}
+	leaderReq.Header.Set("Content-Type", "application/json")
+	h.cache.SetForwarded(leaderReq.Header)
+	leaderReq.Header.Set(leaderForwardedHeader, h.cache.Opts.HttpAddress)
+	resp, err := peerClient.Do(leaderReq)
+	if err == nil {
+		var rs []batchResult
+		if rs, err = decodeBatch(resp); err == nil {
+			return rs, nil
+		}
+	}
+	h.log.Printf("batch %s to leader %s failed:%v", r.URL.Path, leader, err)
+	return nil, &apiError{Code: codePeerUnavailable, Message: err.Error()}
+}
+
+// decodeBatch 读取其他节点返回的批量请求结果并关闭响应
+func decodeBatch(resp *http.Response) ([]batchResult, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var ret batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret.Results, nil
+}
+
+// mgetLocal 读取本节点负责的key
+func (h *httpServer) mgetLocal(ctx context.Context, req batchRequest) []batchResult {
+	results := make([]batchResult, len(req.Keys))
+	for i, key := range req.Keys {
+		results[i].Key = key
+		value, ok := h.cache.DoGetLocal(key)
+		switch {
+		case ok:
+			results[i].Value, results[i].Found = value, true
+		case h.isWrongType(key):
+			_, results[i].Error = h.toAPIError(cache.ErrWrongType)
+		}
+	}
+	return results
+}
+
+func (h *httpServer) isWrongType(key string) bool {
+	typ, ok := h.cache.Cache.Type(key)
+	return ok && typ != cache.TypeString
+}
+
+// msetLocal 把本节点负责的key作为一条raft日志写入
+func (h *httpServer) msetLocal(ctx context.Context, req batchRequest) []batchResult {
+	results := make([]batchResult, len(req.Entries))
+	pairs := make([]string, 0, len(req.Entries)*2)
+	for i, e := range req.Entries {
+		results[i].Key = e.Key
+		pairs = append(pairs, e.Key, string(e.Value))
+	}
+	errs, err := h.cache.DoMSet(ctx, pairs, time.Duration(req.PX)*time.Millisecond, req.Sliding)
+	for i := range results {
+		e := err
+		if e == nil {
+			e = errs[i]
+		}
+		if e != nil {
+			_, results[i].Error = h.toAPIError(e)
+		}
+	}
+	return results
+}
+
+// mdelLocal 把本节点负责的key作为一条raft日志删除
+func (h *httpServer) mdelLocal(ctx context.Context, req batchRequest) []batchResult {
+	results := make([]batchResult, len(req.Keys))
+	deleted, err := h.cache.DoMDel(ctx, req.Keys)
+	for i, key := range req.Keys {
+		results[i].Key = key
+		if err != nil {
+			_, results[i].Error = h.toAPIError(err)
+			continue
+		}
+		results[i].Deleted = deleted[i]
+	}
+	return results
+}
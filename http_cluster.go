@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Emiliaab/gedis/cache"
+	"net/http"
+)
+
+// memberRequest 是POST /v1/cluster/members的请求体，ID为空时使用Address，
+// 和/join一样以raft地址作为节点的ID
+type memberRequest struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	HttpAddress string `json:"http_address"`
+	Nonvoter    bool   `json:"nonvoter"`    // 作为不参与投票的learner加入
+	LogVersion  int    `json:"log_version"` // 节点支持的日志版本，0表示未知，按最低版本处理
+}
+
+// doClusterMembers 管理raft group的成员：
+//
+//	GET    /v1/cluster/members          返回raft配置，任何节点都可以调用
+//	POST   /v1/cluster/members          加入voter或者learner
+//	DELETE /v1/cluster/members?id={id}  移除节点，用于替换故障的机器
+//
+// 修改成员的请求只能由leader执行，follower会把请求交给leader
+func (h *httpServer) doClusterMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		servers, err := h.cache.Configuration()
+		if err != nil {
+			h.writeV1Error(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			Servers []cache.Server `json:"servers"`
+		}{servers})
+	case http.MethodPost:
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			return
+		}
+		if req.Address == "" {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "empty address")
+			return
+		}
+		if req.ID == "" {
+			req.ID = req.Address
+		}
+		if err := h.cache.DoAddServer(req.ID, req.Address, req.HttpAddress, req.LogVersion, !req.Nonvoter); err != nil {
+			h.writeV1Error(w, err)
+			return
+		}
+		h.log.Printf("add server %s(%s), nonvoter:%v", req.ID, req.Address, req.Nonvoter)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		h.doMembership(w, r, h.cache.DoRemoveServer)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+	}
+}
+
+// doDemote POST /v1/cluster/demote?id={id} 把voter降级为learner
+func (h *httpServer) doDemote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	h.doMembership(w, r, h.cache.DoDemoteVoter)
+}
+
+// doTransferLeader POST /v1/cluster/transfer-leader?id={id} 转移leader，
+// 没有id时由raft选择日志最新的voter
+func (h *httpServer) doTransferLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if err := h.cache.DoTransferLeadership(id); err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	h.log.Printf("transfer leadership to %q", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// doMembership 执行以id为参数的成员变更
+func (h *httpServer) doMembership(w http.ResponseWriter, r *http.Request, change func(id string) error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "empty id")
+		return
+	}
+	if err := change(id); err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	h.log.Printf("%s %s %s", r.Method, r.URL.Path, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// doClusterStats GET /v1/cluster/stats 返回本节点raft的运行状态
+func (h *httpServer) doClusterStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.cache.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// touchPath 是follower把读命中的滑动过期key交给leader的接口，由cache包中的follower调用
+const touchPath = cache.TouchPath
+
+// doTouch POST /v1/cluster/touch 请求体为key的json数组，follower把读命中的滑动过期key交给leader顺延
+func (h *httpServer) doTouch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	var keys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(&keys); err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err := h.cache.DoTouch(r.Context(), keys); err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMembershipErrors(t *testing.T) {
+	h := &httpServer{log: log.New(io.Discard, "", 0)}
+	cases := []struct {
+		url    string
+		err    error
+		status int
+		code   string
+	}{
+		{"/v1/cluster/members?id=n1", nil, http.StatusNoContent, ""},
+		{"/v1/cluster/members", nil, http.StatusBadRequest, codeInvalidArgument},
+		{"/v1/cluster/members?id=n1", fmt.Errorf("%w: n1", cache.ErrServerNotFound), http.StatusNotFound, codeNotFound},
+		{"/v1/cluster/members?id=n1", cache.ErrNotLeader, http.StatusServiceUnavailable, codeNotLeader},
+	}
+	for _, c := range cases {
+		var changed string
+		w := httptest.NewRecorder()
+		h.doMembership(w, httptest.NewRequest(http.MethodDelete, c.url, nil), func(id string) error {
+			changed = id
+			return c.err
+		})
+		if w.Code != c.status {
+			t.Errorf("%s with %v: got status %d; want %d", c.url, c.err, w.Code, c.status)
+			continue
+		}
+		if c.code == "" {
+			if changed != "n1" {
+				t.Errorf("%s: got id %q; want n1", c.url, changed)
+			}
+			continue
+		}
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != c.code {
+			t.Errorf("%s with %v: got %+v, %v; want code %s", c.url, c.err, body.Error, err, c.code)
+		}
+	}
+}
+
+func TestRingEpoch(t *testing.T) {
+	proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: "127.0.0.1:8000"}}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add("127.0.0.1:8000", "127.0.0.1:8001")
+	ring.Epoch = 3
+	proxy.SetPeers(ring)
+	h := &httpServer{cache: proxy, log: log.New(io.Discard, "", 0)}
+
+	cases := []struct {
+		handler func(http.ResponseWriter, *http.Request)
+		url     string
+		status  int
+		epoch   uint64
+		peers   int
+	}{
+		// 没有发起方发布的epoch时不修改哈希环
+		{h.addPeer, "/addpeer?peerAddress=127.0.0.1:8002", http.StatusBadRequest, 3, 2},
+		// 采用发起方发布的epoch，而不是在本节点的epoch上加1
+		{h.addPeer, "/addpeer?peerAddress=127.0.0.1:8002&epoch=7", http.StatusOK, 7, 3},
+		// 重复的通知不再修改
+		{h.addPeer, "/addpeer?peerAddress=127.0.0.1:8002&epoch=7", http.StatusOK, 7, 3},
+		// 比本节点旧的通知不会让哈希环倒退
+		{h.removePeer, "/removepeer?peerAddress=127.0.0.1:8002&epoch=5", http.StatusOK, 7, 3},
+		{h.removePeer, "/removepeer?peerAddress=127.0.0.1:8002&epoch=8", http.StatusOK, 8, 2},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest(http.MethodGet, c.url, nil))
+		ring := proxy.Peers()
+		if w.Code != c.status || ring.Epoch != c.epoch || len(ring.GetPeers()) != c.peers {
+			t.Fatalf("%s: got status %d epoch %d peers %v; want %d %d and %d peers", c.url, w.Code, ring.Epoch, ring.GetPeers(), c.status, c.epoch, c.peers)
+		}
+	}
+}
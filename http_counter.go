@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// doIncr 处理/incr、/decr、/incrby和/decrby，sign为1表示加，-1表示减，
+// fixed不为0时使用fixed作为增量，否则从incr参数(/decrby为decr参数)读取，返回计算后的值
+func (h *httpServer) doIncr(sign int64, fixed int64, param string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := r.URL.Query()
+
+		key := vars.Get("key")
+		incr := fixed
+		if incr == 0 {
+			n, err := strconv.ParseInt(vars.Get(param), 10, 64)
+			if err != nil {
+				h.log.Printf("%s error, invalid %s", r.URL.Path, param)
+				fmt.Fprint(w, "param error\n")
+				return
+			}
+			incr = n
+		}
+		if key == "" || (sign < 0 && incr == math.MinInt64) {
+			h.log.Printf("%s error, get nil key or overflowed decrement", r.URL.Path)
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+		value, err := h.cache.DoIncrBy(r.Context(), key, sign*incr)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", value)
+	}
+}
+
+// doIncrByFloat 将key的浮点数值加上incr参数，返回计算后的值
+func (h *httpServer) doIncrByFloat(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	incr, err := cache.ParseScore(vars.Get("incr"))
+	if key == "" || err != nil {
+		h.log.Println("doIncrByFloat() error, get nil key or invalid incr")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	value, err := h.cache.DoIncrByFloat(r.Context(), key, incr)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", cache.FormatFloat(value))
+}
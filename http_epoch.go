@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"net/http"
+	"strconv"
+)
+
+/*
+*
+misrouted 处理转发过来(带forwardedHeader)、但在本节点的哈希环上不属于本节点的请求：
+返回421，响应头和错误中带上本节点哈希环的epoch以及负责key的节点的地址，负责key的是分片组时
+返回分片组中优先使用的节点，请求不再继续转发。
+
+发送方的epoch比本节点新说明本节点的哈希环已经过时，epoch比本节点旧说明发送方的哈希环过时，
+两种情况下请求都不会落到错误的分片上，发送方或者客户端刷新哈希环后重试即可
+*/
+func (h *httpServer) misrouted(w http.ResponseWriter, r *http.Request, owner string) bool {
+	if r.Header.Get(forwardedHeader) == "" {
+		return false
+	}
+	epoch := h.cache.Peers().Epoch
+	if sender, err := strconv.ParseUint(r.Header.Get(cache.EpochHeader), 10, 64); err == nil && sender > epoch {
+		h.log.Printf("ring epoch %d is behind epoch %d of %s", epoch, sender, r.Header.Get(forwardedHeader))
+	}
+
+	e := h.movedError(owner, epoch)
+	w.Header().Set(cache.EpochHeader, strconv.FormatUint(epoch, 10))
+	w.Header().Set(cache.OwnerHeader, e.Owner)
+	if isV1(r) {
+		encodeAPIError(w, http.StatusMisdirectedRequest, e)
+		return true
+	}
+	http.Error(w, e.Message, http.StatusMisdirectedRequest)
+	return true
+}
+
+// publishedEpoch 读取/addpeer和/removepeer中发起变更的节点发布的epoch。
+// epoch只由发起方递增，接收方采用同一个epoch，同一个哈希环在各个节点上的epoch相同
+func publishedEpoch(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("epoch")
+	epoch, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || epoch == 0 {
+		return 0, fmt.Errorf("invalid epoch %q", v)
+	}
+	return epoch, nil
+}
+
+// movedError 返回key在epoch版本的哈希环上属于owner的错误，owner是分片组时错误中带上它的节点地址
+func (h *httpServer) movedError(owner string, epoch uint64) *apiError {
+	address := h.cache.Address(owner)
+	message := fmt.Sprintf("moved to %s at ring epoch %d", address, epoch)
+	if address != owner {
+		message = fmt.Sprintf("moved to group %s (%s) at ring epoch %d", owner, address, epoch)
+	}
+	return &apiError{Code: codeWrongNode, Message: message, Owner: address, Epoch: epoch}
+}
+
+// copyMoved 把对端moved响应中的epoch和owner写回给请求方
+func copyMoved(w http.ResponseWriter, resp *http.Response) {
+	for _, name := range []string{cache.EpochHeader, cache.OwnerHeader} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+}
+
+func encodeAPIError(w http.ResponseWriter, status int, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{e})
+}
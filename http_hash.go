@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"net/http"
+	"strconv"
+)
+
+// writeCommandError 按错误类型返回对应的状态码
+func (h *httpServer) writeCommandError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, lru_k.ErrOutOfMemory):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	case errors.Is(err, cache.ErrWrongType), errors.Is(err, cache.ErrNotInteger),
+		errors.Is(err, cache.ErrNotFloat), errors.Is(err, cache.ErrNaN):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, cache.ErrNotLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		h.log.Printf("command failed:%v", err)
+		fmt.Fprint(w, "internal error\n")
+	}
+}
+
+// doHSet 设置hash的field，field和value参数可以重复多次，按顺序一一对应，返回新增的field数量
+func (h *httpServer) doHSet(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	fields, values := vars["field"], vars["value"]
+	if key == "" || len(fields) == 0 || len(fields) != len(values) {
+		h.log.Println("doHSet() error, get nil key or mismatched field and value")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	pairs := make([]string, 0, len(fields)*2)
+	for i := range fields {
+		pairs = append(pairs, fields[i], values[i])
+	}
+	added, err := h.cache.DoHSet(r.Context(), key, pairs)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", added)
+}
+
+// doHGet 返回hash中field的值，field不存在时返回404
+func (h *httpServer) doHGet(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, field := vars.Get("key"), vars.Get("field")
+	if key == "" || field == "" {
+		h.log.Println("doHGet() error, get nil key or nil field")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	value, ok, err := h.cache.DoHGet(key, field)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(value)
+}
+
+// doHGetAll 以json对象返回hash中所有的field，key不存在时返回空对象
+func (h *httpServer) doHGetAll(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doHGetAll() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	fields, err := h.cache.DoHGetAll(key)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
+
+// doHDel 删除hash中的field，field参数可以重复多次，返回实际删除的数量
+func (h *httpServer) doHDel(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, fields := vars.Get("key"), vars["field"]
+	if key == "" || len(fields) == 0 {
+		h.log.Println("doHDel() error, get nil key or nil field")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	removed, err := h.cache.DoHDel(r.Context(), key, fields)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", removed)
+}
+
+// doHIncrBy 将hash中field的值加上incr，返回相加后的值
+func (h *httpServer) doHIncrBy(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, field := vars.Get("key"), vars.Get("field")
+	incr, err := strconv.ParseInt(vars.Get("incr"), 10, 64)
+	if key == "" || field == "" || err != nil {
+		h.log.Println("doHIncrBy() error, get nil key, nil field or invalid incr")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	value, err := h.cache.DoHIncrBy(r.Context(), key, field, incr)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", value)
+}
+
+// doHLen 返回hash中field的数量，key不存在时返回0
+func (h *httpServer) doHLen(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doHLen() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	n, err := h.cache.Cache.HLen(key)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", n)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// leaderHeader 是follower返回的leader提示，值为leader的http地址
+	leaderHeader = cache.LeaderHeader
+
+	// leaderForwardedHeader 标记请求是follower转发给leader的，收到的节点也不是leader时
+	// 说明两个节点对leader的判断不一致，直接返回503，避免请求在follower之间来回转发
+	leaderForwardedHeader = "X-Gedis-Leader-Forwarded"
+)
+
+// leaderOnly 包装写接口，只有leader可以执行写命令，执行成功的响应带有会话token。
+// follower收到写请求时，默认把请求原样转发给leader并把响应写回，开启-redirectwrites时
+// 返回307重定向到leader，两种情况下响应都带有leaderHeader，客户端可以据此直接连接leader
+func (h *httpServer) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.cache.IsLeader() {
+			session := &cache.Session{}
+			next(&sessionWriter{ResponseWriter: w, session: session}, r.WithContext(cache.WithSession(r.Context(), session)))
+			return
+		}
+		h.sendToLeader(w, r)
+	}
+}
+
+// sendToLeader 把本节点不能执行的请求交给leader：转发或者返回307重定向
+func (h *httpServer) sendToLeader(w http.ResponseWriter, r *http.Request) {
+	leader, ok := h.cache.Leader()
+	if !ok || leader == h.cache.Opts.HttpAddress || r.Header.Get(leaderForwardedHeader) != "" {
+		h.log.Printf("%s %s rejected, not leader, leader:%q", r.Method, r.URL.Path, leader)
+		writeNotLeader(w, r)
+		return
+	}
+	w.Header().Set(leaderHeader, leader)
+	if h.cache.Opts.RedirectWrites {
+		http.Redirect(w, r, "http://"+leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	h.forwardToLeader(w, r, leader)
+}
+
+// writesOnly 只把/v1/keys这类读写共用的接口中的写请求交给leaderOnly，读请求直接交给next
+func (h *httpServer) writesOnly(next http.HandlerFunc) http.HandlerFunc {
+	write := h.leaderOnly(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
+
+// writeNotLeader 还没有选出leader时返回503，/v1接口返回json格式的错误
+func writeNotLeader(w http.ResponseWriter, r *http.Request) {
+	if isV1(r) {
+		writeAPIError(w, http.StatusServiceUnavailable, codeNotLeader, "leader unknown")
+		return
+	}
+	http.Error(w, "leader unknown", http.StatusServiceUnavailable)
+}
+
+func isV1(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/v1/")
+}
+
+// forwardToLeader 把请求原样转发给leader，保留请求体和forwardedHeader，
+// leader会继续按一致性hash把请求路由到负责key的分片
+func (h *httpServer) forwardToLeader(w http.ResponseWriter, r *http.Request, leader string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+leader+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		h.log.Printf("forward %s %s to leader %s failed:%v", r.Method, r.URL.Path, leader, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	for _, name := range []string{"Content-Type", forwardedHeader, cache.EpochHeader} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	req.Header.Set(leaderForwardedHeader, h.cache.Opts.HttpAddress)
+
+	// 阻塞命令可能超过peerClient的超时时间，这里只受原请求的context控制
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.log.Printf("forward %s %s to leader %s failed:%v", r.Method, r.URL.Path, leader, err)
+		if isV1(r) {
+			writeAPIError(w, http.StatusBadGateway, codePeerUnavailable, err.Error())
+		} else {
+			http.Error(w, fmt.Sprintf("leader %s unavailable", leader), http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	for _, name := range []string{"Content-Type", "Content-Length", "Allow", indexHeader} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// doPush 处理/lpush和/rpush，value参数可以重复多次，返回插入后list的长度
+func (h *httpServer) doPush(left bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := r.URL.Query()
+
+		key, values := vars.Get("key"), vars["value"]
+		if key == "" || len(values) == 0 {
+			h.log.Println("doPush() error, get nil key or nil value")
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+		n, err := h.cache.DoPush(r.Context(), key, values, left)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", n)
+	}
+}
+
+// doPop 处理/lpop和/rpop，返回弹出的元素，list为空时返回404
+func (h *httpServer) doPop(left bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			h.log.Println("doPop() error, get nil key")
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+		ret, err := h.cache.DoPop(r.Context(), []string{key}, left)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		if ret == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, ret.Value)
+	}
+}
+
+// doBlockingPop 处理/blpop和/brpop，key参数可以重复多次，从第一个非空的list中弹出元素，
+// 都为空时在leader上阻塞等待，timeout为等待的秒数(可以是小数)，0表示一直等待。
+// 返回json格式的{"key":..., "value":...}，超时返回404
+func (h *httpServer) doBlockingPop(left bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := r.URL.Query()
+
+		keys := vars["key"]
+		seconds, err := strconv.ParseFloat(vars.Get("timeout"), 64)
+		if len(keys) == 0 || err != nil || seconds < 0 {
+			h.log.Println("doBlockingPop() error, get nil key or invalid timeout")
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		// 所有key必须属于同一个分片，否则无法在一条raft日志中原子地弹出
+		peerAddress, ok := h.ownerOf(keys)
+		if !ok {
+			http.Error(w, "keys in request don't hash to the same node", http.StatusBadRequest)
+			return
+		}
+		if peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+
+		timeout := time.Duration(seconds * float64(time.Second))
+		ret, err := h.cache.DoBlockingPop(r.Context(), keys, left, timeout)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		if ret == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ret)
+	}
+}
+
+// doLRange 以json数组返回list中[start, stop]之间的元素，负数下标表示从末尾倒数
+func (h *httpServer) doLRange(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	start, err1 := strconv.ParseInt(vars.Get("start"), 10, 64)
+	stop, err2 := strconv.ParseInt(vars.Get("stop"), 10, 64)
+	if key == "" || err1 != nil || err2 != nil {
+		h.log.Println("doLRange() error, get nil key or invalid range")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	values, err := h.cache.DoLRange(key, start, stop)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	if values == nil {
+		values = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// doLLen 返回list的长度，key不存在时返回0
+func (h *httpServer) doLLen(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doLLen() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	n, err := h.cache.Cache.LLen(key)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+// doLTrim 只保留list中[start, stop]之间的元素
+func (h *httpServer) doLTrim(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	start, err1 := strconv.ParseInt(vars.Get("start"), 10, 64)
+	stop, err2 := strconv.ParseInt(vars.Get("stop"), 10, 64)
+	if key == "" || err1 != nil || err2 != nil {
+		h.log.Println("doLTrim() error, get nil key or invalid range")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	if err := h.cache.DoLTrim(r.Context(), key, start, stop); err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprint(w, "ok\n")
+}
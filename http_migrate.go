@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+*
+迁移来源分片的接口，由接收方的迁移任务调用，都在来源分片的leader上执行：
+
+	POST /v1/cluster/migrate/begin    请求体为{"ranges":[...]}，建立迁移会话，返回{"session":...}
+	GET  /v1/cluster/migrate/range    按hash值从小到大读取区间[start, end]中的key，返回下一页的起点next
+	POST /v1/cluster/migrate/dirty    取走会话建立以来写入过的key和它们当前的值，已经删除的key带deleted
+	POST /v1/cluster/migrate/freeze   冻结会话的区间，直到finish结束会话之前区间内的写入都返回503
+	POST /v1/cluster/migrate/finish   请求体为{"session":...,"ranges":[...]}，本节点的哈希环已经不负责这些区间时
+	                                  通过raft日志删除区间中的key，再结束会话
+
+会话丢失(来源分片重启或者切换了leader)时返回404，错误码为migration_not_found
+*/
+
+type migrationRequest struct {
+	Session string           `json:"session,omitempty"`
+	Ranges  []migrationRange `json:"ranges"`
+}
+
+type migrationResponse struct {
+	Session string                 `json:"session,omitempty"`
+	Entries []cache.MigrationEntry `json:"entries,omitempty"`
+	Next    int                    `json:"next,omitempty"`
+	Purged  int                    `json:"purged,omitempty"`
+}
+
+func (h *httpServer) doMigrateBegin(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeMigration(w, r)
+	if !ok {
+		return
+	}
+	session, err := h.cache.BeginMigration(toRangeNodes(req.Ranges))
+	if err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	h.log.Printf("migration session %s begin, ranges:%v", session, req.Ranges)
+	writeJSON(w, migrationResponse{Session: session})
+}
+
+// doMigrateRange 返回[start, end]中hash值最小的最多limit个key，hash值相同的key在同一页中返回，
+// 下一页从next开始，next大于end表示区间已经读完
+func (h *httpServer) doMigrateRange(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	start, err1 := strconv.Atoi(vars.Get("start"))
+	end, err2 := strconv.Atoi(vars.Get("end"))
+	limit, err3 := strconv.Atoi(vars.Get("limit"))
+	if err1 != nil || err2 != nil || err3 != nil || limit <= 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "invalid start, end or limit")
+		return
+	}
+	entries, next, err := h.cache.MigrationPage(vars.Get("session"), start, end, limit)
+	if err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	writeJSON(w, migrationResponse{Entries: entries, Next: next})
+}
+
+// doMigrateDirty 取走最多limit个脏key，按原样读取它们当前的值，已经删除或者过期的key带deleted
+func (h *httpServer) doMigrateDirty(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	limit, err := strconv.Atoi(vars.Get("limit"))
+	if err != nil || limit <= 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "invalid limit")
+		return
+	}
+	keys, err := h.cache.DrainMigration(vars.Get("session"), limit)
+	if err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	var ret migrationResponse
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		e, ok := h.cache.Cache.Entry(key, now)
+		if !ok {
+			e = cache.MigrationEntry{Key: []byte(key), Deleted: true}
+		}
+		ret.Entries = append(ret.Entries, e)
+	}
+	writeJSON(w, ret)
+}
+
+func (h *httpServer) doMigrateFreeze(w http.ResponseWriter, r *http.Request) {
+	if err := h.cache.FreezeMigration(r.URL.Query().Get("session")); err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	writeJSON(w, migrationResponse{})
+}
+
+// doMigrateFinish 在本节点的哈希环不再负责迁出的区间之后删除区间中的key，删除通过raft日志同步到follower，
+// 删除完成之后才结束会话，在此之前区间一直冻结，不会有接收方没有拷贝的写入被删除。
+// 会话可能已经丢失，删除的区间以请求中的ranges为准
+func (h *httpServer) doMigrateFinish(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeMigration(w, r)
+	if !ok {
+		return
+	}
+	// 按哈希环检查区间，区间中暂时没有key时也不能在切换之前结束会话
+	ring := h.cache.Peers()
+	for _, rg := range req.Ranges {
+		if ring.Owns(h.cache.Opts.HttpAddress, rg.Start, rg.End) {
+			writeAPIError(w, http.StatusConflict, codeInvalidArgument, fmt.Sprintf("range [%d, %d] is still owned by %s", rg.Start, rg.End, h.cache.Opts.HttpAddress))
+			return
+		}
+	}
+
+	keys := h.cache.Cache.KeysInRanges(toRangeNodes(req.Ranges))
+	purged := len(keys)
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchKeys {
+			n = maxBatchKeys
+		}
+		if err := h.cache.PurgeMigration(r.Context(), keys[:n]); err != nil {
+			h.writeV1Error(w, err)
+			return
+		}
+		keys = keys[n:]
+	}
+	if req.Session != "" {
+		h.cache.EndMigration(req.Session)
+	}
+	h.log.Printf("migration session %s finished, ranges:%v", req.Session, req.Ranges)
+	writeJSON(w, migrationResponse{Purged: purged})
+}
+
+func (h *httpServer) decodeMigration(w http.ResponseWriter, r *http.Request) (migrationRequest, bool) {
+	var req migrationRequest
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Ranges) == 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "invalid migration ranges")
+		return req, false
+	}
+	return req, true
+}
+
+func toRangeNodes(ranges []migrationRange) []consistenthash.RangeNode {
+	nodes := make([]consistenthash.RangeNode, len(ranges))
+	for i, r := range ranges {
+		nodes[i] = consistenthash.RangeNode{Start: r.Start, End: r.End}
+	}
+	return nodes
+}
+
+// doMigrations 处理/v1/cluster/migrations，返回本分片组作为接收方的迁移任务和移出哈希环时推送数据的记录，任何节点都可以查询
+func (h *httpServer) doMigrations(w http.ResponseWriter, r *http.Request) {
+	jobs := make([]*migrationJob, 0)
+	for id, state := range h.cache.MigrationJobs() {
+		job, err := decodeJob(state)
+		if err != nil {
+			h.log.Printf("decode migration %s failed:%v", id, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	writeJSON(w, struct {
+		Migrations []*migrationJob `json:"migrations"`
+	}{jobs})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 区间中没有key时也按哈希环检查归属，本节点还负责区间时不删除、不结束会话
+func TestMigrateFinishOwnedRange(t *testing.T) {
+	self := "127.0.0.1:8000"
+	h := newV1Server(self, self)
+	ring := h.cache.Peers().Clone()
+	ring.Add("127.0.0.1:8001")
+	h.cache.SetPeers(ring)
+
+	var owned, other int
+	for _, hash := range ring.Keys {
+		if ring.HashMap[hash] == self {
+			owned = hash
+		} else {
+			other = hash
+		}
+	}
+	for hash, status := range map[int]int{owned: http.StatusConflict, other: http.StatusOK} {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"ranges":[{"start":%d,"end":%d}]}`, hash, hash)
+		h.doMigrateFinish(w, httptest.NewRequest(http.MethodPost, "/v1/cluster/migrate/finish", strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("finish [%d, %d]: got status %d; want %d", hash, hash, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionWaitTimeout 没有指定max_staleness时，follower等待状态机应用到min_index的最长时间，
+// 超时后把请求交给leader
+const sessionWaitTimeout = time.Second
+
+// replicaHeader 标记请求是本分片的节点按-readpolicy交给副本的读请求，副本直接在本地读，不再分散
+const replicaHeader = "X-Gedis-Replica-Read"
+
+// consistentRead 包装读接口，按请求中的consistency、max_staleness和min_index参数选择读的一致性：
+//
+//	consistency=stale(默认)     直接读本地缓存
+//	consistency=leader          在leader上读，依赖leader租约
+//	consistency=linearizable    在leader上按ReadIndex读
+//	max_staleness=500ms         stale读时follower最多落后leader的时间
+//	min_index={token}           读己之写，等负责key的分片组的状态机应用到写命令返回的index再读
+//
+// 一致性只能由负责key的分片组检查：key属于其他分片时不在本节点检查，handler把请求连同这些参数
+// 转发给负责的分片组，不是stale读时交给它的leader；批量读的key可能属于多个分片，由doBatch
+// 对本节点负责的key检查。follower不满足要求时和写请求一样把请求交给leader执行。
+// stale读请求按-readpolicy在本分片的副本(包括learner)之间分散，副本再按上面的参数检查自己的一致性
+func (h *httpServer) consistentRead(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		level, _, _, err := parseConsistency(r)
+		if err != nil {
+			h.log.Printf("%s %s error, %v", r.Method, r.URL.Path, err)
+			if isV1(r) {
+				writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			} else {
+				fmt.Fprint(w, "param error\n")
+			}
+			return
+		}
+		if !h.ownsRead(r) {
+			next(w, r)
+			return
+		}
+
+		if level == cache.ConsistencyStale && h.spreadable(r) {
+			replica, done := h.cache.PickReplica()
+			defer done()
+			if replica != h.cache.Opts.HttpAddress && h.forwardToReplica(w, r, replica) {
+				return
+			}
+		}
+
+		switch err := h.readBarrier(r); {
+		case err == nil:
+			next(w, r)
+		case h.leaderReads(err):
+			h.sendToLeader(w, r)
+		default:
+			h.log.Printf("%s %s read barrier failed:%v", r.Method, r.URL.Path, err)
+			if isV1(r) {
+				writeAPIError(w, http.StatusServiceUnavailable, codeNotLeader, err.Error())
+			} else {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+		}
+	}
+}
+
+// readBarrier 在本节点的分片组上检查读请求的一致性，参数已经由consistentRead校验过
+func (h *httpServer) readBarrier(r *http.Request) error {
+	level, maxStaleness, minIndex, err := parseConsistency(r)
+	if err != nil {
+		return err
+	}
+	err = h.cache.ReadBarrier(level, maxStaleness)
+	if err == nil && minIndex > 0 {
+		timeout := maxStaleness
+		if timeout <= 0 {
+			timeout = sessionWaitTimeout
+		}
+		err = h.cache.WaitIndex(minIndex, timeout)
+	}
+	return err
+}
+
+// leaderReads 判断readBarrier失败时是否应该把读请求交给本分片组的leader
+func (h *httpServer) leaderReads(err error) bool {
+	return errors.Is(err, cache.ErrNotLeader) || errors.Is(err, cache.ErrStaleRead) && !h.cache.IsLeader()
+}
+
+// ownsRead 判断读请求的key是否都属于本节点，只有这时才在本节点的分片组上检查一致性。
+// /v1/mget的key在请求体中，总是交给doBatch按分片分别检查
+func (h *httpServer) ownsRead(r *http.Request) bool {
+	if r.URL.Path == "/v1/mget" {
+		return false
+	}
+	keys := r.URL.Query()["key"]
+	if strings.HasPrefix(r.URL.EscapedPath(), keysPrefix) {
+		key, _ := pathKey(r)
+		keys = []string{key}
+	}
+	for _, key := range keys {
+		if h.cache.Peers().Get(key) != h.cache.Opts.HttpAddress {
+			return false
+		}
+	}
+	return true
+}
+
+// consistencyParams 返回请求中的一致性参数，读其他分片的key时原样带给负责的分片组
+func consistencyParams(vars url.Values) url.Values {
+	params := url.Values{}
+	for _, name := range []string{"consistency", "max_staleness", "min_index"} {
+		if v := vars.Get(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	return params
+}
+
+func parseConsistency(r *http.Request) (level cache.Consistency, maxStaleness time.Duration, minIndex uint64, err error) {
+	vars := r.URL.Query()
+	if level, err = cache.ParseConsistency(vars.Get("consistency")); err != nil {
+		return 0, 0, 0, err
+	}
+	if s := vars.Get("max_staleness"); s != "" {
+		if maxStaleness, err = time.ParseDuration(s); err != nil || maxStaleness <= 0 {
+			return 0, 0, 0, fmt.Errorf("invalid max_staleness %q", s)
+		}
+	}
+	if s := vars.Get("min_index"); s != "" {
+		if minIndex, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid min_index %q", s)
+		}
+	}
+	return level, maxStaleness, minIndex, nil
+}
+
+// spreadable 判断读请求能否交给本分片的其他副本：只读一个key，key属于本节点，
+// 并且不是其他节点为了一致性或者分散读转发过来的
+func (h *httpServer) spreadable(r *http.Request) bool {
+	if r.Header.Get(replicaHeader) != "" || r.Header.Get(leaderForwardedHeader) != "" {
+		return false
+	}
+	var key string
+	if strings.HasPrefix(r.URL.EscapedPath(), keysPrefix) {
+		key, _ = pathKey(r)
+	} else if keys := r.URL.Query()["key"]; len(keys) == 1 {
+		key = keys[0]
+	}
+	return key != "" && h.cache.Peers().Get(key) == h.cache.Opts.HttpAddress
+}
+
+// forwardToReplica 把读请求交给副本并把响应写回，副本不可用时返回false，由本节点自己处理
+func (h *httpServer) forwardToReplica(w http.ResponseWriter, r *http.Request, replica string) bool {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+replica+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set(replicaHeader, h.cache.Opts.HttpAddress)
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		h.log.Printf("forward %s %s to replica %s failed:%v", r.Method, r.URL.Path, replica, err)
+		h.cache.MarkReplicaDown(replica)
+		return false
+	}
+	defer resp.Body.Close()
+	for _, name := range []string{"Content-Type", "Content-Length", "Allow", leaderHeader} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
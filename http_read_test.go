@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsistentReadRemoteKey(t *testing.T) {
+	// 本节点不在哈希环上，所有key都属于其他分片，一致性由负责的分片组检查
+	proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: "127.0.0.1:8000"}}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add("127.0.0.1:8001")
+	proxy.SetPeers(ring)
+	h := &httpServer{cache: proxy, log: log.New(io.Discard, "", 0)}
+
+	for _, url := range []string{
+		"/get?key=a&consistency=linearizable&min_index=9",
+		"/v1/keys/a?consistency=leader&min_index=9",
+		"/sinter?key=a&key=b&min_index=9",
+		"/v1/mget?consistency=linearizable",
+	} {
+		called := false
+		w := httptest.NewRecorder()
+		h.consistentRead(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if got := consistencyParams(r.URL.Query()).Get("min_index"); url != "/v1/mget?consistency=linearizable" && got != "9" {
+				t.Errorf("%s: got min_index %q; want it forwarded", url, got)
+			}
+		})(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if !called {
+			t.Errorf("%s: got status %d; want the handler to forward it", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// leaveFreezeGrace 本节点的哈希环切换之后继续冻结迁出区间的时间，不短于转发请求的超时时间
+const leaveFreezeGrace = 10 * time.Second
+
+/*
+*
+removeNode 处理/removenode，把本节点(使用分片控制器时是本分片组)移出集群，由leader执行，复用扩容时来源分片的迁移会话：
+
+ 1. 计算本节点负责的区间，以及移除后接管每个区间的节点，为这些区间建立迁移会话，之后区间内的写入都记录为脏key
+ 2. 按hash值分页读取区间中的key，按原样(类型、value和存活时间)通过/v1/cluster/import推送给接管的节点，
+    对端提交raft日志之后才返回，数据已经持久化
+ 3. 多轮推送脏key，已经删除的key在对端也删除；之后冻结区间，再推送最后的脏key，冻结期间区间内的写入返回503
+ 4. 全部推送成功后才修改哈希环：先修改自己的哈希环，之后转发过来的请求返回moved、本节点收到的请求转发给接管的节点；
+    再通知哈希环上的其他节点和本raft group的follower调用/removepeer，使用分片控制器时改为从控制器中移除本分片组，
+    并通过raft日志记录推送完成。本节点的哈希环切换之后再过leaveFreezeGrace才结束会话，冻结没有超时
+
+修改哈希环之前的任何一步失败都会结束会话，哈希环不变，key仍然由本节点负责，可以重新执行。
+切换之前区间已经冻结，接管的节点上不会有更新的写入被推送的旧值覆盖
+*/
+func (h *httpServer) removeNode(w http.ResponseWriter, r *http.Request) {
+	self := h.cache.Opts.HttpAddress
+	ring := h.cache.Peers()
+	if !contains(ring.GetPeers(), self) {
+		http.Error(w, self+" is not in the ring", http.StatusConflict)
+		return
+	}
+	ranges := ring.GetRemoveRange(self)
+	if len(ranges) == 0 {
+		http.Error(w, "cannot remove the last node in the ring", http.StatusConflict)
+		return
+	}
+
+	session, err := h.cache.BeginMigration(ranges)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	pushed, err := h.pushRanges(session, ranges)
+	if err != nil {
+		h.cache.EndMigration(session)
+		h.log.Printf("remove node %s failed:%v", self, err)
+		http.Error(w, fmt.Sprintf("migrate failed, ring unchanged: %v", err), http.StatusBadGateway)
+		return
+	}
+	h.log.Printf("remove node %s, %d keys migrated to %v", self, pushed, ranges)
+
+	// leaveRing返回时本节点的哈希环已经切换，区间内的请求都交给接管的节点，或者哈希环没有修改，
+	// 区间仍由本节点负责，这时才结束会话恢复写入。冻结没有超时，不会在切换之前提前恢复。
+	// 切换之前已经按旧的哈希环检查过归属、还没有提交的写入在leaveFreezeGrace内仍然被拒绝
+	err = h.leaveRing(r.Context(), ring, pushed)
+	if contains(h.cache.Peers().GetPeers(), self) {
+		h.cache.EndMigration(session)
+	} else {
+		time.AfterFunc(leaveFreezeGrace, func() { h.cache.EndMigration(session) })
+	}
+	if err != nil {
+		h.log.Printf("remove node %s failed:%v", self, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s removed, %d keys migrated\n", self, pushed)
+}
+
+// pushRanges 把会话区间中的key推送给接管区间的节点，再追赶脏key，返回时区间已经冻结，
+// 冻结之前的写入都已经推送。返回推送的key数量，包括重新推送的脏key
+func (h *httpServer) pushRanges(session string, ranges []consistenthash.RangeNode) (int, error) {
+	pushed := 0
+	for _, rangeNode := range ranges {
+		for next := rangeNode.Start; next <= rangeNode.End; {
+			entries, n, err := h.cache.MigrationPage(session, next, rangeNode.End, migratePageKeys)
+			if err != nil {
+				return pushed, err
+			}
+			if err := h.pushEntries(rangeNode.RealNode, entries); err != nil {
+				return pushed, err
+			}
+			pushed += len(entries)
+			next = n
+		}
+	}
+
+	for round := 0; round < migrateDirtyRounds; round++ {
+		n, err := h.pushDirty(session, ranges)
+		pushed += n
+		if err != nil {
+			return pushed, err
+		}
+		if n < migrateDirtyThreshold {
+			break
+		}
+	}
+	if err := h.cache.FreezeMigration(session); err != nil {
+		return pushed, err
+	}
+	for {
+		n, err := h.pushDirty(session, ranges)
+		pushed += n
+		if err != nil || n == 0 {
+			return pushed, err
+		}
+	}
+}
+
+// pushDirty 取走一批脏key，按接管的节点推送它们当前的值，已经删除或者过期的key带deleted，返回取走的数量
+func (h *httpServer) pushDirty(session string, ranges []consistenthash.RangeNode) (int, error) {
+	keys, err := h.cache.DrainMigration(session, migratePageKeys)
+	if err != nil {
+		return 0, err
+	}
+	batches := make(map[string][]cache.MigrationEntry)
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		e, ok := h.cache.Cache.Entry(key, now)
+		if !ok {
+			e = cache.MigrationEntry{Key: []byte(key), Deleted: true}
+		}
+		hash := int(consistenthash.Murmur3([]byte(key)))
+		for _, rangeNode := range ranges {
+			if hash >= rangeNode.Start && hash <= rangeNode.End {
+				batches[rangeNode.RealNode] = append(batches[rangeNode.RealNode], e)
+				break
+			}
+		}
+	}
+	for owner, entries := range batches {
+		if err := h.pushEntries(owner, entries); err != nil {
+			return len(keys), err
+		}
+	}
+	return len(keys), nil
+}
+
+// pushEntries 把迁移的key推送给owner，对端提交raft日志之后才返回
+func (h *httpServer) pushEntries(owner string, entries []cache.MigrationEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := h.migrationCall(owner, http.MethodPost, "/v1/cluster/import", migrationResponse{Entries: entries}, nil); err != nil {
+		return fmt.Errorf("import to %s: %w", owner, err)
+	}
+	return nil
+}
+
+/*
+*
+leaveRing 把本节点移出哈希环，返回时本节点的哈希环已经不包含自己，或者返回错误并且集群中的哈希环都没有修改：
+
+  - 使用分片控制器时从控制器中移除本分片组，再通过raft日志记录推送完成，其他节点看到这条记录后
+    才切换到移出本分片组的配置，见applyConfig。本分片组已经移出配置，记录一直重试到成功或者本节点不再是leader，
+    不再是leader时会话已经丢弃，返回错误
+  - 否则先修改自己的哈希环，再通知哈希环上的其他节点和本raft group的其他节点，
+    哈希环上的节点再通知它们所在raft group的其他节点，follower的哈希环同样切换
+*/
+func (h *httpServer) leaveRing(ctx context.Context, ring *consistenthash.Map, pushed int) error {
+	self := h.cache.Opts.HttpAddress
+	if h.ctrler != nil {
+		cfg, err := h.ctrler.Leave(ctx, h.cache.Opts.GID)
+		if err != nil {
+			return fmt.Errorf("leave shard controller, ring unchanged: %w", err)
+		}
+		after := cfg.Peers(h.cache.Opts.GID, self)
+		job := &migrationJob{ID: configJobID(cfg.Num), Phase: phaseDone, Before: ring, After: after, Copied: pushed, Started: time.Now()}
+		for {
+			err := h.saveJob(job)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, cache.ErrNotLeader) {
+				return fmt.Errorf("left shard config %d, but lost leadership before recording the push: %w", cfg.Num, err)
+			}
+			h.log.Printf("record the push of shard config %d failed:%v", cfg.Num, err)
+			time.Sleep(ctrlerRetryInterval)
+		}
+		h.cache.SetPeers(after)
+		return nil
+	}
+
+	// 新的epoch只在这里递增一次，其他节点采用通知中的epoch
+	peers := ring.Clone()
+	peers.Remove(self)
+	peers.Epoch++
+	h.cache.SetPeers(peers)
+	failed := h.notifyRemovePeer(peers.GetPeers(), self, peers.Epoch, true)
+	failed = append(failed, h.notifyRemovePeer(h.groupMembers(self), self, peers.Epoch, false)...)
+	if len(failed) > 0 {
+		return fmt.Errorf("removed from the ring, but %v still route to %s, retry /removepeer?peerAddress=%s&epoch=%d&relay=true on them", failed, self, self, peers.Epoch)
+	}
+	return nil
+}
+
+// notifyRemovePeer 通知addresses中的每个节点把peer移出哈希环，relay为true时对方再通知它所在raft group的其他节点，
+// 返回通知失败的节点
+func (h *httpServer) notifyRemovePeer(addresses []string, peer string, epoch uint64, relay bool) []string {
+	var failed []string
+	for _, address := range addresses {
+		uri := fmt.Sprintf("http://%s/removepeer?peerAddress=%s&epoch=%d", address, url.QueryEscape(peer), epoch)
+		if relay {
+			uri += "&relay=true"
+		}
+		resp, err := peerClient.Get(uri)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			h.log.Printf("notify %s to remove %s failed:%v", address, peer, err)
+			failed = append(failed, address)
+		}
+	}
+	return failed
+}
+
+// groupMembers 返回本raft group中除了本节点和exclude以外的节点的http地址
+func (h *httpServer) groupMembers(exclude string) []string {
+	var addresses []string
+	for _, address := range h.cache.Members() {
+		if address != h.cache.Opts.HttpAddress && address != exclude && !contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// removePeer 处理/removepeer，把peerAddress移出本节点的哈希环，是/addpeer的逆操作。
+// 带relay=true时再通知本raft group的其他节点，有节点通知失败时返回502，重复的通知会再次转发
+func (h *httpServer) removePeer(w http.ResponseWriter, r *http.Request) {
+	if h.ringManaged(w) {
+		return
+	}
+	peerAddress := r.URL.Query().Get("peerAddress")
+	if peerAddress == "" || peerAddress == h.cache.Opts.HttpAddress {
+		http.Error(w, "invalid peerAddress "+peerAddress, http.StatusBadRequest)
+		return
+	}
+
+	epoch, err := publishedEpoch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 重复的通知不再修改，已经采用了更新的epoch的哈希环也不会倒退
+	ring := h.cache.Peers()
+	if ring.Epoch < epoch {
+		peers := ring.Clone()
+		peers.Remove(peerAddress)
+		peers.Epoch = epoch
+		h.cache.SetPeers(peers)
+		h.log.Printf("%s removePeer %s success, peers: %v", h.cache.Opts.HttpAddress, peerAddress, peers.GetPeers())
+	}
+	if r.URL.Query().Get("relay") == "true" {
+		if failed := h.notifyRemovePeer(h.groupMembers(peerAddress), peerAddress, epoch, false); len(failed) > 0 {
+			http.Error(w, fmt.Sprintf("%s removePeer %s, but notifying %v failed", h.cache.Opts.HttpAddress, peerAddress, failed), http.StatusBadGateway)
+			return
+		}
+	}
+	fmt.Fprintf(w, "%s removePeer %s success!", h.cache.Opts.HttpAddress, peerAddress)
+}
+
+// doImport 处理/v1/cluster/import，按原样写入迁出的节点推送过来的key，请求体为{"entries":[...]}，
+// 格式和迁移接口返回的entries一致，deleted的key删除。
+// 不检查key是否属于本节点：迁出的节点在数据持久化之后才修改哈希环
+func (h *httpServer) doImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	var req migrationResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if len(req.Entries) == 0 || len(req.Entries) > maxBatchKeys {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("import must contain 1 to %d keys", maxBatchKeys))
+		return
+	}
+	if err := h.applyMigrated(req.Entries); err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	writeJSON(w, migrationResponse{})
+}
+
+func contains(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
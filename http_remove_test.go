@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newInmemNode 启动单节点raft group中的节点，http服务监听在返回的地址上
+func newInmemNode(t *testing.T) (*httpServer, string) {
+	srv := httptest.NewUnstartedServer(nil)
+	address := srv.Listener.Addr().String()
+	proxy, err := cache.NewInmemCacheProxy(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Raft.Raft.Shutdown().Error() })
+	h := NewHttpServer(proxy)
+	h.log = log.New(io.Discard, "", 0)
+	srv.Config.Handler = h
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return h, address
+}
+
+// newRemovePair 返回哈希环上的两个节点src和dst，以及哈希环上属于src的n个key
+func newRemovePair(t *testing.T, n int) (src *httpServer, dst *httpServer, keys []string) {
+	src, srcAddr := newInmemNode(t)
+	dst, dstAddr := newInmemNode(t)
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add(srcAddr, dstAddr)
+	ring.Epoch = 1
+	src.cache.SetPeers(ring)
+	dst.cache.SetPeers(ring.Clone())
+	for i := 0; len(keys) < n; i++ {
+		if key := "k" + strconv.Itoa(i); ring.Get(key) == srcAddr {
+			keys = append(keys, key)
+		}
+	}
+	return src, dst, keys
+}
+
+// putKey 通过/v1/keys写入key，返回状态码
+func putKey(h *httpServer, key string, value string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/keys/"+url.PathEscape(key), strings.NewReader(value)))
+	return w.Code
+}
+
+func TestDoImport(t *testing.T) {
+	h, _ := newInmemNode(t)
+	if err := h.cache.DoSet(context.Background(), cache.OperSet, "old", "v"); err != nil {
+		t.Fatal(err)
+	}
+	entries := []cache.MigrationEntry{
+		{Key: []byte("new"), Type: cache.TypeString, Data: []byte("\x00v")},
+		{Key: []byte("old"), Deleted: true},
+	}
+	body, _ := json.Marshal(migrationResponse{Entries: entries})
+	w := httptest.NewRecorder()
+	h.doImport(w, httptest.NewRequest(http.MethodPost, "/v1/cluster/import", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if v, ok := h.cache.Cache.Get("new"); !ok || string(v) != "\x00v" {
+		t.Fatalf("got new=%q, %v; want the imported value", v, ok)
+	}
+	if _, ok := h.cache.Cache.Get("old"); ok {
+		t.Fatal("old was not deleted")
+	}
+
+	for _, c := range []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, `{"entries":[]}`, http.StatusBadRequest},
+		{http.MethodPost, `{`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.doImport(w, httptest.NewRequest(c.method, "/v1/cluster/import", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("%s %q: got status %d; want %d", c.method, c.body, w.Code, c.status)
+		}
+	}
+}
+
+// 冻结之前的写入和删除都推送给接管的节点，冻结之后区间内的写入被拒绝
+func TestPushRangesFreeze(t *testing.T) {
+	src, dst, keys := newRemovePair(t, 20)
+	for _, key := range keys {
+		if code := putKey(src, key, "0"); code != http.StatusNoContent {
+			t.Fatalf("put %s: got status %d", key, code)
+		}
+	}
+	self := src.cache.Opts.HttpAddress
+	ranges := src.cache.Peers().GetRemoveRange(self)
+	session, err := src.cache.BeginMigration(ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.cache.EndMigration(session)
+
+	// 拷贝期间的写入记录为脏key，由pushDirty推送，删除的key在对端也删除
+	if code := putKey(src, keys[0], "1"); code != http.StatusNoContent {
+		t.Fatalf("put %s: got status %d", keys[0], code)
+	}
+	if _, err := src.cache.DoMDel(context.Background(), []string{keys[1]}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := src.pushDirty(session, ranges)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v from pushDirty; want the 2 dirty keys", n, err)
+	}
+	if v, ok := dst.cache.Cache.Get(keys[0]); !ok || string(v) != "1" {
+		t.Fatalf("got %s=%q at the new owner; want 1", keys[0], v)
+	}
+	if _, ok := dst.cache.Cache.Get(keys[1]); ok {
+		t.Fatalf("%s deleted on the source is still at the new owner", keys[1])
+	}
+
+	// 和pushRanges并发的写入要么在冻结之前提交并被推送，要么被拒绝
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		acked = make(map[string]string)
+	)
+	for i, key := range keys[2:] {
+		wg.Add(1)
+		go func(key string, value string) {
+			defer wg.Done()
+			if putKey(src, key, value) == http.StatusNoContent {
+				mutex.Lock()
+				acked[key] = value
+				mutex.Unlock()
+			}
+		}(key, strconv.Itoa(i+2))
+	}
+	pushed, err := src.pushRanges(session, ranges)
+	wg.Wait()
+	if err != nil || pushed < len(keys)-1 {
+		t.Fatalf("got %d, %v from pushRanges; want at least %d keys", pushed, err, len(keys)-1)
+	}
+	for key, value := range acked {
+		if v, ok := dst.cache.Cache.Get(key); !ok || string(v) != value {
+			t.Errorf("got %s=%q at the new owner; want the acknowledged %s", key, v, value)
+		}
+	}
+
+	if code := putKey(src, keys[0], "2"); code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d for a write to a frozen range; want 503", code)
+	}
+	if _, err := src.cache.DoMDel(context.Background(), []string{keys[0]}); !errors.Is(err, cache.ErrMigrating) {
+		t.Fatalf("got %v for a delete in a frozen range; want ErrMigrating", err)
+	}
+}
+
+// 移除节点时并发的写入要么在冻结之前提交并推送给接管的节点，要么被拒绝，切换之后的写入转发给接管的节点
+func TestRemoveNode(t *testing.T) {
+	src, dst, keys := newRemovePair(t, 30)
+	self := src.cache.Opts.HttpAddress
+	acked := make(map[string]string)
+	for _, key := range keys {
+		if code := putKey(src, key, "0"); code != http.StatusNoContent {
+			t.Fatalf("put %s: got status %d", key, code)
+		}
+		acked[key] = "0"
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key, value := keys[i%len(keys)], strconv.Itoa(i)
+			if putKey(src, key, value) == http.StatusNoContent {
+				acked[key] = value
+			}
+		}
+	}()
+	w := httptest.NewRecorder()
+	src.removeNode(w, httptest.NewRequest(http.MethodGet, "/removenode", nil))
+	close(stop)
+	<-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	for key, value := range acked {
+		if v, ok := dst.cache.Cache.Get(key); !ok || string(v) != value {
+			t.Errorf("got %s=%q at the new owner; want the acknowledged %s", key, v, value)
+		}
+	}
+	for name, h := range map[string]*httpServer{"source": src, "new owner": dst} {
+		if ring := h.cache.Peers(); contains(ring.GetPeers(), self) || ring.Epoch != 2 {
+			t.Errorf("got ring %v at epoch %d on the %s; want %s removed at epoch 2", ring.GetPeers(), ring.Epoch, name, self)
+		}
+	}
+	if code := putKey(src, keys[0], "after"); code != http.StatusNoContent {
+		t.Fatalf("got status %d for a write after removal; want it forwarded", code)
+	}
+	if v, _ := dst.cache.Cache.Get(keys[0]); string(v) != "after" {
+		t.Fatalf("got %s=%q at the new owner; want after", keys[0], v)
+	}
+}
+
+// /removepeer修改哈希环并通知本raft group的其他节点，重复和过时的通知不会让哈希环倒退
+func TestRemovePeer(t *testing.T) {
+	h, self := newInmemNode(t)
+	var (
+		mutex          sync.Mutex
+		relayed        []url.Values
+		followerStatus = http.StatusOK
+	)
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		relayed = append(relayed, r.URL.Query())
+		w.WriteHeader(followerStatus)
+	}))
+	defer follower.Close()
+	followerAddr := strings.TrimPrefix(follower.URL, "http://")
+	if err := h.cache.DoSetMember("follower", followerAddr, 0); err != nil {
+		t.Fatal(err)
+	}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add(self, "127.0.0.1:1", "127.0.0.1:2")
+	ring.Epoch = 1
+	h.cache.SetPeers(ring)
+
+	removePeer := func(query string) int {
+		w := httptest.NewRecorder()
+		h.removePeer(w, httptest.NewRequest(http.MethodGet, "/removepeer?"+query, nil))
+		return w.Code
+	}
+	if code := removePeer("peerAddress=127.0.0.1:1&epoch=2&relay=true"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if ring := h.cache.Peers(); contains(ring.GetPeers(), "127.0.0.1:1") || ring.Epoch != 2 {
+		t.Fatalf("got ring %v at epoch %d; want 127.0.0.1:1 removed at epoch 2", ring.GetPeers(), ring.Epoch)
+	}
+	if len(relayed) != 1 || relayed[0].Get("peerAddress") != "127.0.0.1:1" || relayed[0].Get("epoch") != "2" || relayed[0].Get("relay") != "" {
+		t.Fatalf("got %v at the follower; want one notification without relay", relayed)
+	}
+
+	// 过时的epoch不修改哈希环，不带relay时不通知其他节点
+	if code := removePeer("peerAddress=127.0.0.1:2&epoch=1"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if ring := h.cache.Peers(); !contains(ring.GetPeers(), "127.0.0.1:2") || ring.Epoch != 2 || len(relayed) != 1 {
+		t.Fatalf("got ring %v at epoch %d and %d notifications; want the ring unchanged", ring.GetPeers(), ring.Epoch, len(relayed))
+	}
+
+	// 重复的通知再次转发，follower失败时返回502，可以重试
+	mutex.Lock()
+	followerStatus = http.StatusInternalServerError
+	mutex.Unlock()
+	if code := removePeer("peerAddress=127.0.0.1:1&epoch=2&relay=true"); code != http.StatusBadGateway || len(relayed) != 2 {
+		t.Fatalf("got status %d and %d notifications; want 502 after notifying the follower again", code, len(relayed))
+	}
+
+	for _, query := range []string{"peerAddress=" + self + "&epoch=3", "peerAddress=&epoch=3", "peerAddress=127.0.0.1:2", "peerAddress=127.0.0.1:2&epoch=0"} {
+		if code := removePeer(query); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d; want 400", query, code)
+		}
+	}
+	if peers := h.groupMembers(""); fmt.Sprint(peers) != fmt.Sprint([]string{followerAddr}) {
+		t.Fatalf("got members %v; want only the follower", peers)
+	}
+}
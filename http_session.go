@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/Emiliaab/gedis/cache"
+	"net/http"
+	"strconv"
+)
+
+// indexHeader 是写命令返回的会话token，值为写命令所在的raft日志的index。
+// 之后的读请求带上min_index={token}，负责key的分片会等本地状态机应用到这个index再读，保证读己之写。
+// index只在同一个raft group内有意义，token只对同一个分片的key有效
+const indexHeader = "X-Gedis-Index"
+
+// sessionWriter 在写命令的响应头中加上indexHeader。请求通过ctx中的cache.Session
+// 记录自己提交的写日志的index，没有提交写日志的请求不返回token
+type sessionWriter struct {
+	http.ResponseWriter
+	session *cache.Session
+	wrote   bool
+	skip    bool // 请求被转发给了其他分片，本地的index没有意义
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.wrote = true
+		if index := w.session.Index(); !w.skip && index > 0 && status < http.StatusBadRequest {
+			w.Header().Set(indexHeader, strconv.FormatUint(index, 10))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// skipSessionToken 请求被转发给负责key的其他分片时调用，响应中只保留对端返回的token
+func skipSessionToken(w http.ResponseWriter) {
+	if sw, ok := w.(*sessionWriter); ok {
+		sw.skip = true
+	}
+}
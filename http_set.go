@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"net/http"
+	"strconv"
+)
+
+// doMembers 处理/sadd、/srem和/zrem，member参数可以重复多次，返回实际修改的成员数量
+func (h *httpServer) doMembers(fn func(ctx context.Context, key string, members []string) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := r.URL.Query()
+
+		key, members := vars.Get("key"), vars["member"]
+		if key == "" || len(members) == 0 {
+			h.log.Printf("%s error, get nil key or nil member", r.URL.Path)
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+		n, err := fn(r.Context(), key, members)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", n)
+	}
+}
+
+// doSMembers 以json数组返回set的所有成员
+func (h *httpServer) doSMembers(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.log.Println("doSMembers() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	members, err := h.cache.Cache.SMembers(key)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// doSIsMember 返回1表示member在set中，0表示不在
+func (h *httpServer) doSIsMember(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, member := vars.Get("key"), vars.Get("member")
+	if key == "" {
+		h.log.Println("doSIsMember() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	ok, err := h.cache.Cache.SIsMember(key, member)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", boolToInt(ok))
+}
+
+// doSetAlgebra 处理/sinter和/sunion，key参数可以重复多次，以json数组返回结果，
+// 所有key必须属于同一个节点
+func (h *httpServer) doSetAlgebra(fn func(keys []string) ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := r.URL.Query()["key"]
+		if len(keys) == 0 {
+			h.log.Printf("%s error, get nil key", r.URL.Path)
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+
+		peerAddress, ok := h.ownerOf(keys)
+		if !ok {
+			http.Error(w, "keys in request don't hash to the same node", http.StatusBadRequest)
+			return
+		}
+		if peerAddress != h.cache.Opts.HttpAddress {
+			h.forwardToPeer(w, r, peerAddress)
+			return
+		}
+		members, err := fn(keys)
+		if err != nil {
+			h.writeCommandError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	}
+}
+
+// doZAdd 加入有序集合的成员，score和member参数可以重复多次，按顺序一一对应，返回新加入的数量
+func (h *httpServer) doZAdd(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, scores, members := vars.Get("key"), vars["score"], vars["member"]
+	if key == "" || len(members) == 0 || len(scores) != len(members) {
+		h.log.Println("doZAdd() error, get nil key or mismatched score and member")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+	zmembers := make([]cache.ZMember, 0, len(members))
+	for i := range members {
+		score, err := cache.ParseScore(scores[i])
+		if err != nil {
+			h.log.Printf("doZAdd() error, %v", err)
+			fmt.Fprint(w, "param error\n")
+			return
+		}
+		zmembers = append(zmembers, cache.ZMember{Member: members[i], Score: score})
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	n, err := h.cache.DoZAdd(r.Context(), key, zmembers)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+// doZScore 返回成员的score，成员不存在时返回404
+func (h *httpServer) doZScore(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, member := vars.Get("key"), vars.Get("member")
+	if key == "" {
+		h.log.Println("doZScore() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	score, ok, err := h.cache.Cache.ZScore(key, member)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+// doZRank 返回成员按score升序从0开始的排名，成员不存在时返回404
+func (h *httpServer) doZRank(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key, member := vars.Get("key"), vars.Get("member")
+	if key == "" {
+		h.log.Println("doZRank() error, get nil key")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	rank, ok, err := h.cache.Cache.ZRank(key, member)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", rank)
+}
+
+// doZRange 以json数组返回排名在[start, stop]之间的成员和score
+func (h *httpServer) doZRange(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	start, err1 := strconv.ParseInt(vars.Get("start"), 10, 64)
+	stop, err2 := strconv.ParseInt(vars.Get("stop"), 10, 64)
+	if key == "" || err1 != nil || err2 != nil {
+		h.log.Println("doZRange() error, get nil key or invalid range")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	members, err := h.cache.Cache.ZRange(key, start, stop)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// doZRangeByScore 以json数组返回score在[min, max]之间的成员，支持-inf、+inf以及"("前缀表示的开区间
+func (h *httpServer) doZRangeByScore(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+
+	key := vars.Get("key")
+	scoreRange, err := cache.ParseScoreRange(vars.Get("min"), vars.Get("max"))
+	if key == "" || err != nil {
+		h.log.Println("doZRangeByScore() error, get nil key or invalid range")
+		fmt.Fprint(w, "param error\n")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		h.forwardToPeer(w, r, peerAddress)
+		return
+	}
+	members, err := h.cache.Cache.ZRangeByScore(key, scoreRange)
+	if err != nil {
+		h.writeCommandError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Emiliaab/gedis/cache"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	keysPrefix = "/v1/keys/"
+
+	// maxValueSize 和redis的proto-max-bulk-len一致
+	maxValueSize = 512 << 20
+
+	// forwardedHeader 标记请求是由其他节点转发过来的，两个节点的一致性hash环不一致时
+	// 直接返回错误，避免请求在节点之间来回转发
+	forwardedHeader = cache.ForwardedHeader
+)
+
+// v1接口错误响应中的错误码
+const (
+	codeInvalidArgument   = "invalid_argument"
+	codeNotFound          = "not_found"
+	codeWrongType         = "wrong_type"
+	codeNotInteger        = "not_integer"
+	codeOutOfMemory       = "out_of_memory"
+	codeNotLeader         = "not_leader"
+	codeWrongNode         = "wrong_node"
+	codeValueTooLarge     = "value_too_large"
+	codeMethodNotAllowed  = "method_not_allowed"
+	codePeerUnavailable   = "peer_unavailable"
+	codeMigrating         = "migrating"
+	codeMigrationNotFound = "migration_not_found"
+	codeInternal          = "internal"
+)
+
+// apiError 是v1接口的错误响应: {"error": {"code": "not_found", "message": "..."}}，
+// wrong_node错误还带有本节点哈希环的epoch和负责key的节点
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Owner   string `json:"owner,omitempty"`
+	Epoch   uint64 `json:"epoch,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	encodeAPIError(w, status, &apiError{Code: code, Message: message})
+}
+
+// toAPIError 按错误类型返回对应的状态码和错误码
+func (h *httpServer) toAPIError(err error) (int, *apiError) {
+	status, code := http.StatusInternalServerError, codeInternal
+	switch {
+	case errors.Is(err, cache.ErrNotFound), errors.Is(err, cache.ErrServerNotFound):
+		status, code = http.StatusNotFound, codeNotFound
+	case errors.Is(err, cache.ErrWrongType):
+		status, code = http.StatusBadRequest, codeWrongType
+	case errors.Is(err, cache.ErrNotInteger), errors.Is(err, cache.ErrNotFloat), errors.Is(err, cache.ErrNaN):
+		status, code = http.StatusBadRequest, codeNotInteger
+	case errors.Is(err, lru_k.ErrOutOfMemory):
+		status, code = http.StatusInsufficientStorage, codeOutOfMemory
+	case errors.Is(err, cache.ErrNotLeader):
+		status, code = http.StatusServiceUnavailable, codeNotLeader
+	case errors.Is(err, cache.ErrMigrating):
+		status, code = http.StatusServiceUnavailable, codeMigrating
+	case errors.Is(err, cache.ErrMigrationNotFound):
+		status, code = http.StatusNotFound, codeMigrationNotFound
+	default:
+		h.log.Printf("v1 request failed:%v", err)
+	}
+	return status, &apiError{Code: code, Message: err.Error()}
+}
+
+func (h *httpServer) writeV1Error(w http.ResponseWriter, err error) {
+	status, e := h.toAPIError(err)
+	writeAPIError(w, status, e.Code, e.Message)
+}
+
+/*
+*
+doKey 处理/v1/keys/{key}，key需要按url路径转义，value放在请求体中，可以是任意字节：
+
+	GET     读取value，key不存在返回404
+	HEAD    和GET一样，只返回状态码和Content-Length
+	PUT     写入value，ex/px参数指定存活时间(秒/毫秒)，sliding=true表示滑动过期，成功返回204
+	DELETE  删除key，成功返回204，key不存在返回404
+
+key不属于本节点时把请求原样转发给负责的节点，节点之间的转发也使用这个接口
+*/
+func (h *httpServer) doKey(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if key == "" {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "empty key")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+
+	if peerAddress := h.cache.Peers().Get(key); peerAddress != h.cache.Opts.HttpAddress {
+		if h.misrouted(w, r, peerAddress) {
+			return
+		}
+		h.forwardKey(w, r, peerAddress)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.getKey(w, r, key)
+	case http.MethodPut:
+		h.putKey(w, r, key)
+	case http.MethodDelete:
+		h.deleteKey(w, r, key)
+	}
+}
+
+// pathKey 从/v1/keys/{key}中取出key。r.URL.Path是解码后的路径，key中转义的/和路径分隔符无法区分，
+// 所以从转义的路径中截取后再解码
+func pathKey(r *http.Request) (string, error) {
+	return url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), keysPrefix))
+}
+
+func (h *httpServer) getKey(w http.ResponseWriter, r *http.Request, key string) {
+	value, ok := h.cache.DoGetLocal(key)
+	if !ok {
+		if typ, ok := h.cache.Cache.Type(key); ok && typ != cache.TypeString {
+			h.writeV1Error(w, cache.ErrWrongType)
+			return
+		}
+		h.writeV1Error(w, cache.ErrNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method != http.MethodHead {
+		w.Write(value)
+	}
+}
+
+func (h *httpServer) putKey(w http.ResponseWriter, r *http.Request, key string) {
+	vars := r.URL.Query()
+	ttl, err := parseTTL(vars)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	value, ok := readValue(w, r, maxValueSize)
+	if !ok {
+		return
+	}
+
+	err = h.cache.DoSetEx(r.Context(), cache.OperSet, key, string(value), ttl, vars.Get("sliding") == "true")
+	if err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readValue 读取请求体中的value，超过limit字节时返回413，出错时写入错误响应并返回false
+func readValue(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, codeValueTooLarge, err.Error())
+			return nil, false
+		}
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return nil, false
+	}
+	return value, true
+}
+
+func (h *httpServer) deleteKey(w http.ResponseWriter, r *http.Request, key string) {
+	ok, err := h.cache.DoDel(r.Context(), key)
+	if err != nil {
+		h.writeV1Error(w, err)
+		return
+	}
+	if !ok {
+		h.writeV1Error(w, cache.ErrNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forwardKey 把/v1/keys请求连同请求体转发给负责key的分片组，并把状态码、响应头和响应体写回。
+// 请求体先读到内存中，分片组的节点不可用时可以换一个节点重新发送
+func (h *httpServer) forwardKey(w http.ResponseWriter, r *http.Request, peerAddress string) {
+	skipSessionToken(w)
+	var body []byte
+	if r.Method == http.MethodPut {
+		var ok bool
+		if body, ok = readValue(w, r, maxValueSize); !ok {
+			return
+		}
+	}
+
+	resp, err := h.peerDo(r.Context(), peerClient, peerAddress, isStaleRead(r), r.Method, r.URL.RequestURI(), body, r.Header.Get("Content-Type"))
+	if err != nil {
+		h.log.Printf("forward %s %s to %s failed:%v", r.Method, r.URL.Path, peerAddress, err)
+		writeAPIError(w, http.StatusBadGateway, codePeerUnavailable, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	for _, name := range []string{"Content-Type", "Content-Length", "Allow", indexHeader} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	copyMoved(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// doRing 返回当前节点的一致性hash环，客户端据此把key直接发送给负责的节点
+func (h *httpServer) doRing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.cache.Peers())
+}
+
+// peerClient 节点之间转发请求使用的client，超时时间和raft.Apply的超时时间一致
+var peerClient = &http.Client{Timeout: 5 * time.Second}
+
+// putKeyToPeer 通过/v1/keys接口写入负责key的分片组，返回对端的状态码和响应内容
+func (h *httpServer) putKeyToPeer(peerAddress string, method string, key string, value []byte, query string) (int, string, error) {
+	uri := cache.KeyPath(key)
+	if query != "" {
+		uri += "?" + query
+	}
+	resp, err := h.peerDo(context.Background(), peerClient, peerAddress, false, method, uri, value, "")
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, strings.TrimSpace(string(body)), nil
+}
+
+/*
+*
+peerDo 把请求发送给哈希环上的真实节点owner并带上本节点的地址和哈希环的epoch。owner是分片组时
+由PeerDo选择分片组中的节点，节点不可用时换下一个节点，body在每次尝试时重新读取；
+stale为true表示请求是stale读，可以交给分片组中任意一个节点
+*/
+func (h *httpServer) peerDo(ctx context.Context, client *http.Client, owner string, stale bool, method string, uri string, body []byte, contentType string) (*http.Response, error) {
+	return h.cache.PeerDo(owner, stale, func(address string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+address+uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			req.Body, req.ContentLength = http.NoBody, 0
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		h.cache.SetForwarded(req.Header)
+		return client.Do(req)
+	})
+}
+
+// isStaleRead 判断请求是不是stale读，stale读可以由分片组中的任意一个节点处理
+func isStaleRead(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != "/v1/mget" {
+		return false
+	}
+	level, _, _, err := parseConsistency(r)
+	return err == nil && level == cache.ConsistencyStale
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newV1Server(self string, owner string) *httpServer {
+	proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: self}, Log: log.New(io.Discard, "", 0), Cache: &cache.Cache{}}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add(owner)
+	proxy.SetPeers(ring)
+	return &httpServer{cache: proxy, log: log.New(io.Discard, "", 0), mutex: http.NewServeMux()}
+}
+
+func TestV1Keys(t *testing.T) {
+	h := newV1Server("127.0.0.1:8000", "127.0.0.1:8000")
+	if err := h.cache.Cache.AddWithExpire("k", []byte("v\x00"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.cache.Cache.HSet("h", []string{"f", "v"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method string
+		url    string
+		status int
+		code   string
+		body   string
+	}{
+		{http.MethodGet, "/v1/keys/k", http.StatusOK, "", "v\x00"},
+		{http.MethodHead, "/v1/keys/k", http.StatusOK, "", ""},
+		{http.MethodGet, "/v1/keys/missing", http.StatusNotFound, codeNotFound, ""},
+		{http.MethodHead, "/v1/keys/missing", http.StatusNotFound, codeNotFound, ""},
+		{http.MethodGet, "/v1/keys/h", http.StatusBadRequest, codeWrongType, ""},
+		{http.MethodGet, "/v1/keys/", http.StatusBadRequest, codeInvalidArgument, ""},
+		{http.MethodPost, "/v1/keys/k", http.StatusMethodNotAllowed, codeMethodNotAllowed, ""},
+		// 本节点不是leader，写入返回not_leader
+		{http.MethodPut, "/v1/keys/k", http.StatusServiceUnavailable, codeNotLeader, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://127.0.0.1:8000"+c.url, strings.NewReader("v2"))
+		h.doKey(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %s: got status %d; want %d", c.method, c.url, w.Code, c.status)
+			continue
+		}
+		if c.code == "" {
+			if w.Body.String() != c.body {
+				t.Errorf("%s %s: got body %q; want %q", c.method, c.url, w.Body.String(), c.body)
+			}
+			if got := w.Header().Get("Content-Length"); got != "2" {
+				t.Errorf("%s %s: got Content-Length %q; want 2", c.method, c.url, got)
+			}
+			continue
+		}
+		// 错误响应统一是{"error": {"code": ..., "message": ...}}
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != c.code || body.Error.Message == "" {
+			t.Errorf("%s %s: got %+v, %v; want code %s", c.method, c.url, body.Error, err, c.code)
+		}
+		if c.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+			t.Errorf("%s %s: expected an Allow header", c.method, c.url)
+		}
+	}
+}
+
+// key中的//、/./、..和转义的/都原样交给负责的节点，不被ServeMux重定向
+func TestV1KeyPath(t *testing.T) {
+	var gotKey, gotBody string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey, _ = pathKey(r)
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer owner.Close()
+	h := newV1Server("127.0.0.1:8000", strings.TrimPrefix(owner.URL, "http://"))
+
+	for path, key := range map[string]string{
+		"a//b":    "a//b",
+		"a/./b":   "a/./b",
+		"../x":    "../x",
+		"a%2Fb":   "a/b",
+		"%2E%2E/": "../",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/keys/"+path, nil))
+		if w.Code != http.StatusNoContent || gotKey != key {
+			t.Errorf("GET %s: got status %d and key %q at the owner; want 204 and %q", path, w.Code, gotKey, key)
+		}
+	}
+
+	// PUT的请求体原样转发，可以是任意字节
+	value := "\x00\xff v"
+	w := httptest.NewRecorder()
+	h.doKey(w, httptest.NewRequest(http.MethodPut, "/v1/keys/a%2F%2Fb?ex=10", strings.NewReader(value)))
+	if w.Code != http.StatusNoContent || gotKey != "a//b" || gotBody != value {
+		t.Fatalf("got status %d, key %q and body %q at the owner; want 204, a//b and %q", w.Code, gotKey, gotBody, value)
+	}
+}
+
+func TestReadValueLimit(t *testing.T) {
+	w := httptest.NewRecorder()
+	if value, ok := readValue(w, httptest.NewRequest(http.MethodPut, "/v1/keys/k", strings.NewReader("1234")), 4); !ok || string(value) != "1234" {
+		t.Fatalf("got %q, %v; want the whole body", value, ok)
+	}
+
+	w = httptest.NewRecorder()
+	if _, ok := readValue(w, httptest.NewRequest(http.MethodPut, "/v1/keys/k", bytes.NewReader(make([]byte, 5))), 4); ok {
+		t.Fatal("expected a body over the limit to be rejected")
+	}
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusRequestEntityTooLarge || body.Error.Code != codeValueTooLarge {
+		t.Fatalf("got status %d, %+v, %v; want 413 %s", w.Code, body.Error, err, codeValueTooLarge)
+	}
+}
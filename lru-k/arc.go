@@ -0,0 +1,180 @@
+package lru_k
+
+import "container/list"
+
+const (
+	arcT1 uint8 = iota // 只被访问过一次的entry
+	arcT2              // 被访问过至少两次的entry
+)
+
+// arcPolicy 自适应替换缓存(ARC)，在T1(最近)和T2(频繁)之间根据幽灵列表B1、B2的命中情况
+// 自适应地调整T1的目标大小p。容量以entry个数计，取当前缓存中的entry数
+type arcPolicy struct {
+	t1, t2 *list.List
+	b1, b2 *ghostList
+	p      int
+}
+
+func init() {
+	Register(PolicyARC, func(maxBytes int64, opts ...Option) Cache {
+		return newPolicyCache(maxBytes, &arcPolicy{}, opts...)
+	})
+}
+
+func (p *arcPolicy) reset() {
+	p.t1, p.t2 = list.New(), list.New()
+	p.b1, p.b2 = newGhostList(), newGhostList()
+	p.p = 0
+}
+
+func (p *arcPolicy) capacity() int {
+	if c := p.t1.Len() + p.t2.Len(); c > 0 {
+		return c
+	}
+	return 1
+}
+
+func (p *arcPolicy) add(e *Entry) {
+	c := p.capacity()
+	switch {
+	case p.b1.remove(e.k):
+		// 最近被淘汰的key又被访问，说明T1太小
+		p.p = minInt(p.p+maxInt(p.b2.len()/maxInt(p.b1.len(), 1), 1), c)
+		p.push(e, arcT2)
+	case p.b2.remove(e.k):
+		// 频繁访问的key被淘汰后又被访问，说明T2太小
+		p.p = maxInt(p.p-maxInt(p.b1.len()/maxInt(p.b2.len(), 1), 1), 0)
+		p.push(e, arcT2)
+	default:
+		p.push(e, arcT1)
+	}
+}
+
+func (p *arcPolicy) push(e *Entry, seg uint8) {
+	e.seg = seg
+	if seg == arcT1 {
+		e.elem = p.t1.PushFront(e)
+	} else {
+		e.elem = p.t2.PushFront(e)
+	}
+}
+
+func (p *arcPolicy) list(e *Entry) *list.List {
+	if e.seg == arcT1 {
+		return p.t1
+	}
+	return p.t2
+}
+
+func (p *arcPolicy) access(e *Entry) {
+	if e.seg == arcT2 {
+		p.t2.MoveToFront(e.elem)
+		return
+	}
+	p.t1.Remove(e.elem)
+	p.push(e, arcT2)
+}
+
+func (p *arcPolicy) remove(e *Entry) {
+	p.list(e).Remove(e.elem)
+}
+
+func (p *arcPolicy) victim() *Entry {
+	var e *list.Element
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || p.t2.Len() == 0) {
+		e = p.t1.Back()
+	} else if p.t2.Len() > 0 {
+		e = p.t2.Back()
+	}
+	if e == nil {
+		return nil
+	}
+	p.evicted(e.Value.(*Entry))
+	return e.Value.(*Entry)
+}
+
+// evicted 把被淘汰的key记入T1或者T2对应的幽灵列表，之后再次写入时据此调整p
+func (p *arcPolicy) evicted(e *Entry) {
+	if e.seg == arcT1 {
+		p.b1.push(e.k, p.capacity())
+	} else {
+		p.b2.push(e.k, p.capacity())
+	}
+}
+
+// order 模拟victim的淘汰顺序：T1超过目标大小p时淘汰T1，否则淘汰T2，每淘汰一个都重新比较
+func (p *arcPolicy) order(fn func(e *Entry) bool) {
+	t1, t2 := p.t1.Back(), p.t2.Back()
+	n1, n2 := p.t1.Len(), p.t2.Len()
+	for {
+		var e *list.Element
+		if n1 > 0 && (n1 > p.p || n2 == 0) {
+			e, t1 = t1, t1.Prev()
+			n1--
+		} else if n2 > 0 {
+			e, t2 = t2, t2.Prev()
+			n2--
+		}
+		if e == nil || !fn(e.Value.(*Entry)) {
+			return
+		}
+	}
+}
+
+func (p *arcPolicy) records() []Record {
+	records := make([]Record, 0, p.t1.Len()+p.t2.Len())
+	for e := p.t2.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*Entry).record(true))
+	}
+	for e := p.t1.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*Entry).record(false))
+	}
+	return records
+}
+
+func (p *arcPolicy) load(e *Entry, active bool) {
+	if active {
+		e.seg = arcT2
+		e.elem = p.t2.PushBack(e)
+	} else {
+		e.seg = arcT1
+		e.elem = p.t1.PushBack(e)
+	}
+}
+
+// ghostList 只记录最近被淘汰的key，不保存value，ARC和2Q用它识别被过早淘汰的key
+type ghostList struct {
+	ll   *list.List
+	keys map[string]*list.Element
+}
+
+func newGhostList() *ghostList {
+	return &ghostList{ll: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// push 记录key，超过limit时丢弃最早的记录
+func (g *ghostList) push(k string, limit int) {
+	if e, ok := g.keys[k]; ok {
+		g.ll.MoveToFront(e)
+		return
+	}
+	g.keys[k] = g.ll.PushFront(k)
+	for g.ll.Len() > limit {
+		delete(g.keys, g.ll.Remove(g.ll.Back()).(string))
+	}
+}
+
+// remove 删除key的记录，返回key之前是否存在
+func (g *ghostList) remove(k string) bool {
+	e, ok := g.keys[k]
+	if !ok {
+		return false
+	}
+	g.ll.Remove(e)
+	delete(g.keys, k)
+	return true
+}
+
+func (g *ghostList) len() int {
+	return g.ll.Len()
+}
@@ -0,0 +1,137 @@
+package lru_k
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// lfuPolicy 淘汰访问次数最少的entry，次数相同时淘汰最久未访问的，用最小堆实现
+type lfuPolicy struct {
+	h    entryHeap
+	tick int64
+}
+
+func init() {
+	Register(PolicyLFU, func(maxBytes int64, opts ...Option) Cache {
+		return newPolicyCache(maxBytes, &lfuPolicy{}, opts...)
+	})
+}
+
+func (p *lfuPolicy) reset() {
+	p.h = nil
+	p.tick = 0
+}
+
+func (p *lfuPolicy) add(e *Entry) {
+	p.tick++
+	e.cnt = 1
+	e.tick = p.tick
+	heap.Push(&p.h, e)
+}
+
+func (p *lfuPolicy) access(e *Entry) {
+	p.tick++
+	e.cnt++
+	e.tick = p.tick
+	heap.Fix(&p.h, e.index)
+}
+
+func (p *lfuPolicy) remove(e *Entry) {
+	heap.Remove(&p.h, e.index)
+}
+
+func (p *lfuPolicy) victim() *Entry {
+	if len(p.h) == 0 {
+		return nil
+	}
+	return p.h[0]
+}
+
+// order 从堆顶开始按堆的顺序遍历，只访问候选者的子节点，取出前k个entry是O(k log k)的
+func (p *lfuPolicy) order(fn func(e *Entry) bool) {
+	if len(p.h) == 0 {
+		return
+	}
+	frontier := &indexHeap{h: p.h, index: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if !fn(p.h[i]) {
+			return
+		}
+		for _, child := range [2]int{2*i + 1, 2*i + 2} {
+			if child < len(p.h) {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+}
+
+func (p *lfuPolicy) records() []Record {
+	entries := make([]*Entry, len(p.h))
+	copy(entries, p.h)
+	sort.Slice(entries, func(i, j int) bool {
+		return p.h.Less(entries[j].index, entries[i].index)
+	})
+	records := make([]Record, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, e.record(false))
+	}
+	return records
+}
+
+// load 按records的顺序恢复，越靠后的entry越早被访问，用负数的tick保持这个顺序
+func (p *lfuPolicy) load(e *Entry, active bool) {
+	e.tick = -int64(len(p.h))
+	heap.Push(&p.h, e)
+}
+
+// entryHeap 按(访问次数, 最近访问时间)排序的最小堆
+type entryHeap []*Entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].cnt != h[j].cnt {
+		return h[i].cnt < h[j].cnt
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x any) {
+	e := x.(*Entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// indexHeap 是entryHeap中下标组成的最小堆，用于不修改entryHeap地按顺序遍历
+type indexHeap struct {
+	h     entryHeap
+	index []int
+}
+
+func (h *indexHeap) Len() int           { return len(h.index) }
+func (h *indexHeap) Less(i, j int) bool { return h.h.Less(h.index[i], h.index[j]) }
+func (h *indexHeap) Swap(i, j int)      { h.index[i], h.index[j] = h.index[j], h.index[i] }
+func (h *indexHeap) Push(x any)         { h.index = append(h.index, x.(int)) }
+
+func (h *indexHeap) Pop() any {
+	n := len(h.index)
+	i := h.index[n-1]
+	h.index = h.index[:n-1]
+	return i
+}
@@ -5,21 +5,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/spaolacci/murmur3"
+	"math/rand"
 )
 
 type Hash func(data []byte) uint32
 
 type Cache interface {
 	Get(k string) (v gValue, ok bool)
-	Set(k string, v gValue)
+	// Peek 读取key但不更新访问计数和顺序，可以在读锁下并发调用
+	Peek(k string) (v gValue, ok bool)
+	// Touch 补记一次对key的访问，效果等同于一次不返回值的Get
+	Touch(k string)
+	// Lookup 读取key但不判断是否过期也不更新访问记录，过期由调用方根据raft日志中的时间戳判断
+	Lookup(k string) (v gValue, ok bool)
+	Set(k string, v gValue) error
+	SetWithExpire(k string, v gValue, expireAt int64, slide int64) error
+	Expire(k string, expireAt int64, slide int64) (ok bool)
+	Persist(k string) (ok bool)
+	GetExpire(k string) (expireAt int64, slide int64, ok bool)
+	SampleExpired(now int64, n int) (sampled int, expired []string)
 	Len() int
 	Remove(k string) (ok bool)
+	// Evict 删除Victims选出的key，和Remove不同的是淘汰策略会记录这次淘汰，例如ARC和2Q的幽灵列表
+	Evict(k string) (ok bool)
 	RemoveOldest()
+	// SetMaxBytes 修改最大字节数，按容量划分内部列表的淘汰策略随之重新划分
+	SetMaxBytes(maxBytes int64)
+	// Victims 按maxmemory策略policy选出需要淘汰的key，淘汰之后BytesUsed()加上growth不超过maxBytes，不修改缓存。
+	// skip中的key不会被选中，没有足够的key可以淘汰或者策略为noeviction时返回ErrOutOfMemory
+	Victims(policy string, maxBytes int64, growth int64, skip []string) ([]string, error)
 	Clear()
 	BytesUsed() int64
-	GetData() map[string]*list.Element
-	SetData(map[string]*list.Element)
-	GetRangeData(start, end int) ([]byte, error)
+	Records() []Record
+	Load(records []Record)
+	GetRangeData(start, end int) ([]byte, error) // 只读取，不删除区间中的key
 	GetAll() map[string]gValue
 }
 
@@ -27,15 +46,17 @@ type cache struct {
 	maxBytes int64 // 最大允许的字节大小
 	nbytes   int64 // 当前缓存使用的字节大小
 
-	k int // 使用超过k次就移入缓存列表
-
 	inactiveList *list.List
 	inactiveMap  map[string]*list.Element
 
 	activeList *list.List
 	activeMap  map[string]*list.Element
 
-	onEliminate func(k string, v any)
+	expires map[string]*list.Element // 设置了过期时间的key，供定期采样清理使用
+
+	clock int64 // 访问的逻辑时钟，用于volatile-lru
+
+	options
 }
 
 type gValue interface {
@@ -47,6 +68,26 @@ type Entry struct {
 	k   string
 	v   gValue
 	cnt int
+
+	expireAt int64 // 过期的绝对时间(unix纳秒)，0表示永不过期
+	slide    int64 // 滑动过期的时长(纳秒)，大于0表示每次访问后都顺延expireAt
+	atime    int64 // 最近一次访问的逻辑时间，用于volatile-lru
+
+	// 以下字段只被policy.go中的其他淘汰策略使用
+	elem    *list.Element // entry在策略链表中的位置
+	seg     uint8         // entry所在的分段，含义由各策略定义
+	index   int           // entry在堆中的下标
+	tick    int64         // 最近一次访问的逻辑时间
+	charged int64         // entry计入所在分段的字节数
+}
+
+func (e *Entry) size() int64 {
+	return int64(e.v.Len()) + int64(len(e.k))
+}
+
+// 判断entry在now时刻是否已经过期
+func (e *Entry) expired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
 }
 
 func NewCache(k int, maxBytes int64, opts ...Option) Cache {
@@ -55,16 +96,13 @@ func NewCache(k int, maxBytes int64, opts ...Option) Cache {
 	}
 
 	c := &cache{
-		k:            k,
 		maxBytes:     maxBytes,
 		inactiveList: list.New(),
 		inactiveMap:  make(map[string]*list.Element),
 		activeList:   list.New(),
 		activeMap:    make(map[string]*list.Element),
-	}
-
-	for _, opt := range opts {
-		opt(c)
+		expires:      make(map[string]*list.Element),
+		options:      newOptions(append([]Option{WithK(k)}, opts...)...),
 	}
 
 	return c
@@ -76,6 +114,8 @@ func (c *cache) fill() {
 
 	c.activeList = list.New()
 	c.activeMap = make(map[string]*list.Element)
+
+	c.expires = make(map[string]*list.Element)
 }
 
 func (c *cache) Get(k string) (v gValue, ok bool) {
@@ -83,7 +123,13 @@ func (c *cache) Get(k string) (v gValue, ok bool) {
 		return
 	}
 
+	// 惰性过期：已过期的key对读请求不可见，但这里不做删除，
+	// 真正的删除由leader通过raft日志发起，保证各副本状态一致
 	if e, ok_ := c.activeMap[k]; ok_ {
+		if e.Value.(*Entry).expired(c.now()) {
+			return
+		}
+		c.touch(e.Value.(*Entry))
 		c.activeList.MoveToFront(e)
 		v, ok = e.Value.(*Entry).v, true
 		return
@@ -91,6 +137,10 @@ func (c *cache) Get(k string) (v gValue, ok bool) {
 
 	if e, ok_ := c.inactiveMap[k]; ok_ {
 		entry := e.Value.(*Entry)
+		if entry.expired(c.now()) {
+			return
+		}
+		c.touch(entry)
 		entry.cnt++
 		if entry.cnt >= c.k {
 			c.moveToRealCache(entry, e)
@@ -105,49 +155,233 @@ func (c *cache) Get(k string) (v gValue, ok bool) {
 	return
 }
 
-func (c *cache) moveToRealCache(entry_ *Entry, e *list.Element) {
-	c.activeList.PushFront(entry_)
-	c.activeMap[entry_.k] = e
-	fmt.Println(e.Value)
+func (c *cache) Peek(k string) (v gValue, ok bool) {
+	if c.isNil() {
+		return
+	}
+
+	e, ok_ := c.activeMap[k]
+	if !ok_ {
+		if e, ok_ = c.inactiveMap[k]; !ok_ {
+			return
+		}
+	}
+	entry := e.Value.(*Entry)
+	if entry.expired(c.now()) {
+		return
+	}
+	return entry.v, true
+}
+
+func (c *cache) Touch(k string) {
+	c.Get(k)
+}
 
+func (c *cache) Lookup(k string) (v gValue, ok bool) {
+	if c.isNil() {
+		return
+	}
+	e, found := c.lookup(k)
+	if !found {
+		return
+	}
+	return e.Value.(*Entry).v, true
+}
+
+func (c *cache) moveToRealCache(entry_ *Entry, e *list.Element) {
 	c.inactiveList.Remove(e)
 	delete(c.inactiveMap, entry_.k)
+
+	ne := c.activeList.PushFront(entry_)
+	c.activeMap[entry_.k] = ne
+	if entry_.expireAt != 0 {
+		c.expires[entry_.k] = ne
+	}
 }
 
-func (c *cache) Set(k string, v gValue) {
+func (c *cache) touch(entry *Entry) {
+	c.clock++
+	entry.atime = c.clock
+}
+
+// Set 写入key，和redis的SET语义一致，会清除key原有的过期时间
+func (c *cache) Set(k string, v gValue) error {
+	return c.SetWithExpire(k, v, 0, 0)
+}
+
+// SetWithExpire 写入key并设置过期的绝对时间expireAt(unix纳秒)，expireAt为0表示永不过期
+// 缓存已满且maxmemory策略无法腾出空间时返回ErrOutOfMemory，此时不会写入
+func (c *cache) SetWithExpire(k string, v gValue, expireAt int64, slide int64) error {
 	if c.isNil() {
 		c.fill()
 	}
 
+	if c.maxmemoryPolicy != AllKeysPolicy && !c.externalEviction {
+		growth := int64(v.Len())
+		if e, ok_ := c.lookup(k); ok_ {
+			growth -= int64(e.Value.(*Entry).v.Len())
+		} else {
+			growth += int64(len(k)) + c.overhead
+		}
+		if err := makeRoom(c, &c.options, c.maxBytes, k, growth); err != nil {
+			return err
+		}
+	}
+
 	if e, ok_ := c.inactiveMap[k]; ok_ {
 		entry := e.Value.(*Entry)
 		c.nbytes -= int64(entry.v.Len()) // 减去旧的字节大小
 		entry.v = v
 		c.nbytes += int64(v.Len()) // 加上新的字节大小
+		c.setExpire(entry, e, expireAt, slide)
+		c.touch(entry)
 		entry.cnt++
 		if entry.cnt >= c.k {
 			c.moveToRealCache(entry, e)
 		} else {
 			c.inactiveList.MoveToFront(e)
 		}
-		return
+		return nil
 	}
 
 	if e, ok_ := c.activeMap[k]; ok_ {
-		oldSize := int64(e.Value.(*Entry).v.Len())
+		entry := e.Value.(*Entry)
+		oldSize := int64(entry.v.Len())
 		c.nbytes -= oldSize
-		e.Value.(*Entry).v = v
+		entry.v = v
 		c.nbytes += int64(v.Len())
+		c.setExpire(entry, e, expireAt, slide)
+		c.touch(entry)
 		c.activeList.MoveToFront(e)
 	} else {
-		e := c.inactiveList.PushFront(&Entry{k: k, v: v})
+		entry := &Entry{k: k, v: v}
+		e := c.inactiveList.PushFront(entry)
 		c.inactiveMap[k] = e
-		c.nbytes += int64(v.Len()) + int64(len(k))
+		c.setExpire(entry, e, expireAt, slide)
+		c.touch(entry)
+		c.nbytes += c.entrySize(entry)
 
 	}
-	if c.maxBytes != 0 && c.maxBytes < c.nbytes {
+	// allkeys-policy按LRU-K的顺序淘汰
+	if c.maxmemoryPolicy == AllKeysPolicy && !c.externalEviction && c.maxBytes != 0 && c.maxBytes < c.nbytes {
 		c.RemoveOldest()
 	}
+	return nil
+}
+
+func (c *cache) sample(volatile bool, fn func(e *Entry) bool) {
+	if c.isNil() {
+		return
+	}
+	if volatile {
+		for _, e := range c.expires {
+			if !fn(e.Value.(*Entry)) {
+				return
+			}
+		}
+		return
+	}
+	// 随机决定先遍历哪个map，避免总是从活跃列表中淘汰
+	maps := [2]map[string]*list.Element{c.activeMap, c.inactiveMap}
+	if rand.Intn(2) == 0 {
+		maps[0], maps[1] = maps[1], maps[0]
+	}
+	for _, m := range maps {
+		for _, e := range m {
+			if !fn(e.Value.(*Entry)) {
+				return
+			}
+		}
+	}
+}
+
+// order 和RemoveOldest的顺序一致，先淘汰历史列表，再淘汰缓存列表
+func (c *cache) order(fn func(e *Entry) bool) {
+	if c.isNil() {
+		return
+	}
+	walkBack([]*list.List{c.inactiveList, c.activeList}, fn)
+}
+
+func (c *cache) Victims(policy string, maxBytes int64, growth int64, skip []string) ([]string, error) {
+	return victims(c, &c.options, policy, maxBytes, growth, skip)
+}
+
+func (c *cache) setExpire(entry *Entry, e *list.Element, expireAt int64, slide int64) {
+	entry.expireAt = expireAt
+	entry.slide = slide
+	if expireAt == 0 {
+		entry.slide = 0
+		delete(c.expires, entry.k)
+		return
+	}
+	c.expires[entry.k] = e
+}
+
+func (c *cache) lookup(k string) (*list.Element, bool) {
+	if e, ok := c.activeMap[k]; ok {
+		return e, true
+	}
+	e, ok := c.inactiveMap[k]
+	return e, ok
+}
+
+// Expire 为已存在的key设置过期的绝对时间，key不存在时返回false
+// 是否已经过期由调用方根据raft日志中的时间戳判断，这里不读本地时钟
+func (c *cache) Expire(k string, expireAt int64, slide int64) (ok bool) {
+	if c.isNil() {
+		return
+	}
+	e, found := c.lookup(k)
+	if !found {
+		return false
+	}
+	c.setExpire(e.Value.(*Entry), e, expireAt, slide)
+	return true
+}
+
+// Persist 移除key的过期时间，key不存在或者没有过期时间时返回false
+func (c *cache) Persist(k string) (ok bool) {
+	if c.isNil() {
+		return
+	}
+	e, found := c.lookup(k)
+	if !found || e.Value.(*Entry).expireAt == 0 {
+		return false
+	}
+	c.setExpire(e.Value.(*Entry), e, 0, 0)
+	return true
+}
+
+// GetExpire 返回key的过期时间和滑动过期时长，不影响key在LRU-K中的访问顺序和计数
+func (c *cache) GetExpire(k string) (expireAt int64, slide int64, ok bool) {
+	if c.isNil() {
+		return
+	}
+	e, found := c.lookup(k)
+	if !found {
+		return
+	}
+	entry := e.Value.(*Entry)
+	return entry.expireAt, entry.slide, true
+}
+
+// SampleExpired 从设置了过期时间的key中最多采样n个，返回采样数量以及其中在now时刻已过期的key
+// 依赖map迭代顺序的随机性完成采样，和redis的主动过期策略类似
+func (c *cache) SampleExpired(now int64, n int) (sampled int, expired []string) {
+	if c.isNil() {
+		return
+	}
+	for k, e := range c.expires {
+		if sampled >= n {
+			break
+		}
+		sampled++
+		if e.Value.(*Entry).expired(now) {
+			expired = append(expired, k)
+		}
+	}
+	return
 }
 
 func (c *cache) Remove(k string) (ok bool) {
@@ -159,7 +393,8 @@ func (c *cache) Remove(k string) (ok bool) {
 	if elem, found := c.inactiveMap[k]; found {
 		entry := c.inactiveList.Remove(elem).(*Entry)
 		delete(c.inactiveMap, entry.k)
-		c.nbytes -= int64(entry.v.Len()) + int64(len(entry.k))
+		delete(c.expires, entry.k)
+		c.nbytes -= c.entrySize(entry)
 		if c.onEliminate != nil {
 			c.onEliminate(entry.k, entry.v)
 		}
@@ -170,7 +405,8 @@ func (c *cache) Remove(k string) (ok bool) {
 	if elem, found := c.activeMap[k]; found {
 		entry := c.activeList.Remove(elem).(*Entry)
 		delete(c.activeMap, entry.k)
-		c.nbytes -= int64(entry.v.Len()) + int64(len(entry.k))
+		delete(c.expires, entry.k)
+		c.nbytes -= c.entrySize(entry)
 		if c.onEliminate != nil {
 			c.onEliminate(entry.k, entry.v)
 		}
@@ -180,6 +416,15 @@ func (c *cache) Remove(k string) (ok bool) {
 	return false
 }
 
+// Evict LRU-K不记录淘汰历史，和Remove相同
+func (c *cache) Evict(k string) (ok bool) {
+	return c.Remove(k)
+}
+
+func (c *cache) SetMaxBytes(maxBytes int64) {
+	c.maxBytes = maxBytes
+}
+
 func (c *cache) RemoveOldest() {
 	if c.isNil() {
 		return
@@ -190,7 +435,8 @@ func (c *cache) RemoveOldest() {
 		if e != nil {
 			entry := c.inactiveList.Remove(e).(*Entry)
 			delete(c.inactiveMap, entry.k)
-			c.nbytes -= int64(entry.v.Len()) + int64(len(e.Value.(*Entry).k))
+			delete(c.expires, entry.k)
+			c.nbytes -= c.entrySize(entry)
 			if c.onEliminate != nil {
 				c.onEliminate(entry.k, entry.v)
 			}
@@ -203,7 +449,8 @@ func (c *cache) RemoveOldest() {
 		if e != nil {
 			entry := c.activeList.Remove(e).(*Entry)
 			delete(c.activeMap, entry.k)
-			c.nbytes -= int64(entry.v.Len()) + int64(len(e.Value.(*Entry).k))
+			delete(c.expires, entry.k)
+			c.nbytes -= c.entrySize(entry)
 			if c.onEliminate != nil {
 				c.onEliminate(entry.k, entry.v)
 			}
@@ -223,6 +470,7 @@ func (c *cache) Clear() {
 	c.inactiveMap = nil
 	c.activeList = nil
 	c.inactiveList = nil
+	c.expires = nil
 	c.nbytes = 0
 }
 
@@ -241,34 +489,82 @@ func (c *cache) BytesUsed() int64 {
 	return c.nbytes
 }
 
-func (c *cache) GetData() map[string]*list.Element {
-	return c.activeMap
+// Record 是entry的导出形式，用于raft快照的保存和恢复
+type Record struct {
+	Key      string
+	Value    gValue
+	Count    int  // 在非活跃列表中被访问的次数
+	Active   bool // 是否已经进入活跃列表
+	ExpireAt int64
+	Slide    int64
 }
 
-func (c *cache) SetData(data map[string]*list.Element) {
-	c.activeMap = data
+// Records 按活跃列表、非活跃列表的顺序，从最近访问到最久未访问导出所有entry
+func (c *cache) Records() []Record {
+	if c.isNil() {
+		return nil
+	}
+
+	records := make([]Record, 0, c.Len())
+	processList := func(l *list.List, active bool) {
+		for e := l.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*Entry)
+			records = append(records, Record{
+				Key:      entry.k,
+				Value:    entry.v,
+				Count:    entry.cnt,
+				Active:   active,
+				ExpireAt: entry.expireAt,
+				Slide:    entry.slide,
+			})
+		}
+	}
+	processList(c.activeList, true)
+	processList(c.inactiveList, false)
+	return records
 }
 
+// Load 丢弃当前所有数据，按Records导出的顺序重建两个列表，不会触发onEliminate
+func (c *cache) Load(records []Record) {
+	c.fill()
+	c.nbytes = 0
+
+	for _, r := range records {
+		entry := &Entry{k: r.Key, v: r.Value, cnt: r.Count}
+		var e *list.Element
+		if r.Active {
+			e = c.activeList.PushBack(entry)
+			c.activeMap[r.Key] = e
+		} else {
+			e = c.inactiveList.PushBack(entry)
+			c.inactiveMap[r.Key] = e
+		}
+		c.setExpire(entry, e, r.ExpireAt, r.Slide)
+		c.nbytes += c.entrySize(entry)
+	}
+}
+
+// GetRangeData 返回hash值在[start, end]中的字符串key。迁移由接收方提交之后，
+// 来源分片再通过raft日志删除这些key，这里不能在本地直接删除
 func (c *cache) GetRangeData(start, end int) ([]byte, error) {
 	if c.isNil() {
 		return nil, fmt.Errorf("Cache not initialized")
 	}
 
-	var hash Hash = func(key []byte) uint32 {
-		return uint32(murmur3.Sum64(key))
-	}
-
 	result := make(map[string]string)
+	now := c.now()
 
 	// Helper function to process lists
 	processList := func(list *list.List) {
 		for e := list.Front(); e != nil; e = e.Next() {
 			entry := e.Value.(*Entry)
-			keyInt := int(hash([]byte(entry.k)))
+			if entry.expired(now) {
+				continue
+			}
+			keyInt := rangeHash(entry.k)
 			if keyInt >= start && keyInt <= end {
 				data := entry.v.(gValue).GetBytes()
 				result[entry.k] = string(data)
-				c.Remove(entry.k)
 			}
 		}
 	}
@@ -277,6 +573,18 @@ func (c *cache) GetRangeData(start, end int) ([]byte, error) {
 	processList(c.activeList)
 	processList(c.inactiveList)
 
+	return marshalRangeData(result)
+}
+
+// rangeHash 计算key在一致性hash环上的位置，和consistenthash中使用的hash函数保持一致
+func rangeHash(key string) int {
+	var hash Hash = func(key []byte) uint32 {
+		return uint32(murmur3.Sum64(key))
+	}
+	return int(hash([]byte(key)))
+}
+
+func marshalRangeData(result map[string]string) ([]byte, error) {
 	// Serialize the result into JSON
 	jsonData, err := json.Marshal(result)
 	if err != nil {
@@ -292,11 +600,15 @@ func (c *cache) GetAll() map[string]gValue {
 	}
 
 	result := make(map[string]gValue)
+	now := c.now()
 
 	// Helper function to process lists
 	processList := func(list *list.List) {
 		for e := list.Front(); e != nil; e = e.Next() {
 			entry := e.Value.(*Entry)
+			if entry.expired(now) {
+				continue
+			}
 			result[entry.k] = entry.v
 		}
 	}
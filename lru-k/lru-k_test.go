@@ -1,7 +1,9 @@
 package lru_k
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -25,6 +27,22 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestPeekTouch(t *testing.T) {
+	lru := NewCache(2, 0)
+	lru.Set("key1", String("1234"))
+	if v, ok := lru.Peek("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("cache peek key1=1234 failed")
+	}
+	if records := lru.Records(); records[0].Active {
+		t.Fatalf("peek should not promote key1")
+	}
+	lru.Touch("key1")
+	lru.Touch("key1")
+	if records := lru.Records(); !records[0].Active {
+		t.Fatalf("touch should promote key1")
+	}
+}
+
 func TestRemoveoldest(t *testing.T) {
 	k1, k2, k3 := "key1", "key2", "k3"
 	v1, v2, v3 := "value1", "value2", "v3"
@@ -94,3 +112,126 @@ func TestRemove(t *testing.T) {
 	}
 
 }
+
+func TestExpire(t *testing.T) {
+	now := int64(100)
+	lru := NewCache(2, int64(100), WithClock(func() int64 { return now }))
+	lru.SetWithExpire("key1", String("1234"), 200, 0)
+	lru.Set("key2", String("5678"))
+
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatal("expected key1 before expiration")
+	}
+	now = 200
+	if _, ok := lru.Get("key1"); ok {
+		t.Fatal("expected key1 to be expired")
+	}
+	if _, ok := lru.Get("key2"); !ok {
+		t.Fatal("expected key2 without expiration")
+	}
+
+	// 惰性过期不会删除key，需要显式的Remove
+	if lru.Len() != 2 {
+		t.Fatalf("got len %d; want 2", lru.Len())
+	}
+	sampled, expired := lru.SampleExpired(now, 20)
+	if sampled != 1 || len(expired) != 1 || expired[0] != "key1" {
+		t.Fatalf("got sampled %d expired %v; want 1 [key1]", sampled, expired)
+	}
+	lru.Remove("key1")
+	if sampled, _ = lru.SampleExpired(now, 20); sampled != 0 {
+		t.Fatalf("got sampled %d after remove; want 0", sampled)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	now := int64(100)
+	lru := NewCache(2, int64(100), WithClock(func() int64 { return now }))
+	lru.Set("key", String("1"))
+	if lru.Persist("key") {
+		t.Fatal("expected persist on key without expiration to fail")
+	}
+	if !lru.Expire("key", 150, 50) {
+		t.Fatal("expected expire on existing key to succeed")
+	}
+	if expireAt, slide, ok := lru.GetExpire("key"); !ok || expireAt != 150 || slide != 50 {
+		t.Fatalf("got expireAt %d slide %d; want 150 50", expireAt, slide)
+	}
+	if !lru.Persist("key") {
+		t.Fatal("expected persist to succeed")
+	}
+	now = 200
+	if _, ok := lru.Get("key"); !ok {
+		t.Fatal("expected persisted key to survive")
+	}
+
+	// SET会清除原有的过期时间
+	lru.Expire("key", 300, 0)
+	lru.Set("key", String("2"))
+	if expireAt, _, _ := lru.GetExpire("key"); expireAt != 0 {
+		t.Fatalf("got expireAt %d after set; want 0", expireAt)
+	}
+	if lru.Expire("missing", 300, 0) {
+		t.Fatal("expected expire on missing key to fail")
+	}
+}
+
+func TestRecordsLoad(t *testing.T) {
+	lru := NewCache(2, int64(100))
+	lru.Set("k1", String("v1"))
+	lru.Set("k2", String("v2"))
+	lru.SetWithExpire("k3", String("v3"), 1000, 10)
+	lru.Get("k1")
+	lru.Get("k1") // k1访问满k次进入活跃列表
+	lru.Get("k2")
+
+	records := lru.Records()
+	restored := NewCache(2, int64(100))
+	restored.Load(records)
+
+	if restored.Len() != 3 || restored.BytesUsed() != lru.BytesUsed() {
+		t.Fatalf("got len %d bytes %d; want 3 %d", restored.Len(), restored.BytesUsed(), lru.BytesUsed())
+	}
+	got := restored.Records()
+	for i := range records {
+		if got[i] != records[i] {
+			t.Fatalf("got record %+v at %d; want %+v", got[i], i, records[i])
+		}
+	}
+	if expireAt, slide, _ := restored.GetExpire("k3"); expireAt != 1000 || slide != 10 {
+		t.Fatalf("got expireAt %d slide %d; want 1000 10", expireAt, slide)
+	}
+	// k2已经被访问过一次，再访问一次就会进入活跃列表
+	restored.Get("k2")
+	if got := restored.Records(); got[0].Key != "k2" || !got[0].Active {
+		t.Fatalf("got first record %+v; want active k2", got[0])
+	}
+}
+
+func TestGetRangeData(t *testing.T) {
+	lru := NewCache(2, int64(1000))
+	for i := 0; i < 20; i++ {
+		lru.Set(fmt.Sprintf("k%d", i), String("v"))
+	}
+	// 一半的key进入活跃列表，两个列表都要遍历完
+	for i := 0; i < 20; i += 2 {
+		lru.Get(fmt.Sprintf("k%d", i))
+		lru.Get(fmt.Sprintf("k%d", i))
+	}
+
+	data, err := lru.GetRangeData(0, math.MaxUint32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 20 {
+		t.Fatalf("got %d keys; want 20", len(got))
+	}
+	// 读取区间不删除key，删除由来源分片通过raft日志完成
+	if lru.Len() != 20 {
+		t.Fatalf("got len %d after GetRangeData; want 20", lru.Len())
+	}
+}
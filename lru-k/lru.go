@@ -0,0 +1,54 @@
+package lru_k
+
+import "container/list"
+
+// lruPolicy 经典LRU，一个链表，最近访问的在表头
+type lruPolicy struct {
+	ll *list.List
+}
+
+func init() {
+	Register(PolicyLRU, func(maxBytes int64, opts ...Option) Cache {
+		return newPolicyCache(maxBytes, &lruPolicy{}, opts...)
+	})
+}
+
+func (p *lruPolicy) reset() {
+	p.ll = list.New()
+}
+
+func (p *lruPolicy) add(e *Entry) {
+	e.elem = p.ll.PushFront(e)
+}
+
+func (p *lruPolicy) access(e *Entry) {
+	p.ll.MoveToFront(e.elem)
+}
+
+func (p *lruPolicy) remove(e *Entry) {
+	p.ll.Remove(e.elem)
+}
+
+func (p *lruPolicy) victim() *Entry {
+	if e := p.ll.Back(); e != nil {
+		return e.Value.(*Entry)
+	}
+	return nil
+}
+
+func (p *lruPolicy) order(fn func(e *Entry) bool) {
+	for e := p.ll.Back(); e != nil && fn(e.Value.(*Entry)); e = e.Prev() {
+	}
+}
+
+func (p *lruPolicy) records() []Record {
+	records := make([]Record, 0, p.ll.Len())
+	for e := p.ll.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*Entry).record(false))
+	}
+	return records
+}
+
+func (p *lruPolicy) load(e *Entry, active bool) {
+	e.elem = p.ll.PushBack(e)
+}
@@ -0,0 +1,146 @@
+package lru_k
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// maxmemory策略，决定缓存达到最大字节数后如何处理新的写入，和redis的maxmemory-policy类似
+const (
+	NoEviction     = "noeviction"     // 不淘汰，超出容量的写入返回ErrOutOfMemory
+	AllKeysPolicy  = "allkeys-policy" // 在所有key中按淘汰策略(见Policies)的顺序淘汰
+	AllKeysRandom  = "allkeys-random" // 在所有key中随机淘汰
+	VolatileLRU    = "volatile-lru"   // 在设置了过期时间的key中采样，淘汰最久未访问的
+	VolatileRandom = "volatile-random"
+	VolatileTTL    = "volatile-ttl" // 在设置了过期时间的key中采样，淘汰最早过期的
+
+	DefaultMaxmemoryPolicy = AllKeysPolicy
+
+	evictionSamples = 5 // 近似淘汰时每次采样的key数，和redis的maxmemory-samples默认值一致
+)
+
+// DefaultEntryOverhead 估算每个entry除了key和value以外占用的内存：
+// Entry结构体、链表节点，以及map中一个槽位(key的string header、value指针和tophash)
+const DefaultEntryOverhead = int64(unsafe.Sizeof(Entry{})+unsafe.Sizeof(list.Element{})) + mapSlotOverhead
+
+const mapSlotOverhead = int64(unsafe.Sizeof("")+unsafe.Sizeof(&list.Element{})) + 1
+
+// ErrOutOfMemory 缓存已满且maxmemory策略无法腾出空间时，写入返回该错误
+var ErrOutOfMemory = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+var maxmemoryPolicies = []string{NoEviction, AllKeysPolicy, AllKeysRandom, VolatileLRU, VolatileRandom, VolatileTTL}
+
+// MaxmemoryPolicies 返回所有支持的maxmemory策略
+func MaxmemoryPolicies() []string {
+	return append([]string(nil), maxmemoryPolicies...)
+}
+
+// ValidateMaxmemoryPolicy 检查maxmemory策略名称是否合法
+func ValidateMaxmemoryPolicy(name string) error {
+	for _, p := range maxmemoryPolicies {
+		if p == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown maxmemory policy %q, available: %v", name, maxmemoryPolicies)
+}
+
+// sampler 由两种Cache实现提供，用于在写入前按maxmemory策略腾出空间
+type sampler interface {
+	BytesUsed() int64
+	Remove(k string) (ok bool)
+	// sample 随机地遍历entry，volatile为true时只遍历设置了过期时间的entry，fn返回false时停止
+	sample(volatile bool, fn func(e *Entry) bool)
+	// order 按淘汰策略的顺序遍历entry，fn返回false时停止
+	order(fn func(e *Entry) bool)
+}
+
+// makeRoom 写入前淘汰entry，直到写入后的总字节数不超过maxBytes，
+// k是即将写入的key，不会被淘汰；growth是写入后增加的字节数
+func makeRoom(s sampler, o *options, maxBytes int64, k string, growth int64) error {
+	if maxBytes == 0 || growth <= 0 {
+		return nil
+	}
+	for s.BytesUsed()+growth > maxBytes {
+		if o.maxmemoryPolicy == NoEviction {
+			return ErrOutOfMemory
+		}
+		victim := sampleVictim(s, o.maxmemoryPolicy, map[string]bool{k: true})
+		if victim == nil {
+			// volatile-*策略下没有可以淘汰的key，和redis一样拒绝写入
+			return ErrOutOfMemory
+		}
+		s.Remove(victim.k)
+	}
+	return nil
+}
+
+// victims 按policy选出需要淘汰的key，淘汰之后s使用的字节数加上growth不超过maxBytes，不修改缓存
+func victims(s sampler, o *options, policy string, maxBytes int64, growth int64, skip []string) ([]string, error) {
+	need := s.BytesUsed() + growth - maxBytes
+	if maxBytes == 0 || need <= 0 {
+		return nil, nil
+	}
+	if policy == NoEviction {
+		return nil, ErrOutOfMemory
+	}
+	chosen := make(map[string]bool, len(skip))
+	for _, k := range skip {
+		chosen[k] = true
+	}
+	var keys []string
+	pick := func(e *Entry) {
+		chosen[e.k] = true
+		keys = append(keys, e.k)
+		need -= o.entrySize(e)
+	}
+	if policy == AllKeysPolicy {
+		s.order(func(e *Entry) bool {
+			if !chosen[e.k] {
+				pick(e)
+			}
+			return need > 0
+		})
+	} else {
+		for need > 0 {
+			victim := sampleVictim(s, policy, chosen)
+			if victim == nil {
+				break
+			}
+			pick(victim)
+		}
+	}
+	if need > 0 {
+		return nil, ErrOutOfMemory
+	}
+	return keys, nil
+}
+
+func sampleVictim(s sampler, policy string, skip map[string]bool) *Entry {
+	volatile := policy != AllKeysRandom
+	samples := evictionSamples
+	if policy == AllKeysRandom || policy == VolatileRandom {
+		samples = 1
+	}
+
+	var best *Entry
+	n := 0
+	s.sample(volatile, func(e *Entry) bool {
+		if skip[e.k] {
+			return true
+		}
+		n++
+		switch {
+		case best == nil:
+			best = e
+		case policy == VolatileTTL && e.expireAt < best.expireAt:
+			best = e
+		case policy == VolatileLRU && e.atime < best.atime:
+			best = e
+		}
+		return n < samples
+	})
+	return best
+}
@@ -1,15 +1,79 @@
 package lru_k
 
-type Option func(*cache)
+import "time"
+
+// options 是所有淘汰策略共用的可选配置
+type options struct {
+	k int // LRU-K中使用超过k次就移入缓存列表
+
+	now func() int64 // 时钟，返回unix纳秒时间戳，只用于读路径的惰性过期判断
+
+	onEliminate func(k string, v any)
+
+	maxmemoryPolicy  string // 见maxmemory.go
+	overhead         int64  // 每个entry除key和value以外额外计入的字节数
+	externalEviction bool   // 写入时不淘汰也不拒绝，由调用方通过Victims决定淘汰哪些key
+}
+
+// entrySize 返回entry计入缓存容量的字节数
+func (o *options) entrySize(e *Entry) int64 {
+	return e.size() + o.overhead
+}
+
+type Option func(*options)
+
+func newOptions(opts ...Option) options {
+	o := options{
+		k:               2,
+		maxmemoryPolicy: DefaultMaxmemoryPolicy,
+		now: func() int64 {
+			return time.Now().UnixNano()
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
 
 func WithK(k int) Option {
-	return func(c *cache) {
-		c.k = k
+	return func(o *options) {
+		o.k = k
 	}
 }
 
 func WithOnEliminate(onEliminate func(k string, v any)) Option {
-	return func(c *cache) {
-		c.onEliminate = onEliminate
+	return func(o *options) {
+		o.onEliminate = onEliminate
+	}
+}
+
+// WithClock 指定读路径惰性过期使用的时钟，返回unix纳秒时间戳，主要用于测试
+func WithClock(now func() int64) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithMaxmemoryPolicy 指定达到最大字节数后的处理策略，见maxmemory.go
+func WithMaxmemoryPolicy(policy string) Option {
+	return func(o *options) {
+		o.maxmemoryPolicy = policy
+	}
+}
+
+// WithExternalEviction 写入时不按maxmemory策略淘汰或者拒绝，maxBytes只用于各策略内部的容量划分，
+// 由调用方通过Victims选出需要淘汰的key再删除。raft的各个副本上访问记录不同，淘汰必须由leader统一决定
+func WithExternalEviction() Option {
+	return func(o *options) {
+		o.externalEviction = true
+	}
+}
+
+// WithEntryOverhead 指定每个entry除key和value以外额外计入的字节数，默认为0，
+// 需要准确统计内存时可以使用DefaultEntryOverhead
+func WithEntryOverhead(overhead int64) Option {
+	return func(o *options) {
+		o.overhead = overhead
 	}
 }
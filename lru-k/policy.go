@@ -0,0 +1,408 @@
+package lru_k
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 内置的淘汰策略名称
+const (
+	PolicyLRUK     = "lru-k"
+	PolicyLRU      = "lru"
+	PolicyLFU      = "lfu"
+	PolicyARC      = "arc"
+	Policy2Q       = "2q"
+	PolicyTinyLFU  = "w-tinylfu"
+	DefaultPolicy  = PolicyLRUK
+	defaultPolicyK = 2
+)
+
+// Factory 根据最大字节数和可选配置创建一个淘汰策略的Cache实现
+type Factory func(maxBytes int64, opts ...Option) Cache
+
+var (
+	policiesMu sync.RWMutex
+	policies   = make(map[string]Factory)
+)
+
+// Register 注册一个淘汰策略，重复注册同名策略会panic
+func Register(name string, factory Factory) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	if _, ok := policies[name]; ok {
+		panic(fmt.Sprintf("eviction policy %q registered twice", name))
+	}
+	policies[name] = factory
+}
+
+// New 按策略名称创建Cache，name为空时使用默认的LRU-K
+func New(name string, maxBytes int64, opts ...Option) (Cache, error) {
+	if name == "" {
+		name = DefaultPolicy
+	}
+	policiesMu.RLock()
+	factory, ok := policies[name]
+	policiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown eviction policy %q, available: %v", name, Policies())
+	}
+	return factory(maxBytes, opts...), nil
+}
+
+// Policies 返回所有已注册的策略名称
+func Policies() []string {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register(PolicyLRUK, func(maxBytes int64, opts ...Option) Cache {
+		return NewCache(newOptions(append([]Option{WithK(defaultPolicyK)}, opts...)...).k, maxBytes, opts...)
+	})
+}
+
+// policy 决定entry的组织方式和淘汰顺序，key索引、字节统计和过期时间由policyCache统一维护
+type policy interface {
+	reset()
+	add(e *Entry)                 // 新写入的entry
+	access(e *Entry)              // 读命中或者覆盖写
+	remove(e *Entry)              // 从策略的数据结构中移除entry
+	victim() *Entry               // 选出下一个被淘汰的entry，调用方随后会remove它
+	order(fn func(e *Entry) bool) // 按淘汰的先后顺序遍历entry，不修改策略的状态，fn返回false时停止
+	records() []Record            // 从最有价值到最该被淘汰的顺序导出
+	load(e *Entry, active bool)   // 快照恢复时按records的顺序追加
+}
+
+// ghostPolicy 由记录淘汰历史的策略实现，例如ARC的B1、B2和2Q的A1out。
+// victim选出entry时会记录；外部淘汰时victim不会被调用，由Evict在删除entry之前记录
+type ghostPolicy interface {
+	evicted(e *Entry)
+}
+
+// resizablePolicy 由按容量划分内部列表的策略实现，例如W-TinyLFU的窗口和主缓存
+type resizablePolicy interface {
+	resize(maxBytes int64)
+}
+
+// policyCache 用policy实现Cache接口，LRU-K之外的淘汰策略都基于它
+type policyCache struct {
+	maxBytes int64
+	nbytes   int64
+
+	items   map[string]*Entry
+	expires map[string]*Entry
+
+	policy policy
+
+	clock int64 // 访问的逻辑时钟，用于volatile-lru
+
+	options
+}
+
+func newPolicyCache(maxBytes int64, p policy, opts ...Option) Cache {
+	c := &policyCache{
+		maxBytes: maxBytes,
+		policy:   p,
+		options:  newOptions(opts...),
+	}
+	c.fill()
+	return c
+}
+
+func (c *policyCache) fill() {
+	c.items = make(map[string]*Entry)
+	c.expires = make(map[string]*Entry)
+	c.nbytes = 0
+	c.policy.reset()
+}
+
+func (c *policyCache) Get(k string) (v gValue, ok bool) {
+	e, found := c.items[k]
+	if !found || e.expired(c.now()) {
+		return nil, false
+	}
+	c.touch(e)
+	c.policy.access(e)
+	return e.v, true
+}
+
+func (c *policyCache) Peek(k string) (v gValue, ok bool) {
+	e, found := c.items[k]
+	if !found || e.expired(c.now()) {
+		return nil, false
+	}
+	return e.v, true
+}
+
+func (c *policyCache) Touch(k string) {
+	c.Get(k)
+}
+
+func (c *policyCache) Lookup(k string) (v gValue, ok bool) {
+	e, found := c.items[k]
+	if !found {
+		return nil, false
+	}
+	return e.v, true
+}
+
+func (c *policyCache) touch(e *Entry) {
+	c.clock++
+	e.atime = c.clock
+}
+
+func (c *policyCache) Set(k string, v gValue) error {
+	return c.SetWithExpire(k, v, 0, 0)
+}
+
+func (c *policyCache) SetWithExpire(k string, v gValue, expireAt int64, slide int64) error {
+	if c.maxmemoryPolicy != AllKeysPolicy && !c.externalEviction {
+		growth := int64(v.Len())
+		if e, ok := c.items[k]; ok {
+			growth -= int64(e.v.Len())
+		} else {
+			growth += int64(len(k)) + c.overhead
+		}
+		if err := makeRoom(c, &c.options, c.maxBytes, k, growth); err != nil {
+			return err
+		}
+	}
+
+	if e, ok := c.items[k]; ok {
+		c.nbytes += int64(v.Len()) - int64(e.v.Len())
+		e.v = v
+		c.setExpire(e, expireAt, slide)
+		c.touch(e)
+		c.policy.access(e)
+	} else {
+		e = &Entry{k: k, v: v}
+		c.items[k] = e
+		c.setExpire(e, expireAt, slide)
+		c.touch(e)
+		c.nbytes += c.entrySize(e)
+		c.policy.add(e)
+	}
+	// allkeys-policy按淘汰策略的顺序淘汰
+	for c.maxmemoryPolicy == AllKeysPolicy && !c.externalEviction && c.maxBytes != 0 && c.maxBytes < c.nbytes && len(c.items) > 0 {
+		c.RemoveOldest()
+	}
+	return nil
+}
+
+func (c *policyCache) sample(volatile bool, fn func(e *Entry) bool) {
+	m := c.items
+	if volatile {
+		m = c.expires
+	}
+	for _, e := range m {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+func (c *policyCache) order(fn func(e *Entry) bool) {
+	c.policy.order(fn)
+}
+
+func (c *policyCache) Victims(policy string, maxBytes int64, growth int64, skip []string) ([]string, error) {
+	return victims(c, &c.options, policy, maxBytes, growth, skip)
+}
+
+func (c *policyCache) setExpire(e *Entry, expireAt int64, slide int64) {
+	e.expireAt = expireAt
+	e.slide = slide
+	if expireAt == 0 {
+		e.slide = 0
+		delete(c.expires, e.k)
+		return
+	}
+	c.expires[e.k] = e
+}
+
+func (c *policyCache) Expire(k string, expireAt int64, slide int64) (ok bool) {
+	e, found := c.items[k]
+	if !found {
+		return false
+	}
+	c.setExpire(e, expireAt, slide)
+	return true
+}
+
+func (c *policyCache) Persist(k string) (ok bool) {
+	e, found := c.items[k]
+	if !found || e.expireAt == 0 {
+		return false
+	}
+	c.setExpire(e, 0, 0)
+	return true
+}
+
+func (c *policyCache) GetExpire(k string) (expireAt int64, slide int64, ok bool) {
+	e, found := c.items[k]
+	if !found {
+		return
+	}
+	return e.expireAt, e.slide, true
+}
+
+func (c *policyCache) SampleExpired(now int64, n int) (sampled int, expired []string) {
+	for k, e := range c.expires {
+		if sampled >= n {
+			break
+		}
+		sampled++
+		if e.expired(now) {
+			expired = append(expired, k)
+		}
+	}
+	return
+}
+
+func (c *policyCache) Len() int {
+	return len(c.items)
+}
+
+func (c *policyCache) removeEntry(e *Entry) {
+	c.policy.remove(e)
+	delete(c.items, e.k)
+	delete(c.expires, e.k)
+	c.nbytes -= c.entrySize(e)
+	if c.onEliminate != nil {
+		c.onEliminate(e.k, e.v)
+	}
+}
+
+func (c *policyCache) Remove(k string) (ok bool) {
+	e, found := c.items[k]
+	if !found {
+		return false
+	}
+	c.removeEntry(e)
+	return true
+}
+
+func (c *policyCache) Evict(k string) (ok bool) {
+	e, found := c.items[k]
+	if !found {
+		return false
+	}
+	if g, ok := c.policy.(ghostPolicy); ok {
+		g.evicted(e)
+	}
+	c.removeEntry(e)
+	return true
+}
+
+func (c *policyCache) SetMaxBytes(maxBytes int64) {
+	c.maxBytes = maxBytes
+	if r, ok := c.policy.(resizablePolicy); ok {
+		r.resize(maxBytes)
+	}
+}
+
+func (c *policyCache) RemoveOldest() {
+	if e := c.policy.victim(); e != nil {
+		c.removeEntry(e)
+	}
+}
+
+func (c *policyCache) Clear() {
+	if c.onEliminate != nil {
+		for _, e := range c.items {
+			c.onEliminate(e.k, e.v)
+		}
+	}
+	c.fill()
+}
+
+func (c *policyCache) BytesUsed() int64 {
+	return c.nbytes
+}
+
+func (c *policyCache) Records() []Record {
+	return c.policy.records()
+}
+
+func (c *policyCache) Load(records []Record) {
+	c.fill()
+	for _, r := range records {
+		e := &Entry{k: r.Key, v: r.Value, cnt: r.Count}
+		c.items[r.Key] = e
+		c.setExpire(e, r.ExpireAt, r.Slide)
+		c.nbytes += c.entrySize(e)
+		c.policy.load(e, r.Active)
+	}
+}
+
+func (c *policyCache) GetRangeData(start, end int) ([]byte, error) {
+	result := make(map[string]string)
+	now := c.now()
+	for k, e := range c.items {
+		if e.expired(now) {
+			continue
+		}
+		if keyInt := rangeHash(k); keyInt >= start && keyInt <= end {
+			result[k] = string(e.v.GetBytes())
+		}
+	}
+	return marshalRangeData(result)
+}
+
+func (c *policyCache) GetAll() map[string]gValue {
+	result := make(map[string]gValue)
+	now := c.now()
+	for k, e := range c.items {
+		if !e.expired(now) {
+			result[k] = e.v
+		}
+	}
+	return result
+}
+
+// record 将entry导出为Record，active的含义由各策略定义
+func (e *Entry) record(active bool) Record {
+	return Record{
+		Key:      e.k,
+		Value:    e.v,
+		Count:    e.cnt,
+		Active:   active,
+		ExpireAt: e.expireAt,
+		Slide:    e.slide,
+	}
+}
+
+// walkBack 依次从尾部向头部遍历lists，fn返回false时停止
+func walkBack(lists []*list.List, fn func(e *Entry) bool) {
+	for _, l := range lists {
+		for e := l.Back(); e != nil; e = e.Prev() {
+			if !fn(e.Value.(*Entry)) {
+				return
+			}
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
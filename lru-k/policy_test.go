@@ -0,0 +1,312 @@
+package lru_k
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewUnknownPolicy(t *testing.T) {
+	if _, err := New("fifo", 100); err == nil {
+		t.Fatal("expected unknown policy to fail")
+	}
+	if c, err := New("", 100); err != nil || c == nil {
+		t.Fatalf("expected default policy, got err %v", err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	for _, name := range Policies() {
+		t.Run(name, func(t *testing.T) {
+			maxBytes := int64(100)
+			c, err := New(name, maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Set("key1", String("1234"))
+			if v, ok := c.Get("key1"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key1=1234 failed")
+			}
+			if _, ok := c.Get("key2"); ok {
+				t.Fatalf("cache miss key2 failed")
+			}
+			if !c.Remove("key1") || c.Len() != 0 || c.BytesUsed() != 0 {
+				t.Fatalf("remove key1 failed, len %d bytes %d", c.Len(), c.BytesUsed())
+			}
+
+			for i := 0; i < 100; i++ {
+				c.Set(fmt.Sprintf("k%02d", i), String("v"))
+				c.Get(fmt.Sprintf("k%02d", i%7))
+			}
+			if name == PolicyLRUK {
+				// LRU-K每次写入只淘汰一个entry，允许短暂超出一个entry的大小
+				maxBytes += 4
+			}
+			if c.BytesUsed() > maxBytes {
+				t.Fatalf("got %d bytes used; want at most %d", c.BytesUsed(), maxBytes)
+			}
+
+			restored, _ := New(name, 100)
+			restored.Load(c.Records())
+			if restored.Len() != c.Len() || restored.BytesUsed() != c.BytesUsed() {
+				t.Fatalf("got len %d bytes %d after load; want %d %d", restored.Len(), restored.BytesUsed(), c.Len(), c.BytesUsed())
+			}
+			for k := range c.GetAll() {
+				if _, ok := restored.Get(k); !ok {
+					t.Fatalf("expected %s after load", k)
+				}
+			}
+		})
+	}
+}
+
+func TestLFU(t *testing.T) {
+	c, _ := New(PolicyLFU, int64(3*len("k1v1")))
+	c.Set("k1", String("v1"))
+	c.Set("k2", String("v2"))
+	c.Set("k3", String("v3"))
+	c.Get("k1")
+	c.Get("k3")
+	c.Set("k4", String("v4"))
+
+	if _, ok := c.Get("k2"); ok {
+		t.Fatal("expected least frequently used k2 to be evicted")
+	}
+	for _, k := range []string{"k1", "k3", "k4"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %s to survive", k)
+		}
+	}
+}
+
+// 热点key被多次访问后，一次性扫描大量冷key不应该把热点key全部冲掉
+func TestScanResistance(t *testing.T) {
+	for _, name := range []string{PolicyARC, Policy2Q, PolicyTinyLFU} {
+		t.Run(name, func(t *testing.T) {
+			entrySize := int64(len("hot00") + 1)
+			c, _ := New(name, 20*entrySize)
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 10; i++ {
+					k := fmt.Sprintf("hot%02d", i)
+					if _, ok := c.Get(k); !ok {
+						c.Set(k, String("v"))
+					}
+				}
+			}
+			for i := 0; i < 1000; i++ {
+				c.Set(fmt.Sprintf("s%04d", i), String("v"))
+			}
+
+			hits := 0
+			for i := 0; i < 10; i++ {
+				if _, ok := c.Get(fmt.Sprintf("hot%02d", i)); ok {
+					hits++
+				}
+			}
+			if hits < 5 {
+				t.Fatalf("got %d hot keys after scan; want at least 5", hits)
+			}
+		})
+	}
+}
+
+// 外部淘汰时由调用方通过Victims选出key再Evict，各策略的准入和幽灵列表仍然生效，表现和LRU不同
+func TestExternalEvictionPolicies(t *testing.T) {
+	entrySize := int64(len("hot00") + 1)
+	maxBytes := 20 * entrySize
+	set := func(c Cache, k string) {
+		keys, err := c.Victims(AllKeysPolicy, maxBytes, entrySize, []string{k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, victim := range keys {
+			c.Evict(victim)
+		}
+		c.Set(k, String("v"))
+	}
+	for _, name := range []string{PolicyLRU, PolicyARC, Policy2Q, PolicyTinyLFU} {
+		t.Run(name, func(t *testing.T) {
+			c, _ := New(name, maxBytes, WithExternalEviction())
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 10; i++ {
+					k := fmt.Sprintf("hot%02d", i)
+					if _, ok := c.Get(k); !ok {
+						set(c, k)
+					}
+				}
+			}
+			for i := 0; i < 1000; i++ {
+				set(c, fmt.Sprintf("s%04d", i))
+			}
+			if c.BytesUsed() > maxBytes {
+				t.Fatalf("got %d bytes used; want at most %d", c.BytesUsed(), maxBytes)
+			}
+
+			hits := 0
+			for i := 0; i < 10; i++ {
+				if _, ok := c.Peek(fmt.Sprintf("hot%02d", i)); ok {
+					hits++
+				}
+			}
+			if name == PolicyLRU {
+				if hits != 0 {
+					t.Fatalf("got %d hot keys after scan; want LRU to evict all of them", hits)
+				}
+				return
+			}
+			if hits < 5 {
+				t.Fatalf("got %d hot keys after scan; want at least 5", hits)
+			}
+
+			switch p := c.(*policyCache).policy.(type) {
+			case *arcPolicy:
+				if p.b1.len() == 0 {
+					t.Fatal("expected evicted keys in B1")
+				}
+				// B1中的key再次写入说明T1太小，p随之增大
+				k, before := p.b1.ll.Front().Value.(string), p.p
+				set(c, k)
+				if p.p <= before || p.t2.Front().Value.(*Entry).k != k {
+					t.Fatalf("got p %d after a B1 hit; want p to grow past %d and the key in T2", p.p, before)
+				}
+			case *twoQPolicy:
+				if p.a1out.len() == 0 {
+					t.Fatal("expected evicted keys in A1out")
+				}
+				k := p.a1out.ll.Front().Value.(string)
+				set(c, k)
+				if p.am.Front().Value.(*Entry).k != k {
+					t.Fatal("expected a key in A1out to go straight to Am")
+				}
+			case *tinyLFUPolicy:
+				if p.bytes[tlfuWindow] > p.windowMax+entrySize || p.segments[tlfuProbation].Len()+p.segments[tlfuProtected].Len() == 0 {
+					t.Fatalf("got window %d bytes and main %d entries; want entries admitted out of the window",
+						p.bytes[tlfuWindow], p.segments[tlfuProbation].Len()+p.segments[tlfuProtected].Len())
+				}
+			}
+		})
+	}
+}
+
+func TestCMSketch(t *testing.T) {
+	s := newCMSketch(64)
+	hot, cold := sketchHash("hot"), sketchHash("cold")
+	for i := 0; i < 10; i++ {
+		s.increment(hot)
+	}
+	s.increment(cold)
+	if s.estimate(hot) <= s.estimate(cold) {
+		t.Fatalf("got hot %d cold %d; want hot > cold", s.estimate(hot), s.estimate(cold))
+	}
+	if s.estimate(cold) != 1 {
+		t.Fatalf("got cold %d; want 1 from doorkeeper", s.estimate(cold))
+	}
+	before := s.estimate(hot)
+	s.reset()
+	if s.estimate(hot) >= before {
+		t.Fatalf("got hot %d after reset; want less than %d", s.estimate(hot), before)
+	}
+}
+
+func TestMaxmemoryPolicies(t *testing.T) {
+	for _, name := range []string{PolicyLRUK, PolicyLRU} {
+		t.Run(name+"/"+NoEviction, func(t *testing.T) {
+			c, _ := New(name, int64(2*len("k1v1")), WithMaxmemoryPolicy(NoEviction))
+			c.Set("k1", String("v1"))
+			c.Set("k2", String("v2"))
+			if err := c.Set("k3", String("v3")); err != ErrOutOfMemory {
+				t.Fatalf("got err %v; want ErrOutOfMemory", err)
+			}
+			// 覆盖写不增加字节数时允许写入
+			if err := c.Set("k1", String("v9")); err != nil {
+				t.Fatalf("got err %v on overwrite; want nil", err)
+			}
+			if _, ok := c.Get("k3"); ok || c.Len() != 2 {
+				t.Fatal("expected rejected write to leave cache unchanged")
+			}
+		})
+
+		t.Run(name+"/"+VolatileTTL, func(t *testing.T) {
+			c, _ := New(name, int64(3*len("k1v1")), WithMaxmemoryPolicy(VolatileTTL))
+			c.Set("k1", String("v1"))
+			c.SetWithExpire("k2", String("v2"), 200, 0)
+			c.SetWithExpire("k3", String("v3"), 100, 0)
+			if err := c.Set("k4", String("v4")); err != nil {
+				t.Fatalf("got err %v; want nil", err)
+			}
+			if _, ok := c.Get("k3"); ok {
+				t.Fatal("expected k3 which expires first to be evicted")
+			}
+			c.Remove("k2")
+			c.Set("k5", String("v5"))
+			// 已经没有设置过期时间的key可以淘汰
+			if err := c.Set("k6", String("v6")); err != ErrOutOfMemory {
+				t.Fatalf("got err %v; want ErrOutOfMemory", err)
+			}
+		})
+
+		t.Run(name+"/"+AllKeysRandom, func(t *testing.T) {
+			c, _ := New(name, int64(3*(len("k1v1")+8)), WithMaxmemoryPolicy(AllKeysRandom), WithEntryOverhead(8))
+			for i := 0; i < 10; i++ {
+				if err := c.Set(fmt.Sprintf("k%d", i), String("v1")); err != nil {
+					t.Fatalf("got err %v; want nil", err)
+				}
+			}
+			if c.Len() != 3 || c.BytesUsed() != int64(3*(len("k1v1")+8)) {
+				t.Fatalf("got len %d bytes %d; want 3 %d", c.Len(), c.BytesUsed(), 3*(len("k1v1")+8))
+			}
+		})
+	}
+}
+
+func TestVictims(t *testing.T) {
+	for _, name := range Policies() {
+		t.Run(name, func(t *testing.T) {
+			c, _ := New(name, 100, WithExternalEviction())
+			for i := 0; i < 100; i++ {
+				c.Set(fmt.Sprintf("k%02d", i), String("v"))
+				c.Get(fmt.Sprintf("k%02d", i%7))
+			}
+			// 写入时不淘汰，由调用方决定
+			if c.Len() != 100 || c.BytesUsed() != 400 {
+				t.Fatalf("got len %d bytes %d; want 100 400", c.Len(), c.BytesUsed())
+			}
+
+			keys, err := c.Victims(AllKeysPolicy, 100, 4, []string{"k00"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 76 || c.Len() != 100 {
+				t.Fatalf("got %d victims, len %d; want 76 victims and an unchanged cache", len(keys), c.Len())
+			}
+			again, _ := c.Victims(AllKeysPolicy, 100, 4, []string{"k00"})
+			if fmt.Sprint(again) != fmt.Sprint(keys) {
+				t.Fatalf("got %v then %v; want the same victims", keys, again)
+			}
+			for _, k := range keys {
+				if k == "k00" {
+					t.Fatal("expected skipped key not to be chosen")
+				}
+				c.Remove(k)
+			}
+			if c.BytesUsed()+4 > 100 {
+				t.Fatalf("got %d bytes used after eviction; want at most 96", c.BytesUsed())
+			}
+			// 经常访问的key留在缓存中
+			if _, ok := c.Peek("k03"); !ok && name != PolicyTinyLFU {
+				t.Fatal("expected hot key k03 to survive")
+			}
+		})
+	}
+
+	c, _ := New(PolicyLRU, 8, WithExternalEviction())
+	c.Set("k1", String("v1"))
+	c.Set("k2", String("v2"))
+	if _, err := c.Victims(NoEviction, 8, 4, nil); err != ErrOutOfMemory {
+		t.Fatalf("got err %v; want ErrOutOfMemory", err)
+	}
+	c.SetWithExpire("k1", String("v1"), 200, 0)
+	c.SetWithExpire("k2", String("v2"), 100, 0)
+	if keys, err := c.Victims(VolatileTTL, 8, 4, nil); err != nil || fmt.Sprint(keys) != "[k2]" {
+		t.Fatalf("got %v, %v; want [k2]", keys, err)
+	}
+}
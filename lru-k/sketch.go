@@ -0,0 +1,109 @@
+package lru_k
+
+import "github.com/spaolacci/murmur3"
+
+const (
+	cmDepth      = 4
+	cmMaxCounter = 15 // 和4-bit计数器一致，频率估计只需要区分冷热，不需要精确值
+)
+
+// cmSketch count-min sketch，用固定的内存估计每个key的访问频率，
+// 前面有一个布隆过滤器作为doorkeeper：key第一次出现只记录在doorkeeper里，
+// 第二次出现才进入sketch，避免大量只访问一次的key污染计数器。
+// 累计increment次数达到sampleSize后所有计数减半、doorkeeper清空，让频率随时间衰减
+type cmSketch struct {
+	rows       [cmDepth][]uint8
+	mask       uint64
+	door       []uint64
+	additions  int
+	sampleSize int
+}
+
+func newCMSketch(width int) *cmSketch {
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	s := &cmSketch{
+		mask:       uint64(w - 1),
+		door:       make([]uint64, (w+63)/64),
+		sampleSize: 10 * w,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func sketchHash(k string) uint64 {
+	return murmur3.Sum64([]byte(k))
+}
+
+func (s *cmSketch) index(h uint64, i int) uint64 {
+	lo, hi := h&0xffffffff, h>>32
+	return (lo + uint64(i)*(hi|1)) & s.mask
+}
+
+// doorkeeperAdd 在doorkeeper中记录h，返回h之前是否已经存在
+func (s *cmSketch) doorkeeperAdd(h uint64) bool {
+	present := true
+	for i := 0; i < 2; i++ {
+		bit := s.index(h, cmDepth+i)
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if s.door[word]&mask == 0 {
+			present = false
+			s.door[word] |= mask
+		}
+	}
+	return present
+}
+
+func (s *cmSketch) doorkeeperContains(h uint64) bool {
+	for i := 0; i < 2; i++ {
+		bit := s.index(h, cmDepth+i)
+		if s.door[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *cmSketch) increment(h uint64) {
+	if s.doorkeeperAdd(h) {
+		for i := range s.rows {
+			if idx := s.index(h, i); s.rows[i][idx] < cmMaxCounter {
+				s.rows[i][idx]++
+			}
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// estimate 返回h的估计访问次数，取各行计数的最小值
+func (s *cmSketch) estimate(h uint64) int {
+	est := cmMaxCounter
+	for i := range s.rows {
+		if v := int(s.rows[i][s.index(h, i)]); v < est {
+			est = v
+		}
+	}
+	if s.doorkeeperContains(h) {
+		est++
+	}
+	return est
+}
+
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	for i := range s.door {
+		s.door[i] = 0
+	}
+	s.additions = 0
+}
@@ -0,0 +1,264 @@
+package lru_k
+
+import "container/list"
+
+const (
+	tlfuWindow    uint8 = iota // 准入窗口，LRU
+	tlfuProbation              // 主缓存的试用区，SLRU的低优先级段
+	tlfuProtected              // 主缓存的保护区，SLRU的高优先级段
+)
+
+const (
+	tlfuWindowPercent    = 1  // 窗口占总容量的1%
+	tlfuProtectedPercent = 80 // 保护区占主缓存的80%
+
+	tlfuSketchMinWidth = 1 << 10
+	tlfuSketchMaxWidth = 1 << 20
+	tlfuBytesPerEntry  = 64 // 按每个entry平均64字节估算sketch的宽度
+)
+
+// tinyLFUPolicy W-TinyLFU：新entry先进入一个小的LRU窗口，窗口满了以后淘汰出的候选者
+// 在主缓存(SLRU)还有空间时直接进入主缓存，否则要和主缓存的淘汰者比较count-min sketch
+// 估计的访问频率，频率更高的才能留下
+type tinyLFUPolicy struct {
+	segments [3]*list.List
+	bytes    [3]int64
+
+	windowMax    int64
+	mainMax      int64
+	protectedMax int64
+
+	sketch   *cmSketch
+	width    int
+	overhead int64 // 和policyCache的字节统计保持一致
+}
+
+func init() {
+	Register(PolicyTinyLFU, func(maxBytes int64, opts ...Option) Cache {
+		return newPolicyCache(maxBytes, newTinyLFUPolicy(maxBytes, newOptions(opts...).overhead), opts...)
+	})
+}
+
+func newTinyLFUPolicy(maxBytes int64, overhead int64) *tinyLFUPolicy {
+	width := int(maxBytes / tlfuBytesPerEntry)
+	if width < tlfuSketchMinWidth {
+		width = tlfuSketchMinWidth
+	}
+	if width > tlfuSketchMaxWidth {
+		width = tlfuSketchMaxWidth
+	}
+	p := &tinyLFUPolicy{width: width, overhead: overhead}
+	p.setCapacity(maxBytes)
+	return p
+}
+
+func (p *tinyLFUPolicy) setCapacity(maxBytes int64) {
+	p.windowMax = maxBytes * tlfuWindowPercent / 100
+	p.mainMax = maxBytes - p.windowMax
+	p.protectedMax = p.mainMax * tlfuProtectedPercent / 100
+}
+
+// resize 按新的容量划分窗口和主缓存，sketch的宽度保持创建时的大小
+func (p *tinyLFUPolicy) resize(maxBytes int64) {
+	p.setCapacity(maxBytes)
+	p.admit()
+}
+
+func (p *tinyLFUPolicy) reset() {
+	for i := range p.segments {
+		p.segments[i] = list.New()
+		p.bytes[i] = 0
+	}
+	p.sketch = newCMSketch(p.width)
+}
+
+func (p *tinyLFUPolicy) link(e *Entry, seg uint8, front bool) {
+	e.seg = seg
+	e.charged = e.size() + p.overhead
+	p.bytes[seg] += e.charged
+	if front {
+		e.elem = p.segments[seg].PushFront(e)
+	} else {
+		e.elem = p.segments[seg].PushBack(e)
+	}
+}
+
+func (p *tinyLFUPolicy) unlink(e *Entry) {
+	p.segments[e.seg].Remove(e.elem)
+	p.bytes[e.seg] -= e.charged
+}
+
+func (p *tinyLFUPolicy) add(e *Entry) {
+	p.sketch.increment(sketchHash(e.k))
+	p.link(e, tlfuWindow, true)
+	p.admit()
+}
+
+func (p *tinyLFUPolicy) access(e *Entry) {
+	p.sketch.increment(sketchHash(e.k))
+	// 覆盖写可能改变了entry的大小
+	p.bytes[e.seg] += e.size() + p.overhead - e.charged
+	e.charged = e.size() + p.overhead
+
+	switch e.seg {
+	case tlfuProbation:
+		// 试用区被再次访问就晋升到保护区，保护区超出大小时把最久未访问的降级回试用区
+		p.unlink(e)
+		p.link(e, tlfuProtected, true)
+		protected := p.segments[tlfuProtected]
+		for p.bytes[tlfuProtected] > p.protectedMax && protected.Len() > 1 {
+			demoted := protected.Back().Value.(*Entry)
+			p.unlink(demoted)
+			p.link(demoted, tlfuProbation, true)
+		}
+	default:
+		p.segments[e.seg].MoveToFront(e.elem)
+	}
+}
+
+func (p *tinyLFUPolicy) remove(e *Entry) {
+	p.unlink(e)
+	p.admit()
+}
+
+// admit 窗口超出大小时，把窗口中最久未访问的候选者移入试用区，直到主缓存放不下为止。
+// 主缓存已满时候选者留在窗口中，淘汰时(victim或者order)再和主缓存的淘汰者比较频率
+func (p *tinyLFUPolicy) admit() {
+	for p.bytes[tlfuWindow] > p.windowMax {
+		candidate := p.segments[tlfuWindow].Back().Value.(*Entry)
+		if p.mainVictim() != nil && p.bytes[tlfuProbation]+p.bytes[tlfuProtected]+candidate.charged > p.mainMax {
+			return
+		}
+		p.unlink(candidate)
+		p.link(candidate, tlfuProbation, true)
+	}
+}
+
+func (p *tinyLFUPolicy) mainVictim() *Entry {
+	if e := p.segments[tlfuProbation].Back(); e != nil {
+		return e.Value.(*Entry)
+	}
+	if e := p.segments[tlfuProtected].Back(); e != nil {
+		return e.Value.(*Entry)
+	}
+	return nil
+}
+
+func (p *tinyLFUPolicy) victim() *Entry {
+	for p.bytes[tlfuWindow] > p.windowMax {
+		candidate := p.segments[tlfuWindow].Back().Value.(*Entry)
+		mainBytes := p.bytes[tlfuProbation] + p.bytes[tlfuProtected]
+		victim := p.mainVictim()
+		if victim != nil && mainBytes+candidate.charged > p.mainMax {
+			// 准入判断：主缓存已满，候选者的频率必须高于主缓存的淘汰者才能进入
+			if p.sketch.estimate(sketchHash(candidate.k)) <= p.sketch.estimate(sketchHash(victim.k)) {
+				return candidate
+			}
+			p.unlink(candidate)
+			p.link(candidate, tlfuProbation, true)
+			return victim
+		}
+		p.unlink(candidate)
+		p.link(candidate, tlfuProbation, true)
+	}
+	if victim := p.mainVictim(); victim != nil {
+		return victim
+	}
+	if e := p.segments[tlfuWindow].Back(); e != nil {
+		return e.Value.(*Entry)
+	}
+	return nil
+}
+
+// order 模拟victim的淘汰顺序但不修改状态：窗口超出大小时，窗口的候选者和主缓存的淘汰者比较sketch估计的频率，
+// 频率低的先被淘汰，胜出的候选者进入试用区的头部，排在原有的试用区之后、保护区之前
+func (p *tinyLFUPolicy) order(fn func(e *Entry) bool) {
+	window := p.bytes[tlfuWindow]
+	mainBytes := p.bytes[tlfuProbation] + p.bytes[tlfuProtected]
+	candidate := p.segments[tlfuWindow].Back()
+	probation, protected := p.segments[tlfuProbation].Back(), p.segments[tlfuProtected].Back()
+	var admitted []*Entry
+	// mainVictim 返回模拟状态下主缓存的淘汰者，pop为true时同时把它移出主缓存
+	mainVictim := func(pop bool) *Entry {
+		var e *Entry
+		switch {
+		case probation != nil:
+			e = probation.Value.(*Entry)
+			if pop {
+				probation = probation.Prev()
+			}
+		case len(admitted) > 0:
+			e = admitted[0]
+			if pop {
+				admitted = admitted[1:]
+			}
+		case protected != nil:
+			e = protected.Value.(*Entry)
+			if pop {
+				protected = protected.Prev()
+			}
+		}
+		if e != nil && pop {
+			mainBytes -= e.charged
+		}
+		return e
+	}
+	for {
+		var e *Entry
+		for e == nil && window > p.windowMax && candidate != nil {
+			c := candidate.Value.(*Entry)
+			candidate = candidate.Prev()
+			window -= c.charged
+			victim := mainVictim(false)
+			full := victim != nil && mainBytes+c.charged > p.mainMax
+			if full && p.sketch.estimate(sketchHash(c.k)) <= p.sketch.estimate(sketchHash(victim.k)) {
+				e = c
+				continue
+			}
+			if full {
+				e = mainVictim(true)
+			}
+			admitted = append(admitted, c)
+			mainBytes += c.charged
+		}
+		if e == nil {
+			e = mainVictim(true)
+		}
+		if e == nil && candidate != nil {
+			e = candidate.Value.(*Entry)
+			candidate = candidate.Prev()
+			window -= e.charged
+		}
+		if e == nil || !fn(e) {
+			return
+		}
+	}
+}
+
+// records 导出时用Count保存sketch估计的频率，恢复时重新灌入sketch
+func (p *tinyLFUPolicy) records() []Record {
+	var records []Record
+	appendList := func(l *list.List, active bool) {
+		for e := l.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*Entry)
+			entry.cnt = p.sketch.estimate(sketchHash(entry.k))
+			records = append(records, entry.record(active))
+		}
+	}
+	appendList(p.segments[tlfuProtected], true)
+	appendList(p.segments[tlfuWindow], false)
+	appendList(p.segments[tlfuProbation], false)
+	return records
+}
+
+func (p *tinyLFUPolicy) load(e *Entry, active bool) {
+	h := sketchHash(e.k)
+	for i := 0; i < e.cnt && i <= cmMaxCounter; i++ {
+		p.sketch.increment(h)
+	}
+	if active {
+		p.link(e, tlfuProtected, false)
+	} else {
+		p.link(e, tlfuProbation, false)
+	}
+}
@@ -0,0 +1,121 @@
+package lru_k
+
+import "container/list"
+
+const (
+	twoQA1in uint8 = iota // 只访问过一次的entry，FIFO
+	twoQAm                // 再次访问过的entry，LRU
+)
+
+const (
+	twoQInRatio  = 4 // A1in最多占entry总数的1/4
+	twoQOutRatio = 2 // A1out最多记录entry总数1/2的key
+)
+
+// twoQPolicy 2Q算法：新entry先进入FIFO的A1in，再次被访问才进入LRU的Am；
+// 从A1in淘汰的key记录在幽灵列表A1out中，A1out中的key再次写入时直接进入Am。
+// 一次性的扫描只会冲掉A1in，不会影响Am中的热点数据
+type twoQPolicy struct {
+	a1in  *list.List
+	am    *list.List
+	a1out *ghostList
+}
+
+func init() {
+	Register(Policy2Q, func(maxBytes int64, opts ...Option) Cache {
+		return newPolicyCache(maxBytes, &twoQPolicy{}, opts...)
+	})
+}
+
+func (p *twoQPolicy) reset() {
+	p.a1in, p.am = list.New(), list.New()
+	p.a1out = newGhostList()
+}
+
+func (p *twoQPolicy) add(e *Entry) {
+	if p.a1out.remove(e.k) {
+		e.seg = twoQAm
+		e.elem = p.am.PushFront(e)
+		return
+	}
+	e.seg = twoQA1in
+	e.elem = p.a1in.PushFront(e)
+}
+
+func (p *twoQPolicy) access(e *Entry) {
+	if e.seg == twoQAm {
+		p.am.MoveToFront(e.elem)
+		return
+	}
+	p.a1in.Remove(e.elem)
+	e.seg = twoQAm
+	e.elem = p.am.PushFront(e)
+}
+
+func (p *twoQPolicy) remove(e *Entry) {
+	if e.seg == twoQAm {
+		p.am.Remove(e.elem)
+	} else {
+		p.a1in.Remove(e.elem)
+	}
+}
+
+func (p *twoQPolicy) victim() *Entry {
+	total := p.a1in.Len() + p.am.Len()
+	if p.a1in.Len() > 0 && (p.a1in.Len()*twoQInRatio > total || p.am.Len() == 0) {
+		e := p.a1in.Back().Value.(*Entry)
+		p.evicted(e)
+		return e
+	}
+	if e := p.am.Back(); e != nil {
+		return e.Value.(*Entry)
+	}
+	return nil
+}
+
+// evicted 从A1in淘汰的key记入A1out，再次写入时直接进入Am
+func (p *twoQPolicy) evicted(e *Entry) {
+	if e.seg == twoQA1in {
+		p.a1out.push(e.k, maxInt((p.a1in.Len()+p.am.Len())/twoQOutRatio, 1))
+	}
+}
+
+// order 模拟victim的淘汰顺序：A1in超过1/4时淘汰A1in，否则淘汰Am，每淘汰一个都重新比较
+func (p *twoQPolicy) order(fn func(e *Entry) bool) {
+	a1in, am := p.a1in.Back(), p.am.Back()
+	nin, nm := p.a1in.Len(), p.am.Len()
+	for {
+		var e *list.Element
+		if nin > 0 && (nin*twoQInRatio > nin+nm || nm == 0) {
+			e, a1in = a1in, a1in.Prev()
+			nin--
+		} else if nm > 0 {
+			e, am = am, am.Prev()
+			nm--
+		}
+		if e == nil || !fn(e.Value.(*Entry)) {
+			return
+		}
+	}
+}
+
+func (p *twoQPolicy) records() []Record {
+	records := make([]Record, 0, p.a1in.Len()+p.am.Len())
+	for e := p.am.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*Entry).record(true))
+	}
+	for e := p.a1in.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*Entry).record(false))
+	}
+	return records
+}
+
+func (p *twoQPolicy) load(e *Entry, active bool) {
+	if active {
+		e.seg = twoQAm
+		e.elem = p.am.PushBack(e)
+	} else {
+		e.seg = twoQA1in
+		e.elem = p.a1in.PushBack(e)
+	}
+}
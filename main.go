@@ -13,7 +13,7 @@ import (
 func main() {
 	config := cache.NewConfig()
 
-	proxy := cache.NewCacheProxy(config.HttpPort, config.RaftPort, config.NodeName, config.Bootstrap, config.JoinAddress)
+	proxy := cache.NewCacheProxy(config)
 
 	var l net.Listener
 	var err error
@@ -27,9 +27,27 @@ func main() {
 
 	httpServer := NewHttpServer(proxy)
 	go func() {
-		http.Serve(l, httpServer.mutex)
+		http.Serve(l, httpServer)
 	}()
 
+	if config.RespPort != 0 {
+		respAddr := "127.0.0.1:" + strconv.Itoa(int(config.RespPort))
+		rl, err := net.Listen("tcp", respAddr)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("listen %s failed: %s", respAddr, err))
+		}
+		logger.Printf("resp server listen:%s", rl.Addr())
+		respServer := NewRespServer(proxy)
+		go func() {
+			respServer.Serve(rl)
+		}()
+	}
+
+	// 哈希环由分片控制器维护时订阅控制器发布的配置
+	if httpServer.ctrler != nil {
+		go httpServer.watchConfig(httpServer.ctrler)
+	}
+
 	if config.JoinAddress != "" {
 		err = cache.JoinRaftCluster(proxy.Opts)
 		if err != nil {
@@ -38,20 +56,36 @@ func main() {
 	}
 
 	// monitor leadership
+	var stopExpire chan struct{}
 	for {
 		select {
 		case leader := <-proxy.Raft.LeaderNotifyCh:
 			if leader {
 				proxy.Log.Println("become leader, enable write api")
 				proxy.SetWriteFlag(true)
+				// 把自己的http地址写入成员表，follower据此把写请求转发给leader，
+				// 登记了新的日志版本之后才能写入统一的maxmemory设置
+				go func() {
+					proxy.RegisterSelf()
+					proxy.PublishMaxMemory()
+				}()
+				// 继续执行之前的leader没有完成的迁移任务
+				go httpServer.resumeMigrations()
 				// 只有raft group中的leader node开启与数据库的写回策略
 				go func() {
 					proxy.Cache.FlushDirtyKeys()
 				}()
+				// 只有leader进行主动过期，删除通过raft日志同步到follower
+				stopExpire = make(chan struct{})
+				go proxy.ExpireCycle(stopExpire)
 			} else {
 				proxy.Log.Println("become follower, close write api")
 				proxy.SetWriteFlag(false)
 				proxy.Cache.Close()
+				if stopExpire != nil {
+					close(stopExpire)
+					stopExpire = nil
+				}
 			}
 		}
 	}
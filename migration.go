@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	migratePageKeys       = 1000 // 每次从来源分片拷贝的key数量
+	migrateDirtyRounds    = 5    // 冻结之前追赶脏key的最多轮数
+	migrateDirtyThreshold = 100  // 一轮取走的脏key少于这个数量时不再追赶，直接冻结
+	migrateRetryInterval  = time.Second
+)
+
+// 迁移任务的阶段，按顺序执行
+const (
+	phaseCopy    = "copy"    // 按检查点分页拷贝区间中的key
+	phaseCatchup = "catchup" // 重新拷贝拷贝期间写入过的key
+	phaseCutover = "cutover" // 冻结来源分片的区间，拷贝最后的脏key，切换哈希环
+	phasePurge   = "purge"   // 来源分片通过raft日志删除迁出的key
+	phaseDone    = "done"
+)
+
+/*
+*
+migrationJob 是本分片作为接收方的一次数据迁移，状态通过raft日志保存在本分片组中，每完成一页拷贝保存一次检查点，
+leader崩溃或者切换后由新的leader从检查点继续执行：
+
+ 1. copy: 在每个来源分片上建立迁移会话，按hash值分页拷贝区间中的key，每页作为一条raft日志提交到本分片，
+    提交之后才推进检查点。来源分片的会话丢失时重新建立会话，从头拷贝
+ 2. catchup: 取走来源分片记录的拷贝期间写入过的key，重新拷贝它们当前的值，直到剩下的脏key很少
+ 3. cutover: 冻结来源分片的区间，取走最后的脏key，通过raft日志记录切换(进入purge阶段)之后本节点切换到新的哈希环，
+    分片组的其他节点和使用分片控制器时其他分片组的节点看到这条记录后才切换
+ 4. purge: 需要时通知其他节点，来源分片确认自己的哈希环已经不负责这些区间后通过raft日志删除迁出的key，再结束会话
+
+切换之前本节点使用迁移之前的哈希环，这些区间的读写仍由来源分片处理；来源分片在切换完成之前不会删除数据。
+使用分片控制器时移出哈希环的分片组也用配置的任务ID记录一个done阶段的任务，表示数据已经推送给接管的分片组
+*/
+type migrationJob struct {
+	ID       string              `json:"id"`
+	Phase    string              `json:"phase"`
+	Sources  []*migrationSource  `json:"sources"`
+	Before   *consistenthash.Map `json:"before"` // 切换之前本节点使用的哈希环
+	After    *consistenthash.Map `json:"after"`  // 切换之后的哈希环
+	Notify   bool                `json:"notify"` // 切换后通过/addpeer通知哈希环上的其他节点
+	Notified bool                `json:"notified,omitempty"`
+	Copied   int                 `json:"copied"` // 拷贝的key数量，包括重新拷贝的脏key
+	Purged   int                 `json:"purged"` // 来源分片删除的key数量
+	Error    string              `json:"error,omitempty"`
+	Started  time.Time           `json:"started"`
+	Updated  time.Time           `json:"updated"`
+}
+
+// migrationSource 是一个来源分片，Node是它在哈希环上的真实节点，使用分片控制器时是分片组ID
+type migrationSource struct {
+	Node    string           `json:"node"`
+	Session string           `json:"session,omitempty"`
+	Ranges  []migrationRange `json:"ranges"`
+	Purged  bool             `json:"purged,omitempty"`
+}
+
+// migrationRange 是要迁移的hash区间[Start, End]，[Start, Next)中的key已经拷贝并提交
+type migrationRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	Next  int `json:"next,omitempty"`
+}
+
+// errMigrationLost 来源分片上的迁移会话已经丢失
+var errMigrationLost = errors.New("migration session lost")
+
+// migrations 记录本节点正在执行的迁移任务，以及任务切换之前本节点哈希环的状态
+type migrations struct {
+	mutex   sync.Mutex
+	running map[string]bool
+	holding int                 // 还没有切换哈希环的任务数
+	held    *consistenthash.Map // 任务切换之前收到的新哈希环，切换时使用
+}
+
+// migrate 创建ID为id的迁移任务，把ranges从来源节点迁移到本节点，切换之后本节点使用after，返回时迁移已经完成
+func (h *httpServer) migrate(id string, ranges []consistenthash.RangeNode, before *consistenthash.Map, after *consistenthash.Map, notify bool) (*migrationJob, error) {
+	now := time.Now()
+	job := &migrationJob{
+		ID:      id,
+		Phase:   phaseCopy,
+		Before:  before,
+		After:   after,
+		Notify:  notify,
+		Started: now,
+	}
+	sources := make(map[string]*migrationSource)
+	for _, rangeNode := range ranges {
+		src, ok := sources[rangeNode.RealNode]
+		if !ok {
+			src = &migrationSource{Node: rangeNode.RealNode}
+			sources[rangeNode.RealNode] = src
+			job.Sources = append(job.Sources, src)
+		}
+		src.Ranges = append(src.Ranges, migrationRange{Start: rangeNode.Start, End: rangeNode.End, Next: rangeNode.Start})
+	}
+	if err := h.saveJob(job); err != nil {
+		return nil, err
+	}
+	h.log.Printf("migration %s created, sources:%d", job.ID, len(job.Sources))
+	return job, h.runMigration(job)
+}
+
+// resumeMigrations 成为leader后继续执行没有完成的迁移任务
+func (h *httpServer) resumeMigrations() {
+	// 等待之前的leader提交的日志都已经应用，读到最新的任务状态
+	if err := h.cache.Barrier(); err != nil {
+		h.log.Printf("resume migrations failed:%v", err)
+		return
+	}
+	for id, state := range h.cache.MigrationJobs() {
+		job, err := decodeJob(state)
+		if err != nil {
+			h.log.Printf("decode migration %s failed:%v", id, err)
+			continue
+		}
+		if job.Phase == phaseDone {
+			continue
+		}
+		h.log.Printf("resume migration %s at phase %s", job.ID, job.Phase)
+		go func() {
+			if err := h.runMigration(job); err != nil {
+				h.log.Printf("migration %s stopped:%v", job.ID, err)
+			}
+		}()
+	}
+}
+
+// runMigration 执行迁移任务直到完成，出错时记录错误并重试，本节点不再是leader时返回
+func (h *httpServer) runMigration(job *migrationJob) error {
+	m := &h.migrations
+	m.mutex.Lock()
+	if m.running[job.ID] {
+		m.mutex.Unlock()
+		return fmt.Errorf("migration %s is already running", job.ID)
+	}
+	if m.running == nil {
+		m.running = make(map[string]bool)
+	}
+	m.running[job.ID] = true
+	m.mutex.Unlock()
+
+	holding := job.Phase == phaseCopy || job.Phase == phaseCatchup || job.Phase == phaseCutover
+	if holding {
+		h.holdRing(job.Before)
+	}
+	release := func() {
+		if holding {
+			holding = false
+			h.releaseRing(job.After)
+		}
+	}
+	defer func() {
+		release()
+		m.mutex.Lock()
+		delete(m.running, job.ID)
+		m.mutex.Unlock()
+	}()
+
+	for job.Phase != phaseDone {
+		if !h.cache.IsLeader() {
+			return cache.ErrNotLeader
+		}
+		var err error
+		switch job.Phase {
+		case phaseCopy:
+			err = h.migrateCopy(job)
+		case phaseCatchup:
+			err = h.migrateCatchup(job)
+		case phaseCutover:
+			err = h.migrateCutover(job, release)
+		case phasePurge:
+			err = h.migratePurge(job)
+		default:
+			return fmt.Errorf("unknown migration phase %q", job.Phase)
+		}
+		if err != nil {
+			h.log.Printf("migration %s %s failed:%v", job.ID, job.Phase, err)
+			job.Error = err.Error()
+			h.saveJob(job)
+			time.Sleep(migrateRetryInterval)
+		}
+	}
+	h.log.Printf("migration %s done, copied:%d purged:%d", job.ID, job.Copied, job.Purged)
+	return nil
+}
+
+// migrateCopy 分页拷贝每个来源分片的区间，每页提交之后保存检查点
+func (h *httpServer) migrateCopy(job *migrationJob) error {
+	for _, src := range job.Sources {
+		if src.Session == "" {
+			var ret migrationResponse
+			if err := h.migrationCall(src.Node, http.MethodPost, "/v1/cluster/migrate/begin", migrationRequest{Ranges: src.Ranges}, &ret); err != nil {
+				return err
+			}
+			// 新的会话只记录建立之后的写入，之前拷贝的key可能已经过时，从头拷贝
+			src.Session = ret.Session
+			for i := range src.Ranges {
+				src.Ranges[i].Next = src.Ranges[i].Start
+			}
+			if err := h.saveJob(job); err != nil {
+				return err
+			}
+		}
+		for i := range src.Ranges {
+			r := &src.Ranges[i]
+			for r.Next <= r.End {
+				start := time.Now()
+				query := url.Values{
+					"session": {src.Session},
+					"start":   {strconv.Itoa(r.Next)},
+					"end":     {strconv.Itoa(r.End)},
+					"limit":   {strconv.Itoa(migratePageKeys)},
+				}
+				var ret migrationResponse
+				if err := h.migrationCall(src.Node, http.MethodGet, "/v1/cluster/migrate/range?"+query.Encode(), nil, &ret); err != nil {
+					return h.migrationFailed(job, src, err)
+				}
+				if err := h.applyMigrated(ret.Entries); err != nil {
+					return err
+				}
+				r.Next = ret.Next
+				job.Copied += len(ret.Entries)
+				if err := h.saveJob(job); err != nil {
+					return err
+				}
+				h.throttle(len(ret.Entries), time.Since(start))
+			}
+		}
+	}
+	job.Phase = phaseCatchup
+	return h.saveJob(job)
+}
+
+// migrateCatchup 重新拷贝拷贝期间写入过的key，直到一轮取走的脏key很少
+func (h *httpServer) migrateCatchup(job *migrationJob) error {
+	for _, src := range job.Sources {
+		for round := 0; round < migrateDirtyRounds; round++ {
+			n, err := h.drainDirty(job, src)
+			if err != nil {
+				return err
+			}
+			if n < migrateDirtyThreshold {
+				break
+			}
+		}
+	}
+	job.Phase = phaseCutover
+	return h.saveJob(job)
+}
+
+// migrateCutover 冻结来源分片的区间并拷贝最后的脏key，之后这些key只在本节点写入，记录切换后再调用release切换哈希环。
+// 来源分片的区间一直冻结到purge阶段结束会话，重新执行时再次冻结没有影响；来源分片的会话丢失时回到copy阶段重新拷贝
+func (h *httpServer) migrateCutover(job *migrationJob, release func()) error {
+	for _, src := range job.Sources {
+		if err := h.migrationCall(src.Node, http.MethodPost, "/v1/cluster/migrate/freeze?session="+url.QueryEscape(src.Session), nil, nil); err != nil {
+			return h.migrationFailed(job, src, err)
+		}
+		for {
+			n, err := h.drainDirty(job, src)
+			if err != nil {
+				return err
+			}
+			if n < migratePageKeys {
+				break
+			}
+		}
+	}
+
+	// 先通过raft日志记录切换再切换本节点的哈希环，之后新的leader不会再使用旧的哈希环
+	job.Phase = phasePurge
+	if err := h.saveJob(job); err != nil {
+		job.Phase = phaseCutover
+		return err
+	}
+	release()
+	return nil
+}
+
+// migratePurge 需要时通过/addpeer通知哈希环上的其他节点，再通知来源分片删除迁出的key，
+// 来源分片的哈希环还没有切换时返回409，稍后重试
+func (h *httpServer) migratePurge(job *migrationJob) error {
+	if job.Notify && !job.Notified {
+		self := h.cache.Opts.HttpAddress
+		for _, peer := range job.After.GetPeers() {
+			if peer == self {
+				continue
+			}
+			resp, err := http.Get(fmt.Sprintf("http://%s/addpeer?peerAddress=%s&epoch=%d", peer, self, job.After.Epoch))
+			if err != nil {
+				return fmt.Errorf("notify %s: %w", peer, err)
+			}
+			resp.Body.Close()
+			h.log.Printf("send to peer %s peerAddress %s", peer, self)
+		}
+		job.Notified = true
+		if err := h.saveJob(job); err != nil {
+			return err
+		}
+	}
+	for _, src := range job.Sources {
+		if src.Purged {
+			continue
+		}
+		var ret migrationResponse
+		if err := h.migrationCall(src.Node, http.MethodPost, "/v1/cluster/migrate/finish", migrationRequest{Session: src.Session, Ranges: src.Ranges}, &ret); err != nil {
+			return err
+		}
+		src.Purged = true
+		job.Purged += ret.Purged
+		if err := h.saveJob(job); err != nil {
+			return err
+		}
+	}
+	job.Phase = phaseDone
+	job.Error = ""
+	return h.saveJob(job)
+}
+
+// drainDirty 取走来源分片的一批脏key并写入本分片，返回取走的数量
+func (h *httpServer) drainDirty(job *migrationJob, src *migrationSource) (int, error) {
+	query := url.Values{"session": {src.Session}, "limit": {strconv.Itoa(migratePageKeys)}}
+	var ret migrationResponse
+	if err := h.migrationCall(src.Node, http.MethodPost, "/v1/cluster/migrate/dirty?"+query.Encode(), nil, &ret); err != nil {
+		return 0, h.migrationFailed(job, src, err)
+	}
+	if err := h.applyMigrated(ret.Entries); err != nil {
+		return 0, err
+	}
+	job.Copied += len(ret.Entries)
+	return len(ret.Entries), nil
+}
+
+// migrationFailed 来源分片的会话丢失时回到copy阶段重新建立会话
+func (h *httpServer) migrationFailed(job *migrationJob, src *migrationSource, err error) error {
+	if !errors.Is(err, errMigrationLost) {
+		return err
+	}
+	src.Session = ""
+	job.Phase = phaseCopy
+	return err
+}
+
+// applyMigrated 把迁移的key按原样作为raft日志写入本分片，类型和存活时间不变，返回时已经提交
+func (h *httpServer) applyMigrated(entries []cache.MigrationEntry) error {
+	var restored []cache.MigrationEntry
+	var deleted []string
+	for _, e := range entries {
+		if e.Deleted {
+			deleted = append(deleted, string(e.Key))
+			continue
+		}
+		restored = append(restored, e)
+	}
+	if len(restored) > 0 {
+		errs, err := h.cache.DoRestore(context.Background(), restored)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err != nil {
+				return fmt.Errorf("import %s: %w", restored[i].Key, err)
+			}
+		}
+	}
+	if len(deleted) > 0 {
+		if _, err := h.cache.DoMDel(context.Background(), deleted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttle 按-migraterate限制拷贝速度
+func (h *httpServer) throttle(n int, elapsed time.Duration) {
+	rate := h.cache.Opts.MigrateRate
+	if rate <= 0 || n == 0 {
+		return
+	}
+	if wait := time.Duration(n)*time.Second/time.Duration(rate) - elapsed; wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// migrationCall 调用来源分片的迁移接口，req不为nil时作为json请求体，响应解码到ret中
+func (h *httpServer) migrationCall(node string, method string, uri string, req interface{}, ret interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	resp, err := h.peerDo(context.Background(), peerClient, node, false, method, uri, body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error *apiError `json:"error"`
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(msg, &e) == nil && e.Error != nil {
+			if e.Error.Code == codeMigrationNotFound {
+				return fmt.Errorf("%w on %s", errMigrationLost, node)
+			}
+			return fmt.Errorf("%s: status %d: %s", node, resp.StatusCode, e.Error.Message)
+		}
+		return fmt.Errorf("%s: status %d: %s", node, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if ret == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+func (h *httpServer) saveJob(job *migrationJob) error {
+	job.Updated = time.Now()
+	state, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return h.cache.DoSetMigration(job.ID, string(state))
+}
+
+// cutover 判断迁移任务是否已经通过raft日志记录了切换
+func (job *migrationJob) cutover() bool {
+	return job.Phase == phasePurge || job.Phase == phaseDone
+}
+
+func decodeJob(state string) (*migrationJob, error) {
+	var job migrationJob
+	if err := json.Unmarshal([]byte(state), &job); err != nil {
+		return nil, err
+	}
+	for _, ring := range []*consistenthash.Map{job.Before, job.After} {
+		if ring != nil {
+			ring.Hash = consistenthash.Murmur3
+		}
+	}
+	return &job, nil
+}
+
+// holdRing 迁移任务切换之前本节点使用迁移之前的哈希环，这些区间的请求仍然交给来源分片
+func (h *httpServer) holdRing(before *consistenthash.Map) {
+	m := &h.migrations
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.holding++
+	if before != nil {
+		h.cache.SetPeers(before)
+	}
+}
+
+// releaseRing 迁移任务切换哈希环，切换之前收到过更新的哈希环时使用更新的
+func (h *httpServer) releaseRing(after *consistenthash.Map) {
+	m := &h.migrations
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.holding--
+	ring := after
+	if m.held != nil && (ring == nil || m.held.Epoch > ring.Epoch) {
+		ring = m.held
+	}
+	if m.holding == 0 {
+		m.held = nil
+	}
+	if ring != nil {
+		h.cache.SetPeers(ring)
+	}
+}
+
+// setRing 替换本节点的哈希环，有迁移任务还没有切换时先记录下来，由任务切换时使用
+func (h *httpServer) setRing(ring *consistenthash.Map) {
+	m := &h.migrations
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.holding > 0 {
+		if m.held == nil || ring.Epoch >= m.held.Epoch {
+			m.held = ring
+		}
+		return
+	}
+	h.cache.SetPeers(ring)
+}
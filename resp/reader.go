@@ -0,0 +1,105 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	maxBulkLen  = 512 << 20 // 和redis的proto-max-bulk-len默认值一致
+	maxArrayLen = 1 << 20
+	maxInline   = 64 << 10
+)
+
+// ErrProtocol 客户端发送了不合法的数据，出现后连接上的后续数据都无法解析，需要关闭连接
+var ErrProtocol = errors.New("Protocol error")
+
+// Reader 从连接中读取客户端发送的命令，支持RESP的multibulk格式和telnet使用的inline格式
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(rd io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReader(rd)}
+}
+
+// Buffered 返回已读入缓冲区但还没有解析的字节数，为0说明流水线中的命令都已处理完
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadCommand 读取一条命令，返回命令名和参数，空行返回长度为0的命令
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := parseLen(line[1:], maxArrayLen)
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, ErrProtocol
+		}
+		size, err := parseLen(line[1:], maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		// 多读CRLF两个字节
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r.rd, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+// readLine 读取以CRLF结尾的一行，返回的内容不含CRLF
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// 超过缓冲区的长行只可能是inline命令
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(buf) <= maxInline {
+			line, err = r.rd.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProtocol
+		}
+		line = buf
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func parseLen(b []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > max {
+		return 0, ErrProtocol
+	}
+	return n, nil
+}
@@ -0,0 +1,65 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	// 流水线：multibulk命令后面跟着inline命令
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\na\r\nbc\r\nPING  hello\r\n\r\n"))
+	args, err := r.ReadCommand()
+	if err != nil || len(args) != 3 || string(args[2]) != "a\r\nbc" {
+		t.Fatalf("got %q, %v; want SET key a\\r\\nbc", args, err)
+	}
+	if r.Buffered() == 0 {
+		t.Fatal("got 0 buffered bytes; want pipelined commands")
+	}
+	args, err = r.ReadCommand()
+	if err != nil || len(args) != 2 || string(args[0]) != "PING" || string(args[1]) != "hello" {
+		t.Fatalf("got %q, %v; want PING hello", args, err)
+	}
+	if args, err = r.ReadCommand(); err != nil || len(args) != 0 {
+		t.Fatalf("got %q, %v; want empty command", args, err)
+	}
+	if _, err = r.ReadCommand(); err != io.EOF {
+		t.Fatalf("got err %v; want EOF", err)
+	}
+
+	for _, input := range []string{"*1\r\n:1\r\n", "*1\r\n$-1\r\n", "*1\r\n$3\r\nabcd\r\n", "*x\r\n"} {
+		if _, err := NewReader(strings.NewReader(input)).ReadCommand(); err != ErrProtocol {
+			t.Fatalf("got err %v for %q; want ErrProtocol", err, input)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	write := func(proto int, fn func(w *Writer)) string {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Proto = proto
+		fn(w)
+		w.Flush()
+		return buf.String()
+	}
+	reply := func(w *Writer) {
+		w.WriteMap(1)
+		w.WriteBulkString("k")
+		w.WriteDouble(1.5)
+		w.WriteNull()
+		w.WriteSet(1)
+		w.WriteInt(-3)
+		w.WriteDouble(math.Inf(-1))
+		w.WriteError("ERR x")
+	}
+
+	if got, want := write(Proto2, reply), "*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n$-1\r\n*1\r\n:-3\r\n$4\r\n-inf\r\n-ERR x\r\n"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+	if got, want := write(Proto3, reply), "%1\r\n$1\r\nk\r\n,1.5\r\n_\r\n~1\r\n:-3\r\n,-inf\r\n-ERR x\r\n"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	Proto2 = 2
+	Proto3 = 3
+)
+
+/*
+*
+Writer 按协议版本编码回复。RESP3新增的null、map、set、double类型在RESP2下
+退化为redis一样的表示：null为nil bulk string，map为key和value交替的数组，
+set为数组，double为bulk string
+*/
+type Writer struct {
+	wr    *bufio.Writer
+	Proto int
+	num   []byte
+}
+
+func NewWriter(wr io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(wr), Proto: Proto2}
+}
+
+// Flush 把缓冲的回复写到连接，流水线中的命令处理完后再统一Flush
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *Writer) writeHeader(prefix byte, n int64) {
+	w.wr.WriteByte(prefix)
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	w.wr.Write(w.num)
+	w.wr.WriteString("\r\n")
+}
+
+// WriteRaw 写入已经编码好的回复，用于把其他节点的回复原样交给客户端
+func (w *Writer) WriteRaw(b []byte) {
+	w.wr.Write(b)
+}
+
+func (w *Writer) WriteSimple(s string) {
+	w.wr.WriteByte('+')
+	w.wr.WriteString(s)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *Writer) WriteOK() {
+	w.WriteSimple("OK")
+}
+
+// WriteError 写入错误，msg需要以ERR、WRONGTYPE这样的错误码开头
+func (w *Writer) WriteError(msg string) {
+	w.wr.WriteByte('-')
+	w.wr.WriteString(msg)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *Writer) WriteInt(n int64) {
+	w.writeHeader(':', n)
+}
+
+func (w *Writer) WriteBulk(b []byte) {
+	w.writeHeader('$', int64(len(b)))
+	w.wr.Write(b)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *Writer) WriteBulkString(s string) {
+	w.writeHeader('$', int64(len(s)))
+	w.wr.WriteString(s)
+	w.wr.WriteString("\r\n")
+}
+
+// WriteNull 写入不存在的值
+func (w *Writer) WriteNull() {
+	if w.Proto == Proto3 {
+		w.wr.WriteString("_\r\n")
+		return
+	}
+	w.wr.WriteString("$-1\r\n")
+}
+
+// WriteNullArray 写入不存在的数组，例如BLPOP超时
+func (w *Writer) WriteNullArray() {
+	if w.Proto == Proto3 {
+		w.wr.WriteString("_\r\n")
+		return
+	}
+	w.wr.WriteString("*-1\r\n")
+}
+
+func (w *Writer) WriteArray(n int) {
+	w.writeHeader('*', int64(n))
+}
+
+// WriteMap 写入n个键值对的map头，之后依次写入n对key和value
+func (w *Writer) WriteMap(n int) {
+	if w.Proto == Proto3 {
+		w.writeHeader('%', int64(n))
+		return
+	}
+	w.writeHeader('*', int64(n*2))
+}
+
+func (w *Writer) WriteSet(n int) {
+	if w.Proto == Proto3 {
+		w.writeHeader('~', int64(n))
+		return
+	}
+	w.writeHeader('*', int64(n))
+}
+
+func (w *Writer) WriteDouble(f float64) {
+	s := formatDouble(f)
+	if w.Proto == Proto3 {
+		w.wr.WriteByte(',')
+		w.wr.WriteString(s)
+		w.wr.WriteString("\r\n")
+		return
+	}
+	w.WriteBulkString(s)
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteStrings 写入字符串数组
+func (w *Writer) WriteStrings(values []string) {
+	w.WriteArray(len(values))
+	for _, v := range values {
+		w.WriteBulkString(v)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/resp"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// respPath 是执行其他节点的RESP服务转发来的命令的http接口。redis客户端只连接了一个节点，
+// key属于其他分片时由收到命令的节点通过http接口转发，不需要知道其他节点的RESP端口
+const respPath = "/v1/resp"
+
+// forward 把命令args交给哈希环上的真实节点owner执行，把对端按当前连接的协议版本编码的回复原样写回。
+// 两个节点的一致性hash环不一致时不再继续转发，回复TRYAGAIN，客户端稍后重试
+func (s *respServer) forward(w *resp.Writer, owner string, args []string) {
+	reply, err := s.forwardRaw(owner, w.Proto, args)
+	if err != nil {
+		w.WriteError(err.Error())
+		return
+	}
+	w.WriteRaw(reply)
+}
+
+// forwardInt 把回复为整数的命令args交给owner执行，返回对端回复的整数，对端回复错误时作为错误返回
+func (s *respServer) forwardInt(owner string, args []string) (int64, error) {
+	reply, err := s.forwardRaw(owner, resp.Proto2, args)
+	if err != nil {
+		return 0, err
+	}
+	line := strings.TrimSuffix(string(reply), "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return 0, errors.New(line[1:])
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(line, ":"), 10, 64)
+	if err != nil || !strings.HasPrefix(line, ":") {
+		return 0, fmt.Errorf("ERR unexpected reply %q from %s", line, owner)
+	}
+	return n, nil
+}
+
+// forwardRaw 把命令args交给owner执行，返回对端按协议版本proto编码的回复，失败时返回redis格式的错误
+func (s *respServer) forwardRaw(owner string, proto int, args []string) ([]byte, error) {
+	if s.forwarded {
+		return nil, fmt.Errorf("TRYAGAIN key moved to %s at ring epoch %d", s.cache.Address(owner), s.cache.Peers().Epoch)
+	}
+	raw := make([][]byte, len(args))
+	for i, arg := range args {
+		raw[i] = []byte(arg)
+	}
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	uri := respPath + "?proto=" + strconv.Itoa(proto)
+	// 阻塞命令可能超过peerClient的超时时间，使用不限制超时的客户端
+	resp, err := s.cache.PeerDo(owner, false, func(address string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+address+uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		s.cache.SetForwarded(req.Header)
+		return http.DefaultClient.Do(req)
+	})
+	if err != nil {
+		s.log.Printf("forward %s to %s failed:%v", args[0], owner, err)
+		return nil, fmt.Errorf("ERR forward to %s failed: %v", owner, err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ERR forward to %s failed: %v", owner, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ERR forward to %s failed, status %d: %s", owner, resp.StatusCode, bytes.TrimSpace(reply))
+	}
+	return reply, nil
+}
+
+// doResp 执行其他节点转发来的RESP命令，请求体是json编码的命令参数，
+// 响应体是按proto参数指定的协议版本编码的回复
+func (h *httpServer) doResp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	var args [][]byte
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(&args); err != nil || len(args) == 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidArgument, "invalid command")
+		return
+	}
+	var buf bytes.Buffer
+	rw := resp.NewWriter(&buf)
+	if r.URL.Query().Get("proto") == strconv.Itoa(resp.Proto3) {
+		rw.Proto = resp.Proto3
+	}
+	h.resp.execute(rw, strings.ToLower(string(args[0])), args)
+	rw.Flush()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
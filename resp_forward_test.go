@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"github.com/Emiliaab/gedis/resp"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespForward(t *testing.T) {
+	newProxy := func(self string, owner string) *cache.Cache_proxy {
+		proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: self}, Log: log.New(io.Discard, "", 0)}
+		ring := consistenthash.New(3, consistenthash.Murmur3)
+		ring.Add(owner)
+		ring.Epoch = 2
+		proxy.SetPeers(ring)
+		return proxy
+	}
+
+	// 负责key的节点和收到命令的节点的哈希环不一致，不再继续转发
+	owner := &httpServer{log: log.New(io.Discard, "", 0)}
+	srv := httptest.NewServer(http.HandlerFunc(owner.doResp))
+	defer srv.Close()
+	address := strings.TrimPrefix(srv.URL, "http://")
+	owner.cache = newProxy(address, "127.0.0.1:1")
+	owner.resp = NewRespServer(owner.cache)
+	owner.resp.forwarded = true
+
+	s := NewRespServer(newProxy("127.0.0.1:2", address))
+	var buf bytes.Buffer
+	w := resp.NewWriter(&buf)
+	s.execute(w, "get", [][]byte{[]byte("GET"), []byte("k")})
+	w.Flush()
+	if got := buf.String(); got != "-TRYAGAIN key moved to 127.0.0.1:1 at ring epoch 2\r\n" {
+		t.Fatalf("got reply %q; want the owner's TRYAGAIN", got)
+	}
+}
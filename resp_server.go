@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	lru_k "github.com/Emiliaab/gedis/lru-k"
+	"github.com/Emiliaab/gedis/resp"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// respCommand 是一条RESP命令的处理函数，arity和redis的定义一致：
+// 包括命令名在内的参数个数，负数表示至少-arity个
+type respCommand struct {
+	arity   int
+	handler func(w *resp.Writer, args []string)
+}
+
+// redisVersion 是INFO和HELLO报告的redis版本。客户端按版本判断可以使用的命令和协议(例如HELLO 3)，
+// gedis实现的是redis 7命令的子集，版本固定为7.0.0，和gedis自身的版本无关
+const redisVersion = "7.0.0"
+
+// respServer 用redis协议(RESP2/RESP3)对外提供服务，redis-cli和现有的redis客户端可以直接连接。
+// 命令映射到Cache_proxy上，写命令和http接口一样经过raft
+type respServer struct {
+	cache    *cache.Cache_proxy
+	log      *log.Logger
+	commands map[string]respCommand
+	batch    *httpServer // 多key命令跨分片时复用http批量接口的分组和转发
+
+	forwarded bool // 执行其他节点转发来的命令，key不属于本节点时不再继续转发
+}
+
+func NewRespServer(cache *cache.Cache_proxy) *respServer {
+	s := &respServer{
+		cache: cache,
+		log:   log.New(os.Stderr, "resp_server: ", log.Ldate|log.Ltime),
+	}
+	s.batch = &httpServer{cache: cache, log: s.log}
+	s.commands = map[string]respCommand{
+		"ping":        {-1, s.ping},
+		"echo":        {2, s.echo},
+		"hello":       {-1, s.hello},
+		"select":      {2, s.selectDB},
+		"command":     {-1, s.command},
+		"client":      {-2, s.client},
+		"info":        {-1, s.info},
+		"dbsize":      {1, s.dbsize},
+		"get":         {2, s.get},
+		"set":         {-3, s.set},
+		"setex":       {4, s.setex(time.Second)},
+		"psetex":      {4, s.setex(time.Millisecond)},
+		"mget":        {-2, s.mget},
+		"mset":        {-3, s.mset},
+		"del":         {-2, s.del},
+		"unlink":      {-2, s.del},
+		"exists":      {-2, s.exists},
+		"type":        {2, s.typ},
+		"expire":      {3, s.expire(time.Second)},
+		"pexpire":     {3, s.expire(time.Millisecond)},
+		"ttl":         {2, s.ttl(time.Second)},
+		"pttl":        {2, s.ttl(time.Millisecond)},
+		"persist":     {2, s.persist},
+		"incr":        {2, s.incr(1, 1)},
+		"decr":        {2, s.incr(-1, 1)},
+		"incrby":      {3, s.incr(1, 0)},
+		"decrby":      {3, s.incr(-1, 0)},
+		"incrbyfloat": {3, s.incrByFloat},
+	}
+	s.registerTypes()
+	return s
+}
+
+// Serve 在l上接受连接，每个连接一个goroutine，直到l被关闭
+func (s *respServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn 依次执行连接上的命令，支持流水线：读缓冲区中还有命令时只把回复写入写缓冲区，
+// 处理完缓冲区中所有的命令后再一次性Flush
+func (s *respServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := resp.NewReader(conn)
+	w := resp.NewWriter(conn)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if err == resp.ErrProtocol {
+				w.WriteError("ERR Protocol error")
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(string(args[0]))
+		if name == "quit" {
+			w.WriteOK()
+			w.Flush()
+			return
+		}
+		s.execute(w, name, args)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *respServer) execute(w *resp.Writer, name string, args [][]byte) {
+	cmd, ok := s.commands[name]
+	if !ok {
+		w.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	cmd.handler(w, strs)
+}
+
+// local 判断keys是否都由本节点负责，不是时把命令args转发给负责第一个key的分片组执行并把回复写回，
+// 负责的是分片组时交给分片组的leader。多个key不属于同一个节点时无法在一条raft日志中执行，回复CROSSSLOT；
+// MGET、MSET、DEL和EXISTS不经过这里，通过scatter在每个分片上分别执行
+func (s *respServer) local(w *resp.Writer, args []string, keys ...string) bool {
+	peerAddress := s.cache.Peers().Get(keys[0])
+	for _, key := range keys[1:] {
+		if s.cache.Peers().Get(key) != peerAddress {
+			w.WriteError("CROSSSLOT Keys in request don't hash to the same node")
+			return false
+		}
+	}
+	if peerAddress != s.cache.Opts.HttpAddress {
+		s.forward(w, peerAddress, args)
+		return false
+	}
+	return true
+}
+
+// writeError 把命令的错误转换为redis的错误回复，OOM和WRONGTYPE的错误信息本身带有错误码
+func (s *respServer) writeError(w *resp.Writer, err error) {
+	switch {
+	case errors.Is(err, lru_k.ErrOutOfMemory), errors.Is(err, cache.ErrWrongType):
+		w.WriteError(err.Error())
+	case errors.Is(err, cache.ErrNotInteger), errors.Is(err, cache.ErrNotFloat), errors.Is(err, cache.ErrNaN):
+		w.WriteError("ERR " + err.Error())
+	case errors.Is(err, cache.ErrNotLeader):
+		// 和redis的只读副本一致返回READONLY，并带上leader的http地址
+		msg := "READONLY You can't write against a read only replica."
+		if leader, ok := s.cache.Leader(); ok {
+			msg += " leader " + leader
+		}
+		w.WriteError(msg)
+	case errors.Is(err, cache.ErrMigrating):
+		// 和redis cluster迁移slot时一致，客户端稍后重试
+		w.WriteError("TRYAGAIN " + err.Error())
+	default:
+		s.log.Printf("command failed:%v", err)
+		w.WriteError("ERR " + err.Error())
+	}
+}
+
+func parseInt(w *resp.Writer, s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		w.WriteError("ERR " + cache.ErrNotInteger.Error())
+		return 0, false
+	}
+	return n, true
+}
+
+func (s *respServer) ping(w *resp.Writer, args []string) {
+	switch len(args) {
+	case 1:
+		w.WriteSimple("PONG")
+	case 2:
+		w.WriteBulkString(args[1])
+	default:
+		w.WriteError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *respServer) echo(w *resp.Writer, args []string) {
+	w.WriteBulkString(args[1])
+}
+
+// hello 切换协议版本并返回服务端信息，go-redis等客户端建立连接时会先发送HELLO 3
+func (s *respServer) hello(w *resp.Writer, args []string) {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(args[1])
+		if err != nil {
+			w.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != resp.Proto2 && proto != resp.Proto3 {
+			w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		w.Proto = proto
+	}
+
+	role := "replica"
+	if s.cache.IsLeader() {
+		role = "master"
+	}
+	w.WriteMap(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("gedis")
+	w.WriteBulkString("version")
+	w.WriteBulkString(redisVersion)
+	w.WriteBulkString("proto")
+	w.WriteInt(int64(w.Proto))
+	w.WriteBulkString("id")
+	w.WriteInt(0)
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString(role)
+	w.WriteBulkString("modules")
+	w.WriteArray(0)
+}
+
+// selectDB 只有0号数据库
+func (s *respServer) selectDB(w *resp.Writer, args []string) {
+	if args[1] != "0" {
+		w.WriteError("ERR DB index is out of range")
+		return
+	}
+	w.WriteOK()
+}
+
+// command redis-cli启动时会查询命令文档，返回空结果即可
+func (s *respServer) command(w *resp.Writer, args []string) {
+	w.WriteArray(0)
+}
+
+// client 接受客户端连接时发送的CLIENT SETNAME、CLIENT SETINFO等命令，不做处理
+func (s *respServer) client(w *resp.Writer, args []string) {
+	if strings.EqualFold(args[1], "getname") {
+		w.WriteNull()
+		return
+	}
+	w.WriteOK()
+}
+
+func (s *respServer) info(w *resp.Writer, args []string) {
+	used, max := s.cache.Cache.MemoryUsage()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nredis_version:%s\r\ngedis_node:%s\r\n", redisVersion, s.cache.Opts.HttpAddress)
+	fmt.Fprintf(&b, "# Replication\r\nraft_state:%s\r\n", s.cache.Raft.Raft.State())
+	fmt.Fprintf(&b, "# Memory\r\nused_memory:%d\r\nmaxmemory:%d\r\n", used, max)
+	fmt.Fprintf(&b, "# Keyspace\r\ndb0:keys=%d\r\n", s.cache.Cache.Len())
+	w.WriteBulkString(b.String())
+}
+
+func (s *respServer) dbsize(w *resp.Writer, args []string) {
+	w.WriteInt(int64(s.cache.Cache.Len()))
+}
+
+func (s *respServer) get(w *resp.Writer, args []string) {
+	key := args[1]
+	if !s.local(w, args, key) {
+		return
+	}
+	value, ok := s.cache.DoGetLocal(key)
+	if ok {
+		w.WriteBulk(value)
+		return
+	}
+	if typ, ok := s.cache.Cache.Type(key); ok && typ != cache.TypeString {
+		w.WriteError(cache.ErrWrongType.Error())
+		return
+	}
+	w.WriteNull()
+}
+
+// set 支持EX和PX选项
+func (s *respServer) set(w *resp.Writer, args []string) {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		unit := time.Second
+		switch strings.ToLower(args[i]) {
+		case "ex":
+		case "px":
+			unit = time.Millisecond
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+		if i+1 == len(args) {
+			w.WriteError("ERR syntax error")
+			return
+		}
+		i++
+		n, ok := parseInt(w, args[i])
+		if !ok {
+			return
+		}
+		if n <= 0 {
+			w.WriteError("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+	s.doSet(w, args, args[1], args[2], ttl)
+}
+
+func (s *respServer) setex(unit time.Duration) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		n, ok := parseInt(w, args[2])
+		if !ok {
+			return
+		}
+		if n <= 0 {
+			w.WriteError(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(args[0])))
+			return
+		}
+		s.doSet(w, args, args[1], args[3], time.Duration(n)*unit)
+	}
+}
+
+func (s *respServer) doSet(w *resp.Writer, args []string, key, value string, ttl time.Duration) {
+	if !s.local(w, args, key) {
+		return
+	}
+	if err := s.cache.DoSetEx(context.Background(), cache.OperSet, key, value, ttl, false); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteOK()
+}
+
+// del 删除任意类型的key，返回删除的个数，每个分片上的key作为一条raft日志删除
+func (s *respServer) del(w *resp.Writer, args []string) {
+	keys := args[1:]
+	results, err := s.scatter("/v1/mdel", batchRequest{Keys: keys}, false, keys, s.batch.mdelLocal)
+	if err != nil {
+		w.WriteError(err.Error())
+		return
+	}
+	n := 0
+	for _, r := range results {
+		n += boolToInt(r.Deleted)
+	}
+	w.WriteInt(int64(n))
+}
+
+// mget 读取多个字符串类型的key，不存在或者类型不是字符串的key返回null
+func (s *respServer) mget(w *resp.Writer, args []string) {
+	keys := args[1:]
+	results := s.batch.scatter(context.Background(), keys, batchRequest{Keys: keys}, false, "/v1/mget", false, s.forwarded, func(sub batchRequest) ([]batchResult, *apiError) {
+		return s.batch.mgetLocal(context.Background(), sub), nil
+	})
+	for _, r := range results {
+		if r.Error != nil && r.Error.Code != codeWrongType {
+			w.WriteError(respAPIError(r.Error).Error())
+			return
+		}
+	}
+	w.WriteArray(len(keys))
+	for _, r := range results {
+		if r.Found {
+			w.WriteBulk(r.Value)
+		} else {
+			w.WriteNull()
+		}
+	}
+}
+
+// mset 写入多个key，每个分片上的key作为一条raft日志写入。和http的/v1/mset一样，跨分片时各分片分别提交
+func (s *respServer) mset(w *resp.Writer, args []string) {
+	if len(args)%2 == 0 {
+		w.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	pairs := args[1:]
+	keys := make([]string, 0, len(pairs)/2)
+	entries := make([]batchEntry, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		keys = append(keys, pairs[i])
+		entries = append(entries, batchEntry{Key: pairs[i], Value: []byte(pairs[i+1])})
+	}
+	if _, err := s.scatter("/v1/mset", batchRequest{Entries: entries}, true, keys, s.batch.msetLocal); err != nil {
+		w.WriteError(err.Error())
+		return
+	}
+	w.WriteOK()
+}
+
+// scatter 通过http批量接口的scatter在每个分片上分别执行多key命令，任意一个key出错时返回转换成redis错误回复的第一个错误
+func (s *respServer) scatter(uri string, req batchRequest, entries bool, keys []string, local func(ctx context.Context, req batchRequest) []batchResult) ([]batchResult, error) {
+	results := s.batch.scatter(context.Background(), keys, req, entries, uri, false, s.forwarded, func(sub batchRequest) ([]batchResult, *apiError) {
+		return local(context.Background(), sub), nil
+	})
+	for _, r := range results {
+		if r.Error != nil {
+			return nil, respAPIError(r.Error)
+		}
+	}
+	return results, nil
+}
+
+// respAPIError 把批量接口中一个key的错误转换为redis的错误回复，和writeError的转换保持一致
+func respAPIError(e *apiError) error {
+	switch e.Code {
+	case codeWrongType, codeOutOfMemory:
+		// 错误信息本身带有WRONGTYPE和OOM错误码
+		return errors.New(e.Message)
+	case codeNotLeader:
+		return errors.New("READONLY You can't write against a read only replica.")
+	case codeWrongNode:
+		return fmt.Errorf("TRYAGAIN key moved to %s at ring epoch %d", e.Owner, e.Epoch)
+	case codeMigrating:
+		return errors.New("TRYAGAIN " + e.Message)
+	}
+	return errors.New("ERR " + e.Message)
+}
+
+// exists 返回存在的key的个数，其他分片的key按分片分组，各自作为一条EXISTS命令转发
+func (s *respServer) exists(w *resp.Writer, args []string) {
+	keys := args[1:]
+	n := int64(0)
+	for owner, idx := range s.batch.groupByOwner(keys) {
+		if owner == s.cache.Opts.HttpAddress {
+			for _, i := range idx {
+				_, ok := s.cache.Cache.Type(keys[i])
+				n += int64(boolToInt(ok))
+			}
+			continue
+		}
+		sub := []string{args[0]}
+		for _, i := range idx {
+			sub = append(sub, keys[i])
+		}
+		count, err := s.forwardInt(owner, sub)
+		if err != nil {
+			w.WriteError(err.Error())
+			return
+		}
+		n += count
+	}
+	w.WriteInt(n)
+}
+
+func (s *respServer) typ(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	typ, ok := s.cache.Cache.Type(args[1])
+	if !ok {
+		w.WriteSimple("none")
+		return
+	}
+	w.WriteSimple(cache.TypeName(typ))
+}
+
+// expire 和redis一致，存活时间不是正数时直接删除key
+func (s *respServer) expire(unit time.Duration) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		key := args[1]
+		n, ok := parseInt(w, args[2])
+		if !ok || !s.local(w, args, key) {
+			return
+		}
+		var err error
+		if n <= 0 {
+			ok, err = s.cache.DoDel(context.Background(), key)
+		} else {
+			ok, err = s.cache.DoExpire(context.Background(), key, time.Duration(n)*unit, false)
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteInt(int64(boolToInt(ok)))
+	}
+}
+
+// ttl 返回剩余的存活时间，-1表示没有存活时间，-2表示key不存在
+func (s *respServer) ttl(unit time.Duration) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		if !s.local(w, args, args[1]) {
+			return
+		}
+		ttl, _, ok := s.cache.Cache.TTL(args[1])
+		switch {
+		case !ok:
+			w.WriteInt(-2)
+		case ttl < 0:
+			w.WriteInt(-1)
+		default:
+			w.WriteInt(int64((ttl + unit - 1) / unit))
+		}
+	}
+}
+
+func (s *respServer) persist(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	ok, err := s.cache.DoPersist(context.Background(), args[1])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(boolToInt(ok)))
+}
+
+// incr 处理INCR、DECR、INCRBY和DECRBY，fixed不为0时使用fixed作为增量，否则从参数读取
+func (s *respServer) incr(sign int64, fixed int64) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		incr := fixed
+		if incr == 0 {
+			n, ok := parseInt(w, args[2])
+			if !ok {
+				return
+			}
+			if sign < 0 && n == math.MinInt64 {
+				w.WriteError("ERR decrement would overflow")
+				return
+			}
+			incr = n
+		}
+		if !s.local(w, args, args[1]) {
+			return
+		}
+		value, err := s.cache.DoIncrBy(context.Background(), args[1], sign*incr)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteInt(value)
+	}
+}
+
+func (s *respServer) incrByFloat(w *resp.Writer, args []string) {
+	incr, err := cache.ParseScore(args[2])
+	if err != nil {
+		w.WriteError("ERR " + cache.ErrNotFloat.Error())
+		return
+	}
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	value, err := s.cache.DoIncrByFloat(context.Background(), args[1], incr)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteBulk(cache.FormatFloat(value))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"github.com/Emiliaab/gedis/resp"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newBatchOwner 模拟负责其他分片的节点，批量接口对每个key返回成功，EXISTS返回key的个数
+func newBatchOwner(t *testing.T, written *sync.Map) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == respPath {
+			var args [][]byte
+			json.NewDecoder(r.Body).Decode(&args)
+			fmt.Fprintf(w, ":%d\r\n", len(args)-1)
+			return
+		}
+		var req batchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var results []batchResult
+		for _, key := range req.Keys {
+			results = append(results, batchResult{Key: key, Value: []byte("v-" + key), Found: true, Deleted: true})
+		}
+		for _, e := range req.Entries {
+			written.Store(e.Key, string(e.Value))
+			results = append(results, batchResult{Key: e.Key})
+		}
+		json.NewEncoder(w).Encode(batchResponse{Results: results})
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// 跨分片的MGET、MSET、DEL和EXISTS按分片拆开执行，不回复CROSSSLOT
+func TestRespMultiKey(t *testing.T) {
+	var written sync.Map
+	a, b := newBatchOwner(t, &written), newBatchOwner(t, &written)
+	self := "127.0.0.1:8000"
+	proxy := &cache.Cache_proxy{Opts: &cache.Options{HttpAddress: self}, Log: log.New(io.Discard, "", 0), Cache: &cache.Cache{}}
+	ring := consistenthash.New(3, consistenthash.Murmur3)
+	ring.Add(self, a, b)
+	proxy.SetPeers(ring)
+	s := NewRespServer(proxy)
+	s.log = log.New(io.Discard, "", 0)
+
+	// 每个节点各取一个key
+	owned := map[string]string{}
+	for i := 0; len(owned) < 3; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if _, ok := owned[ring.Get(key)]; !ok {
+			owned[ring.Get(key)] = key
+		}
+	}
+	local, ka, kb := owned[self], owned[a], owned[b]
+	// 本节点上不存在的key
+	missing := ""
+	for i := 0; missing == ""; i++ {
+		if key := fmt.Sprintf("missing-%d", i); ring.Get(key) == self {
+			missing = key
+		}
+	}
+	if err := proxy.Cache.AddWithExpire(local, []byte("v"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) string {
+		raw := make([][]byte, len(args))
+		for i, arg := range args {
+			raw[i] = []byte(arg)
+		}
+		var buf bytes.Buffer
+		w := resp.NewWriter(&buf)
+		s.execute(w, strings.ToLower(args[0]), raw)
+		w.Flush()
+		return buf.String()
+	}
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"MGET", ka, local, missing, kb}, fmt.Sprintf("*4\r\n$%d\r\nv-%s\r\n$1\r\nv\r\n$-1\r\n$%d\r\nv-%s\r\n", len(ka)+2, ka, len(kb)+2, kb)},
+		{[]string{"EXISTS", local, ka, kb, kb}, ":4\r\n"},
+		{[]string{"MSET", ka, "1", kb, "2"}, "+OK\r\n"},
+		{[]string{"DEL", ka, kb}, ":2\r\n"},
+	}
+	for _, c := range cases {
+		if got := run(c.args...); got != c.want {
+			t.Errorf("%v: got %q; want %q", c.args, got, c.want)
+		}
+	}
+	if v, _ := written.Load(kb); v != "2" {
+		t.Fatalf("got %v for %s at its owner; want 2", v, kb)
+	}
+
+	// 转发来的命令不再继续转发
+	s.forwarded = true
+	if got := run("DEL", ka); !strings.HasPrefix(got, "-TRYAGAIN key moved to "+a) {
+		t.Fatalf("got %q; want TRYAGAIN", got)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"github.com/Emiliaab/gedis/cache"
+	"github.com/Emiliaab/gedis/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerTypes 注册hash、list、set和zset的命令
+func (s *respServer) registerTypes() {
+	types := map[string]respCommand{
+		"hset":          {-4, s.hset},
+		"hmset":         {-4, s.hset},
+		"hget":          {3, s.hget},
+		"hgetall":       {2, s.hgetall},
+		"hdel":          {-3, s.hdel},
+		"hincrby":       {4, s.hincrby},
+		"hlen":          {2, s.hlen},
+		"lpush":         {-3, s.push(true)},
+		"rpush":         {-3, s.push(false)},
+		"lpop":          {2, s.pop(true)},
+		"rpop":          {2, s.pop(false)},
+		"blpop":         {-3, s.blockingPop(true)},
+		"brpop":         {-3, s.blockingPop(false)},
+		"lrange":        {4, s.lrange},
+		"llen":          {2, s.llen},
+		"ltrim":         {4, s.ltrim},
+		"sadd":          {-3, s.members(s.cache.DoSAdd)},
+		"srem":          {-3, s.members(s.cache.DoSRem)},
+		"smembers":      {2, s.smembers},
+		"sismember":     {3, s.sismember},
+		"sinter":        {-2, s.setAlgebra(s.cache.Cache.SInter)},
+		"sunion":        {-2, s.setAlgebra(s.cache.Cache.SUnion)},
+		"zadd":          {-4, s.zadd},
+		"zrem":          {-3, s.members(s.cache.DoZRem)},
+		"zscore":        {3, s.zscore},
+		"zrank":         {3, s.zrank},
+		"zrange":        {-4, s.zrange},
+		"zrangebyscore": {-4, s.zrangebyscore},
+	}
+	for name, cmd := range types {
+		s.commands[name] = cmd
+	}
+}
+
+// hset 返回新增的field数量，HMSET返回OK
+func (s *respServer) hset(w *resp.Writer, args []string) {
+	if len(args)%2 != 0 {
+		w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+		return
+	}
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	added, err := s.cache.DoHSet(context.Background(), args[1], args[2:])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if strings.EqualFold(args[0], "hmset") {
+		w.WriteOK()
+		return
+	}
+	w.WriteInt(int64(added))
+}
+
+func (s *respServer) hget(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	value, ok, err := s.cache.DoHGet(args[1], args[2])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if !ok {
+		w.WriteNull()
+		return
+	}
+	w.WriteBulk(value)
+}
+
+func (s *respServer) hgetall(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	fields, err := s.cache.DoHGetAll(args[1])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteMap(len(fields))
+	for field, value := range fields {
+		w.WriteBulkString(field)
+		w.WriteBulkString(value)
+	}
+}
+
+func (s *respServer) hdel(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	deleted, err := s.cache.DoHDel(context.Background(), args[1], args[2:])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(deleted))
+}
+
+func (s *respServer) hincrby(w *resp.Writer, args []string) {
+	incr, ok := parseInt(w, args[3])
+	if !ok || !s.local(w, args, args[1]) {
+		return
+	}
+	value, err := s.cache.DoHIncrBy(context.Background(), args[1], args[2], incr)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(value)
+}
+
+func (s *respServer) hlen(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	n, err := s.cache.Cache.HLen(args[1])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(n))
+}
+
+func (s *respServer) push(left bool) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		if !s.local(w, args, args[1]) {
+			return
+		}
+		n, err := s.cache.DoPush(context.Background(), args[1], args[2:], left)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteInt(int64(n))
+	}
+}
+
+func (s *respServer) pop(left bool) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		if !s.local(w, args, args[1]) {
+			return
+		}
+		ret, err := s.cache.DoPop(context.Background(), args[1:2], left)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if ret == nil {
+			w.WriteNull()
+			return
+		}
+		w.WriteBulkString(ret.Value)
+	}
+}
+
+// blockingPop 处理BLPOP和BRPOP，最后一个参数是等待的秒数(可以是小数)，0表示一直等待，
+// 返回[key, value]，超时返回空数组。阻塞前先把流水线中前面命令的回复发送出去
+func (s *respServer) blockingPop(left bool) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		keys := args[1 : len(args)-1]
+		seconds, err := strconv.ParseFloat(args[len(args)-1], 64)
+		if err != nil || seconds < 0 {
+			w.WriteError("ERR timeout is not a float or out of range")
+			return
+		}
+		if !s.local(w, args, keys...) {
+			return
+		}
+
+		w.Flush()
+		timeout := time.Duration(seconds * float64(time.Second))
+		ret, err := s.cache.DoBlockingPop(context.Background(), keys, left, timeout)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if ret == nil {
+			w.WriteNullArray()
+			return
+		}
+		w.WriteStrings([]string{ret.Key, ret.Value})
+	}
+}
+
+func (s *respServer) lrange(w *resp.Writer, args []string) {
+	start, ok := parseInt(w, args[2])
+	if !ok {
+		return
+	}
+	stop, ok := parseInt(w, args[3])
+	if !ok || !s.local(w, args, args[1]) {
+		return
+	}
+	values, err := s.cache.DoLRange(args[1], start, stop)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteStrings(values)
+}
+
+func (s *respServer) llen(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	n, err := s.cache.Cache.LLen(args[1])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(n))
+}
+
+func (s *respServer) ltrim(w *resp.Writer, args []string) {
+	start, ok := parseInt(w, args[2])
+	if !ok {
+		return
+	}
+	stop, ok := parseInt(w, args[3])
+	if !ok || !s.local(w, args, args[1]) {
+		return
+	}
+	if err := s.cache.DoLTrim(context.Background(), args[1], start, stop); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteOK()
+}
+
+// members 处理SADD、SREM和ZREM，返回新增或删除的成员数量
+func (s *respServer) members(fn func(ctx context.Context, key string, members []string) (int, error)) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		if !s.local(w, args, args[1]) {
+			return
+		}
+		n, err := fn(context.Background(), args[1], args[2:])
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteInt(int64(n))
+	}
+}
+
+func (s *respServer) smembers(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	members, err := s.cache.Cache.SMembers(args[1])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteSet(len(members))
+	for _, m := range members {
+		w.WriteBulkString(m)
+	}
+}
+
+func (s *respServer) sismember(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	ok, err := s.cache.Cache.SIsMember(args[1], args[2])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(boolToInt(ok)))
+}
+
+// setAlgebra 处理SINTER和SUNION，所有key必须属于同一个节点
+func (s *respServer) setAlgebra(fn func(keys []string) ([]string, error)) func(w *resp.Writer, args []string) {
+	return func(w *resp.Writer, args []string) {
+		if !s.local(w, args, args[1:]...) {
+			return
+		}
+		members, err := fn(args[1:])
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteSet(len(members))
+		for _, m := range members {
+			w.WriteBulkString(m)
+		}
+	}
+}
+
+// zadd 参数依次为score和member，不支持NX、XX等选项
+func (s *respServer) zadd(w *resp.Writer, args []string) {
+	if len(args)%2 != 0 {
+		w.WriteError("ERR syntax error")
+		return
+	}
+	members := make([]cache.ZMember, 0, len(args)/2-1)
+	for i := 2; i < len(args); i += 2 {
+		score, err := cache.ParseScore(args[i])
+		if err != nil {
+			w.WriteError("ERR " + cache.ErrNotFloat.Error())
+			return
+		}
+		members = append(members, cache.ZMember{Member: args[i+1], Score: score})
+	}
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	added, err := s.cache.DoZAdd(context.Background(), args[1], members)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteInt(int64(added))
+}
+
+func (s *respServer) zscore(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	score, ok, err := s.cache.Cache.ZScore(args[1], args[2])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if !ok {
+		w.WriteNull()
+		return
+	}
+	w.WriteDouble(score)
+}
+
+func (s *respServer) zrank(w *resp.Writer, args []string) {
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	rank, ok, err := s.cache.Cache.ZRank(args[1], args[2])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if !ok {
+		w.WriteNull()
+		return
+	}
+	w.WriteInt(int64(rank))
+}
+
+// withScores 解析ZRANGE和ZRANGEBYSCORE末尾可选的WITHSCORES
+func withScores(w *resp.Writer, args []string) (withScores bool, ok bool) {
+	switch {
+	case len(args) == 4:
+		return false, true
+	case len(args) == 5 && strings.EqualFold(args[4], "withscores"):
+		return true, true
+	}
+	w.WriteError("ERR syntax error")
+	return false, false
+}
+
+func (s *respServer) zrange(w *resp.Writer, args []string) {
+	scores, ok := withScores(w, args)
+	if !ok {
+		return
+	}
+	start, ok := parseInt(w, args[2])
+	if !ok {
+		return
+	}
+	stop, ok := parseInt(w, args[3])
+	if !ok || !s.local(w, args, args[1]) {
+		return
+	}
+	members, err := s.cache.Cache.ZRange(args[1], start, stop)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeZMembers(w, members, scores)
+}
+
+func (s *respServer) zrangebyscore(w *resp.Writer, args []string) {
+	scores, ok := withScores(w, args)
+	if !ok {
+		return
+	}
+	r, err := cache.ParseScoreRange(args[2], args[3])
+	if err != nil {
+		w.WriteError("ERR min or max is not a float")
+		return
+	}
+	if !s.local(w, args, args[1]) {
+		return
+	}
+	members, err := s.cache.Cache.ZRangeByScore(args[1], r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeZMembers(w, members, scores)
+}
+
+// writeZMembers 和redis一致，带score时RESP3返回[member, score]的数组，RESP2把score平铺在member之后
+func writeZMembers(w *resp.Writer, members []cache.ZMember, scores bool) {
+	if !scores {
+		w.WriteArray(len(members))
+		for _, m := range members {
+			w.WriteBulkString(m.Member)
+		}
+		return
+	}
+	if w.Proto == resp.Proto3 {
+		w.WriteArray(len(members))
+		for _, m := range members {
+			w.WriteArray(2)
+			w.WriteBulkString(m.Member)
+			w.WriteDouble(m.Score)
+		}
+		return
+	}
+	w.WriteArray(len(members) * 2)
+	for _, m := range members {
+		w.WriteBulkString(m.Member)
+		w.WriteDouble(m.Score)
+	}
+}
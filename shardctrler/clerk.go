@@ -0,0 +1,159 @@
+package shardctrler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// watchTimeout Clerk.Watch每次长轮询等待的时间
+const watchTimeout = 30 * time.Second
+
+// Clerk 是分片控制器的客户端，缓存节点使用它订阅配置，运维工具使用它加入和移除分片组。
+// 写请求发给leader，遇到不是leader的副本时按返回的leader提示重试
+type Clerk struct {
+	servers []string
+	client  *http.Client
+	mutex   sync.Mutex
+	leader  string // 最近一次成功处理写请求的控制器节点
+}
+
+func NewClerk(servers []string) *Clerk {
+	return &Clerk{
+		servers: servers,
+		// 超时时间比watch的长轮询稍长
+		client: &http.Client{Timeout: watchTimeout + 5*time.Second},
+	}
+}
+
+// Query 返回编号为num的配置，num小于0时返回最新的配置
+func (ck *Clerk) Query(ctx context.Context, num int) (*Config, error) {
+	var cfg *Config
+	err := ck.each(ctx, func(server string) (bool, error) {
+		c, err := ck.get(ctx, fmt.Sprintf("http://%s/ctrler/query?num=%d", server, num))
+		cfg = c
+		return err == nil, err
+	})
+	return cfg, err
+}
+
+// Watch 等待编号大于after的配置，超时没有新配置时返回nil, nil
+func (ck *Clerk) Watch(ctx context.Context, after int) (*Config, error) {
+	var cfg *Config
+	err := ck.each(ctx, func(server string) (bool, error) {
+		c, err := ck.get(ctx, fmt.Sprintf("http://%s/ctrler/watch?after=%d&timeout=%s", server, after, watchTimeout))
+		cfg = c
+		return err == nil, err
+	})
+	return cfg, err
+}
+
+// Join 加入分片组或者更新分片组的节点列表，返回生成的配置
+func (ck *Clerk) Join(ctx context.Context, groups map[string][]string) (*Config, error) {
+	return ck.write(ctx, "/ctrler/join", op{Groups: groups})
+}
+
+// Leave 把分片组移出哈希环，返回生成的配置
+func (ck *Clerk) Leave(ctx context.Context, gids ...string) (*Config, error) {
+	return ck.write(ctx, "/ctrler/leave", op{GIDs: gids})
+}
+
+func (ck *Clerk) write(ctx context.Context, path string, o op) (*Config, error) {
+	body, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	var cfg *Config
+	err = ck.each(ctx, func(server string) (bool, error) {
+		for hops := 0; hops < 2; hops++ {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+server+path, bytes.NewReader(body))
+			if err != nil {
+				return true, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := ck.client.Do(req)
+			if err != nil {
+				return false, err
+			}
+			leader := resp.Header.Get(LeaderHeader)
+			cfg, err = decodeConfig(resp)
+			if err == nil {
+				ck.setLeader(server)
+				return true, nil
+			}
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				// 请求本身有错误，换一个节点也不会成功
+				return true, err
+			}
+			if leader == "" || leader == server {
+				return false, err
+			}
+			server = leader
+		}
+		return false, ErrNotLeader
+	})
+	return cfg, err
+}
+
+// each 从最近的leader开始依次尝试每个控制器节点，fn返回true时停止
+func (ck *Clerk) each(ctx context.Context, fn func(server string) (bool, error)) error {
+	ck.mutex.Lock()
+	servers := make([]string, 0, len(ck.servers)+1)
+	if ck.leader != "" {
+		servers = append(servers, ck.leader)
+	}
+	servers = append(servers, ck.servers...)
+	ck.mutex.Unlock()
+
+	err := fmt.Errorf("no shard controller servers")
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var done bool
+		if done, err = fn(server); done {
+			return err
+		}
+	}
+	return err
+}
+
+func (ck *Clerk) setLeader(server string) {
+	ck.mutex.Lock()
+	defer ck.mutex.Unlock()
+	ck.leader = server
+}
+
+func (ck *Clerk) get(ctx context.Context, url string) (*Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ck.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, nil
+	}
+	return decodeConfig(resp)
+}
+
+func decodeConfig(resp *http.Response) (*Config, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("shard controller returned %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	var cfg Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,135 @@
+package shardctrler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Emiliaab/gedis/consistenthash"
+	"sort"
+)
+
+// ringReplicas 每个分片组在哈希环上的虚拟节点数，和Cache_proxy的哈希环一致
+const ringReplicas = 3
+
+var (
+	ErrNotLeader    = errors.New("shard controller is not the leader")
+	ErrGroupUnknown = errors.New("shard group not found")
+	ErrNoServers    = errors.New("shard group has no servers")
+)
+
+/*
+*
+Config 是分片控制器发布的一份集群配置，每次分片组加入或者离开都生成一份编号加1的新配置，
+旧的配置保留，节点可以查询任意编号的配置：
+
+	Num     配置编号，0号配置没有任何分片组
+	Ring    一致性hash环，虚拟节点映射到分片组的ID(gid)，哈希环的epoch等于配置编号
+	Groups  每个分片组(一个raft group)中节点的http地址，第一个地址作为默认的转发目标
+
+节点只应用编号比当前大的配置，因此可以从控制器的任意副本读取配置
+*/
+type Config struct {
+	Num    int                 `json:"num"`
+	Ring   *consistenthash.Map `json:"ring"`
+	Groups map[string][]string `json:"groups"`
+}
+
+func newConfig() *Config {
+	return &Config{
+		Ring:   consistenthash.New(ringReplicas, consistenthash.Murmur3),
+		Groups: make(map[string][]string),
+	}
+}
+
+// UnmarshalJSON 解码后恢复哈希环的hash函数
+func (cfg *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if c.Ring == nil {
+		c.Ring = consistenthash.New(ringReplicas, consistenthash.Murmur3)
+	}
+	c.Ring.Hash = consistenthash.Murmur3
+	if c.Ring.HashMap == nil {
+		c.Ring.HashMap = make(map[int]string)
+	}
+	if c.Groups == nil {
+		c.Groups = make(map[string][]string)
+	}
+	*cfg = Config(c)
+	return nil
+}
+
+// next 返回编号加1的副本，用于生成下一份配置
+func (cfg *Config) next() *Config {
+	c := &Config{
+		Num:    cfg.Num + 1,
+		Ring:   cfg.Ring.Clone(),
+		Groups: make(map[string][]string, len(cfg.Groups)),
+	}
+	c.Ring.Epoch = uint64(c.Num)
+	for gid, servers := range cfg.Groups {
+		c.Groups[gid] = append([]string(nil), servers...)
+	}
+	return c
+}
+
+// join 加入新的分片组或者更新已有分片组的节点列表，新的分片组加入哈希环
+func (cfg *Config) join(groups map[string][]string) (*Config, error) {
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("%w: empty join", ErrNoServers)
+	}
+	c := cfg.next()
+	gids := make([]string, 0, len(groups))
+	for gid, servers := range groups {
+		if gid == "" || len(servers) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrNoServers, gid)
+		}
+		if _, ok := c.Groups[gid]; !ok {
+			gids = append(gids, gid)
+		}
+		c.Groups[gid] = append([]string(nil), servers...)
+	}
+	// 按gid排序后加入，保证每个副本得到相同的哈希环
+	sort.Strings(gids)
+	c.Ring.Add(gids...)
+	return c, nil
+}
+
+// leave 把分片组移出哈希环，它负责的区间由哈希环上的后继分片组接管
+func (cfg *Config) leave(gids []string) (*Config, error) {
+	c := cfg.next()
+	for _, gid := range gids {
+		if _, ok := c.Groups[gid]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrGroupUnknown, gid)
+		}
+		delete(c.Groups, gid)
+	}
+	c.Ring.Remove(gids...)
+	return c, nil
+}
+
+// Owner 返回负责key的分片组的ID
+func (cfg *Config) Owner(key string) string {
+	return cfg.Ring.Get(key)
+}
+
+// Peers 返回节点self使用的哈希环，虚拟节点的位置不变：本节点所在的分片组映射为self，
+// key在本地处理；其他分片组仍然是gid，哈希环中带上它们的节点列表，转发时由分片组中可用的节点处理
+func (cfg *Config) Peers(gid string, self string) *consistenthash.Map {
+	peers := cfg.Ring.Clone()
+	for hash, g := range peers.HashMap {
+		if g == gid {
+			peers.HashMap[hash] = self
+		}
+	}
+	peers.Groups = make(map[string][]string, len(cfg.Groups))
+	for g, servers := range cfg.Groups {
+		if g != gid {
+			peers.Groups[g] = servers
+		}
+	}
+	return peers
+}
@@ -0,0 +1,145 @@
+package shardctrler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hashicorp/raft"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestFSM() *fsm {
+	return newFSM(log.New(io.Discard, "", 0))
+}
+
+func applyOp(t *testing.T, f *fsm, o op) interface{} {
+	t.Helper()
+	data, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Apply(&raft.Log{Type: raft.LogCommand, Data: data})
+}
+
+func TestJoinLeave(t *testing.T) {
+	cfg, err := newConfig().join(map[string][]string{
+		"g2": {"127.0.0.1:8002"},
+		"g1": {"127.0.0.1:8001", "127.0.0.1:8004"},
+	})
+	if err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	if cfg.Num != 1 || len(cfg.Ring.Keys) != 2*ringReplicas {
+		t.Fatalf("got config %d with %d virtual nodes; want 1 with %d", cfg.Num, len(cfg.Ring.Keys), 2*ringReplicas)
+	}
+
+	// 同样的变更在每个副本上得到同样的哈希环
+	again, _ := newConfig().join(map[string][]string{
+		"g1": {"127.0.0.1:8001"},
+		"g2": {"127.0.0.1:8002"},
+	})
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if cfg.Owner(key) != again.Owner(key) {
+			t.Fatalf("key %s owned by %s and %s", key, cfg.Owner(key), again.Owner(key))
+		}
+	}
+
+	left, err := cfg.leave([]string{"g2"})
+	if err != nil {
+		t.Fatalf("leave failed: %v", err)
+	}
+	if left.Num != 2 || len(left.Groups) != 1 || left.Owner("42") != "g1" {
+		t.Fatalf("got config %+v; want only g1", left)
+	}
+	// 旧配置不受影响
+	if len(cfg.Groups) != 2 || len(cfg.Ring.GetPeers()) != 2 {
+		t.Fatalf("config 1 changed after leave: %+v", cfg)
+	}
+	if _, err := left.leave([]string{"g2"}); !errors.Is(err, ErrGroupUnknown) {
+		t.Fatalf("got err %v; want ErrGroupUnknown", err)
+	}
+	if _, err := left.join(map[string][]string{"g3": nil}); !errors.Is(err, ErrNoServers) {
+		t.Fatalf("got err %v; want ErrNoServers", err)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	cfg, _ := newConfig().join(map[string][]string{
+		"g1": {"127.0.0.1:8001", "127.0.0.1:8004"},
+		"g2": {"127.0.0.1:8002", "127.0.0.1:8005"},
+	})
+	peers := cfg.Peers("g1", "127.0.0.1:8004")
+	if peers.Epoch != uint64(cfg.Num) {
+		t.Fatalf("got ring epoch %d; want %d", peers.Epoch, cfg.Num)
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		want := "g2"
+		if cfg.Owner(key) == "g1" {
+			want = "127.0.0.1:8004"
+		}
+		if got := peers.Get(key); got != want {
+			t.Fatalf("key %s routed to %s; want %s", key, got, want)
+		}
+	}
+	if members := peers.Members("g2"); len(members) != 2 || members[1] != "127.0.0.1:8005" {
+		t.Fatalf("got members %v of g2", members)
+	}
+	if members := peers.Members("127.0.0.1:8004"); len(members) != 1 {
+		t.Fatalf("got members %v of self", members)
+	}
+}
+
+func TestFSM(t *testing.T) {
+	f := newTestFSM()
+	if cfg := f.query(-1); cfg.Num != 0 {
+		t.Fatalf("got initial config %d; want 0", cfg.Num)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	watched := make(chan *Config, 1)
+	go func() { watched <- f.watch(ctx, 0) }()
+
+	applyOp(t, f, op{Type: OpJoin, Groups: map[string][]string{"g1": {"127.0.0.1:8001"}}})
+	applyOp(t, f, op{Type: OpJoin, Groups: map[string][]string{"g2": {"127.0.0.1:8002"}}})
+	if cfg := <-watched; cfg == nil || cfg.Num < 1 {
+		t.Fatalf("got watched config %+v; want a new config", cfg)
+	}
+	if err, ok := applyOp(t, f, op{Type: OpLeave, GIDs: []string{"g9"}}).(error); !ok || !errors.Is(err, ErrGroupUnknown) {
+		t.Fatalf("got %v; want ErrGroupUnknown", err)
+	}
+	if _, ok := applyOp(t, f, op{Type: "move"}).(error); !ok {
+		t.Fatal("expected unknown op to be rejected")
+	}
+	if cfg := f.query(1); cfg.Num != 1 || len(cfg.Groups) != 1 {
+		t.Fatalf("got config %+v; want config 1 with g1", cfg)
+	}
+
+	// 快照恢复后哈希环仍然可用
+	snap, _ := f.Snapshot()
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(snap.(*snapshot).configs); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestFSM()
+	if err := restored.Restore(io.NopCloser(&buf)); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	latest := restored.query(-1)
+	if latest.Num != 2 || latest.Owner("k1") != f.query(-1).Owner("k1") {
+		t.Fatalf("got restored config %+v; want config 2", latest)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if cfg := restored.watch(ctx, 2); cfg != nil {
+		t.Fatalf("got %+v; want nil after timeout", cfg)
+	}
+}
@@ -0,0 +1,130 @@
+package shardctrler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"io"
+	"log"
+	"sync"
+)
+
+const (
+	OpJoin  = "join"  // Groups为加入或者更新的分片组
+	OpLeave = "leave" // GIDs为离开的分片组
+)
+
+// op 是分片控制器的raft日志，控制器的写入很少，使用json编码
+type op struct {
+	Type   string              `json:"type"`
+	Groups map[string][]string `json:"groups,omitempty"`
+	GIDs   []string            `json:"gids,omitempty"`
+}
+
+// fsm 保存所有编号的配置，configs[i].Num == i
+type fsm struct {
+	mutex   sync.RWMutex
+	configs []*Config
+	changed chan struct{} // 生成新配置时关闭并替换，用于唤醒等待新配置的watch请求
+	log     *log.Logger
+}
+
+func newFSM(logger *log.Logger) *fsm {
+	return &fsm{configs: []*Config{newConfig()}, changed: make(chan struct{}), log: logger}
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var o op
+	if err := json.Unmarshal(l.Data, &o); err != nil {
+		f.log.Printf("shardctrler rejected log entry %d: %v", l.Index, err)
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	latest := f.configs[len(f.configs)-1]
+	var cfg *Config
+	var err error
+	switch o.Type {
+	case OpJoin:
+		cfg, err = latest.join(o.Groups)
+	case OpLeave:
+		cfg, err = latest.leave(o.GIDs)
+	default:
+		err = fmt.Errorf("unknown op %q", o.Type)
+	}
+	if err != nil {
+		return err
+	}
+	f.configs = append(f.configs, cfg)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.log.Printf("config %d: groups %v", cfg.Num, cfg.Groups)
+	return cfg
+}
+
+// query 返回编号为num的配置，num小于0或者超过最新的编号时返回最新的配置
+func (f *fsm) query(num int) *Config {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if num < 0 || num >= len(f.configs) {
+		return f.configs[len(f.configs)-1]
+	}
+	return f.configs[num]
+}
+
+// watch 等待编号大于after的配置，ctx结束时返回nil
+func (f *fsm) watch(ctx context.Context, after int) *Config {
+	for {
+		f.mutex.RLock()
+		latest, changed := f.configs[len(f.configs)-1], f.changed
+		f.mutex.RUnlock()
+		if latest.Num > after {
+			return latest
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	// 配置生成后不再修改，复制切片即可
+	return &snapshot{configs: append([]*Config(nil), f.configs...)}, nil
+}
+
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	var configs []*Config
+	if err := json.NewDecoder(r).Decode(&configs); err != nil {
+		return err
+	}
+	if len(configs) == 0 {
+		configs = []*Config{newConfig()}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.configs = configs
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return nil
+}
+
+type snapshot struct {
+	configs []*Config
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.configs); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
@@ -0,0 +1,281 @@
+package shardctrler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// LeaderHeader 是不是leader的控制器节点返回的leader提示，值为leader的http地址
+	LeaderHeader = "X-Gedis-Leader"
+
+	applyTimeout = 5 * time.Second
+	// maxWatchTimeout watch请求最长等待的时间
+	maxWatchTimeout = time.Minute
+)
+
+type Options struct {
+	HttpAddress string
+	RaftAddress string
+	DataDir     string
+	Bootstrap   bool
+	JoinAddress string // 控制器raft group中任意节点的http地址
+}
+
+/*
+*
+Server 是分片控制器的一个副本。控制器是独立的raft group，保存权威的一致性hash环和分片组，
+每次变更生成一份编号的配置。控制器raft group中节点的ServerID就是它的http地址，
+follower可以直接把写请求的发送者引导到leader。接口：
+
+	GET  /ctrler/query?num={num}              返回编号为num的配置，不带num返回最新的配置
+	GET  /ctrler/watch?after={num}&timeout=30s 等待编号大于after的配置，超时返回304
+	POST /ctrler/join   {"groups":{"g1":["127.0.0.1:8001","127.0.0.1:8004"]}}
+	POST /ctrler/leave  {"gids":["g1"]}
+	GET  /ctrler/raft/join?peerAddress={raft地址}&httpAddress={http地址}  控制器节点加入控制器的raft group
+*/
+type Server struct {
+	opts Options
+	raft *raft.Raft
+	fsm  *fsm
+	log  *log.Logger
+	mux  *http.ServeMux
+}
+
+func NewServer(opts Options) (*Server, error) {
+	s := &Server{
+		opts: opts,
+		fsm:  newFSM(log.New(os.Stderr, "shardctrler fsm: ", log.Ldate|log.Ltime)),
+		log:  log.New(os.Stderr, "shardctrler: ", log.Ldate|log.Ltime),
+		mux:  http.NewServeMux(),
+	}
+	if err := s.startRaft(); err != nil {
+		return nil, err
+	}
+
+	s.mux.HandleFunc("/ctrler/query", s.doQuery)
+	s.mux.HandleFunc("/ctrler/watch", s.doWatch)
+	s.mux.HandleFunc("/ctrler/join", s.doJoin)
+	s.mux.HandleFunc("/ctrler/leave", s.doLeave)
+	s.mux.HandleFunc("/ctrler/raft/join", s.doRaftJoin)
+	return s, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+func (s *Server) startRaft() error {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(s.opts.HttpAddress)
+
+	address, err := net.ResolveTCPAddr("tcp", s.opts.RaftAddress)
+	if err != nil {
+		return err
+	}
+	transport, err := raft.NewTCPTransport(address.String(), address, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.opts.DataDir, 0700); err != nil {
+		return err
+	}
+	snapshotStore, err := raft.NewFileSnapshotStore(s.opts.DataDir, 1, os.Stderr)
+	if err != nil {
+		return err
+	}
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(s.opts.DataDir, "shardctrler-log.bolt"))
+	if err != nil {
+		return err
+	}
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(s.opts.DataDir, "shardctrler-stable.bolt"))
+	if err != nil {
+		return err
+	}
+	s.raft, err = raft.NewRaft(raftConfig, s.fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return err
+	}
+
+	if s.opts.Bootstrap {
+		s.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: raftConfig.LocalID, Address: transport.LocalAddr()}},
+		})
+	}
+	return nil
+}
+
+// JoinRaft 请求控制器raft group的leader把本节点加入raft group，JoinAddress不是leader时按leader提示重试
+func (s *Server) JoinRaft() error {
+	address := s.opts.JoinAddress
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("http://%s/ctrler/raft/join?peerAddress=%s&httpAddress=%s", address, s.opts.RaftAddress, s.opts.HttpAddress)
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		if leader := resp.Header.Get(LeaderHeader); resp.StatusCode == http.StatusServiceUnavailable && leader != "" {
+			address = leader
+			continue
+		}
+		return fmt.Errorf("join shard controller failed: %s", body)
+	}
+	return fmt.Errorf("join shard controller failed: leader of %s unavailable", s.opts.JoinAddress)
+}
+
+// apply 由leader提交一条日志，返回生成的配置
+func (s *Server) apply(o op) (*Config, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	future := s.raft.Apply(data, applyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response().(*Config), nil
+}
+
+func (s *Server) doQuery(w http.ResponseWriter, r *http.Request) {
+	num := -1
+	if v := r.URL.Query().Get("num"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid num "+v, http.StatusBadRequest)
+			return
+		}
+		num = n
+	}
+	writeConfig(w, s.fsm.query(num))
+}
+
+func (s *Server) doWatch(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	after, err := strconv.Atoi(vars.Get("after"))
+	if err != nil {
+		http.Error(w, "invalid after "+vars.Get("after"), http.StatusBadRequest)
+		return
+	}
+	timeout := maxWatchTimeout
+	if v := vars.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			http.Error(w, "invalid timeout "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	cfg := s.fsm.watch(ctx, after)
+	if cfg == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeConfig(w, cfg)
+}
+
+func (s *Server) doJoin(w http.ResponseWriter, r *http.Request) {
+	var o op
+	if !s.decodeOp(w, r, &o) {
+		return
+	}
+	s.writeApply(w, op{Type: OpJoin, Groups: o.Groups})
+}
+
+func (s *Server) doLeave(w http.ResponseWriter, r *http.Request) {
+	var o op
+	if !s.decodeOp(w, r, &o) {
+		return
+	}
+	s.writeApply(w, op{Type: OpLeave, GIDs: o.GIDs})
+}
+
+func (s *Server) decodeOp(w http.ResponseWriter, r *http.Request, o *op) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeApply 提交变更并返回生成的配置，不是leader时返回503和leader提示
+func (s *Server) writeApply(w http.ResponseWriter, o op) {
+	cfg, err := s.apply(o)
+	switch {
+	case err == nil:
+		s.log.Printf("%s %v%v, config %d", o.Type, o.Groups, o.GIDs, cfg.Num)
+		writeConfig(w, cfg)
+	case errors.Is(err, ErrNotLeader):
+		s.writeNotLeader(w)
+	case errors.Is(err, ErrGroupUnknown):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNoServers):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log.Printf("%s failed:%v", o.Type, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) writeNotLeader(w http.ResponseWriter) {
+	if _, leader := s.raft.LeaderWithID(); leader != "" {
+		w.Header().Set(LeaderHeader, string(leader))
+	}
+	http.Error(w, ErrNotLeader.Error(), http.StatusServiceUnavailable)
+}
+
+func (s *Server) doRaftJoin(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	peerAddress, httpAddress := vars.Get("peerAddress"), vars.Get("httpAddress")
+	if peerAddress == "" || httpAddress == "" {
+		http.Error(w, "invalid peerAddress or httpAddress", http.StatusBadRequest)
+		return
+	}
+	if s.raft.State() != raft.Leader {
+		s.writeNotLeader(w)
+		return
+	}
+	if err := s.raft.AddVoter(raft.ServerID(httpAddress), raft.ServerAddress(peerAddress), 0, applyTimeout).Error(); err != nil {
+		s.log.Printf("add controller %s(%s) failed:%v", httpAddress, peerAddress, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.log.Printf("controller %s(%s) joined", httpAddress, peerAddress)
+	fmt.Fprint(w, "ok")
+}
+
+func writeConfig(w http.ResponseWriter, cfg *Config) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}